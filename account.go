@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const (
+	csrfTokenField = "csrf_token"
+	loginTimeField = "login_time"
+	loginUserField = "login_user"
+
+	// Time after an interactive login in which credentials used to log
+	// in can be changed without logging in again
+	freshLoginTTL = 15 * time.Minute
+)
+
+func handleAccountPasswordRequest(res http.ResponseWriter, r *http.Request) {
+	user, _, err := detectSessionUser(res, r)
+	switch {
+	case err == nil:
+		// All fine
+
+	case errors.Is(err, plugins.ErrNoValidUserFound):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(r.URL.Path), http.StatusFound)
+		return
+
+	default:
+		log.WithError(err).Error("Failed to get user for password change")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	changer := findPasswordChanger(res, r, user)
+	tplCtx := pongo2.Context{
+		"can_change": changer != nil,
+		"user":       user,
+	}
+
+	if r.Method == http.MethodPost && changer != nil {
+		if !validateCSRFToken(r) {
+			http.Error(res, "Invalid CSRF token", http.StatusBadRequest)
+			return
+		}
+
+		auditFields := map[string]string{"username": user}
+
+		var (
+			currentPassword = r.FormValue("current-password")
+			newPassword     = r.FormValue("new-password")
+			policyErr       plugins.PasswordPolicyViolation
+		)
+
+		if newPassword != r.FormValue("confirm-password") {
+			tplCtx["error"] = "New passwords do not match"
+		} else {
+			err = changer.ChangePassword(user, currentPassword, newPassword)
+			switch {
+			case err == nil:
+				auditFields["result"] = "password changed"
+				tplCtx["success"] = "Your password has been changed"
+
+			case errors.Is(err, plugins.ErrNoValidUserFound):
+				auditFields["result"] = "invalid current password"
+				tplCtx["error"] = "Current password is not valid"
+
+			case errors.As(err, &policyErr):
+				auditFields["result"] = "rejected by password policy"
+				tplCtx["error"] = policyErr.Reason
+
+			default:
+				auditFields["result"] = "error"
+				auditFields["error"] = err.Error()
+				log.WithError(err).Error("Unable to change password")
+				tplCtx["error"] = "Something went wrong, please try again later"
+			}
+
+			mainCfg.AuditLog.Log(auditEventPasswordChange, r, auditFields) // #nosec G104 - This is only logging
+		}
+	}
+
+	renderAccountTemplate(res, r, "account_password.html", tplCtx)
+}
+
+// findPasswordChanger returns the active PasswordChanger responsible
+// for the given user or nil if the password cannot be changed
+func findPasswordChanger(res http.ResponseWriter, r *http.Request, user string) plugins.PasswordChanger {
+	authenticatorRegistryMutex.RLock()
+	defer authenticatorRegistryMutex.RUnlock()
+
+	for _, a := range activeAuthenticators {
+		pc, ok := a.(plugins.PasswordChanger)
+		if !ok {
+			continue
+		}
+
+		if detected, _, err := a.DetectUser(res, r); err != nil || detected != user {
+			continue
+		}
+
+		if pc.CanChangePassword(user) {
+			return pc
+		}
+	}
+
+	return nil
+}
+
+// recordLogin remembers the user completed an interactive login
+// including the second factor in the main session
+func recordLogin(res http.ResponseWriter, r *http.Request, user string) error {
+	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, "main"}, "-")) // #nosec G104 - On error empty session is returned
+	sess.Options = mainCfg.Cookie.GetSessionOpts()
+	sess.Values[loginUserField] = user
+	sess.Values[loginTimeField] = time.Now().Unix()
+
+	return errors.Wrap(sess.Save(r, res), "Unable to save session")
+}
+
+// hasFreshLogin reports whether the user completed an interactive login
+// in this browser within the freshLoginTTL
+func hasFreshLogin(r *http.Request, user string) bool {
+	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, "main"}, "-")) // #nosec G104 - On error empty session is returned
+	loginUser, _ := sess.Values[loginUserField].(string)
+	loginTime, _ := sess.Values[loginTimeField].(int64)
+
+	return loginUser == user && time.Since(time.Unix(loginTime, 0)) < freshLoginTTL
+}
+
+// getCSRFToken retrieves the CSRF token from the main session or
+// creates a new one if there is none
+func getCSRFToken(res http.ResponseWriter, r *http.Request) (string, error) {
+	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, "main"}, "-")) // #nosec G104 - On error empty session is returned
+	if token, ok := sess.Values[csrfTokenField].(string); ok && token != "" {
+		return token, nil
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, "Unable to generate CSRF token")
+	}
+
+	token := hex.EncodeToString(raw)
+	sess.Options = mainCfg.Cookie.GetSessionOpts()
+	sess.Values[csrfTokenField] = token
+
+	return token, errors.Wrap(sess.Save(r, res), "Unable to save session")
+}
+
+// validateCSRFToken checks the token submitted in the form or in the
+// X-CSRF-Token header against the one stored in the main session
+func validateCSRFToken(r *http.Request) bool {
+	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, "main"}, "-")) // #nosec G104 - On error empty session is returned
+	expected, ok := sess.Values[csrfTokenField].(string)
+	if !ok || expected == "" {
+		return false
+	}
+
+	submitted := r.Header.Get("X-CSRF-Token")
+	if submitted == "" {
+		submitted = r.FormValue(csrfTokenField)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(submitted)) == 1
+}
+
+func renderAccountTemplate(res http.ResponseWriter, r *http.Request, template string, tplCtx pongo2.Context) {
+	csrfToken, err := getCSRFToken(res, r)
+	if err != nil {
+		log.WithError(err).Error("Unable to get CSRF token")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	tplCtx["csrf_token"] = csrfToken
+	tplCtx["login"] = mainCfg.Login
+
+	tpl := pongo2.Must(pongo2.FromFile(path.Join(cfg.TemplateDir, template)))
+	if err := tpl.ExecuteWriter(tplCtx, res); err != nil {
+		log.WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+	}
+}
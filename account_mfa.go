@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const (
+	mfaEnrollmentTTL = 10 * time.Minute
+	mfaQRCodeSize    = 200
+)
+
+// mfaEnrollment is a generated TOTP secret waiting for the first code
+// to be confirmed. It is kept in memory to prevent users from choosing
+// their own secret by modifying the form.
+type mfaEnrollment struct {
+	key     *otp.Key
+	expires time.Time
+}
+
+var (
+	mfaEnrollments     = map[string]mfaEnrollment{}
+	mfaEnrollmentsLock sync.Mutex
+
+	// Settings used for secrets generated on the account page, they
+	// match the defaults of the TOTP provider
+	mfaEnrollmentOpts = totp.ValidateOpts{
+		Period:    30,
+		Skew:      1,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+)
+
+func handleAccountMFARequest(res http.ResponseWriter, r *http.Request) {
+	// The page contains TOTP secrets and recovery codes which must not
+	// be kept in any cache
+	res.Header().Set("Cache-Control", "no-store")
+
+	user, _, err := detectSessionUser(res, r)
+	switch {
+	case err == nil:
+		// All fine
+
+	case errors.Is(err, plugins.ErrNoValidUserFound):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(r.URL.Path), http.StatusFound)
+		return
+
+	default:
+		log.WithError(err).Error("Failed to get user for MFA management")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	rm := findRecoveryCodeManager()
+	tplCtx := pongo2.Context{
+		"bypass_methods":   mfaBypassingAuthenticators(),
+		"code_name":        plugins.MFALoginFieldName,
+		"enabled":          mainCfg.MFAStore.enabled() || rm != nil,
+		"recovery_enabled": rm != nil,
+		"totp_enabled":     mainCfg.MFAStore.enabled(),
+		"user":             user,
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRFToken(r) {
+			http.Error(res, "Invalid CSRF token", http.StatusBadRequest)
+			return
+		}
+
+		switch action := r.FormValue("action"); {
+		case action == "enable" && mainCfg.MFAStore.enabled():
+			err = enableAccountTOTP(res, r, user)
+			if err == nil {
+				tplCtx["success"] = "Your authenticator app has been set up"
+			}
+
+		case action == "disable" && mainCfg.MFAStore.enabled():
+			err = disableAccountTOTP(res, r, rm, user)
+			if err == nil {
+				tplCtx["success"] = "Your authenticator app has been removed"
+			}
+
+		case action == "recovery" && rm != nil:
+			var codes []string
+			codes, err = generateAccountRecoveryCodes(rm, r, user)
+			if err == nil {
+				tplCtx["recovery_codes"] = codes
+				tplCtx["success"] = "New recovery codes have been generated, your previous codes are no longer valid"
+			}
+
+		default:
+			http.Error(res, "Invalid action", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			tplCtx["error"] = plugins.FailureReason(err, "")
+			if !errors.Is(err, plugins.ErrNoValidUserFound) {
+				log.WithError(err).Error("Unable to manage MFA")
+				tplCtx["error"] = "Something went wrong, please try again later"
+			}
+		}
+	}
+
+	if rm != nil {
+		remaining, low, err := rm.RecoveryCodeStatus(user)
+		if err != nil {
+			log.WithError(err).Error("Unable to get recovery code status")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		tplCtx["recovery_low"] = low
+		tplCtx["recovery_remaining"] = remaining
+	}
+
+	secret := accountTOTPSecret(user)
+	tplCtx["totp_enrolled"] = secret != ""
+
+	if mainCfg.MFAStore.enabled() && secret == "" {
+		key, err := startAccountTOTPEnrollment(user)
+		if err != nil {
+			log.WithError(err).Error("Unable to start TOTP enrollment")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		qrCode, err := totpQRCode(key)
+		if err != nil {
+			log.WithError(err).Error("Unable to render TOTP QR code")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		tplCtx["totp_qr_code"] = qrCode
+		tplCtx["totp_secret"] = key.Secret()
+		tplCtx["totp_url"] = key.URL()
+	}
+
+	renderAccountTemplate(res, r, "account_mfa.html", tplCtx)
+}
+
+// startAccountTOTPEnrollment returns the pending enrollment of the user
+// or generates a new secret if there is none
+func startAccountTOTPEnrollment(user string) (*otp.Key, error) {
+	mfaEnrollmentsLock.Lock()
+	defer mfaEnrollmentsLock.Unlock()
+
+	now := time.Now()
+	for k, e := range mfaEnrollments {
+		if now.After(e.expires) {
+			delete(mfaEnrollments, k)
+		}
+	}
+
+	if e, ok := mfaEnrollments[user]; ok {
+		return e.key, nil
+	}
+
+	issuer := mainCfg.Login.Title
+	if issuer == "" {
+		issuer = "nginx-sso"
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: user,
+		Period:      mfaEnrollmentOpts.Period,
+		Digits:      mfaEnrollmentOpts.Digits,
+		Algorithm:   mfaEnrollmentOpts.Algorithm,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to generate TOTP secret")
+	}
+
+	mfaEnrollments[user] = mfaEnrollment{key: key, expires: now.Add(mfaEnrollmentTTL)}
+	return key, nil
+}
+
+// enableAccountTOTP stores the pending secret of the user in the MFA
+// store after the user proved to have set up the authenticator app
+func enableAccountTOTP(res http.ResponseWriter, r *http.Request, user string) error {
+	mfaEnrollmentsLock.Lock()
+	e, ok := mfaEnrollments[user]
+	mfaEnrollmentsLock.Unlock()
+
+	if !ok || time.Now().After(e.expires) {
+		return plugins.NewLoginFailure("The setup has expired, please scan the new QR code")
+	}
+
+	if err := checkTOTPCode(res, r, user, e.key.Secret()); err != nil {
+		return err
+	}
+
+	if err := mainCfg.MFAStore.set(user, "totp", []plugins.MFAConfig{totpConfig(e.key.Secret())}); err != nil {
+		return err
+	}
+
+	mfaEnrollmentsLock.Lock()
+	delete(mfaEnrollments, user)
+	mfaEnrollmentsLock.Unlock()
+
+	mainCfg.AuditLog.Log(auditEventMFAEnroll, r, map[string]string{"username": user, "mfa_provider": "totp"}) // #nosec G104 - This is only logging
+
+	return nil
+}
+
+// disableAccountTOTP removes the secret of the user from the MFA store,
+// a current code is required to prevent a stolen session from removing
+// the second factor. Users who lost their authenticator app can use
+// one of their recovery codes instead.
+func disableAccountTOTP(res http.ResponseWriter, r *http.Request, rm plugins.RecoveryCodeManager, user string) error {
+	secret := accountTOTPSecret(user)
+	if secret == "" {
+		return plugins.NewLoginFailure("No authenticator app is set up")
+	}
+
+	usedRecovery := false
+	if rm != nil {
+		remaining, ok, err := rm.UseRecoveryCode(user, r.FormValue(plugins.MFALoginFieldName))
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			usedRecovery = true
+			mainCfg.AuditLog.Log(auditEventMFARecoveryUsed, r, map[string]string{"username": user, "recovery_codes_remaining": strconv.Itoa(remaining)}) // #nosec G104 - This is only logging
+		}
+	}
+
+	if !usedRecovery {
+		if err := checkTOTPCode(res, r, user, secret); err != nil {
+			return err
+		}
+	}
+
+	if err := mainCfg.MFAStore.set(user, "totp", nil); err != nil {
+		return err
+	}
+
+	mainCfg.AuditLog.Log(auditEventMFARemove, r, map[string]string{"username": user, "mfa_provider": "totp"}) // #nosec G104 - This is only logging
+
+	return nil
+}
+
+// checkTOTPCode validates the code submitted in the MFA field through
+// the TOTP provider so each code is only accepted once, including the
+// codes used on the login page
+func checkTOTPCode(res http.ResponseWriter, r *http.Request, user, secret string) error {
+	m := findMFAProvider("totp")
+	if m == nil {
+		return errors.New("TOTP provider is not active")
+	}
+
+	// The provider reads the code from the parsed form
+	if err := r.ParseForm(); err != nil {
+		return plugins.NewLoginFailure("The code is not valid")
+	}
+
+	var challenge plugins.MFAChallenge
+
+	err := m.ValidateMFA(res, r, user, []plugins.MFAConfig{totpConfig(secret)})
+	switch {
+	case err == nil:
+		return nil
+
+	case errors.As(err, &challenge):
+		// No code was submitted
+		return plugins.NewLoginFailure("The code is not valid")
+
+	case errors.Is(err, plugins.ErrNoValidUserFound):
+		return plugins.NewLoginFailure(plugins.FailureReason(err, "The code is not valid"))
+
+	default:
+		return errors.Wrap(err, "Unable to validate TOTP code")
+	}
+}
+
+// totpConfig returns the MFA config for a secret generated on the
+// account page
+func totpConfig(secret string) plugins.MFAConfig {
+	return plugins.MFAConfig{
+		Provider:   "totp",
+		Attributes: map[string]interface{}{"secret": secret},
+	}
+}
+
+// accountTOTPSecret returns the TOTP secret the user stored in the MFA
+// store or an empty string if there is none
+func accountTOTPSecret(user string) string {
+	for _, c := range mainCfg.MFAStore.get(user) {
+		if c.Provider == "totp" {
+			return c.AttributeString("secret")
+		}
+	}
+
+	return ""
+}
+
+// generateAccountRecoveryCodes replaces the recovery codes of the user
+func generateAccountRecoveryCodes(rm plugins.RecoveryCodeManager, r *http.Request, user string) ([]string, error) {
+	codes, err := rm.GenerateRecoveryCodes(user)
+	if err != nil {
+		return nil, err
+	}
+
+	mainCfg.AuditLog.Log(auditEventMFAEnroll, r, map[string]string{"username": user, "mfa_provider": "recovery", "recovery_codes_remaining": strconv.Itoa(len(codes))}) // #nosec G104 - This is only logging
+
+	return codes, nil
+}
+
+// printRecoveryCodes replaces the recovery codes of the user and prints
+// them to stdout for administrators handing them out to users who lost
+// access to their second factor
+func printRecoveryCodes(user string) error {
+	rm := findRecoveryCodeManager()
+	if rm == nil {
+		return errors.New("Recovery codes are not enabled")
+	}
+
+	codes, err := rm.GenerateRecoveryCodes(user)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range codes {
+		fmt.Println(c)
+	}
+
+	return nil
+}
+
+// findRecoveryCodeManager returns the first active MFA provider
+// implementing the RecoveryCodeManager or nil if there is none
+func findRecoveryCodeManager() plugins.RecoveryCodeManager {
+	mfaRegistryMutex.RLock()
+	defer mfaRegistryMutex.RUnlock()
+
+	for _, m := range activeMFAProviders {
+		if rm, ok := m.(plugins.RecoveryCodeManager); ok {
+			return rm
+		}
+	}
+
+	return nil
+}
+
+// mfaBypassingAuthenticators returns the IDs of the active
+// authenticators detecting users without the login form: their users
+// are not asked for the second factor enrolled on the account page
+func mfaBypassingAuthenticators() []string {
+	authenticatorRegistryMutex.RLock()
+	defer authenticatorRegistryMutex.RUnlock()
+
+	var ids []string
+	for _, a := range activeAuthenticators {
+		if sa, ok := a.(plugins.SessionAuthenticator); !ok || !sa.UsesLoginSession() {
+			ids = append(ids, a.AuthenticatorID())
+		}
+	}
+
+	return ids
+}
+
+// totpQRCode renders the otpauth:// URL of the key as a PNG data URI
+func totpQRCode(key *otp.Key) (string, error) {
+	img, err := key.Image(mfaQRCodeSize, mfaQRCodeSize)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to generate QR code")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return "", errors.Wrap(err, "Unable to encode QR code")
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const maxPasskeyResponseSize = 64 * 1024
+
+// passkeyPage describes an account page managing WebAuthn credentials
+// registered with a PasskeyManager: passkeys used to login and
+// security keys used as second factor share the same page and API
+type passkeyPage struct {
+	path    string
+	apiPath string
+
+	// title is displayed as heading, noun is used in messages
+	title string
+	noun  string
+
+	// mfaProvider is enrolled in the MFA store while the user has
+	// credentials registered, empty if they are no second factor
+	mfaProvider string
+
+	find func() plugins.PasskeyManager
+}
+
+var (
+	accountPasskeysPage = passkeyPage{
+		path:    "/account/passkeys",
+		apiPath: "/api/account/passkeys",
+		title:   "Passkeys",
+		noun:    "passkey",
+		find:    findPasskeyManager,
+	}
+
+	accountSecurityKeysPage = passkeyPage{
+		path:    "/account/security-keys",
+		apiPath: "/api/account/security-keys",
+		title:   "Security keys",
+		noun:    "security key",
+
+		mfaProvider: "webauthn",
+
+		find: findSecurityKeyManager,
+	}
+)
+
+func (p passkeyPage) handlePageRequest(res http.ResponseWriter, r *http.Request) {
+	user, _, err := detectSessionUser(res, r)
+	switch {
+	case err == nil:
+		// All fine
+
+	case errors.Is(err, plugins.ErrNoValidUserFound):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(r.URL.Path), http.StatusFound)
+		return
+
+	default:
+		log.WithError(err).Error("Failed to get user for passkey management")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	pm := p.find()
+	tplCtx := pongo2.Context{
+		"api":     p.apiPath,
+		"enabled": pm != nil,
+		"noun":    p.noun,
+		"page":    p.path,
+		"title":   p.title,
+		"user":    user,
+	}
+
+	if !hasFreshLogin(r, user) {
+		tplCtx["reauth_url"] = "/logout?go=" + url.QueryEscape("/login?go="+p.path)
+	}
+
+	if pm == nil {
+		renderAccountTemplate(res, r, "account_keys.html", tplCtx)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRFToken(r) {
+			http.Error(res, "Invalid CSRF token", http.StatusBadRequest)
+			return
+		}
+
+		if r.FormValue("action") != "remove" {
+			http.Error(res, "Invalid action", http.StatusBadRequest)
+			return
+		}
+
+		if err := p.removePasskey(pm, r, user, r.FormValue("id")); err != nil {
+			tplCtx["error"] = p.errorMessage(err)
+		} else {
+			tplCtx["success"] = "The " + p.noun + " has been removed"
+		}
+	}
+
+	if r.URL.Query().Get("registered") != "" {
+		tplCtx["success"] = "Your " + p.noun + " has been registered"
+	}
+
+	keys, err := pm.ListPasskeys(user)
+	if err != nil {
+		log.WithError(err).Error("Unable to list passkeys")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	tplCtx["passkeys"] = passkeyTemplateView(keys)
+	renderAccountTemplate(res, r, "account_keys.html", tplCtx)
+}
+
+func (p passkeyPage) handleAPIRequest(res http.ResponseWriter, r *http.Request) {
+	user, _, err := detectSessionUser(res, r)
+	switch {
+	case err == nil:
+		// All fine
+
+	case errors.Is(err, plugins.ErrNoValidUserFound):
+		writeJSONError(res, http.StatusUnauthorized, "No valid user found")
+		return
+
+	default:
+		log.WithError(err).Error("Failed to get user for passkey management")
+		writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	pm := p.find()
+	if pm == nil {
+		writeJSONError(res, http.StatusNotFound, p.title+" are not enabled")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, p.apiPath), "/")
+
+	if r.Method != http.MethodGet && !validateCSRFToken(r) {
+		writeJSONError(res, http.StatusForbidden, "Invalid CSRF token")
+		return
+	}
+
+	if r.Method != http.MethodGet && !hasFreshLogin(r, user) {
+		writeJSONError(res, http.StatusForbidden, p.reauthMessage())
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		csrfToken, err := getCSRFToken(res, r)
+		if err != nil {
+			log.WithError(err).Error("Unable to get CSRF token")
+			writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		keys, err := pm.ListPasskeys(user)
+		if err != nil {
+			log.WithError(err).Error("Unable to list passkeys")
+			writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		res.Header().Set("X-CSRF-Token", csrfToken)
+		writeJSON(res, http.StatusOK, map[string]interface{}{"passkeys": keys})
+
+	case r.Method == http.MethodPost && id == "register":
+		// Start the registration ceremony, the options are passed to
+		// navigator.credentials.create() by the browser
+		options, err := pm.BeginPasskeyRegistration(res, r, user)
+		if err != nil {
+			log.WithError(err).Error("Unable to start passkey registration")
+			writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		writeJSON(res, http.StatusOK, options)
+
+	case r.Method == http.MethodPut && id == "register":
+		var req struct {
+			Name       string          `json:"name"`
+			Credential json.RawMessage `json:"credential"`
+		}
+
+		if err := json.NewDecoder(http.MaxBytesReader(res, r.Body, maxPasskeyResponseSize)).Decode(&req); err != nil {
+			writeJSONError(res, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		info, err := pm.FinishPasskeyRegistration(res, r, user, req.Name, req.Credential)
+		if err != nil {
+			writeJSONError(res, passkeyErrorStatus(err), p.errorMessage(err))
+			return
+		}
+
+		mainCfg.AuditLog.Log(auditEventPasskeyRegister, r, map[string]string{"username": user, "passkey_id": info.ID, "passkey_name": info.Name, "passkey_type": p.noun}) // #nosec G104 - This is only logging
+
+		if err := p.syncMFAStore(pm, user); err != nil {
+			log.WithError(err).Error("Unable to enroll security keys")
+			writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		writeJSON(res, http.StatusCreated, map[string]interface{}{"passkey": info})
+
+	case r.Method == http.MethodDelete && id != "" && id != "register":
+		if err := p.removePasskey(pm, r, user, id); err != nil {
+			writeJSONError(res, passkeyErrorStatus(err), p.errorMessage(err))
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(res, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (p passkeyPage) removePasskey(pm plugins.PasskeyManager, r *http.Request, user, id string) error {
+	if !hasFreshLogin(r, user) {
+		return plugins.PasskeyRejected{Reason: p.reauthMessage()}
+	}
+
+	if err := pm.RemovePasskey(user, id); err != nil {
+		return err
+	}
+
+	mainCfg.AuditLog.Log(auditEventPasskeyRemove, r, map[string]string{"username": user, "passkey_id": id, "passkey_type": p.noun}) // #nosec G104 - This is only logging
+
+	return p.syncMFAStore(pm, user)
+}
+
+// syncMFAStore enrolls the MFA provider of the page in the MFA store
+// while the user has credentials registered so they are challenged
+// on login and removes it with the last credential
+func (p passkeyPage) syncMFAStore(pm plugins.PasskeyManager, user string) error {
+	if p.mfaProvider == "" || !mainCfg.MFAStore.enabled() {
+		return nil
+	}
+
+	keys, err := pm.ListPasskeys(user)
+	if err != nil {
+		return errors.Wrap(err, "Unable to list passkeys")
+	}
+
+	var cfgs []plugins.MFAConfig
+	if len(keys) > 0 {
+		cfgs = []plugins.MFAConfig{{Provider: p.mfaProvider}}
+	}
+
+	return mainCfg.MFAStore.set(user, p.mfaProvider, cfgs)
+}
+
+// reauthMessage tells the user to log in again as credentials must not
+// be changed using a stolen session
+func (p passkeyPage) reauthMessage() string {
+	return "Please log in again to manage your " + p.noun + "s"
+}
+
+// findPasskeyManager returns the first active PasskeyManager or nil
+// if there is none
+func findPasskeyManager() plugins.PasskeyManager {
+	authenticatorRegistryMutex.RLock()
+	defer authenticatorRegistryMutex.RUnlock()
+
+	for _, a := range activeAuthenticators {
+		if pm, ok := a.(plugins.PasskeyManager); ok {
+			return pm
+		}
+	}
+
+	return nil
+}
+
+// findSecurityKeyManager returns the first active MFA provider
+// implementing the PasskeyManager or nil if there is none
+func findSecurityKeyManager() plugins.PasskeyManager {
+	mfaRegistryMutex.RLock()
+	defer mfaRegistryMutex.RUnlock()
+
+	for _, m := range activeMFAProviders {
+		if pm, ok := m.(plugins.PasskeyManager); ok {
+			return pm
+		}
+	}
+
+	return nil
+}
+
+// passkeyTemplateView formats the passkey information for the template
+// as pongo2 is unable to format optional timestamps
+func passkeyTemplateView(keys []plugins.Passkey) []map[string]string {
+	view := []map[string]string{}
+	for _, k := range keys {
+		lastUsed := "never"
+		if k.LastUsed != nil {
+			lastUsed = k.LastUsed.Local().Format("2006-01-02 15:04")
+		}
+
+		view = append(view, map[string]string{
+			"id":         k.ID,
+			"name":       k.Name,
+			"created_at": k.CreatedAt.Local().Format("2006-01-02"),
+			"last_used":  lastUsed,
+		})
+	}
+
+	return view
+}
+
+func (p passkeyPage) errorMessage(err error) string {
+	var rejected plugins.PasskeyRejected
+
+	switch {
+	case errors.As(err, &rejected):
+		return rejected.Reason
+
+	case errors.Is(err, plugins.ErrPasskeyNotFound):
+		return "The " + p.noun + " was not found"
+
+	default:
+		log.WithError(err).Error("Unable to manage passkey")
+		return "Something went wrong, please try again later"
+	}
+}
+
+func passkeyErrorStatus(err error) int {
+	var rejected plugins.PasskeyRejected
+
+	switch {
+	case errors.As(err, &rejected):
+		return http.StatusBadRequest
+
+	case errors.Is(err, plugins.ErrPasskeyNotFound):
+		return http.StatusNotFound
+
+	default:
+		return http.StatusInternalServerError
+	}
+}
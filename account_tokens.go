@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const accountTokensAPIPath = "/api/account/tokens"
+
+func handleAccountTokensRequest(res http.ResponseWriter, r *http.Request) {
+	authenticator, user, groups, err := detectSession(res, r)
+	switch {
+	case err == nil:
+		// All fine
+
+	case errors.Is(err, plugins.ErrNoValidUserFound):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(r.URL.Path), http.StatusFound)
+		return
+
+	default:
+		log.WithError(err).Error("Failed to get user for token management")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	tm := findTokenManager()
+	tplCtx := pongo2.Context{
+		"enabled": tm != nil,
+		"user":    user,
+	}
+
+	if tm == nil {
+		renderAccountTemplate(res, r, "account_tokens.html", tplCtx)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !validateCSRFToken(r) {
+			http.Error(res, "Invalid CSRF token", http.StatusBadRequest)
+			return
+		}
+
+		switch r.FormValue("action") {
+		case "create":
+			var expiresAt *time.Time
+			if days, _ := strconv.Atoi(r.FormValue("expires_in")); days > 0 {
+				t := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+				expiresAt = &t
+			}
+
+			token, _, err := createPersonalToken(tm, r, authenticator, user, groups, r.FormValue("name"), expiresAt)
+			if err != nil {
+				tplCtx["error"] = tokenErrorMessage(err)
+				break
+			}
+
+			tplCtx["new_token"] = token
+			tplCtx["success"] = "Your token has been created, copy it now as it will not be shown again"
+
+		case "revoke":
+			if err := revokePersonalToken(tm, r, user, r.FormValue("id")); err != nil {
+				tplCtx["error"] = tokenErrorMessage(err)
+				break
+			}
+
+			tplCtx["success"] = "The token has been revoked"
+
+		default:
+			http.Error(res, "Invalid action", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tokens, err := tm.ListPersonalTokens(user)
+	if err != nil {
+		log.WithError(err).Error("Unable to list personal tokens")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	tplCtx["tokens"] = tokenTemplateView(tokens)
+	renderAccountTemplate(res, r, "account_tokens.html", tplCtx)
+}
+
+func handleAccountTokensAPIRequest(res http.ResponseWriter, r *http.Request) {
+	authenticator, user, groups, err := detectSession(res, r)
+	switch {
+	case err == nil:
+		// All fine
+
+	case errors.Is(err, plugins.ErrNoValidUserFound):
+		writeJSONError(res, http.StatusUnauthorized, "No valid user found")
+		return
+
+	default:
+		log.WithError(err).Error("Failed to get user for token management")
+		writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	tm := findTokenManager()
+	if tm == nil {
+		writeJSONError(res, http.StatusNotFound, "Personal tokens are not enabled")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, accountTokensAPIPath), "/")
+
+	if r.Method != http.MethodGet && !validateCSRFToken(r) {
+		writeJSONError(res, http.StatusForbidden, "Invalid CSRF token")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		csrfToken, err := getCSRFToken(res, r)
+		if err != nil {
+			log.WithError(err).Error("Unable to get CSRF token")
+			writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		tokens, err := tm.ListPersonalTokens(user)
+		if err != nil {
+			log.WithError(err).Error("Unable to list personal tokens")
+			writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+			return
+		}
+
+		res.Header().Set("X-CSRF-Token", csrfToken)
+		writeJSON(res, http.StatusOK, map[string]interface{}{"tokens": tokens})
+
+	case r.Method == http.MethodPost && id == "":
+		var req struct {
+			Name      string     `json:"name"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(res, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		token, info, err := createPersonalToken(tm, r, authenticator, user, groups, req.Name, req.ExpiresAt)
+		if err != nil {
+			writeJSONError(res, tokenErrorStatus(err), tokenErrorMessage(err))
+			return
+		}
+
+		writeJSON(res, http.StatusCreated, map[string]interface{}{"token": token, "info": info})
+
+	case r.Method == http.MethodDelete && id != "":
+		if err := revokePersonalToken(tm, r, user, id); err != nil {
+			writeJSONError(res, tokenErrorStatus(err), tokenErrorMessage(err))
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(res, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func createPersonalToken(tm plugins.TokenManager, r *http.Request, authenticator, user string, groups []string, name string, expiresAt *time.Time) (string, plugins.PersonalToken, error) {
+	token, info, err := tm.CreatePersonalToken(authenticator, user, groups, name, expiresAt)
+	if err != nil {
+		return "", info, err
+	}
+
+	mainCfg.AuditLog.Log(auditEventTokenCreate, r, map[string]string{"username": user, "token_id": info.ID, "token_name": info.Name}) // #nosec G104 - This is only logging
+
+	return token, info, nil
+}
+
+func revokePersonalToken(tm plugins.TokenManager, r *http.Request, user, id string) error {
+	if err := tm.RevokePersonalToken(user, id); err != nil {
+		return err
+	}
+
+	mainCfg.AuditLog.Log(auditEventTokenRevoke, r, map[string]string{"username": user, "token_id": id}) // #nosec G104 - This is only logging
+
+	return nil
+}
+
+// detectSessionUser detects the user like detectUser but only accepts
+// users detected by a SessionAuthenticator: tokens, certificates,
+// trusted headers or credentials sent along with the request are not
+// bound to an interactive login (including its second factor) and must
+// not be able to manage the account
+func detectSessionUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	_, user, groups, err := detectSession(res, r)
+	return user, groups, err
+}
+
+// detectSession works like detectSessionUser and additionally returns
+// the ID of the authenticator the user logged in through
+func detectSession(res http.ResponseWriter, r *http.Request) (string, string, []string, error) {
+	if r.Header.Get("Authorization") != "" {
+		return "", "", nil, plugins.NewLoginFailure("Authorization header not allowed for account management")
+	}
+
+	authenticatorRegistryMutex.RLock()
+	defer authenticatorRegistryMutex.RUnlock()
+
+	noUserErr := plugins.ErrNoValidUserFound
+	for _, a := range activeAuthenticators {
+		if sa, ok := a.(plugins.SessionAuthenticator); !ok || !sa.UsesLoginSession() {
+			continue
+		}
+
+		user, groups, err := a.DetectUser(res, r)
+		switch {
+		case err == nil:
+			return a.AuthenticatorID(), user, groups, err
+		case errors.Is(err, plugins.ErrNoValidUserFound):
+			// This is okay, keep a more specific reason if there is one
+			if err != plugins.ErrNoValidUserFound {
+				noUserErr = err
+			}
+		default:
+			return "", "", nil, err
+		}
+	}
+
+	return "", "", nil, noUserErr
+}
+
+// findTokenManager returns the active TokenManager having personal
+// tokens enabled or nil if there is none
+func findTokenManager() plugins.TokenManager {
+	authenticatorRegistryMutex.RLock()
+	defer authenticatorRegistryMutex.RUnlock()
+
+	for _, a := range activeAuthenticators {
+		if tm, ok := a.(plugins.TokenManager); ok && tm.SupportsPersonalTokens() {
+			return tm
+		}
+	}
+
+	return nil
+}
+
+// tokenTemplateView formats the token information for the template as
+// pongo2 is unable to format optional timestamps
+func tokenTemplateView(tokens []plugins.PersonalToken) []map[string]string {
+	formatOptional := func(t *time.Time, layout string) string {
+		if t == nil {
+			return "never"
+		}
+		return t.Local().Format(layout)
+	}
+
+	view := []map[string]string{}
+	for _, t := range tokens {
+		view = append(view, map[string]string{
+			"id":         t.ID,
+			"name":       t.Name,
+			"created_at": t.CreatedAt.Local().Format("2006-01-02"),
+			"expires_at": formatOptional(t.ExpiresAt, "2006-01-02"),
+			"last_used":  formatOptional(t.LastUsed, "2006-01-02 15:04"),
+		})
+	}
+
+	return view
+}
+
+func tokenErrorMessage(err error) string {
+	var rejected plugins.TokenRejected
+
+	switch {
+	case errors.As(err, &rejected):
+		return rejected.Reason
+
+	case errors.Is(err, plugins.ErrTokenNotFound):
+		return "Token not found"
+
+	default:
+		log.WithError(err).Error("Unable to manage personal token")
+		return "Something went wrong, please try again later"
+	}
+}
+
+func tokenErrorStatus(err error) int {
+	var rejected plugins.TokenRejected
+
+	switch {
+	case errors.As(err, &rejected):
+		return http.StatusBadRequest
+
+	case errors.Is(err, plugins.ErrTokenNotFound):
+		return http.StatusNotFound
+
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		log.WithError(err).Error("Unable to encode JSON response")
+	}
+}
+
+func writeJSONError(res http.ResponseWriter, status int, message string) {
+	writeJSON(res, status, map[string]string{"error": message})
+}
@@ -13,16 +13,26 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/plugins"
 )
 
 type auditEvent string
 
 const (
-	auditEventAccessDenied            = "access_denied"
-	auditEventLoginFailure            = "login_failure"
-	auditEventLoginSuccess auditEvent = "login_success"
-	auditEventLogout                  = "logout"
-	auditEventValidate                = "validate"
+	auditEventAccessDenied               = "access_denied"
+	auditEventLoginFailure               = "login_failure"
+	auditEventLoginSuccess    auditEvent = "login_success"
+	auditEventLogout                     = "logout"
+	auditEventMFAEnroll                  = "mfa_enroll"
+	auditEventMFARecoveryUsed            = "mfa_recovery_used"
+	auditEventMFARemove                  = "mfa_remove"
+	auditEventPasskeyRegister            = "passkey_register"
+	auditEventPasskeyRemove              = "passkey_remove"
+	auditEventPasswordChange             = "password_change"
+	auditEventTokenCreate                = "token_create"
+	auditEventTokenRevoke                = "token_revoke"
+	auditEventValidate                   = "validate"
 )
 
 type auditLogger struct {
@@ -53,6 +63,10 @@ func (a *auditLogger) Log(event auditEvent, r *http.Request, extraFields map[str
 	evt["event_type"] = event
 	evt["remote_addr"] = a.findIP(r)
 
+	for k, v := range plugins.AuditFields(r) {
+		evt[k] = v
+	}
+
 	for k, v := range extraFields {
 		evt[k] = v
 	}
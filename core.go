@@ -1,33 +1,72 @@
 package main
 
 import (
+	"github.com/Luzifer/nginx-sso/plugins"
 	"github.com/Luzifer/nginx-sso/plugins/auth/crowd"
 	"github.com/Luzifer/nginx-sso/plugins/auth/google"
+	"github.com/Luzifer/nginx-sso/plugins/auth/introspection"
+	"github.com/Luzifer/nginx-sso/plugins/auth/jwt"
+	"github.com/Luzifer/nginx-sso/plugins/auth/kerberos"
 	"github.com/Luzifer/nginx-sso/plugins/auth/ldap"
+	"github.com/Luzifer/nginx-sso/plugins/auth/magiclink"
+	"github.com/Luzifer/nginx-sso/plugins/auth/mtls"
 	"github.com/Luzifer/nginx-sso/plugins/auth/oidc"
+	"github.com/Luzifer/nginx-sso/plugins/auth/proxyheader"
+	"github.com/Luzifer/nginx-sso/plugins/auth/radius"
+	"github.com/Luzifer/nginx-sso/plugins/auth/saml"
 	"github.com/Luzifer/nginx-sso/plugins/auth/simple"
+	"github.com/Luzifer/nginx-sso/plugins/auth/sql"
 	"github.com/Luzifer/nginx-sso/plugins/auth/token"
+	"github.com/Luzifer/nginx-sso/plugins/auth/webauthn"
 	auth_yubikey "github.com/Luzifer/nginx-sso/plugins/auth/yubikey"
 	"github.com/Luzifer/nginx-sso/plugins/mfa/duo"
+	"github.com/Luzifer/nginx-sso/plugins/mfa/onetimecode"
+	"github.com/Luzifer/nginx-sso/plugins/mfa/recovery"
 	"github.com/Luzifer/nginx-sso/plugins/mfa/totp"
+	mfa_webauthn "github.com/Luzifer/nginx-sso/plugins/mfa/webauthn"
 	mfa_yubikey "github.com/Luzifer/nginx-sso/plugins/mfa/yubikey"
 )
 
+// optionalAuthenticators contains constructors of authenticators
+// which are only available when built with their respective build tag
+// (i.e. `pam` as it requires cgo)
+var optionalAuthenticators []func() plugins.Authenticator
+
 func registerModules() {
 	// Start with very simple, local auth providers as they are cheap
 	// in their execution and therefore if they are used nginx-sso
 	// can process far more requests than through the other providers
 	registerAuthenticator(simple.New(cookieStore))
+	for _, newAuthenticator := range optionalAuthenticators {
+		registerAuthenticator(newAuthenticator())
+	}
 	registerAuthenticator(token.New())
+	registerAuthenticator(jwt.New())
+	registerAuthenticator(mtls.New())
+	registerAuthenticator(proxyheader.New())
+	registerAuthenticator(kerberos.New(cookieStore))
+	registerAuthenticator(webauthn.New(cookieStore))
 
 	// Afterwards utilize the more expensive remove providers
 	registerAuthenticator(crowd.New())
+	registerAuthenticator(introspection.New())
 	registerAuthenticator(ldap.New(cookieStore))
+	registerAuthenticator(radius.New(cookieStore))
+	registerAuthenticator(sql.New(cookieStore))
+	registerAuthenticator(magiclink.New(cookieStore))
 	registerAuthenticator(google.New(cookieStore))
 	registerAuthenticator(oidc.New(cookieStore))
+	registerAuthenticator(saml.New(cookieStore))
 	registerAuthenticator(auth_yubikey.New(cookieStore))
 
+	// Recovery codes are accepted in place of any other second factor,
+	// they are checked first so no push or code is sent to the user
+	// when logging in using a recovery code
+	registerMFAProvider(recovery.New())
+
 	registerMFAProvider(duo.New())
 	registerMFAProvider(totp.New())
 	registerMFAProvider(mfa_yubikey.New())
+	registerMFAProvider(mfa_webauthn.New(cookieStore))
+	registerMFAProvider(onetimecode.New())
 }
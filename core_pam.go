@@ -0,0 +1,12 @@
+//go:build pam
+
+package main
+
+import (
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/auth/pam"
+)
+
+func init() {
+	optionalAuthenticators = append(optionalAuthenticators, func() plugins.Authenticator { return pam.New(cookieStore) })
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -31,6 +33,10 @@ type mainConfig struct {
 	Listen   struct {
 		Addr string `yaml:"addr"`
 		Port int    `yaml:"port"`
+		TLS  struct {
+			CertFile string `yaml:"cert_file"`
+			KeyFile  string `yaml:"key_file"`
+		} `yaml:"tls"`
 	} `yaml:"listen"`
 	Login struct {
 		Title           string            `yaml:"title" json:"title"`
@@ -39,18 +45,20 @@ type mainConfig struct {
 		HideMFAField    bool              `yaml:"hide_mfa_field" json:"hide_mfa_field"`
 		Names           map[string]string `yaml:"names" json:"names"`
 	} `yaml:"login"`
-	Plugins struct {
+	MFAStore mfaStore `yaml:"mfa_store"`
+	Plugins  struct {
 		Directory string `yaml:"directory"`
 	} `yaml:"plugins"`
 }
 
 var (
 	cfg = struct {
-		ConfigFile     string `flag:"config,c" default:"config.yaml" env:"CONFIG" description:"Location of the configuration file"`
-		AuthKey        string `flag:"authkey" env:"COOKIE_AUTHENTICATION_KEY" description:"Cookie authentication key"`
-		LogLevel       string `flag:"log-level" default:"info" description:"Level of logs to display (debug, info, warn, error)"`
-		TemplateDir    string `flag:"frontend-dir" default:"./frontend/" env:"FRONTEND_DIR" description:"Location of the directory containing the web assets"`
-		VersionAndExit bool   `flag:"version" default:"false" description:"Prints current version and exits"`
+		ConfigFile            string `flag:"config,c" default:"config.yaml" env:"CONFIG" description:"Location of the configuration file"`
+		AuthKey               string `flag:"authkey" env:"COOKIE_AUTHENTICATION_KEY" description:"Cookie authentication key"`
+		GenerateRecoveryCodes string `flag:"generate-recovery-codes" description:"Generates new MFA recovery codes for the given user, prints them and exits"`
+		LogLevel              string `flag:"log-level" default:"info" description:"Level of logs to display (debug, info, warn, error)"`
+		TemplateDir           string `flag:"frontend-dir" default:"./frontend/" env:"FRONTEND_DIR" description:"Location of the directory containing the web assets"`
+		VersionAndExit        bool   `flag:"version" default:"false" description:"Prints current version and exits"`
 	}{}
 
 	mainCfg     = mainConfig{}
@@ -127,6 +135,10 @@ func initializeModules(yamlSource []byte) error {
 		log.WithError(err).Fatal("Unable to configure MFA providers")
 	}
 
+	if err := mainCfg.MFAStore.load(); err != nil {
+		return errors.Wrap(err, "Unable to load MFA store")
+	}
+
 	return nil
 }
 
@@ -143,17 +155,33 @@ func main() {
 		log.WithError(err).Fatal("Unable to initialize modules")
 	}
 
+	if cfg.GenerateRecoveryCodes != "" {
+		if err = printRecoveryCodes(cfg.GenerateRecoveryCodes); err != nil {
+			log.WithError(err).Fatal("Unable to generate recovery codes")
+		}
+		os.Exit(0)
+	}
+
 	http.HandleFunc("/", handleRootRequest)
+	http.HandleFunc(accountPasskeysPage.path, accountPasskeysPage.handlePageRequest)
+	http.HandleFunc(accountPasskeysPage.apiPath, accountPasskeysPage.handleAPIRequest)
+	http.HandleFunc(accountPasskeysPage.apiPath+"/", accountPasskeysPage.handleAPIRequest)
+	http.HandleFunc("/account/mfa", handleAccountMFARequest)
+	http.HandleFunc("/account/password", handleAccountPasswordRequest)
+	http.HandleFunc(accountSecurityKeysPage.path, accountSecurityKeysPage.handlePageRequest)
+	http.HandleFunc(accountSecurityKeysPage.apiPath, accountSecurityKeysPage.handleAPIRequest)
+	http.HandleFunc(accountSecurityKeysPage.apiPath+"/", accountSecurityKeysPage.handleAPIRequest)
+	http.HandleFunc("/account/tokens", handleAccountTokensRequest)
+	http.HandleFunc(accountTokensAPIPath, handleAccountTokensAPIRequest)
+	http.HandleFunc(accountTokensAPIPath+"/", handleAccountTokensAPIRequest)
 	http.HandleFunc("/auth", handleAuthRequest)
 	http.HandleFunc("/debug", handleLoginDebug)
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) })
 	http.HandleFunc("/login", handleLoginRequest)
 	http.HandleFunc("/logout", handleLogoutRequest)
+	http.HandleFunc(providerEndpointPrefix, handleProviderRequest)
 
-	go http.ListenAndServe(
-		fmt.Sprintf("%s:%d", mainCfg.Listen.Addr, mainCfg.Listen.Port),
-		context.ClearHandler(http.DefaultServeMux),
-	)
+	go listenAndServe()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
@@ -176,6 +204,31 @@ func main() {
 	}
 }
 
+func listenAndServe() {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", mainCfg.Listen.Addr, mainCfg.Listen.Port),
+		Handler: context.ClearHandler(http.DefaultServeMux),
+	}
+
+	if mainCfg.Listen.TLS.CertFile == "" {
+		if err := srv.ListenAndServe(); err != nil {
+			log.WithError(err).Fatal("HTTP server exited unexpectedly")
+		}
+		return
+	}
+
+	// Client certificates are requested but not verified here: They
+	// are validated by the mtls authenticator against its CA
+	srv.TLSConfig = &tls.Config{
+		ClientAuth: tls.RequestClientCert,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if err := srv.ListenAndServeTLS(mainCfg.Listen.TLS.CertFile, mainCfg.Listen.TLS.KeyFile); err != nil {
+		log.WithError(err).Fatal("HTTPS server exited unexpectedly")
+	}
+}
+
 func handleRootRequest(res http.ResponseWriter, r *http.Request) {
 	// In case of a request to `/` redirect to login utilizing the default redirect
 	http.Redirect(res, r, "login", http.StatusFound)
@@ -184,8 +237,8 @@ func handleRootRequest(res http.ResponseWriter, r *http.Request) {
 func handleAuthRequest(res http.ResponseWriter, r *http.Request) {
 	user, groups, err := detectUser(res, r)
 
-	switch err {
-	case plugins.ErrNoValidUserFound:
+	switch {
+	case errors.Is(err, plugins.ErrNoValidUserFound):
 		// No valid user found, check whether special anonymous "user" has access
 		// Username is set to 0x0 character to prevent accidental whitelist-match
 		if mainCfg.ACL.HasAccess(string(byte(0x0)), nil, r) {
@@ -194,10 +247,10 @@ func handleAuthRequest(res http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		mainCfg.AuditLog.Log(auditEventValidate, r, map[string]string{"result": "no valid user found"}) // #nosec G104 - This is only logging
+		mainCfg.AuditLog.Log(auditEventValidate, r, map[string]string{"result": plugins.FailureReason(err, "no valid user found")}) // #nosec G104 - This is only logging
 		http.Error(res, "No valid user found", http.StatusUnauthorized)
 
-	case nil:
+	case err == nil:
 		if !mainCfg.ACL.HasAccess(user, groups, r) {
 			mainCfg.AuditLog.Log(auditEventAccessDenied, r, map[string]string{"username": user}) // #nosec G104 - This is only logging
 			http.Error(res, "Access denied for this resource", http.StatusForbidden)
@@ -231,16 +284,42 @@ func handleLoginRequest(res http.ResponseWriter, r *http.Request) {
 		"go": redirURL,
 	}
 
+	if r.Method == "POST" && r.FormValue(mfaPendingField) != "" {
+		// Response to an MFA challenge of a login passing the first factor
+		login, err := takePendingMFALogin(res, r)
+		if err != nil {
+			auditFields["reason"] = plugins.FailureReason(err, "invalid credentials")
+			mainCfg.AuditLog.Log(auditEventLoginFailure, r, auditFields) // #nosec G104 - This is only logging
+			http.Redirect(res, r, "/login?go="+url.QueryEscape(redirURL), http.StatusFound)
+			return
+		}
+
+		finishMFALogin(res, r, redirURL, auditFields, login)
+		return
+	}
+
 	if r.Method == "POST" || r.URL.Query().Get("code") != "" {
 		// Simple authentication
 		user, mfaCfgs, err := loginUser(res, r)
-		switch err {
-		case plugins.ErrNoValidUserFound:
-			auditFields["reason"] = "invalid credentials"
+		var (
+			challenge plugins.LoginChallenge
+			pending   plugins.LoginPending
+		)
+		switch {
+		case errors.As(err, &challenge):
+			// Provider needs another response, keep its cookies and ask the user
+			renderLoginChallenge(res, redirURL, challenge)
+			return
+		case errors.As(err, &pending):
+			// Login continues out of band, only inform the user
+			renderLoginChallenge(res, redirURL, plugins.LoginChallenge{Message: pending.Message})
+			return
+		case errors.Is(err, plugins.ErrNoValidUserFound):
+			auditFields["reason"] = plugins.FailureReason(err, "invalid credentials")
 			mainCfg.AuditLog.Log(auditEventLoginFailure, r, auditFields) // #nosec G104 - This is only logging
 			http.Redirect(res, r, "/login?go="+url.QueryEscape(redirURL), http.StatusFound)
 			return
-		case nil:
+		case err == nil:
 			// Don't handle for now, MFA validation comes first
 		default:
 			auditFields["reason"] = "error"
@@ -251,30 +330,13 @@ func handleLoginRequest(res http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// MFA validation against configs from login
-		err = validateMFA(res, r, user, mfaCfgs)
-		switch err {
-		case plugins.ErrNoValidUserFound:
-			auditFields["reason"] = "invalid credentials"
-			mainCfg.AuditLog.Log(auditEventLoginFailure, r, auditFields) // #nosec G104 - This is only logging
-			res.Header().Del("Set-Cookie")                               // Remove login cookie
-			http.Redirect(res, r, "/login?go="+url.QueryEscape(redirURL), http.StatusFound)
-			return
-
-		case nil:
-			mainCfg.AuditLog.Log(auditEventLoginSuccess, r, auditFields) // #nosec G104 - This is only logging
-			http.Redirect(res, r, redirURL, http.StatusFound)
-			return
+		// The login cookies are only handed out after the MFA validation
+		// succeeded, providers might need to set cookies on their own
+		loginCookies := res.Header().Values("Set-Cookie")
+		res.Header().Del("Set-Cookie")
 
-		default:
-			auditFields["reason"] = "error"
-			auditFields["error"] = err.Error()
-			mainCfg.AuditLog.Log(auditEventLoginFailure, r, auditFields) // #nosec G104 - This is only logging
-			log.WithError(err).Error("Login failed with unexpected error")
-			res.Header().Del("Set-Cookie") // Remove login cookie
-			http.Redirect(res, r, "/login?go="+url.QueryEscape(redirURL), http.StatusFound)
-			return
-		}
+		finishMFALogin(res, r, redirURL, auditFields, pendingMFALogin{user: user, mfaCfgs: mfaCfgs, cookies: loginCookies})
+		return
 	}
 
 	// Store redirect URL in session (required for oAuth2 flows)
@@ -287,6 +349,15 @@ func handleLoginRequest(res http.ResponseWriter, r *http.Request) {
 		http.Error(res, "Something went wrong", http.StatusInternalServerError)
 	}
 
+	// Let browsers authenticate through the HTTP authentication
+	// framework and show the login form if they can't
+	if challenges := getHTTPAuthChallenges(r); len(challenges) > 0 {
+		for _, c := range challenges {
+			res.Header().Add("WWW-Authenticate", c)
+		}
+		res.WriteHeader(http.StatusUnauthorized)
+	}
+
 	// Render login page
 	tpl := pongo2.Must(pongo2.FromFile(path.Join(cfg.TemplateDir, "index.html")))
 	if err := tpl.ExecuteWriter(pongo2.Context{
@@ -299,6 +370,106 @@ func handleLoginRequest(res http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// finishMFALogin validates the MFA of a login which passed the first
+// factor and either completes the login or asks the user to respond to
+// the challenge of an MFA provider
+func finishMFALogin(res http.ResponseWriter, r *http.Request, redirURL string, auditFields map[string]string, login pendingMFALogin) {
+	if login.id == "" {
+		var err error
+		if login.id, err = newPendingMFALoginID(); err != nil {
+			log.WithError(err).Error("Unable to start MFA login")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	plugins.SetMFALoginID(r, login.id)
+
+	err := validateMFA(res, r, login.user, login.mfaCfgs)
+
+	var challenge plugins.MFAChallenge
+	switch {
+	case errors.As(err, &challenge):
+		if err := storePendingMFALogin(res, r, login); err != nil {
+			log.WithError(err).Error("Unable to store pending MFA login")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		renderMFAChallenge(res, redirURL, login.id, challenge)
+
+	case errors.Is(err, plugins.ErrNoValidUserFound):
+		auditFields["reason"] = plugins.FailureReason(err, "invalid credentials")
+		mainCfg.AuditLog.Log(auditEventLoginFailure, r, auditFields) // #nosec G104 - This is only logging
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(redirURL), http.StatusFound)
+
+	case err == nil:
+		for _, c := range login.cookies {
+			res.Header().Add("Set-Cookie", c)
+		}
+
+		if err := recordLogin(res, r, login.user); err != nil {
+			log.WithError(err).Error("Unable to record login")
+		}
+
+		if remaining, ok := plugins.AuditFields(r)["recovery_codes_remaining"]; ok {
+			mainCfg.AuditLog.Log(auditEventMFARecoveryUsed, r, map[string]string{"username": login.user, "recovery_codes_remaining": remaining}) // #nosec G104 - This is only logging
+		}
+
+		mainCfg.AuditLog.Log(auditEventLoginSuccess, r, auditFields) // #nosec G104 - This is only logging
+		http.Redirect(res, r, redirURL, http.StatusFound)
+
+	default:
+		auditFields["reason"] = "error"
+		auditFields["error"] = err.Error()
+		mainCfg.AuditLog.Log(auditEventLoginFailure, r, auditFields) // #nosec G104 - This is only logging
+		log.WithError(err).Error("Login failed with unexpected error")
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(redirURL), http.StatusFound)
+	}
+}
+
+func renderLoginChallenge(res http.ResponseWriter, redirURL string, challenge plugins.LoginChallenge) {
+	renderChallengeTemplate(res, pongo2.Context{
+		"challenge":  challenge,
+		"field_name": strings.Join([]string{challenge.Authenticator, challenge.Field.Name}, "-"),
+		"go":         redirURL,
+		"login":      mainCfg.Login,
+	})
+}
+
+func renderMFAChallenge(res http.ResponseWriter, redirURL, pendingID string, challenge plugins.MFAChallenge) {
+	options, err := json.Marshal(challenge.Options)
+	if err != nil {
+		log.WithError(err).Error("Unable to encode MFA challenge options")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	renderChallengeTemplate(res, pongo2.Context{
+		"challenge": plugins.LoginChallenge{
+			Authenticator: challenge.Provider,
+			Message:       challenge.Message,
+			Field:         challenge.Field,
+		},
+		"field_name":    strings.Join([]string{challenge.Provider, challenge.Field.Name}, "-"),
+		"go":            redirURL,
+		"login":         mainCfg.Login,
+		"mfa_pending":   pendingID,
+		"options":       string(options),
+		"recovery":      findRecoveryCodeManager() != nil,
+		"recovery_name": plugins.MFARecoveryFieldName,
+		"resend":        challenge.Resend,
+		"resend_name":   strings.Join([]string{challenge.Provider, plugins.MFAResendFieldName}, "-"),
+	})
+}
+
+func renderChallengeTemplate(res http.ResponseWriter, tplCtx pongo2.Context) {
+	tpl := pongo2.Must(pongo2.FromFile(path.Join(cfg.TemplateDir, "challenge.html")))
+	if err := tpl.ExecuteWriter(tplCtx, res); err != nil {
+		log.WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+	}
+}
+
 func handleLogoutRequest(res http.ResponseWriter, r *http.Request) {
 	redirURL, err := getRedirectURL(r, mainCfg.Login.DefaultRedirect)
 	if err != nil {
@@ -317,11 +488,11 @@ func handleLogoutRequest(res http.ResponseWriter, r *http.Request) {
 
 func handleLoginDebug(w http.ResponseWriter, r *http.Request) {
 	user, groups, err := detectUser(w, r)
-	switch err {
-	case nil:
+	switch {
+	case err == nil:
 		// All fine
 
-	case plugins.ErrNoValidUserFound:
+	case errors.Is(err, plugins.ErrNoValidUserFound):
 		http.Redirect(w, r, "login", http.StatusFound)
 		return
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
@@ -62,19 +63,59 @@ func validateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs
 	mfaRegistryMutex.RLock()
 	defer mfaRegistryMutex.RUnlock()
 
+	var (
+		challenge  *plugins.MFAChallenge
+		challenger plugins.MFAProvider
+		noUserErr  = plugins.ErrNoValidUserFound
+	)
+
 	for _, m := range activeMFAProviders {
 		err := m.ValidateMFA(res, r, user, mfaCfgs)
-		switch err {
-		case nil:
+
+		var c plugins.MFAChallenge
+		switch {
+		case err == nil:
 			// Validated successfully
 			return nil
-		case plugins.ErrNoValidUserFound:
-			// This is fine for now
+		case errors.As(err, &c):
+			// Provider needs another response, only ask for it if no
+			// other provider is able to validate the request
+			if challenge == nil {
+				challenge, challenger = &c, m
+			}
+		case errors.Is(err, plugins.ErrNoValidUserFound):
+			// This is fine for now, keep a more specific reason if there is one
+			if err != plugins.ErrNoValidUserFound {
+				noUserErr = err
+			}
 		default:
 			return err
 		}
 	}
 
+	if challenge != nil {
+		if s, ok := challenger.(plugins.MFAChallengeSender); ok {
+			// Only the provider of the shown challenge delivers it
+			return s.SendChallenge(r, user, mfaCfgs, *challenge)
+		}
+		return *challenge
+	}
+
 	// No method could verify the user
-	return plugins.ErrNoValidUserFound
+	return noUserErr
+}
+
+// findMFAProvider returns the active MFA provider with the given ID or
+// nil if it is not active
+func findMFAProvider(id string) plugins.MFAProvider {
+	mfaRegistryMutex.RLock()
+	defer mfaRegistryMutex.RUnlock()
+
+	for _, m := range activeMFAProviders {
+		if m.ProviderID() == id {
+			return m
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const (
+	mfaPendingField = "mfa_pending"
+	mfaPendingTTL   = 5 * time.Minute
+)
+
+// pendingMFALogin is a login which passed the first factor and waits
+// for the response to an MFA challenge. It is kept in memory as the
+// login cookies must not be handed to the browser before the MFA
+// validation succeeded and the session cookie is only signed.
+type pendingMFALogin struct {
+	id      string
+	user    string
+	mfaCfgs []plugins.MFAConfig
+	cookies []string
+	expires time.Time
+}
+
+var (
+	pendingMFALogins     = map[string]pendingMFALogin{}
+	pendingMFALoginsLock sync.Mutex
+)
+
+// newPendingMFALoginID generates the ID of a login waiting for the MFA
+// validation, it is kept for all challenges of the login
+func newPendingMFALoginID() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, "Unable to generate pending login ID")
+	}
+
+	return hex.EncodeToString(raw), nil
+}
+
+// storePendingMFALogin remembers the login under its ID and binds it to
+// the main session of the browser. The ID needs to be submitted with
+// the response to the challenge.
+func storePendingMFALogin(res http.ResponseWriter, r *http.Request, login pendingMFALogin) error {
+	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, "main"}, "-")) // #nosec G104 - On error empty session is returned
+	sess.Options = mainCfg.Cookie.GetSessionOpts()
+	sess.Values[mfaPendingField] = login.id
+
+	if err := sess.Save(r, res); err != nil {
+		return errors.Wrap(err, "Unable to save session")
+	}
+
+	pendingMFALoginsLock.Lock()
+	defer pendingMFALoginsLock.Unlock()
+
+	now := time.Now()
+	for k, p := range pendingMFALogins {
+		if now.After(p.expires) {
+			delete(pendingMFALogins, k)
+		}
+	}
+
+	login.expires = now.Add(mfaPendingTTL)
+	pendingMFALogins[login.id] = login
+
+	return nil
+}
+
+// takePendingMFALogin returns and removes the pending login referenced
+// by the request. Each pending login can only be used once.
+func takePendingMFALogin(res http.ResponseWriter, r *http.Request) (pendingMFALogin, error) {
+	id := r.FormValue(mfaPendingField)
+
+	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, "main"}, "-")) // #nosec G104 - On error empty session is returned
+	sess.Options = mainCfg.Cookie.GetSessionOpts()
+	expected, _ := sess.Values[mfaPendingField].(string)
+	delete(sess.Values, mfaPendingField)
+
+	if err := sess.Save(r, res); err != nil {
+		return pendingMFALogin{}, errors.Wrap(err, "Unable to save session")
+	}
+
+	pendingMFALoginsLock.Lock()
+	defer pendingMFALoginsLock.Unlock()
+
+	login, ok := pendingMFALogins[id]
+	delete(pendingMFALogins, id)
+
+	if !ok || expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(id)) != 1 || time.Now().After(login.expires) {
+		return pendingMFALogin{}, plugins.NewLoginFailure("MFA challenge expired")
+	}
+
+	return login, nil
+}
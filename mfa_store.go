@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
+)
+
+// mfaStore keeps the MFA configs users enrolled themselves on the
+// account pages. The configs are added to the ones returned by the
+// authenticator the user logged in with.
+type mfaStore struct {
+	File string `yaml:"file"`
+
+	lock    sync.RWMutex
+	configs map[string][]plugins.MFAConfig
+}
+
+func (m *mfaStore) enabled() bool { return m.File != "" }
+
+// load reads the configs from the file, a missing file is treated as
+// an empty store
+func (m *mfaStore) load() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.configs = map[string][]plugins.MFAConfig{}
+	if !m.enabled() {
+		return nil
+	}
+
+	raw, err := os.ReadFile(m.File)
+	switch {
+	case err == nil:
+		// All fine
+
+	case os.IsNotExist(err):
+		return nil
+
+	default:
+		return errors.Wrap(err, "Unable to read MFA store")
+	}
+
+	return errors.Wrap(yaml.Unmarshal(raw, &m.configs), "Unable to decode MFA store")
+}
+
+// get returns the configs enrolled by the user
+func (m *mfaStore) get(user string) []plugins.MFAConfig {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return append([]plugins.MFAConfig{}, m.configs[user]...)
+}
+
+// set replaces all configs of the provider enrolled by the user
+func (m *mfaStore) set(user, provider string, cfgs []plugins.MFAConfig) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.enabled() {
+		return errors.New("MFA store is not configured")
+	}
+
+	prev := m.configs[user]
+
+	updated := []plugins.MFAConfig{}
+	for _, c := range prev {
+		if c.Provider != provider {
+			updated = append(updated, c)
+		}
+	}
+	updated = append(updated, cfgs...)
+
+	if len(updated) == 0 {
+		delete(m.configs, user)
+	} else {
+		m.configs[user] = updated
+	}
+
+	raw, err := yaml.Marshal(m.configs)
+	if err == nil {
+		err = filestore.WriteAtomic(m.File, raw)
+	}
+
+	if err != nil {
+		// Keep memory and file in sync
+		if prev == nil {
+			delete(m.configs, user)
+		} else {
+			m.configs[user] = prev
+		}
+		return errors.Wrap(err, "Unable to save MFA store")
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestMFAStore(t *testing.T) {
+	file := path.Join(t.TempDir(), "mfa.yaml")
+
+	s := &mfaStore{File: file}
+	require.NoError(t, s.load())
+	assert.Empty(t, s.get("luzifer"))
+
+	require.NoError(t, s.set("luzifer", "yubikey", []plugins.MFAConfig{{Provider: "yubikey", Attributes: map[string]interface{}{"device": "ccccccfcvuul"}}}))
+	require.NoError(t, s.set("luzifer", "totp", []plugins.MFAConfig{{Provider: "totp", Attributes: map[string]interface{}{"secret": "MZXW6YTBOIFA"}}}))
+
+	// Configs survive restarts
+	s = &mfaStore{File: file}
+	require.NoError(t, s.load())
+	cfgs := s.get("luzifer")
+	require.Len(t, cfgs, 2)
+	assert.Equal(t, "MZXW6YTBOIFA", cfgs[1].AttributeString("secret"))
+
+	// Only the configs of the given provider are replaced
+	require.NoError(t, s.set("luzifer", "totp", nil))
+	cfgs = s.get("luzifer")
+	require.Len(t, cfgs, 1)
+	assert.Equal(t, "yubikey", cfgs[0].Provider)
+
+	// Without a file the store cannot be written
+	assert.Error(t, (&mfaStore{}).set("luzifer", "totp", nil))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+// mfaTestProvider always asks for its challenge and counts the
+// challenges it delivered
+type mfaTestProvider struct {
+	id   string
+	sent int
+}
+
+func (m *mfaTestProvider) ProviderID() string                      { return m.id }
+func (m *mfaTestProvider) Configure(yamlSource []byte) (err error) { return nil }
+func (m *mfaTestProvider) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []plugins.MFAConfig) error {
+	return plugins.MFAChallenge{Provider: m.id}
+}
+
+func (m *mfaTestProvider) SendChallenge(r *http.Request, user string, mfaCfgs []plugins.MFAConfig, challenge plugins.MFAChallenge) error {
+	m.sent++
+	challenge.Message = "sent"
+	return challenge
+}
+
+func TestOnlyShownChallengeIsSent(t *testing.T) {
+	defer func(prev []plugins.MFAProvider) { activeMFAProviders = prev }(activeMFAProviders)
+
+	first, second := &mfaTestProvider{id: "first"}, &mfaTestProvider{id: "second"}
+	activeMFAProviders = []plugins.MFAProvider{first, second}
+
+	err := validateMFA(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/login", nil), "jane", []plugins.MFAConfig{{Provider: "second"}})
+
+	var challenge plugins.MFAChallenge
+	require.ErrorAs(t, err, &challenge)
+	assert.Equal(t, "first", challenge.Provider)
+	assert.Equal(t, "sent", challenge.Message)
+	assert.Equal(t, 1, first.sent)
+	assert.Equal(t, 0, second.sent)
+}
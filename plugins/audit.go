@@ -0,0 +1,63 @@
+package plugins
+
+import (
+	"net/http"
+
+	"github.com/gorilla/context"
+)
+
+type (
+	auditFieldsKey struct{}
+	auditLoginKey  struct{}
+	issuerKey      struct{}
+)
+
+// AddAuditFields attaches additional fields to the audit log events
+// logged for the request (i.e. details of the MFA validation)
+func AddAuditFields(r *http.Request, fields map[string]string) {
+	stored := AuditFields(r)
+	for k, v := range fields {
+		stored[k] = v
+	}
+
+	context.Set(r, auditFieldsKey{}, stored)
+}
+
+// AuditFields returns a copy of the fields attached to the request
+func AuditFields(r *http.Request) map[string]string {
+	fields := map[string]string{}
+	if stored, ok := context.Get(r, auditFieldsKey{}).(map[string]string); ok {
+		for k, v := range stored {
+			fields[k] = v
+		}
+	}
+
+	return fields
+}
+
+// MarkLogin flags the request to have logged in the user without the
+// login form (i.e. by negotiating a Kerberos ticket) in order to log
+// the login in the audit log
+func MarkLogin(r *http.Request) { context.Set(r, auditLoginKey{}, true) }
+
+// IsMarkedLogin reports whether the request logged in the user without
+// the login form
+func IsMarkedLogin(r *http.Request) bool {
+	marked, _ := context.Get(r, auditLoginKey{}).(bool)
+	return marked
+}
+
+// SetIssuingAuthenticator records the ID of the authenticator the user
+// was logged in through when the credential used in the request (i.e.
+// a personal access token) was issued in order to re-check the user
+// through its UserStatusChecker
+func SetIssuingAuthenticator(r *http.Request, authenticator string) {
+	context.Set(r, issuerKey{}, authenticator)
+}
+
+// IssuingAuthenticator returns the ID set by SetIssuingAuthenticator
+// or an empty string if there is none
+func IssuingAuthenticator(r *http.Request) string {
+	id, _ := context.Get(r, issuerKey{}).(string)
+	return id
+}
@@ -1,6 +1,9 @@
 package plugins
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 type Authenticator interface {
 	// AuthenticatorID needs to return an unique string to identify
@@ -47,6 +50,130 @@ type Authenticator interface {
 	SupportsMFA() bool
 }
 
+// PasswordChanger can optionally be implemented by an Authenticator
+// which is able to update the passwords of its users
+type PasswordChanger interface {
+	// CanChangePassword reports whether the password of the given user
+	// can be changed through this Authenticator
+	CanChangePassword(user string) bool
+
+	// ChangePassword verifies the current password of the user and
+	// replaces it with the new password. If the current password is
+	// not valid the ErrNoValidUserFound needs to be returned, if the
+	// new password is not acceptable a PasswordPolicyViolation
+	ChangePassword(user, currentPassword, newPassword string) error
+}
+
+// SessionAuthenticator can optionally be implemented by an
+// Authenticator whose users log in interactively through the login
+// page and are detected through the session written by Login
+// afterwards. Only users detected by these Authenticators are allowed
+// to manage their account (personal tokens, passkeys, MFA) as other
+// credentials (tokens, certificates, trusted headers) are not bound to
+// an interactive login.
+type SessionAuthenticator interface {
+	// UsesLoginSession reports whether users detected by DetectUser
+	// logged in interactively through the login page
+	UsesLoginSession() bool
+}
+
+// TokenManager can optionally be implemented by an Authenticator
+// which is able to issue personal access tokens to logged in users
+type TokenManager interface {
+	// SupportsPersonalTokens reports whether personal access tokens
+	// are enabled in the configuration of the Authenticator
+	SupportsPersonalTokens() bool
+
+	// CreatePersonalToken issues a new token for the user logged in
+	// through the given authenticator which is granted the given
+	// groups. The cleartext token is returned only once and cannot be
+	// retrieved afterwards. If the request is not acceptable a
+	// TokenRejected error needs to be returned. When the token is used
+	// the authenticator must be passed to SetIssuingAuthenticator.
+	CreatePersonalToken(authenticator, user string, groups []string, name string, expiresAt *time.Time) (token string, info PersonalToken, err error)
+
+	// ListPersonalTokens returns all tokens issued to the user
+	ListPersonalTokens(user string) ([]PersonalToken, error)
+
+	// RevokePersonalToken removes the token with the given ID issued
+	// to the user. If there is no such token ErrTokenNotFound needs
+	// to be returned.
+	RevokePersonalToken(user, id string) error
+}
+
+// UserStatusChecker can optionally be implemented by an Authenticator
+// which is able to check the account of a user it detected before
+// without their credentials, i.e. when the user sends a personal
+// access token issued while being logged in through the Authenticator
+type UserStatusChecker interface {
+	// CheckUserStatus returns the current groups of the user or an
+	// error when the account must no longer be used. If the user is
+	// unknown the plugins.ErrNoValidUserFound needs to be returned.
+	CheckUserStatus(user string) (groups []string, err error)
+}
+
+// PasskeyManager can optionally be implemented by an Authenticator
+// which lets logged in users register WebAuthn credentials (passkeys)
+// or by an MFAProvider to register security keys used as second factor.
+// The options and responses are passed through to and from the
+// browser as JSON.
+type PasskeyManager interface {
+	// BeginPasskeyRegistration returns the options to be passed to
+	// navigator.credentials.create() for the user and remembers the
+	// challenge for FinishPasskeyRegistration
+	BeginPasskeyRegistration(res http.ResponseWriter, r *http.Request, user string) (options interface{}, err error)
+
+	// FinishPasskeyRegistration verifies the credential created by the
+	// browser and stores it under the given name. If the credential is
+	// not acceptable a PasskeyRejected error needs to be returned.
+	FinishPasskeyRegistration(res http.ResponseWriter, r *http.Request, user, name string, response []byte) (info Passkey, err error)
+
+	// ListPasskeys returns all passkeys registered by the user
+	ListPasskeys(user string) ([]Passkey, error)
+
+	// RemovePasskey removes the passkey with the given ID registered by
+	// the user. If there is no such passkey ErrPasskeyNotFound needs to
+	// be returned.
+	RemovePasskey(user, id string) error
+}
+
+// EndpointProvider can optionally be implemented by an Authenticator
+// which needs to serve own endpoints (i.e. metadata or callbacks of an
+// identity provider). Requests to /provider/<AuthenticatorID>/ are
+// passed to ServeEndpoint with that prefix removed from the path.
+type EndpointProvider interface {
+	ServeEndpoint(res http.ResponseWriter, r *http.Request)
+}
+
+// HTTPAuthChallenger can optionally be implemented by an Authenticator
+// using the HTTP authentication framework (i.e. SPNEGO). The challenge
+// is sent in the WWW-Authenticate header of the login page which is then
+// served with status 401 so capable browsers retry with credentials
+// while all others display the login form. An empty challenge means the
+// Authenticator does not want to challenge this request.
+type HTTPAuthChallenger interface {
+	HTTPAuthChallenge(r *http.Request) string
+}
+
+// PersonalToken describes a personal access token without exposing
+// the token itself
+type PersonalToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+// Passkey describes a registered WebAuthn credential without exposing
+// its key material
+type Passkey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
 type LoginField struct {
 	Action      string `json:"action"`
 	Label       string `json:"label"`
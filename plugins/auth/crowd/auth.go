@@ -185,3 +185,7 @@ func (a AuthCrowd) Logout(res http.ResponseWriter, r *http.Request) (err error)
 // will display an additional field for this provider for the user
 // to fill in their MFA token.
 func (a AuthCrowd) SupportsMFA() bool { return false }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a AuthCrowd) UsesLoginSession() bool { return true }
@@ -207,6 +207,10 @@ func (a *AuthGoogleOAuth) Logout(res http.ResponseWriter, r *http.Request) (err
 // to fill in their MFA token.
 func (a *AuthGoogleOAuth) SupportsMFA() bool { return false }
 
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a *AuthGoogleOAuth) UsesLoginSession() bool { return true }
+
 func (a *AuthGoogleOAuth) getOAuthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		ClientID:     a.ClientID,
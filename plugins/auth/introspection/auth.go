@@ -0,0 +1,310 @@
+package introspection
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/claims"
+)
+
+const (
+	authMethodBasic = "client_secret_basic"
+	authMethodPost  = "client_secret_post"
+
+	defaultMaxCacheEntries  = 10000
+	defaultNegativeCacheTTL = time.Minute
+	defaultTimeout          = 5 * time.Second
+)
+
+var defaultUsernameClaims = []string{"username", "sub"}
+
+type AuthIntrospection struct {
+	IntrospectionURL string        `yaml:"introspection_url"`
+	ClientID         string        `yaml:"client_id"`
+	ClientSecret     string        `yaml:"client_secret"`
+	AuthMethod       string        `yaml:"auth_method"`
+	Audience         string        `yaml:"audience"`
+	AllowedClientIDs []string      `yaml:"allowed_client_ids"`
+	UsernameClaim    string        `yaml:"username_claim"`
+	GroupsClaim      string        `yaml:"groups_claim"`
+	MaxCacheTTL      time.Duration `yaml:"max_cache_ttl"`
+	MaxCacheEntries  int           `yaml:"max_cache_entries"`
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"`
+	Timeout          time.Duration `yaml:"timeout"`
+
+	cache  *resultCache
+	client *http.Client
+}
+
+func New() *AuthIntrospection {
+	return &AuthIntrospection{
+		cache: &resultCache{},
+	}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a AuthIntrospection) AuthenticatorID() string { return "oauth2_introspection" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthIntrospection) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Providers struct {
+			Introspection *AuthIntrospection `yaml:"oauth2_introspection"`
+		} `yaml:"providers"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.Introspection == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.IntrospectionURL = envelope.Providers.Introspection.IntrospectionURL
+	a.ClientID = envelope.Providers.Introspection.ClientID
+	a.ClientSecret = envelope.Providers.Introspection.ClientSecret
+	a.AuthMethod = envelope.Providers.Introspection.AuthMethod
+	a.Audience = envelope.Providers.Introspection.Audience
+	a.AllowedClientIDs = envelope.Providers.Introspection.AllowedClientIDs
+	a.UsernameClaim = envelope.Providers.Introspection.UsernameClaim
+	a.GroupsClaim = envelope.Providers.Introspection.GroupsClaim
+	a.MaxCacheTTL = envelope.Providers.Introspection.MaxCacheTTL
+	a.MaxCacheEntries = envelope.Providers.Introspection.MaxCacheEntries
+	a.NegativeCacheTTL = envelope.Providers.Introspection.NegativeCacheTTL
+	a.Timeout = envelope.Providers.Introspection.Timeout
+
+	if a.IntrospectionURL == "" {
+		return errors.New("introspection_url needs to be set")
+	}
+
+	// Authorization servers confirm tokens issued to any of their
+	// clients, without restriction tokens of other applications would
+	// be accepted
+	if a.Audience == "" && len(a.AllowedClientIDs) == 0 {
+		return errors.New("audience or allowed_client_ids needs to be set")
+	}
+
+	switch a.AuthMethod {
+	case "":
+		a.AuthMethod = authMethodBasic
+	case authMethodBasic, authMethodPost:
+		// Valid method
+	default:
+		return errors.Errorf("Invalid auth_method %q", a.AuthMethod)
+	}
+
+	if a.GroupsClaim == "" {
+		a.GroupsClaim = "scope"
+	}
+
+	if a.MaxCacheEntries <= 0 {
+		a.MaxCacheEntries = defaultMaxCacheEntries
+	}
+
+	if a.NegativeCacheTTL == 0 {
+		a.NegativeCacheTTL = defaultNegativeCacheTTL
+	}
+
+	if a.Timeout == 0 {
+		a.Timeout = defaultTimeout
+	}
+
+	a.client = &http.Client{Timeout: a.Timeout}
+	a.cache.reset(a.MaxCacheEntries)
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a AuthIntrospection) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if token = strings.TrimSpace(token); !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	now := time.Now()
+	key := sha256.Sum256([]byte(token))
+
+	result, ok := a.cache.get(key, now)
+	if !ok {
+		var err error
+		if result, err = a.introspect(r, token, now); err != nil {
+			// An unreachable authorization server must not prevent other
+			// authenticators from detecting the user
+			log.WithError(err).Error("Unable to introspect token")
+			return "", nil, plugins.ErrNoValidUserFound
+		}
+
+		a.cache.set(key, result)
+	}
+
+	if !result.active {
+		return "", nil, plugins.NewLoginFailure("token not active")
+	}
+
+	return result.user, result.groups, nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a AuthIntrospection) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	return "", nil, plugins.ErrNoValidUserFound
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a AuthIntrospection) LoginFields() []plugins.LoginField { return nil }
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a AuthIntrospection) Logout(res http.ResponseWriter, r *http.Request) error { return nil }
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a AuthIntrospection) SupportsMFA() bool { return false }
+
+// introspect asks the authorization server about the token as
+// described in RFC 7662 and converts the response into a cacheable
+// result
+func (a AuthIntrospection) introspect(r *http.Request, token string, now time.Time) (introspectionResult, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+
+	if a.AuthMethod == authMethodPost {
+		form.Set("client_id", a.ClientID)
+		form.Set("client_secret", a.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, a.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return introspectionResult{}, errors.Wrap(err, "Unable to create request")
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if a.AuthMethod == authMethodBasic {
+		req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return introspectionResult{}, errors.Wrap(err, "Unable to execute request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) // #nosec G104 - Only used for the error message
+		return introspectionResult{}, fmt.Errorf("Introspection endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	response := map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return introspectionResult{}, errors.Wrap(err, "Unable to decode response")
+	}
+
+	return a.buildResult(response, now), nil
+}
+
+func (a AuthIntrospection) buildResult(response map[string]interface{}, now time.Time) introspectionResult {
+	negative := introspectionResult{validUntil: now.Add(a.NegativeCacheTTL)}
+
+	if active, _ := response["active"].(bool); !active {
+		return negative
+	}
+
+	var user string
+	usernameClaims := defaultUsernameClaims
+	if a.UsernameClaim != "" {
+		usernameClaims = []string{a.UsernameClaim}
+	}
+
+	for _, c := range usernameClaims {
+		if user, _ = claims.Value(response, c).(string); user != "" {
+			break
+		}
+	}
+
+	if user == "" {
+		log.Warn("Active token without username in introspection response")
+		return negative
+	}
+
+	if !a.isIntendedForUs(response) {
+		log.WithField("user", user).Warn("Active token issued for another audience or client")
+		return negative
+	}
+
+	result := introspectionResult{
+		active: true,
+		user:   user,
+		groups: claims.Strings(claims.Value(response, a.GroupsClaim)),
+	}
+
+	// Cache positive results for the remaining lifetime of the token,
+	// tokens without expiry are cached for the maximum cache TTL only
+	exp, hasExpiry := response["exp"].(float64)
+	switch {
+	case hasExpiry:
+		result.validUntil = time.Unix(int64(exp), 0)
+		if !result.validUntil.After(now) {
+			return negative
+		}
+
+	case a.MaxCacheTTL == 0:
+		result.validUntil = now
+	}
+
+	if a.MaxCacheTTL > 0 && (result.validUntil.IsZero() || result.validUntil.After(now.Add(a.MaxCacheTTL))) {
+		result.validUntil = now.Add(a.MaxCacheTTL)
+	}
+
+	return result
+}
+
+// isIntendedForUs checks the token was issued for the configured
+// audience and to one of the allowed clients
+func (a AuthIntrospection) isIntendedForUs(response map[string]interface{}) bool {
+	if a.Audience != "" && !slices.Contains(claims.Strings(response["aud"]), a.Audience) {
+		return false
+	}
+
+	if len(a.AllowedClientIDs) > 0 {
+		clientID, _ := response["client_id"].(string)
+		if clientID == "" || !slices.Contains(a.AllowedClientIDs, clientID) {
+			return false
+		}
+	}
+
+	return true
+}
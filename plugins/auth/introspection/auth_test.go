@@ -0,0 +1,165 @@
+package introspection
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestDetectUser(t *testing.T) {
+	var calls int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		user, pass, _ := r.BasicAuth()
+		if user != "nginx-sso" || pass != "secret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+
+		resp := map[string]interface{}{"active": false}
+		if r.FormValue("token") == "valid" {
+			resp = map[string]interface{}{
+				"active":   true,
+				"sub":      "1234",
+				"username": "luzifer",
+				"scope":    "read write",
+				"aud":      []string{"https://app.example.com"},
+				"exp":      time.Now().Add(time.Hour).Unix(),
+			}
+		}
+
+		json.NewEncoder(w).Encode(resp) // #nosec G104 - Test server
+	}))
+	defer srv.Close()
+
+	a := New()
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  oauth2_introspection:
+    introspection_url: "`+srv.URL+`"
+    client_id: "nginx-sso"
+    client_secret: "secret"
+    audience: "https://app.example.com"
+`)))
+
+	detect := func(token string) (string, []string, error) {
+		r := httptest.NewRequest("GET", "/auth", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return a.DetectUser(httptest.NewRecorder(), r)
+	}
+
+	for i := 0; i < 2; i++ {
+		user, groups, err := detect("valid")
+		require.NoError(t, err)
+		assert.Equal(t, "luzifer", user)
+		assert.Equal(t, []string{"read", "write"}, groups)
+
+		_, _, err = detect("revoked")
+		assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	}
+
+	// Second round is served from the cache
+	assert.Equal(t, 2, calls)
+
+	// Failed introspections let other authenticators try and are not cached
+	a.ClientSecret = "wrong"
+	_, _, err := detect("other")
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+
+	a.ClientSecret = "secret"
+	_, _, err = detect("other")
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.Equal(t, 4, calls)
+
+	srv.Close()
+	_, _, err = detect("unreachable")
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
+
+func TestCacheSizeLimit(t *testing.T) {
+	c := &resultCache{}
+	c.reset(2)
+
+	validUntil := time.Now().Add(time.Hour)
+	for _, token := range []string{"a", "b", "c"} {
+		c.set(sha256.Sum256([]byte(token)), introspectionResult{active: true, user: token, validUntil: validUntil})
+	}
+
+	assert.Len(t, c.results, 2)
+
+	// Updating a cached result does not evict another one
+	c.set(sha256.Sum256([]byte("c")), introspectionResult{validUntil: validUntil})
+	assert.Len(t, c.results, 2)
+}
+
+func TestBuildResultCacheTTL(t *testing.T) {
+	now := time.Now()
+	a := AuthIntrospection{NegativeCacheTTL: time.Minute, GroupsClaim: "groups", AllowedClientIDs: []string{"app"}}
+
+	res := a.buildResult(map[string]interface{}{"active": true, "sub": "luzifer", "client_id": "app", "groups": []interface{}{"admins"}}, now)
+	assert.Equal(t, "luzifer", res.user)
+	assert.Equal(t, []string{"admins"}, res.groups)
+	assert.Equal(t, now, res.validUntil, "token without expiry must not be cached without max_cache_ttl")
+
+	a.MaxCacheTTL = 5 * time.Minute
+	res = a.buildResult(map[string]interface{}{"active": true, "sub": "luzifer", "client_id": "app", "exp": float64(now.Add(time.Hour).Unix())}, now)
+	assert.Equal(t, now.Add(5*time.Minute), res.validUntil)
+
+	res = a.buildResult(map[string]interface{}{"active": false}, now)
+	assert.False(t, res.active)
+	assert.Equal(t, now.Add(time.Minute), res.validUntil)
+}
+
+func TestAudienceRestriction(t *testing.T) {
+	now := time.Now()
+
+	require.ErrorContains(t, New().Configure([]byte(`---
+providers:
+  oauth2_introspection:
+    introspection_url: "https://auth.example.com/introspect"
+`)), "audience or allowed_client_ids")
+
+	a := AuthIntrospection{Audience: "app", AllowedClientIDs: []string{"web", "cli"}}
+
+	for name, tc := range map[string]struct {
+		response map[string]interface{}
+		active   bool
+	}{
+		"matching audience and client": {
+			response: map[string]interface{}{"aud": "app", "client_id": "cli"},
+			active:   true,
+		},
+		"audience in list": {
+			response: map[string]interface{}{"aud": []interface{}{"other", "app"}, "client_id": "web"},
+			active:   true,
+		},
+		"other audience": {
+			response: map[string]interface{}{"aud": "other", "client_id": "web"},
+		},
+		"missing audience": {
+			response: map[string]interface{}{"client_id": "web"},
+		},
+		"other client": {
+			response: map[string]interface{}{"aud": "app", "client_id": "foreign"},
+		},
+		"missing client": {
+			response: map[string]interface{}{"aud": "app"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc.response["active"] = true
+			tc.response["sub"] = "luzifer"
+			assert.Equal(t, tc.active, a.buildResult(tc.response, now).active)
+		})
+	}
+}
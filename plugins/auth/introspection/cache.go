@@ -0,0 +1,78 @@
+package introspection
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// cacheCleanupInterval defines how often expired results are removed
+// from the cache
+const cacheCleanupInterval = time.Minute
+
+type introspectionResult struct {
+	active     bool
+	user       string
+	groups     []string
+	validUntil time.Time
+}
+
+// resultCache stores introspection results keyed by the SHA-256 hash
+// of the token in order not to keep the tokens in memory. At most
+// maxEntries results are kept to limit the memory random tokens can use.
+type resultCache struct {
+	lock        sync.Mutex
+	maxEntries  int
+	results     map[[sha256.Size]byte]introspectionResult
+	lastCleanup time.Time
+}
+
+func (c *resultCache) get(key [sha256.Size]byte, now time.Time) (introspectionResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result, ok := c.results[key]
+	if !ok || !now.Before(result.validUntil) {
+		return introspectionResult{}, false
+	}
+
+	return result, true
+}
+
+func (c *resultCache) set(key [sha256.Size]byte, result introspectionResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.results == nil {
+		c.results = map[[sha256.Size]byte]introspectionResult{}
+	}
+
+	now := time.Now()
+	if now.Sub(c.lastCleanup) > cacheCleanupInterval {
+		for k, r := range c.results {
+			if !now.Before(r.validUntil) {
+				delete(c.results, k)
+			}
+		}
+		c.lastCleanup = now
+	}
+
+	if _, ok := c.results[key]; !ok && len(c.results) >= c.maxEntries {
+		// Make room by evicting an arbitrary result, the map iteration
+		// order is random
+		for k := range c.results {
+			delete(c.results, k)
+			break
+		}
+	}
+
+	c.results[key] = result
+}
+
+func (c *resultCache) reset(maxEntries int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.maxEntries = maxEntries
+	c.results = nil
+}
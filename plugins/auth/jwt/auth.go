@@ -0,0 +1,169 @@
+package jwt
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/claims"
+)
+
+const defaultUsernameClaim = "sub"
+
+var defaultAlgorithms = []string{oidc.RS256}
+
+type AuthJWT struct {
+	JWKSURL       string   `yaml:"jwks_url"`
+	KeyFile       string   `yaml:"key_file"`
+	Issuer        string   `yaml:"issuer"`
+	Audience      string   `yaml:"audience"`
+	Algorithms    []string `yaml:"algorithms"`
+	UsernameClaim string   `yaml:"username_claim"`
+	GroupsClaim   string   `yaml:"groups_claim"`
+
+	verifier *oidc.IDTokenVerifier
+}
+
+func New() *AuthJWT {
+	return &AuthJWT{}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a AuthJWT) AuthenticatorID() string { return "jwt" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthJWT) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Providers struct {
+			JWT *AuthJWT `yaml:"jwt"`
+		} `yaml:"providers"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.JWT == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.JWKSURL = envelope.Providers.JWT.JWKSURL
+	a.KeyFile = envelope.Providers.JWT.KeyFile
+	a.Issuer = envelope.Providers.JWT.Issuer
+	a.Audience = envelope.Providers.JWT.Audience
+	a.Algorithms = envelope.Providers.JWT.Algorithms
+	a.UsernameClaim = envelope.Providers.JWT.UsernameClaim
+	a.GroupsClaim = envelope.Providers.JWT.GroupsClaim
+
+	if len(a.Algorithms) == 0 {
+		a.Algorithms = defaultAlgorithms
+	}
+
+	if a.UsernameClaim == "" {
+		a.UsernameClaim = defaultUsernameClaim
+	}
+
+	var keySet oidc.KeySet
+	switch {
+	case a.JWKSURL != "" && a.KeyFile != "":
+		return errors.New("Only one of jwks_url and key_file can be set")
+
+	case a.JWKSURL != "":
+		keySet = oidc.NewRemoteKeySet(context.Background(), a.JWKSURL)
+
+	case a.KeyFile != "":
+		keys, err := loadKeyFile(a.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "Unable to load key file")
+		}
+		keySet = &oidc.StaticKeySet{PublicKeys: keys}
+
+	default:
+		return errors.New("One of jwks_url and key_file needs to be set")
+	}
+
+	a.verifier = oidc.NewVerifier(a.Issuer, keySet, &oidc.Config{
+		ClientID:             a.Audience,
+		SkipClientIDCheck:    a.Audience == "",
+		SkipIssuerCheck:      a.Issuer == "",
+		SupportedSigningAlgs: a.Algorithms,
+	})
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a AuthJWT) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	scheme, rawToken, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.Count(rawToken, ".") != 2 {
+		// Not a JWT, might be a token for another authenticator
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	token, err := a.verifier.Verify(r.Context(), strings.TrimSpace(rawToken))
+	if err != nil {
+		log.WithError(err).Debug("JWT validation failed")
+
+		var expired *oidc.TokenExpiredError
+		if errors.As(err, &expired) {
+			return "", nil, plugins.NewLoginFailure("token expired")
+		}
+		return "", nil, plugins.NewLoginFailure("invalid token")
+	}
+
+	tokenClaims := map[string]interface{}{}
+	if err = token.Claims(&tokenClaims); err != nil {
+		return "", nil, errors.Wrap(err, "Unable to decode claims")
+	}
+
+	user, ok := claims.Value(tokenClaims, a.UsernameClaim).(string)
+	if !ok || user == "" {
+		return "", nil, plugins.NewLoginFailure("token without username claim")
+	}
+
+	groups := []string{}
+	if a.GroupsClaim != "" {
+		groups = claims.Strings(claims.Value(tokenClaims, a.GroupsClaim))
+	}
+
+	return user, groups, nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a AuthJWT) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	return "", nil, plugins.ErrNoValidUserFound
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a AuthJWT) LoginFields() []plugins.LoginField { return nil }
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a AuthJWT) Logout(res http.ResponseWriter, r *http.Request) error { return nil }
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a AuthJWT) SupportsMFA() bool { return false }
@@ -0,0 +1,123 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestDetectUser(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	keyFile := path.Join(t.TempDir(), "keys.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	a := New()
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  jwt:
+    key_file: "`+keyFile+`"
+    issuer: "https://idp.example.com"
+    audience: "nginx-sso"
+    algorithms: ["ES256"]
+    username_claim: "preferred_username"
+    groups_claim: "realm_access.roles"
+`)))
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	require.NoError(t, err)
+
+	sign := func(claims map[string]interface{}) string {
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+		jws, err := signer.Sign(payload)
+		require.NoError(t, err)
+		token, err := jws.CompactSerialize()
+		require.NoError(t, err)
+		return token
+	}
+
+	valid := map[string]interface{}{
+		"iss":                "https://idp.example.com",
+		"aud":                "nginx-sso",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"sub":                "1234",
+		"preferred_username": "luzifer",
+		"realm_access":       map[string]interface{}{"roles": []string{"admins", "users"}},
+	}
+
+	detect := func(token string) (string, []string, error) {
+		r := httptest.NewRequest("GET", "/auth", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return a.DetectUser(httptest.NewRecorder(), r)
+	}
+
+	user, groups, err := detect(sign(valid))
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	assert.Equal(t, []string{"admins", "users"}, groups)
+
+	for name, modify := range map[string]func(map[string]interface{}){
+		"expired":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"no username":    func(c map[string]interface{}) { delete(c, "preferred_username") },
+	} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		modify(claims)
+
+		_, _, err = detect(sign(claims))
+		assert.ErrorIs(t, err, plugins.ErrNoValidUserFound, name)
+	}
+
+	_, _, err = detect("MYTOKEN")
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
+
+func TestLoadJWKSSkipsSymmetricKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	raw, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: []byte("shared-secret"), KeyID: "hmac", Algorithm: string(jose.HS256)},
+		{Key: &key.PublicKey, KeyID: "ec", Algorithm: string(jose.ES256)},
+	}})
+	require.NoError(t, err)
+
+	keyFile := path.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(keyFile, raw, 0o600))
+
+	keys, err := loadKeyFile(keyFile)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, &key.PublicKey, keys[0])
+
+	// A set of only symmetric keys contains no usable key
+	raw, err = json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: []byte("shared-secret"), KeyID: "hmac"}}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, raw, 0o600))
+
+	_, err = loadKeyFile(keyFile)
+	assert.Error(t, err)
+}
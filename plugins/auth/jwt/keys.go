@@ -0,0 +1,69 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/pkg/errors"
+)
+
+// loadKeyFile reads the public keys to validate tokens with from either
+// a JSON Web Key Set or a file containing PEM encoded public keys or
+// certificates
+func loadKeyFile(path string) ([]crypto.PublicKey, error) {
+	raw, err := os.ReadFile(path) // #nosec G304 - Path is taken from the configuration
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read key file")
+	}
+
+	var keys []crypto.PublicKey
+
+	if json.Valid(raw) {
+		var jwks jose.JSONWebKeySet
+		if err = json.Unmarshal(raw, &jwks); err != nil {
+			return nil, errors.Wrap(err, "Unable to decode JWKS")
+		}
+
+		for _, k := range jwks.Keys {
+			// Symmetric keys have no public key and are not supported
+			if pub := k.Public(); pub.Key != nil {
+				keys = append(keys, pub.Key)
+			}
+		}
+	} else {
+		for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, errors.Wrap(err, "Unable to parse certificate")
+				}
+				keys = append(keys, cert.PublicKey)
+
+			case "PUBLIC KEY":
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return nil, errors.Wrap(err, "Unable to parse public key")
+				}
+				keys = append(keys, key)
+
+			case "RSA PUBLIC KEY":
+				key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+				if err != nil {
+					return nil, errors.Wrap(err, "Unable to parse public key")
+				}
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("No public keys found")
+	}
+
+	return keys, nil
+}
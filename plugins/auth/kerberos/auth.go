@@ -0,0 +1,237 @@
+// Package kerberos implements an Authenticator logging in users of
+// domain-joined machines through SPNEGO (`Authorization: Negotiate`)
+// validated against the keytab of the service.
+package kerberos
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/jcmturner/goidentity/v6"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const negotiateScheme = "Negotiate"
+
+type AuthKerberos struct {
+	Keytab           string   `yaml:"keytab"`
+	ServicePrincipal string   `yaml:"service_principal"`
+	StripRealm       bool     `yaml:"strip_realm"`
+	AllowedRealms    []string `yaml:"allowed_realms"`
+
+	cookie      plugins.CookieConfig
+	cookieStore *sessions.CookieStore
+
+	keytab *keytab.Keytab
+}
+
+func New(cs *sessions.CookieStore) *AuthKerberos {
+	return &AuthKerberos{
+		cookieStore: cs,
+	}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a *AuthKerberos) AuthenticatorID() string { return "kerberos" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthKerberos) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Cookie    plugins.CookieConfig `yaml:"cookie"`
+		Providers struct {
+			Kerberos *AuthKerberos `yaml:"kerberos"`
+		} `yaml:"providers"`
+	}{}
+
+	envelope.Cookie = plugins.DefaultCookieConfig()
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.Kerberos == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.Keytab = envelope.Providers.Kerberos.Keytab
+	a.ServicePrincipal = envelope.Providers.Kerberos.ServicePrincipal
+	a.StripRealm = envelope.Providers.Kerberos.StripRealm
+	a.AllowedRealms = envelope.Providers.Kerberos.AllowedRealms
+
+	if a.Keytab == "" {
+		return errors.New("Keytab is required")
+	}
+
+	kt, err := keytab.Load(a.Keytab)
+	if err != nil {
+		return errors.Wrap(err, "Unable to load keytab")
+	}
+
+	a.keytab = kt
+	a.cookie = envelope.Cookie
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a *AuthKerberos) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+
+	negotiateErr := plugins.ErrNoValidUserFound
+
+	if token, ok := negotiateToken(r); ok {
+		user, err := a.verifyToken(r, token)
+		if err == nil {
+			// Remember the user as the browser only negotiates when challenged
+			sess.Values["user"] = user
+			plugins.MarkLogin(r)
+			return user, nil, sess.Save(r, res)
+		}
+
+		log.WithError(err).Debug("SPNEGO negotiation failed")
+		negotiateErr = err
+	}
+
+	user, ok := sess.Values["user"].(string)
+	if !ok {
+		return "", nil, negotiateErr
+	}
+
+	// We had a cookie, lets renew it
+	if err := sess.Save(r, res); err != nil {
+		return "", nil, err
+	}
+
+	return user, nil, nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a *AuthKerberos) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	return "", nil, plugins.ErrNoValidUserFound
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a *AuthKerberos) LoginFields() (fields []plugins.LoginField) { return nil }
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a *AuthKerberos) Logout(res http.ResponseWriter, r *http.Request) (err error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Options.MaxAge = -1 // Instant delete
+	return sess.Save(r, res)
+}
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a *AuthKerberos) SupportsMFA() bool { return false }
+
+// HTTPAuthChallenge asks browsers to negotiate unless they already
+// tried and failed (i.e. the machine is not joined to the domain)
+func (a *AuthKerberos) HTTPAuthChallenge(r *http.Request) string {
+	if _, ok := negotiateToken(r); ok {
+		return ""
+	}
+	return negotiateScheme
+}
+
+// verifyToken validates the SPNEGO token against the keytab and maps
+// the client principal to the username
+func (a *AuthKerberos) verifyToken(r *http.Request, token []byte) (string, error) {
+	var settings []func(*service.Settings)
+	if a.ServicePrincipal != "" {
+		settings = append(settings, service.KeytabPrincipal(a.ServicePrincipal))
+	}
+
+	// The gokrb5 handler only passes requests with a valid ticket to
+	// the inner handler, adding the identity to the request context
+	var id goidentity.Identity
+	handler := spnego.SPNEGOKRB5Authenticate(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		id = goidentity.FromHTTPRequestContext(r)
+	}), a.keytab, settings...)
+
+	// Pass the token in the exact form expected by gokrb5
+	req := r.Clone(r.Context())
+	req.Header.Set("Authorization", negotiateScheme+" "+base64.StdEncoding.EncodeToString(token))
+	handler.ServeHTTP(discardResponse{header: http.Header{}}, req)
+
+	if id == nil {
+		return "", plugins.NewLoginFailure("invalid kerberos ticket")
+	}
+
+	return a.mapPrincipal(id.UserName(), id.Domain())
+}
+
+// discardResponse swallows the responses of the gokrb5 handler as the
+// challenge is sent by the login page
+type discardResponse struct{ header http.Header }
+
+func (d discardResponse) Header() http.Header         { return d.header }
+func (d discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardResponse) WriteHeader(int)             {}
+
+func (a *AuthKerberos) mapPrincipal(name, realm string) (string, error) {
+	if len(a.AllowedRealms) > 0 {
+		allowed := false
+		for _, r := range a.AllowedRealms {
+			allowed = allowed || strings.EqualFold(r, realm)
+		}
+
+		if !allowed {
+			return "", plugins.NewLoginFailure("realm not allowed")
+		}
+	}
+
+	if a.StripRealm {
+		return name, nil
+	}
+
+	return strings.Join([]string{name, realm}, "@"), nil
+}
+
+func (a *AuthKerberos) sessionName() string {
+	return strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")
+}
+
+// negotiateToken extracts the decoded token from an
+// `Authorization: Negotiate <token>` header
+func negotiateToken(r *http.Request) ([]byte, bool) {
+	scheme, value, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, negotiateScheme) {
+		return nil, false
+	}
+
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, false
+	}
+
+	return token, true
+}
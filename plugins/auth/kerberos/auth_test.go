@@ -0,0 +1,151 @@
+package kerberos
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const (
+	testRealm = "EXAMPLE.COM"
+	testSPN   = "HTTP/login.example.com"
+)
+
+// testKDC issues service tickets for the HTTP service encrypted with
+// the keys of the service keytab, which is what a real KDC does when
+// the browser requests a ticket for the service
+type testKDC struct {
+	serviceKeytab *keytab.Keytab
+}
+
+func newTestKDC(t *testing.T, servicePassword string) *testKDC {
+	kt := keytab.New()
+	require.NoError(t, kt.AddEntry(testSPN, testRealm, servicePassword, time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96))
+	return &testKDC{serviceKeytab: kt}
+}
+
+func (k *testKDC) writeKeytab(t *testing.T) string {
+	raw, err := k.serviceKeytab.Marshal()
+	require.NoError(t, err)
+
+	ktFile := path.Join(t.TempDir(), "http.keytab")
+	require.NoError(t, os.WriteFile(ktFile, raw, 0o600))
+	return ktFile
+}
+
+// negotiateHeader creates the `Authorization` header value a browser of
+// the given user would send
+func (k *testKDC) negotiateHeader(t *testing.T, user, realm string) string {
+	now := time.Now().UTC()
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user)
+
+	tkt, sessionKey, err := messages.NewTicket(
+		cname, realm,
+		types.NewPrincipalName(nametype.KRB_NT_SRV_INST, testSPN), testRealm,
+		types.NewKrbFlags(), k.serviceKeytab, etypeID.AES256_CTS_HMAC_SHA1_96, 1,
+		now, now, now.Add(time.Hour), now.Add(time.Hour),
+	)
+	require.NoError(t, err)
+
+	cl := client.NewWithPassword(user, realm, "unused", config.New())
+	negTokenInit, err := spnego.NewNegTokenInitKRB5(cl, tkt, sessionKey)
+	require.NoError(t, err)
+
+	raw, err := (&spnego.SPNEGOToken{Init: true, NegTokenInit: negTokenInit}).Marshal()
+	require.NoError(t, err)
+
+	return "Negotiate " + base64.StdEncoding.EncodeToString(raw)
+}
+
+func newTestAuth(t *testing.T, ktFile, extra string) *AuthKerberos {
+	a := New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72")))
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  kerberos:
+    keytab: "`+ktFile+`"
+`+extra)))
+	return a
+}
+
+func TestNegotiate(t *testing.T) {
+	kdc := newTestKDC(t, "s3cr3t")
+	a := newTestAuth(t, kdc.writeKeytab(t), "    strip_realm: true\n")
+
+	r := httptest.NewRequest("GET", "/login", nil)
+	assert.Equal(t, "Negotiate", a.HTTPAuthChallenge(r))
+
+	r.Header.Set("Authorization", kdc.negotiateHeader(t, "luzifer", testRealm))
+	assert.Empty(t, a.HTTPAuthChallenge(r), "must not challenge again")
+
+	res := httptest.NewRecorder()
+	user, _, err := a.DetectUser(res, r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	assert.True(t, plugins.IsMarkedLogin(r), "negotiation must be logged as login")
+
+	// Subsequent requests are detected from the session
+	r = httptest.NewRequest("GET", "/auth", nil)
+	for _, c := range res.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	user, _, err = a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	assert.False(t, plugins.IsMarkedLogin(r))
+}
+
+func TestNegotiateKeepsRealm(t *testing.T) {
+	kdc := newTestKDC(t, "s3cr3t")
+	a := newTestAuth(t, kdc.writeKeytab(t), "")
+
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.Header.Set("Authorization", kdc.negotiateHeader(t, "luzifer", testRealm))
+
+	user, _, err := a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer@EXAMPLE.COM", user)
+}
+
+func TestNegotiateRejected(t *testing.T) {
+	kdc := newTestKDC(t, "s3cr3t")
+	a := newTestAuth(t, kdc.writeKeytab(t), "    allowed_realms: [OTHER.COM]\n")
+
+	// Realm not allowed
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.Header.Set("Authorization", kdc.negotiateHeader(t, "luzifer", testRealm))
+	_, _, err := a.DetectUser(httptest.NewRecorder(), r)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.Equal(t, "realm not allowed", plugins.FailureReason(err, ""))
+
+	// Ticket encrypted for another service key
+	r.Header.Set("Authorization", newTestKDC(t, "other").negotiateHeader(t, "luzifer", "OTHER.COM"))
+	_, _, err = a.DetectUser(httptest.NewRecorder(), r)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.Equal(t, "invalid kerberos ticket", plugins.FailureReason(err, ""))
+
+	// NTLM token sent by browsers outside the domain
+	r.Header.Set("Authorization", "Negotiate TlRMTVNTUAABAAAAB4IIogAAAAAAAAAAAAAAAAAAAAAKAGFKAAAADw==")
+	_, _, err = a.DetectUser(httptest.NewRecorder(), r)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	// No header at all
+	_, _, err = a.DetectUser(httptest.NewRecorder(), httptest.NewRequest("GET", "/auth", nil))
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
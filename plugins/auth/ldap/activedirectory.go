@@ -0,0 +1,175 @@
+package ldap
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const (
+	// https://learn.microsoft.com/en-us/troubleshoot/windows-server/active-directory/useraccountcontrol-manipulate-account-properties
+	adUACAccountDisable   = 0x2
+	adUACLockout          = 0x10
+	adUACPasswordExpired  = 0x800000
+	adFiletimeUnixEpoch   = 116444736000000000
+	adFiletimeNeverExpire = 0x7FFFFFFFFFFFFFFF
+
+	adDefaultUserSearchFilter = `(&(objectCategory=person)(objectClass=user)(|(sAMAccountName={0})(userPrincipalName={1})))`
+)
+
+var (
+	adBindErrorData = regexp.MustCompile(`data ([0-9a-fA-F]+)`)
+
+	// Sub-codes contained in the diagnostic message of a failed bind
+	// https://ldapwiki.com/wiki/Wiki.jsp?page=Common%20Active%20Directory%20Bind%20Errors
+	adBindErrorReasons = map[string]string{
+		"530": "logon not permitted at this time",
+		"531": "logon not permitted from this workstation",
+		"532": "password expired",
+		"533": "account disabled",
+		"701": "account expired",
+		"773": "password must be changed",
+		"775": "account locked",
+	}
+
+	adStatusAttributes = []string{
+		"accountExpires",
+		"lockoutTime",
+		"msDS-User-Account-Control-Computed",
+		"pwdLastSet",
+		"userAccountControl",
+	}
+)
+
+// parseADUsername splits the username given in one of the formats
+// `DOMAIN\user`, `user@domain` or `user` into the sAMAccountName
+// and the userPrincipalName to search for
+func (a AuthLDAP) parseADUsername(username string) (sam, upn string, err error) {
+	switch {
+	case strings.Contains(username, `\`):
+		parts := strings.SplitN(username, `\`, 2)
+		if a.ActiveDirectory.Domain != "" && !strings.EqualFold(parts[0], a.ActiveDirectory.Domain) {
+			return "", "", plugins.NewLoginFailure("domain not accepted")
+		}
+		sam = parts[1]
+
+	case strings.Contains(username, "@"):
+		idx := strings.LastIndex(username, "@")
+		if !a.acceptsUPNDomain(username[idx+1:]) {
+			return "", "", plugins.NewLoginFailure("domain not accepted")
+		}
+		upn = username
+		sam = username[:idx]
+
+	default:
+		sam = username
+	}
+
+	if sam == "" {
+		return "", "", plugins.ErrNoValidUserFound
+	}
+
+	if upn == "" {
+		upn = sam
+		if a.ActiveDirectory.UPNSuffix != "" {
+			upn = strings.Join([]string{sam, a.ActiveDirectory.UPNSuffix}, "@")
+		}
+	}
+
+	return sam, upn, nil
+}
+
+// acceptsUPNDomain checks the domain of a `user@domain` login matches
+// the configured UPN suffix or domain name. Without either being
+// configured every domain is accepted.
+func (a AuthLDAP) acceptsUPNDomain(domain string) bool {
+	if a.ActiveDirectory.Domain == "" && a.ActiveDirectory.UPNSuffix == "" {
+		return true
+	}
+
+	for _, accepted := range []string{a.ActiveDirectory.UPNSuffix, a.ActiveDirectory.Domain} {
+		if accepted != "" && strings.EqualFold(domain, accepted) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkADAccountStatus validates the account state attributes of the
+// given entry and returns a LoginFailure if the account must not be
+// used to log in
+func checkADAccountStatus(entry *ldap.Entry, now time.Time) error {
+	uac := adAttributeInt(entry, "userAccountControl")
+	if uac&adUACAccountDisable != 0 {
+		return plugins.NewLoginFailure("account disabled")
+	}
+
+	if expires := adAttributeInt(entry, "accountExpires"); expires != 0 && expires != adFiletimeNeverExpire {
+		if adFiletimeToTime(expires).Before(now) {
+			return plugins.NewLoginFailure("account expired")
+		}
+	}
+
+	if entry.GetAttributeValue("msDS-User-Account-Control-Computed") != "" {
+		// The computed attribute respects the lockout duration of the
+		// domain so we can rely on it instead of the raw lockoutTime
+		uac |= adAttributeInt(entry, "msDS-User-Account-Control-Computed")
+	} else if adAttributeInt(entry, "lockoutTime") > 0 {
+		uac |= adUACLockout
+	}
+
+	if uac&adUACLockout != 0 {
+		return plugins.NewLoginFailure("account locked")
+	}
+
+	if uac&adUACPasswordExpired != 0 {
+		return plugins.NewLoginFailure("password expired")
+	}
+
+	if entry.GetAttributeValue("pwdLastSet") == "0" {
+		return plugins.NewLoginFailure("password must be changed")
+	}
+
+	return nil
+}
+
+// adBindError maps the sub-code from the diagnostic message of a
+// failed AD bind into a LoginFailure
+func adBindError(err error) error {
+	lerr, ok := err.(*ldap.Error)
+	if !ok || lerr.ResultCode != ldap.LDAPResultInvalidCredentials {
+		return plugins.ErrNoValidUserFound
+	}
+
+	m := adBindErrorData.FindStringSubmatch(lerr.Err.Error())
+	if m == nil {
+		return plugins.ErrNoValidUserFound
+	}
+
+	if reason, ok := adBindErrorReasons[strings.ToLower(m[1])]; ok {
+		return plugins.NewLoginFailure(reason)
+	}
+
+	return plugins.ErrNoValidUserFound
+}
+
+func adAttributeInt(entry *ldap.Entry, attribute string) int64 {
+	v, err := strconv.ParseInt(entry.GetAttributeValue(attribute), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// adFiletimeToTime converts a Windows FILETIME (100ns intervals since
+// 1601-01-01) into a time.Time
+func adFiletimeToTime(ft int64) time.Time {
+	ft -= adFiletimeUnixEpoch
+	return time.Unix(ft/10000000, (ft%10000000)*100)
+}
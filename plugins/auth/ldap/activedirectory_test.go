@@ -0,0 +1,104 @@
+package ldap
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ldap "gopkg.in/ldap.v2"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func adTestEntry(attrs map[string]string) *ldap.Entry {
+	e := &ldap.Entry{DN: "CN=Test,DC=example,DC=com"}
+	for k, v := range attrs {
+		e.Attributes = append(e.Attributes, &ldap.EntryAttribute{Name: k, Values: []string{v}})
+	}
+	return e
+}
+
+func TestParseADUsername(t *testing.T) {
+	a := AuthLDAP{}
+	a.ActiveDirectory = &struct {
+		Domain    string `yaml:"domain"`
+		UPNSuffix string `yaml:"upn_suffix"`
+	}{Domain: "EXAMPLE", UPNSuffix: "example.com"}
+
+	for in, exp := range map[string][2]string{
+		`EXAMPLE\jdoe`:        {"jdoe", "jdoe@example.com"},
+		`example\jdoe`:        {"jdoe", "jdoe@example.com"},
+		`jdoe@EXAMPLE.com`:    {"jdoe", "jdoe@EXAMPLE.com"},
+		`jdoe@example`:        {"jdoe", "jdoe@example"},
+		`jdoe`:                {"jdoe", "jdoe@example.com"},
+		`j.doe@a@example.com`: {"j.doe@a", "j.doe@a@example.com"},
+	} {
+		sam, upn, err := a.parseADUsername(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, exp[0], sam, in)
+		assert.Equal(t, exp[1], upn, in)
+	}
+
+	_, _, err := a.parseADUsername(`OTHER\jdoe`)
+	assert.Equal(t, "domain not accepted", plugins.FailureReason(err, ""))
+
+	for _, in := range []string{`jdoe@corp.example`, `jdoe@example.com@other.example`} {
+		_, _, err = a.parseADUsername(in)
+		assert.Equal(t, "domain not accepted", plugins.FailureReason(err, ""), in)
+	}
+
+	_, _, err = a.parseADUsername(`@example.com`)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	// Without restrictions every domain is accepted
+	a.ActiveDirectory.Domain, a.ActiveDirectory.UPNSuffix = "", ""
+	sam, upn, err := a.parseADUsername(`jdoe@corp.example`)
+	assert.NoError(t, err)
+	assert.Equal(t, "jdoe", sam)
+	assert.Equal(t, "jdoe@corp.example", upn)
+}
+
+func TestCheckADAccountStatus(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	// 2024-01-01T00:00:00Z as FILETIME
+	past := "133485408000000000"
+
+	for reason, attrs := range map[string]map[string]string{
+		"":                         {"userAccountControl": "512", "accountExpires": "0", "lockoutTime": "0", "pwdLastSet": "1"},
+		"account disabled":         {"userAccountControl": "514"},
+		"account expired":          {"userAccountControl": "512", "accountExpires": past},
+		"account locked":           {"userAccountControl": "512", "lockoutTime": past},
+		"password expired":         {"userAccountControl": "512", "msDS-User-Account-Control-Computed": "8388608"},
+		"password must be changed": {"userAccountControl": "512", "pwdLastSet": "0"},
+	} {
+		err := checkADAccountStatus(adTestEntry(attrs), now)
+		if reason == "" {
+			assert.NoError(t, err)
+			continue
+		}
+		assert.Equal(t, reason, plugins.FailureReason(err, ""))
+	}
+
+	// Lockout time is set but the computed attribute reports the lockout
+	// duration to be over
+	assert.NoError(t, checkADAccountStatus(adTestEntry(map[string]string{
+		"userAccountControl":                 "512",
+		"lockoutTime":                        past,
+		"msDS-User-Account-Control-Computed": "0",
+	}), now))
+}
+
+func TestADBindError(t *testing.T) {
+	bindErr := func(data string) error {
+		return &ldap.Error{
+			ResultCode: ldap.LDAPResultInvalidCredentials,
+			Err:        errors.New("80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data " + data + ", v4563"),
+		}
+	}
+
+	assert.Equal(t, "password expired", plugins.FailureReason(adBindError(bindErr("532")), ""))
+	assert.Equal(t, "password must be changed", plugins.FailureReason(adBindError(bindErr("773")), ""))
+	assert.Equal(t, plugins.ErrNoValidUserFound, adBindError(bindErr("52e")))
+	assert.Equal(t, plugins.ErrNoValidUserFound, adBindError(errors.New("connection reset")))
+}
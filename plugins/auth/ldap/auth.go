@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	ldap "gopkg.in/ldap.v2"
 	yaml "gopkg.in/yaml.v3"
@@ -35,6 +36,10 @@ type AuthLDAP struct {
 		ValidateHostname string `yaml:"validate_hostname"`
 		AllowInsecure    bool   `yaml:"allow_insecure"`
 	} `yaml:"tls_config"`
+	ActiveDirectory *struct {
+		Domain    string `yaml:"domain"`
+		UPNSuffix string `yaml:"upn_suffix"`
+	} `yaml:"active_directory"`
 
 	cookie      plugins.CookieConfig
 	cookieStore *sessions.CookieStore
@@ -83,12 +88,16 @@ func (a *AuthLDAP) Configure(yamlSource []byte) error {
 	a.UserSearchFilter = envelope.Providers.LDAP.UserSearchFilter
 	a.UsernameAttribute = envelope.Providers.LDAP.UsernameAttribute
 	a.TLSConfig = envelope.Providers.LDAP.TLSConfig
+	a.ActiveDirectory = envelope.Providers.LDAP.ActiveDirectory
 
 	a.cookie = envelope.Cookie
 
 	// Set defaults
 	if a.UserSearchFilter == "" {
 		a.UserSearchFilter = `(uid={0})`
+		if a.ActiveDirectory != nil {
+			a.UserSearchFilter = adDefaultUserSearchFilter
+		}
 	}
 	if a.GroupMembershipFilter == "" {
 		a.GroupMembershipFilter = `(|(member={0})(uniqueMember={0}))`
@@ -211,9 +220,85 @@ func (a AuthLDAP) Logout(res http.ResponseWriter, r *http.Request) (err error) {
 	return sess.Save(r, res)
 }
 
+// CheckUserStatus returns the current groups of the user or an
+// error when the account must no longer be used. If the user is
+// unknown the plugins.ErrNoValidUserFound needs to be returned.
+func (a AuthLDAP) CheckUserStatus(user string) ([]string, error) {
+	var (
+		attributes = []string{"dn"}
+		base       = a.UserSearchBase
+		filter     = fmt.Sprintf("(%s=%s)", a.UsernameAttribute, ldap.EscapeFilter(user))
+		scope      = ldap.ScopeWholeSubtree
+	)
+
+	if a.UsernameAttribute == "dn" {
+		// DN is not searchable through a filter as it is not an attribute
+		base, filter, scope = user, "(objectClass=*)", ldap.ScopeBaseObject
+	}
+
+	if a.ActiveDirectory != nil {
+		attributes = append(attributes, adStatusAttributes...)
+	}
+
+	l, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	sres, err := l.Search(ldap.NewSearchRequest(
+		base,
+		scope,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		filter,
+		attributes,
+		nil,
+	))
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		return nil, plugins.ErrNoValidUserFound
+	case err != nil:
+		return nil, fmt.Errorf("Unable to search for user: %s", err)
+	case len(sres.Entries) != 1:
+		return nil, plugins.ErrNoValidUserFound
+	}
+
+	if a.ActiveDirectory != nil {
+		if err := checkADAccountStatus(sres.Entries[0], time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	return a.getUserGroups(sres.Entries[0].DN, user)
+}
+
 // checkLogin searches for the username using the specified UserSearchFilter
 // and returns the UserDN and an error (plugins.ErrNoValidUserFound / processing error)
 func (a AuthLDAP) checkLogin(username, password, aliasAttribute string) (string, string, error) {
+	var (
+		attributes = []string{"dn", aliasAttribute}
+		filter     = strings.Replace(a.UserSearchFilter, `{0}`, username, -1)
+	)
+
+	if a.ActiveDirectory != nil {
+		if password == "" {
+			// AD treats a bind with empty password as anonymous bind which succeeds
+			return "", "", plugins.ErrNoValidUserFound
+		}
+
+		sam, upn, err := a.parseADUsername(username)
+		if err != nil {
+			return "", "", err
+		}
+
+		attributes = append(attributes, adStatusAttributes...)
+		filter = strings.NewReplacer(
+			`{0}`, ldap.EscapeFilter(sam),
+			`{1}`, ldap.EscapeFilter(upn),
+		).Replace(a.UserSearchFilter)
+	}
+
 	l, err := a.dial()
 	if err != nil {
 		return "", "", err
@@ -225,8 +310,8 @@ func (a AuthLDAP) checkLogin(username, password, aliasAttribute string) (string,
 		ldap.ScopeWholeSubtree,
 		ldap.NeverDerefAliases,
 		0, 0, false,
-		strings.Replace(a.UserSearchFilter, `{0}`, username, -1),
-		[]string{"dn", aliasAttribute},
+		filter,
+		attributes,
 		nil,
 	)
 
@@ -242,9 +327,20 @@ func (a AuthLDAP) checkLogin(username, password, aliasAttribute string) (string,
 	userDN := sres.Entries[0].DN
 
 	if err := l.Bind(userDN, password); err != nil {
+		if a.ActiveDirectory != nil {
+			return "", "", adBindError(err)
+		}
 		return "", "", plugins.ErrNoValidUserFound
 	}
 
+	if a.ActiveDirectory != nil {
+		// The account state is only checked after a successful bind in
+		// order not to reveal it to someone not knowing the password
+		if err := checkADAccountStatus(sres.Entries[0], time.Now()); err != nil {
+			return "", "", err
+		}
+	}
+
 	alias := sres.Entries[0].GetAttributeValue(aliasAttribute)
 	if aliasAttribute == "dn" {
 		// DN is not fetchable through GetAttributeValue as it is not an attribute
@@ -356,3 +452,7 @@ func (a AuthLDAP) getUserGroups(userDN, alias string) ([]string, error) {
 // will display an additional field for this provider for the user
 // to fill in their MFA token.
 func (a AuthLDAP) SupportsMFA() bool { return false } // TODO: Implement
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a AuthLDAP) UsesLoginSession() bool { return true }
@@ -0,0 +1,341 @@
+// Package magiclink implements a passwordless Authenticator sending
+// single-use login links to the email address of the user.
+package magiclink
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/mailer"
+)
+
+const (
+	defaultLinkTTL           = 15 * time.Minute
+	defaultRateLimitInterval = 15 * time.Minute
+	defaultRateLimitRequests = 3
+	defaultSubject           = "Your login link"
+
+	pendingMessage = "If your address is allowed to log in you will receive an email with a login link shortly."
+
+	mailBody = `Hello,
+
+please use the following link to log in. The link is valid for %d minutes
+and can only be used once.
+
+%s
+
+If you did not request this link you can ignore this email.
+`
+)
+
+var (
+	errTokenExpired = plugins.NewLoginFailure("login link expired")
+	errTokenInvalid = plugins.NewLoginFailure("invalid login link")
+	errTokenUsed    = plugins.NewLoginFailure("login link already used")
+)
+
+// RateLimit restricts the number of links sent to one address
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type AuthMagicLink struct {
+	RootURL          string              `yaml:"root_url"`
+	LinkTTL          time.Duration       `yaml:"link_ttl"`
+	Subject          string              `yaml:"subject"`
+	AllowedDomains   []string            `yaml:"allowed_domains"`
+	AllowedAddresses []string            `yaml:"allowed_addresses"`
+	Groups           map[string][]string `yaml:"groups"`
+	RateLimit        RateLimit           `yaml:"rate_limit"`
+	SMTP             mailer.Config       `yaml:"smtp"`
+	StateFile        string              `yaml:"state_file"`
+
+	cookie      plugins.CookieConfig
+	cookieStore *sessions.CookieStore
+
+	limiter  *rateLimiter
+	sendMail func(to, subject, body string) error
+	signer   *tokenSigner
+}
+
+func New(cs *sessions.CookieStore) *AuthMagicLink {
+	return &AuthMagicLink{
+		cookieStore: cs,
+		limiter:     newRateLimiter(),
+		signer:      newTokenSigner(),
+	}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a *AuthMagicLink) AuthenticatorID() string { return "magic_link" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthMagicLink) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Cookie    plugins.CookieConfig `yaml:"cookie"`
+		Providers struct {
+			MagicLink *AuthMagicLink `yaml:"magic_link"`
+		} `yaml:"providers"`
+	}{}
+
+	envelope.Cookie = plugins.DefaultCookieConfig()
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.MagicLink == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.RootURL = strings.TrimRight(envelope.Providers.MagicLink.RootURL, "/")
+	a.LinkTTL = envelope.Providers.MagicLink.LinkTTL
+	a.Subject = envelope.Providers.MagicLink.Subject
+	a.AllowedDomains = envelope.Providers.MagicLink.AllowedDomains
+	a.AllowedAddresses = envelope.Providers.MagicLink.AllowedAddresses
+	a.Groups = envelope.Providers.MagicLink.Groups
+	a.RateLimit = envelope.Providers.MagicLink.RateLimit
+	a.SMTP = envelope.Providers.MagicLink.SMTP
+	a.StateFile = envelope.Providers.MagicLink.StateFile
+
+	if u, err := url.Parse(a.RootURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("root_url must be an absolute URL")
+	}
+
+	if len(a.AllowedDomains) == 0 && len(a.AllowedAddresses) == 0 {
+		return errors.New("At least one of allowed_domains or allowed_addresses is required")
+	}
+
+	if a.SMTP.Host == "" || a.SMTP.From == "" {
+		return errors.New("SMTP host and from address are required")
+	}
+
+	if envelope.Cookie.AuthKey == "" {
+		return errors.New("cookie.authentication_key is required to sign login links")
+	}
+
+	if a.StateFile == "" {
+		return errors.New("state_file is required to remember used login links")
+	}
+
+	if a.LinkTTL == 0 {
+		a.LinkTTL = defaultLinkTTL
+	}
+
+	if a.Subject == "" {
+		a.Subject = defaultSubject
+	}
+
+	if a.RateLimit.Requests == 0 {
+		a.RateLimit.Requests = defaultRateLimitRequests
+	}
+
+	if a.RateLimit.Interval == 0 {
+		a.RateLimit.Interval = defaultRateLimitInterval
+	}
+
+	if a.SMTP.Port == 0 {
+		a.SMTP.Port = mailer.DefaultPort
+	}
+
+	a.cookie = envelope.Cookie
+	a.sendMail = a.SMTP.Send
+	a.signer.setKey(envelope.Cookie.AuthKey)
+
+	return a.signer.load(a.StateFile)
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a *AuthMagicLink) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	sess, err := a.cookieStore.Get(r, a.sessionName())
+	if err != nil {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	user, ok := sess.Values["user"].(string)
+	if !ok {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	// Existing sessions must end when the address is no longer allowed
+	if !a.isAllowed(user) {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	// We had a cookie, lets renew it
+	sess.Options = a.cookie.GetSessionOpts()
+	if err := sess.Save(r, res); err != nil {
+		return "", nil, err
+	}
+
+	return user, a.groupsOf(user), nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a *AuthMagicLink) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	if code := r.URL.Query().Get("code"); code != "" && r.URL.Query().Get("state") == a.AuthenticatorID() {
+		// User followed the link from the mail
+		user, err := a.signer.redeem(code, time.Now())
+		if err != nil {
+			return "", nil, err
+		}
+
+		if !a.isAllowed(user) {
+			return "", nil, plugins.NewLoginFailure("address not allowed")
+		}
+
+		sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+		sess.Options = a.cookie.GetSessionOpts()
+		sess.Values["user"] = user
+		return user, nil, sess.Save(r, res)
+	}
+
+	input := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "email"}, "-"))
+	if input == "" {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	address, err := normalizeAddress(input)
+	if err != nil {
+		return "", nil, plugins.NewLoginFailure("invalid email address")
+	}
+
+	// Do not disclose which addresses are allowed to log in
+	pending := plugins.LoginPending{Message: pendingMessage}
+	logger := log.WithField("address", address)
+
+	if !a.isAllowed(address) {
+		logger.Info("Login link requested for address not allowed")
+		return "", nil, pending
+	}
+
+	if !a.limiter.allow(address, a.RateLimit.Requests, a.RateLimit.Interval, time.Now()) {
+		logger.Warn("Login link rate limit exceeded")
+		return "", nil, pending
+	}
+
+	token, err := a.signer.create(address, time.Now().Add(a.LinkTTL))
+	if err != nil {
+		return "", nil, err
+	}
+
+	link := a.RootURL + "/login?" + url.Values{"code": {token}, "state": {a.AuthenticatorID()}}.Encode()
+	body := fmt.Sprintf(mailBody, int(a.LinkTTL.Minutes()), link)
+
+	if err = a.sendMail(address, a.Subject, body); err != nil {
+		return "", nil, errors.Wrap(err, "Unable to send login link")
+	}
+
+	return "", nil, pending
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a *AuthMagicLink) LoginFields() (fields []plugins.LoginField) {
+	return []plugins.LoginField{
+		{
+			Label:       "E-Mail",
+			Name:        "email",
+			Placeholder: "you@example.com",
+			Type:        "email",
+		},
+	}
+}
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a *AuthMagicLink) Logout(res http.ResponseWriter, r *http.Request) (err error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Options.MaxAge = -1 // Instant delete
+	return sess.Save(r, res)
+}
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a *AuthMagicLink) SupportsMFA() bool { return false }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a *AuthMagicLink) UsesLoginSession() bool { return true }
+
+func (a *AuthMagicLink) isAllowed(address string) bool {
+	for _, allowed := range a.AllowedAddresses {
+		if strings.EqualFold(allowed, address) {
+			return true
+		}
+	}
+
+	domain := address[strings.LastIndex(address, "@")+1:]
+	for _, allowed := range a.AllowedDomains {
+		if strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// groupsOf returns the groups the address is member of. Members can be
+// listed by address or by domain (`@example.com`).
+func (a *AuthMagicLink) groupsOf(address string) []string {
+	domain := address[strings.LastIndex(address, "@"):]
+
+	groups := []string{}
+	for group, members := range a.Groups {
+		for _, m := range members {
+			if strings.EqualFold(m, address) || strings.EqualFold(m, domain) {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+
+	return groups
+}
+
+func (a *AuthMagicLink) sessionName() string {
+	return strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")
+}
+
+// normalizeAddress validates the address entered by the user and
+// returns it in lower case
+func normalizeAddress(input string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(input))
+	if err != nil {
+		return "", err
+	}
+
+	if addr.Name != "" || !strings.Contains(addr.Address, "@") {
+		return "", errors.New("Only plain addresses are accepted")
+	}
+
+	return strings.ToLower(addr.Address), nil
+}
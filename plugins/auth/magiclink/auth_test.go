@@ -0,0 +1,185 @@
+package magiclink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const testConfig = `---
+cookie:
+  authentication_key: "Ff1uWJcLouKu9kwxgbnKcU3ps47gps72"
+providers:
+  magic_link:
+    root_url: "https://login.example.com/"
+    allowed_domains: [example.com]
+    allowed_addresses: [jane@example.org]
+    groups:
+      admins: [jane@example.org]
+      staff: ["@example.com"]
+    rate_limit:
+      requests: 2
+      interval: 1m
+    smtp:
+      host: smtp.example.com
+      from: login@example.com
+`
+
+type sentMail struct {
+	to, subject, body string
+}
+
+func newTestAuth(t *testing.T) (*AuthMagicLink, *[]sentMail) {
+	return newTestAuthWithState(t, path.Join(t.TempDir(), "state.json"))
+}
+
+func newTestAuthWithState(t *testing.T, stateFile string) (*AuthMagicLink, *[]sentMail) {
+	a := New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72")))
+	require.NoError(t, a.Configure([]byte(testConfig+"    state_file: \""+stateFile+"\"\n")))
+
+	sent := []sentMail{}
+	a.sendMail = func(to, subject, body string) error {
+		sent = append(sent, sentMail{to, subject, body})
+		return nil
+	}
+
+	return a, &sent
+}
+
+func requestLink(a *AuthMagicLink, address string) error {
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"magic_link-email": {address}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, _, err := a.Login(httptest.NewRecorder(), r)
+	return err
+}
+
+func followLink(a *AuthMagicLink, body string) (*httptest.ResponseRecorder, string, error) {
+	link := regexp.MustCompile(`https://\S+`).FindString(body)
+	u, _ := url.Parse(link)
+
+	res := httptest.NewRecorder()
+	user, _, err := a.Login(res, httptest.NewRequest("GET", u.RequestURI(), nil))
+	return res, user, err
+}
+
+func TestLoginFlow(t *testing.T) {
+	a, sent := newTestAuth(t)
+
+	err := requestLink(a, "Jane@Example.org")
+	var pending plugins.LoginPending
+	require.ErrorAs(t, err, &pending)
+	require.Len(t, *sent, 1)
+	assert.Equal(t, "jane@example.org", (*sent)[0].to)
+	assert.Equal(t, defaultSubject, (*sent)[0].subject)
+	assert.Contains(t, (*sent)[0].body, "https://login.example.com/login?code=")
+
+	res, user, err := followLink(a, (*sent)[0].body)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.org", user)
+
+	r := httptest.NewRequest("GET", "/auth", nil)
+	for _, c := range res.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	user, groups, err := a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.org", user)
+	assert.Equal(t, []string{"admins"}, groups)
+
+	// Links can only be used once
+	_, _, err = followLink(a, (*sent)[0].body)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.Equal(t, "login link already used", plugins.FailureReason(err, ""))
+}
+
+func TestNoMailForUnknownAddress(t *testing.T) {
+	a, sent := newTestAuth(t)
+
+	// Same response as for allowed addresses
+	var pending plugins.LoginPending
+	assert.ErrorAs(t, requestLink(a, "mallory@example.net"), &pending)
+	assert.Empty(t, *sent)
+
+	err := requestLink(a, "not an address")
+	assert.Equal(t, "invalid email address", plugins.FailureReason(err, ""))
+
+	_, _, err = a.Login(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil))
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
+
+func TestRateLimit(t *testing.T) {
+	a, sent := newTestAuth(t)
+
+	for i := 0; i < 3; i++ {
+		var pending plugins.LoginPending
+		assert.ErrorAs(t, requestLink(a, "john@example.com"), &pending)
+	}
+	assert.Len(t, *sent, 2)
+
+	// Other addresses are not affected
+	assert.Error(t, requestLink(a, "jack@example.com"))
+	assert.Len(t, *sent, 3)
+
+	l := newRateLimiter()
+	now := time.Now()
+	assert.True(t, l.allow("a", 1, time.Minute, now))
+	assert.False(t, l.allow("a", 1, time.Minute, now.Add(30*time.Second)))
+	assert.True(t, l.allow("a", 1, time.Minute, now.Add(time.Minute)))
+}
+
+func TestTokenValidation(t *testing.T) {
+	a, _ := newTestAuth(t)
+	now := time.Now()
+
+	token, err := a.signer.create("jane@example.org", now.Add(time.Minute))
+	require.NoError(t, err)
+
+	_, err = a.signer.redeem(token, now.Add(2*time.Minute))
+	assert.Equal(t, errTokenExpired, err)
+
+	_, err = a.signer.redeem(token+"x", now)
+	assert.Equal(t, errTokenInvalid, err)
+
+	// Tokens signed with another key are rejected
+	other := newTokenSigner()
+	other.setKey("other")
+	token, err = other.create("jane@example.org", now.Add(time.Minute))
+	require.NoError(t, err)
+	_, err = a.signer.redeem(token, now)
+	assert.Equal(t, errTokenInvalid, err)
+
+	// Links of other providers are ignored
+	_, _, err = a.Login(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/login?code=abc&state=oidc", nil))
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
+
+func TestUsedLinksSurviveRestart(t *testing.T) {
+	stateFile := path.Join(t.TempDir(), "state.json")
+	a, _ := newTestAuthWithState(t, stateFile)
+	now := time.Now()
+
+	token, err := a.signer.create("jane@example.org", now.Add(time.Minute))
+	require.NoError(t, err)
+
+	user, err := a.signer.redeem(token, now)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.org", user)
+
+	a, _ = newTestAuthWithState(t, stateFile)
+	_, err = a.signer.redeem(token, now)
+	assert.Equal(t, errTokenUsed, err)
+
+	// The state file is required
+	assert.Error(t, New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72"))).Configure([]byte(testConfig)))
+}
@@ -0,0 +1,186 @@
+package magiclink
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
+)
+
+// tokenSigner creates and verifies the signed login tokens. Tokens
+// contain the address, the expiry and a nonce which is remembered
+// after use until the token expires so every token can only be used
+// once, even across restarts.
+type tokenSigner struct {
+	key []byte
+
+	lock sync.Mutex
+	file string
+	used map[string]time.Time
+}
+
+func newTokenSigner() *tokenSigner {
+	return &tokenSigner{used: map[string]time.Time{}}
+}
+
+// setKey derives the signing key from the given secret
+func (t *tokenSigner) setKey(secret string) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("nginx-sso magic-link")) // #nosec G104 - Writing to hash never fails
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.key = mac.Sum(nil)
+}
+
+// load reads the nonces of used tokens from the file and persists
+// further used nonces to it
+func (t *tokenSigner) load(file string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.file = file
+	t.used = map[string]time.Time{}
+	return errors.Wrap(filestore.LoadJSON(file, &t.used), "Unable to load used login links")
+}
+
+func (t *tokenSigner) create(address string, expiresAt time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "Unable to generate nonce")
+	}
+
+	payload := strings.Join([]string{address, strconv.FormatInt(expiresAt.Unix(), 10), hex.EncodeToString(nonce)}, "|")
+
+	return strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(payload)),
+		base64.RawURLEncoding.EncodeToString(t.sign(payload)),
+	}, "."), nil
+}
+
+// redeem verifies the token and marks it as used. The address the
+// token was issued for is returned.
+func (t *tokenSigner) redeem(token string, now time.Time) (string, error) {
+	rawPayload, rawSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(rawPayload)
+	if err != nil {
+		return "", errTokenInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(rawSig)
+	if err != nil || !hmac.Equal(sig, t.sign(string(payload))) {
+		return "", errTokenInvalid
+	}
+
+	// Address might contain the separator, so split from the right
+	rest, nonce, _ := cutLast(string(payload), "|")
+	address, rawExpiry, ok := cutLast(rest, "|")
+	if !ok || nonce == "" {
+		return "", errTokenInvalid
+	}
+
+	expiry, err := strconv.ParseInt(rawExpiry, 10, 64)
+	if err != nil {
+		return "", errTokenInvalid
+	}
+	expiresAt := time.Unix(expiry, 0)
+
+	if now.After(expiresAt) {
+		return "", errTokenExpired
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for n, exp := range t.used {
+		if now.After(exp) {
+			delete(t.used, n)
+		}
+	}
+
+	if _, ok := t.used[nonce]; ok {
+		return "", errTokenUsed
+	}
+	t.used[nonce] = expiresAt
+
+	if t.file == "" {
+		return address, nil
+	}
+
+	if err := filestore.SaveJSON(t.file, t.used); err != nil {
+		// Do not accept the token when its use cannot be remembered
+		delete(t.used, nonce)
+		return "", errors.Wrap(err, "Unable to save used login links")
+	}
+
+	return address, nil
+}
+
+func (t *tokenSigner) sign(payload string) []byte {
+	t.lock.Lock()
+	key := t.key
+	t.lock.Unlock()
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload)) // #nosec G104 - Writing to hash never fails
+	return mac.Sum(nil)
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// rateLimiter allows a limited number of requests per address within
+// a sliding interval
+type rateLimiter struct {
+	lock     sync.Mutex
+	requests map[string][]time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{requests: map[string][]time.Time{}}
+}
+
+// allow records the request if the address did not exceed the limit
+func (l *rateLimiter) allow(address string, limit int, interval time.Duration, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for addr, reqs := range l.requests {
+		var recent []time.Time
+		for _, t := range reqs {
+			if now.Sub(t) < interval {
+				recent = append(recent, t)
+			}
+		}
+
+		if len(recent) == 0 {
+			delete(l.requests, addr)
+		} else {
+			l.requests[addr] = recent
+		}
+	}
+
+	if len(l.requests[address]) >= limit {
+		return false
+	}
+
+	l.requests[address] = append(l.requests[address], now)
+	return true
+}
@@ -0,0 +1,325 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/trustedsource"
+)
+
+const (
+	sourceCN      = "cn"
+	sourceDNSName = "dns"
+	sourceEmail   = "email"
+	sourceNone    = "none"
+	sourceO       = "o"
+	sourceOU      = "ou"
+	sourceURI     = "uri"
+
+	verifySuccess = "SUCCESS"
+)
+
+type AuthMTLS struct {
+	CAFile            string   `yaml:"ca_file"`
+	CRLFiles          []string `yaml:"crl_files"`
+	CertificateHeader string   `yaml:"certificate_header"`
+	SubjectHeader     string   `yaml:"subject_header"`
+	VerifyHeader      string   `yaml:"verify_header"`
+	UsernameSource    string   `yaml:"username_source"`
+	GroupsSource      string   `yaml:"groups_source"`
+
+	// Trust anchor for the certificate and subject headers which
+	// must only be accepted when set by nginx
+	trustedsource.Config `yaml:",inline"`
+
+	roots   *x509.CertPool
+	revoked *revocationList
+}
+
+func New() *AuthMTLS {
+	return &AuthMTLS{}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a AuthMTLS) AuthenticatorID() string { return "mtls" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthMTLS) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Providers struct {
+			MTLS *AuthMTLS `yaml:"mtls"`
+		} `yaml:"providers"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.MTLS == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.CAFile = envelope.Providers.MTLS.CAFile
+	a.CRLFiles = envelope.Providers.MTLS.CRLFiles
+	a.CertificateHeader = envelope.Providers.MTLS.CertificateHeader
+	a.SubjectHeader = envelope.Providers.MTLS.SubjectHeader
+	a.VerifyHeader = envelope.Providers.MTLS.VerifyHeader
+	a.UsernameSource = envelope.Providers.MTLS.UsernameSource
+	a.GroupsSource = envelope.Providers.MTLS.GroupsSource
+	a.Config = envelope.Providers.MTLS.Config
+
+	if a.UsernameSource == "" {
+		a.UsernameSource = sourceCN
+	}
+
+	if a.GroupsSource == "" {
+		a.GroupsSource = sourceOU
+	}
+
+	switch a.UsernameSource {
+	case sourceCN, sourceDNSName, sourceEmail, sourceURI:
+		// Valid source
+	default:
+		return errors.Errorf("Invalid username_source %q", a.UsernameSource)
+	}
+
+	switch a.GroupsSource {
+	case sourceNone, sourceO, sourceOU:
+		// Valid source
+	default:
+		return errors.Errorf("Invalid groups_source %q", a.GroupsSource)
+	}
+
+	if a.SubjectHeader != "" && (a.VerifyHeader == "" || a.UsernameSource != sourceCN) {
+		return errors.New("subject_header requires verify_header and the username_source cn")
+	}
+
+	if a.usesHeaders() {
+		if err := a.Config.Parse(); err != nil {
+			return errors.Wrap(err, "Headers require a trust configuration")
+		}
+	}
+
+	caPEM, err := os.ReadFile(a.CAFile) // #nosec G304 - Path is taken from the configuration
+	if err != nil {
+		return errors.Wrap(err, "Unable to read CA file")
+	}
+
+	a.roots = x509.NewCertPool()
+	if !a.roots.AppendCertsFromPEM(caPEM) {
+		return errors.New("No certificates found in CA file")
+	}
+
+	if a.revoked, err = loadRevocationLists(a.CRLFiles, caPEM); err != nil {
+		return errors.Wrap(err, "Unable to load CRL files")
+	}
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a AuthMTLS) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	certs, err := a.clientCertificates(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(certs) == 0 {
+		return a.detectFromSubjectHeader(r)
+	}
+
+	cert := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	now := time.Now()
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		log.WithError(err).WithField("subject", cert.Subject.String()).Debug("Client certificate verification failed")
+		return "", nil, plugins.NewLoginFailure("invalid client certificate")
+	}
+
+	// Check the client and intermediate certificates, the root is taken
+	// from the CA file and trusted
+	chain := chains[0]
+	if err = a.revoked.check(chain[:len(chain)-1], now); err != nil {
+		return "", nil, err
+	}
+
+	user := a.username(cert)
+	if user == "" {
+		return "", nil, plugins.NewLoginFailure("client certificate without username")
+	}
+
+	return user, a.groups(cert.Subject.Organization, cert.Subject.OrganizationalUnit), nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a AuthMTLS) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	return "", nil, plugins.ErrNoValidUserFound
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a AuthMTLS) LoginFields() []plugins.LoginField { return nil }
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a AuthMTLS) Logout(res http.ResponseWriter, r *http.Request) error { return nil }
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a AuthMTLS) SupportsMFA() bool { return false }
+
+// clientCertificates returns the certificate chain presented to
+// nginx-sso itself when terminating TLS or the certificates forwarded
+// by nginx in the certificate header starting with the client
+// certificate. If there is none nil is returned.
+func (a AuthMTLS) clientCertificates(r *http.Request) ([]*x509.Certificate, error) {
+	if r.TLS != nil {
+		// Connections terminated by nginx-sso itself must present their
+		// certificate through TLS, headers are sent by the client
+		return r.TLS.PeerCertificates, nil
+	}
+
+	if a.CertificateHeader == "" {
+		return nil, nil
+	}
+
+	raw := r.Header.Get(a.CertificateHeader)
+	if raw == "" {
+		return nil, nil
+	}
+
+	if !a.IsTrusted(r) {
+		return nil, plugins.NewLoginFailure("client certificate header from untrusted source")
+	}
+
+	// The `$ssl_client_escaped_cert` variable contains the urlencoded
+	// PEM while the deprecated `$ssl_client_cert` contains the PEM
+	// with a tab prepended to every line but the first one
+	if strings.Contains(raw, "%") {
+		unescaped, err := url.QueryUnescape(raw)
+		if err != nil {
+			return nil, plugins.NewLoginFailure("malformed client certificate header")
+		}
+		raw = unescaped
+	}
+
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode([]byte(strings.ReplaceAll(raw, "\t", ""))); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			return nil, plugins.NewLoginFailure("malformed client certificate header")
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, plugins.NewLoginFailure("malformed client certificate header")
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, plugins.NewLoginFailure("malformed client certificate header")
+	}
+
+	return certs, nil
+}
+
+// detectFromSubjectHeader trusts the verification nginx did against
+// the `ssl_client_certificate` and reads the user from the subject DN
+// passed in the subject header (`$ssl_client_s_dn`)
+func (a AuthMTLS) detectFromSubjectHeader(r *http.Request) (string, []string, error) {
+	if a.SubjectHeader == "" || r.TLS != nil || r.Header.Get(a.SubjectHeader) == "" {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	if !a.IsTrusted(r) {
+		return "", nil, plugins.NewLoginFailure("client certificate header from untrusted source")
+	}
+
+	if r.Header.Get(a.VerifyHeader) != verifySuccess {
+		return "", nil, plugins.NewLoginFailure("client certificate not verified")
+	}
+
+	dn := parseDN(r.Header.Get(a.SubjectHeader))
+	if len(dn["CN"]) == 0 || dn["CN"][0] == "" {
+		return "", nil, plugins.NewLoginFailure("client certificate without username")
+	}
+
+	return dn["CN"][0], a.groups(dn["O"], dn["OU"]), nil
+}
+
+// usesHeaders tells whether certificates or subjects are accepted from
+// headers set by nginx terminating the TLS connection
+func (a AuthMTLS) usesHeaders() bool {
+	return a.CertificateHeader != "" || a.SubjectHeader != ""
+}
+
+func (a AuthMTLS) username(cert *x509.Certificate) string {
+	switch a.UsernameSource {
+	case sourceDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+
+	case sourceEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+
+	case sourceURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
+
+func (a AuthMTLS) groups(o, ou []string) []string {
+	switch a.GroupsSource {
+	case sourceO:
+		return append([]string{}, o...)
+	case sourceOU:
+		return append([]string{}, ou...)
+	default:
+		return []string{}
+	}
+}
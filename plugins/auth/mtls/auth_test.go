@@ -0,0 +1,331 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return testCA{cert: cert, key: key}
+}
+
+// intermediate creates a CA certificate signed by the CA
+func (c testCA) intermediate(t *testing.T, serial int64) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "Test Intermediate CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, c.cert, &key.PublicKey, c.key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return testCA{cert: cert, key: key}
+}
+
+// crl creates a PEM encoded CRL of the CA revoking the given serials
+func (c testCA) crl(t *testing.T, nextUpdate time.Time, serials ...int64) []byte {
+	var entries []x509.RevocationListEntry
+	for _, s := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, c.cert, c.key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func (c testCA) issue(t *testing.T, serial int64, subject pkix.Name) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        subject,
+		EmailAddresses: []string{subject.CommonName + "@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, c.cert, &key.PublicKey, c.key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestDetectUser(t *testing.T) {
+	var (
+		ca    = newTestCA(t)
+		other = newTestCA(t)
+		dir   = t.TempDir()
+	)
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(3), RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(path.Join(dir, "ca.crl"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0o600))
+
+	a := New()
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  mtls:
+    ca_file: "`+path.Join(dir, "ca.pem")+`"
+    crl_files: ["`+path.Join(dir, "ca.crl")+`"]
+    certificate_header: X-SSL-Client-Cert
+    subject_header: X-SSL-Client-S-DN
+    verify_header: X-SSL-Client-Verify
+    trusted_sources: ["192.0.2.0/24"]
+`)))
+
+	detect := func(headers map[string]string) (string, []string, error) {
+		r := httptest.NewRequest("GET", "/auth", nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return a.DetectUser(httptest.NewRecorder(), r)
+	}
+
+	user, groups, err := detect(map[string]string{
+		"X-SSL-Client-Cert": url.QueryEscape(string(ca.issue(t, 2, pkix.Name{CommonName: "luzifer", OrganizationalUnit: []string{"admins"}}))),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	assert.Equal(t, []string{"admins"}, groups)
+
+	_, _, err = detect(map[string]string{"X-SSL-Client-Cert": url.QueryEscape(string(ca.issue(t, 3, pkix.Name{CommonName: "revoked"})))})
+	assert.Equal(t, "client certificate revoked", plugins.FailureReason(err, ""))
+
+	_, _, err = detect(map[string]string{"X-SSL-Client-Cert": url.QueryEscape(string(other.issue(t, 2, pkix.Name{CommonName: "luzifer"})))})
+	assert.Equal(t, "invalid client certificate", plugins.FailureReason(err, ""))
+
+	user, groups, err = detect(map[string]string{
+		"X-SSL-Client-S-DN":   `CN=jdoe,OU=users,OU=ops,O=Example\, Inc.`,
+		"X-SSL-Client-Verify": "SUCCESS",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "jdoe", user)
+	assert.Equal(t, []string{"users", "ops"}, groups)
+
+	_, _, err = detect(map[string]string{
+		"X-SSL-Client-S-DN":   "CN=jdoe",
+		"X-SSL-Client-Verify": "FAILED:certificate has expired",
+	})
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	_, _, err = detect(nil)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
+
+func TestForgedHeaders(t *testing.T) {
+	var (
+		ca  = newTestCA(t)
+		dir = t.TempDir()
+	)
+
+	require.NoError(t, os.WriteFile(path.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+
+	a := New()
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  mtls:
+    ca_file: "`+path.Join(dir, "ca.pem")+`"
+    certificate_header: X-SSL-Client-Cert
+    subject_header: X-SSL-Client-S-DN
+    verify_header: X-SSL-Client-Verify
+    trusted_sources: ["10.0.0.0/8"]
+`)))
+
+	forged := func(r *http.Request) *http.Request {
+		r.Header.Set("X-SSL-Client-Cert", url.QueryEscape(string(ca.issue(t, 2, pkix.Name{CommonName: "luzifer"}))))
+		return r
+	}
+
+	// Header from an untrusted source
+	_, _, err := a.DetectUser(httptest.NewRecorder(), forged(httptest.NewRequest("GET", "/auth", nil)))
+	assert.Equal(t, "client certificate header from untrusted source", plugins.FailureReason(err, ""))
+
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.Header.Set("X-SSL-Client-S-DN", "CN=luzifer")
+	r.Header.Set("X-SSL-Client-Verify", "SUCCESS")
+	_, _, err = a.DetectUser(httptest.NewRecorder(), r)
+	assert.Equal(t, "client certificate header from untrusted source", plugins.FailureReason(err, ""))
+
+	// Header on a TLS connection without client certificate, even from
+	// a trusted source
+	r = forged(httptest.NewRequest("GET", "/auth", nil))
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.TLS = &tls.ConnectionState{}
+	_, _, err = a.DetectUser(httptest.NewRecorder(), r)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+
+	r.TLS = nil
+	user, _, err := a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+
+	// Header mode requires a trust configuration
+	assert.Error(t, New().Configure([]byte(`---
+providers:
+  mtls:
+    ca_file: "`+path.Join(dir, "ca.pem")+`"
+    certificate_header: X-SSL-Client-Cert
+`)))
+}
+
+func TestParseDN(t *testing.T) {
+	assert.Equal(t, map[string][]string{
+		"CN": {"jdoe"},
+		"O":  {"Example, Inc."},
+	}, parseDN(`CN=jdoe,O=Example\, Inc.`))
+
+	assert.Equal(t, map[string][]string{
+		"CN": {"jdoe"},
+		"OU": {"users"},
+	}, parseDN("/OU=users/CN=jdoe"))
+}
+
+func TestIntermediateCertificates(t *testing.T) {
+	var (
+		ca      = newTestCA(t)
+		inter   = ca.intermediate(t, 10)
+		revoked = ca.intermediate(t, 11)
+		dir     = t.TempDir()
+	)
+
+	require.NoError(t, os.WriteFile(path.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(path.Join(dir, "ca.crl"), ca.crl(t, time.Now().Add(time.Hour), 11), 0o600))
+
+	a := New()
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  mtls:
+    ca_file: "`+path.Join(dir, "ca.pem")+`"
+    crl_files: ["`+path.Join(dir, "ca.crl")+`"]
+    certificate_header: X-SSL-Client-Cert
+    shared_secret_header: X-Proxy-Secret
+    shared_secret: "s3cr3t"
+`)))
+
+	parse := func(raw []byte) *x509.Certificate {
+		block, _ := pem.Decode(raw)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		return cert
+	}
+
+	detectTLS := func(certs ...*x509.Certificate) (string, error) {
+		r := httptest.NewRequest("GET", "/auth", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: certs}
+		user, _, err := a.DetectUser(httptest.NewRecorder(), r)
+		return user, err
+	}
+
+	leaf := parse(inter.issue(t, 2, pkix.Name{CommonName: "luzifer"}))
+
+	user, err := detectTLS(leaf, inter.cert)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+
+	// The intermediate is required to build the chain
+	_, err = detectTLS(leaf)
+	assert.Equal(t, "invalid client certificate", plugins.FailureReason(err, ""))
+
+	// Revoked intermediates are rejected
+	_, err = detectTLS(parse(revoked.issue(t, 2, pkix.Name{CommonName: "luzifer"})), revoked.cert)
+	assert.Equal(t, "client certificate revoked", plugins.FailureReason(err, ""))
+
+	// Chains forwarded in the header are accepted as well
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.Header.Set("X-Proxy-Secret", "s3cr3t")
+	r.Header.Set("X-SSL-Client-Cert", url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}))+
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: inter.cert.Raw}))))
+	user, _, err = a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+}
+
+func TestOutdatedCRL(t *testing.T) {
+	var (
+		ca  = newTestCA(t)
+		dir = t.TempDir()
+		now = time.Now()
+	)
+
+	crlFile := path.Join(dir, "ca.crl")
+	require.NoError(t, os.WriteFile(crlFile, ca.crl(t, now.Add(-time.Minute)), 0o600))
+
+	rl, err := loadRevocationLists([]string{crlFile}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(ca.issue(t, 2, pkix.Name{CommonName: "luzifer"}))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	assert.Equal(t, errCRLOutdated, rl.check([]*x509.Certificate{cert}, now))
+
+	// Updated CRLs are picked up once the reload interval passed
+	require.NoError(t, os.WriteFile(crlFile, ca.crl(t, now.Add(time.Hour), 2), 0o600))
+	assert.Equal(t, errCRLOutdated, rl.check([]*x509.Certificate{cert}, now))
+	assert.Equal(t, errCertificateRevoked, rl.check([]*x509.Certificate{cert}, now.Add(crlReloadInterval+time.Second)))
+}
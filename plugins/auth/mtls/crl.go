@@ -0,0 +1,176 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+// crlReloadInterval limits how often outdated CRL files are read again
+const crlReloadInterval = time.Minute
+
+var (
+	errCertificateRevoked = plugins.NewLoginFailure("client certificate revoked")
+	errCRLOutdated        = plugins.NewLoginFailure("certificate revocation list outdated")
+)
+
+// revocationList contains the serial numbers of revoked certificates
+// grouped by the raw subject of their issuer. The CRL files are read
+// again when the first of them reached its next update.
+type revocationList struct {
+	files []string
+	cas   []*x509.Certificate
+
+	lock       sync.RWMutex
+	serials    map[string]map[string]bool
+	nextUpdate time.Time
+	lastReload time.Time
+}
+
+// loadRevocationLists reads the given CRL files (PEM or DER encoded)
+// and verifies their signature against the CA certificates
+func loadRevocationLists(files []string, caPEM []byte) (*revocationList, error) {
+	rl := &revocationList{files: files, serials: map[string]map[string]bool{}}
+	if len(files) == 0 {
+		return rl, nil
+	}
+
+	for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to parse CA certificate")
+		}
+		rl.cas = append(rl.cas, cert)
+	}
+
+	return rl, rl.reload(time.Now())
+}
+
+// reload reads the CRL files and replaces the revoked serials, on
+// error the previously loaded serials are kept
+func (r *revocationList) reload(now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.lastReload = now
+
+	var (
+		serials    = map[string]map[string]bool{}
+		nextUpdate time.Time
+	)
+
+	for _, file := range r.files {
+		raw, err := os.ReadFile(file) // #nosec G304 - Path is taken from the configuration
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read CRL file %q", file)
+		}
+
+		ders := [][]byte{raw}
+		if strings.Contains(string(raw), "-----BEGIN") {
+			ders = nil
+			for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type == "X509 CRL" {
+					ders = append(ders, block.Bytes)
+				}
+			}
+		}
+
+		for _, der := range ders {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return errors.Wrapf(err, "Unable to parse CRL file %q", file)
+			}
+
+			if !crlSignedByCA(crl, r.cas) {
+				return errors.Errorf("CRL in file %q is not signed by a configured CA", file)
+			}
+
+			if !crl.NextUpdate.IsZero() && (nextUpdate.IsZero() || crl.NextUpdate.Before(nextUpdate)) {
+				nextUpdate = crl.NextUpdate
+			}
+
+			issuer := string(crl.RawIssuer)
+			if serials[issuer] == nil {
+				serials[issuer] = map[string]bool{}
+			}
+
+			for _, entry := range crl.RevokedCertificateEntries {
+				serials[issuer][entry.SerialNumber.String()] = true
+			}
+
+			log.WithField("file", file).WithField("revoked", len(crl.RevokedCertificateEntries)).Debug("Loaded CRL")
+		}
+	}
+
+	r.serials = serials
+	r.nextUpdate = nextUpdate
+
+	return nil
+}
+
+func crlSignedByCA(crl *x509.RevocationList, cas []*x509.Certificate) bool {
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check returns an error if one of the certificates is revoked. As
+// revocations might be missing from outdated CRLs the certificates
+// are rejected when the CRL files are still outdated after reading
+// them again.
+func (r *revocationList) check(certs []*x509.Certificate, now time.Time) error {
+	if r == nil || len(r.files) == 0 {
+		return nil
+	}
+
+	if r.outdated(now) {
+		r.lock.RLock()
+		reload := now.Sub(r.lastReload) >= crlReloadInterval
+		r.lock.RUnlock()
+
+		if reload {
+			if err := r.reload(now); err != nil {
+				log.WithError(err).Error("Unable to reload CRL files")
+			}
+		}
+
+		if r.outdated(now) {
+			log.Error("CRL files are outdated, rejecting client certificates")
+			return errCRLOutdated
+		}
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, cert := range certs {
+		if r.serials[string(cert.RawIssuer)][cert.SerialNumber.String()] {
+			return errCertificateRevoked
+		}
+	}
+
+	return nil
+}
+
+func (r *revocationList) outdated(now time.Time) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return !r.nextUpdate.IsZero() && now.After(r.nextUpdate)
+}
@@ -0,0 +1,51 @@
+package mtls
+
+import "strings"
+
+// parseDN parses a distinguished name as formatted by nginx into its
+// attributes. Both the RFC 2253 format (`CN=user,OU=group`) used by
+// nginx 1.11.6+ and the legacy format (`/OU=group/CN=user`) are
+// supported.
+func parseDN(dn string) map[string][]string {
+	result := map[string][]string{}
+
+	sep := ','
+	if strings.HasPrefix(dn, "/") {
+		sep = '/'
+		dn = dn[1:]
+	}
+
+	var (
+		parts   []string
+		current strings.Builder
+		escaped bool
+	)
+
+	for _, c := range dn {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == sep:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(c)
+		}
+	}
+	parts = append(parts, current.String())
+
+	for _, part := range parts {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			continue
+		}
+
+		key = strings.ToUpper(strings.TrimSpace(key))
+		result[key] = append(result[key], strings.TrimSpace(value))
+	}
+
+	return result
+}
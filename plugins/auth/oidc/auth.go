@@ -210,6 +210,10 @@ func (a *AuthOIDC) Logout(res http.ResponseWriter, r *http.Request) (err error)
 // to fill in their MFA token.
 func (a *AuthOIDC) SupportsMFA() bool { return false }
 
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a *AuthOIDC) UsesLoginSession() bool { return true }
+
 func (a *AuthOIDC) getOAuthConfig() *oauth2.Config {
 	return &oauth2.Config{
 		ClientID:     a.ClientID,
@@ -0,0 +1,268 @@
+//go:build pam
+
+// Package pam implements an Authenticator verifying users through the
+// pluggable authentication modules of the host. As PAM requires cgo
+// the package is only built with the `pam` build tag.
+package pam
+
+import (
+	"net/http"
+	"os/user"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/msteinert/pam/v2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const defaultService = "nginx-sso"
+
+type AuthPAM struct {
+	EnableBasicAuth bool                           `yaml:"enable_basic_auth"`
+	Service         string                         `yaml:"service"`
+	MFA             map[string][]plugins.MFAConfig `yaml:"mfa"`
+
+	cookie      plugins.CookieConfig
+	cookieStore *sessions.CookieStore
+}
+
+func New(cs *sessions.CookieStore) *AuthPAM {
+	return &AuthPAM{
+		cookieStore: cs,
+	}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a AuthPAM) AuthenticatorID() string { return "pam" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthPAM) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Cookie    plugins.CookieConfig `yaml:"cookie"`
+		Providers struct {
+			PAM *AuthPAM `yaml:"pam"`
+		} `yaml:"providers"`
+	}{}
+
+	envelope.Cookie = plugins.DefaultCookieConfig()
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.PAM == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.EnableBasicAuth = envelope.Providers.PAM.EnableBasicAuth
+	a.Service = envelope.Providers.PAM.Service
+	a.MFA = envelope.Providers.PAM.MFA
+
+	if a.Service == "" {
+		a.Service = defaultService
+	}
+
+	a.cookie = envelope.Cookie
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a AuthPAM) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	var username string
+
+	if a.EnableBasicAuth {
+		if basicUser, basicPass, ok := r.BasicAuth(); ok {
+			if err := a.checkPassword(basicUser, basicPass); err == nil {
+				username = basicUser
+			} else if !errors.Is(err, plugins.ErrNoValidUserFound) {
+				return "", nil, err
+			}
+		}
+	}
+
+	if username == "" {
+		sess, err := a.cookieStore.Get(r, strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-"))
+		if err != nil {
+			return "", nil, plugins.ErrNoValidUserFound
+		}
+
+		var ok bool
+		username, ok = sess.Values["user"].(string)
+		if !ok {
+			return "", nil, plugins.ErrNoValidUserFound
+		}
+
+		// Existing sessions must end when the account was removed
+		if _, err = user.Lookup(username); err != nil {
+			return "", nil, plugins.ErrNoValidUserFound
+		}
+
+		// We had a cookie, lets renew it
+		sess.Options = a.cookie.GetSessionOpts()
+		if err := sess.Save(r, res); err != nil {
+			return "", nil, err
+		}
+	}
+
+	groups, err := unixGroups(username)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return username, groups, nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a AuthPAM) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	username := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "username"}, "-"))
+	password := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "password"}, "-"))
+
+	if err := a.checkPassword(username, password); err != nil {
+		return "", nil, err
+	}
+
+	sess, _ := a.cookieStore.Get(r, strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Values["user"] = username
+	return username, a.MFA[username], sess.Save(r, res)
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a AuthPAM) LoginFields() (fields []plugins.LoginField) {
+	return []plugins.LoginField{
+		{
+			Label:       "Username",
+			Name:        "username",
+			Placeholder: "Username",
+			Type:        "text",
+		},
+		{
+			Label:       "Password",
+			Name:        "password",
+			Placeholder: "****",
+			Type:        "password",
+		},
+	}
+}
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a AuthPAM) Logout(res http.ResponseWriter, r *http.Request) (err error) {
+	sess, _ := a.cookieStore.Get(r, strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Options.MaxAge = -1 // Instant delete
+	return sess.Save(r, res)
+}
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a AuthPAM) SupportsMFA() bool { return true }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a AuthPAM) UsesLoginSession() bool { return true }
+
+// checkPassword runs the authentication and account management of the
+// configured PAM service for the user
+func (a AuthPAM) checkPassword(username, password string) error {
+	if username == "" || password == "" {
+		return plugins.ErrNoValidUserFound
+	}
+
+	tx, err := pam.StartFunc(a.Service, username, func(s pam.Style, msg string) (string, error) {
+		switch s {
+		case pam.PromptEchoOff:
+			return password, nil
+		case pam.PromptEchoOn:
+			return username, nil
+		case pam.ErrorMsg, pam.TextInfo:
+			log.WithField("user", username).Debugf("PAM message: %s", msg)
+			return "", nil
+		default:
+			return "", errors.New("Unsupported PAM conversation style")
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "Unable to start PAM transaction")
+	}
+	defer tx.End() // #nosec G104 - Nothing to do on error
+
+	if err = tx.Authenticate(pam.Silent | pam.DisallowNullAuthtok); err != nil {
+		return pamError(err)
+	}
+
+	if err = tx.AcctMgmt(pam.Silent); err != nil {
+		return pamError(err)
+	}
+
+	return nil
+}
+
+// pamError maps the errors returned by PAM to login failures with a
+// reason for the audit log or passes through unexpected errors
+func pamError(err error) error {
+	f := failureUnexpected
+
+	switch {
+	case errors.Is(err, pam.ErrAuth), errors.Is(err, pam.ErrUserUnknown), errors.Is(err, pam.ErrCredInsufficient):
+		f = failureCredentials
+	case errors.Is(err, pam.ErrMaxtries):
+		f = failureMaxTries
+	case errors.Is(err, pam.ErrAcctExpired):
+		f = failureAccountExpired
+	case errors.Is(err, pam.ErrNewAuthtokReqd):
+		f = failurePasswordExpired
+	case errors.Is(err, pam.ErrPermDenied):
+		f = failurePermissionDenied
+	}
+
+	return loginFailure(f, err)
+}
+
+// unixGroups returns the names of all groups the user is member of
+// including the primary group
+func unixGroups(username string) ([]string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, plugins.ErrNoValidUserFound
+	}
+
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list groups")
+	}
+
+	groups := []string{}
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			log.WithError(err).WithField("gid", gid).Debug("Unable to resolve group")
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+
+	return groups, nil
+}
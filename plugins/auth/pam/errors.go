@@ -0,0 +1,40 @@
+package pam
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+// failure classifies the errors returned by PAM. It is kept apart from
+// the PAM bindings requiring cgo to keep the mapping testable without
+// the `pam` build tag.
+type failure int
+
+const (
+	failureUnexpected failure = iota
+	failureCredentials
+	failureMaxTries
+	failureAccountExpired
+	failurePasswordExpired
+	failurePermissionDenied
+)
+
+// loginFailure maps the classified PAM error to a login failure with a
+// reason for the audit log or passes through unexpected errors
+func loginFailure(f failure, err error) error {
+	switch f {
+	case failureCredentials:
+		return plugins.ErrNoValidUserFound
+	case failureMaxTries:
+		return plugins.NewLoginFailure("too many failed attempts")
+	case failureAccountExpired:
+		return plugins.NewLoginFailure("account expired")
+	case failurePasswordExpired:
+		return plugins.NewLoginFailure("password must be changed")
+	case failurePermissionDenied:
+		return plugins.NewLoginFailure("access denied by PAM")
+	default:
+		return errors.Wrap(err, "PAM authentication failed")
+	}
+}
@@ -0,0 +1,33 @@
+package pam
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestLoginFailure(t *testing.T) {
+	pamErr := errors.New("Authentication failure")
+
+	for f, reason := range map[failure]string{
+		failureMaxTries:         "too many failed attempts",
+		failureAccountExpired:   "account expired",
+		failurePasswordExpired:  "password must be changed",
+		failurePermissionDenied: "access denied by PAM",
+	} {
+		err := loginFailure(f, pamErr)
+		assert.ErrorIs(t, err, plugins.ErrNoValidUserFound, reason)
+		assert.Equal(t, reason, plugins.FailureReason(err, ""))
+	}
+
+	// Invalid credentials do not reveal whether the user exists
+	assert.Equal(t, plugins.ErrNoValidUserFound, loginFailure(failureCredentials, pamErr))
+
+	// Unexpected errors abort the login
+	err := loginFailure(failureUnexpected, pamErr)
+	assert.NotErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.ErrorIs(t, err, pamErr)
+}
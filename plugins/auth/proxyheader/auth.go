@@ -0,0 +1,119 @@
+package proxyheader
+
+import (
+	"net/http"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/trustedsource"
+)
+
+const (
+	defaultUserHeader      = "X-Remote-User"
+	defaultGroupsSeparator = ","
+)
+
+type AuthProxyHeader struct {
+	UserHeader      string `yaml:"user_header"`
+	GroupsHeader    string `yaml:"groups_header"`
+	GroupsSeparator string `yaml:"groups_separator"`
+
+	trustedsource.Config `yaml:",inline"`
+}
+
+func New() *AuthProxyHeader {
+	return &AuthProxyHeader{}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a AuthProxyHeader) AuthenticatorID() string { return "proxy_header" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthProxyHeader) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Providers struct {
+			ProxyHeader *AuthProxyHeader `yaml:"proxy_header"`
+		} `yaml:"providers"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.ProxyHeader == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.UserHeader = envelope.Providers.ProxyHeader.UserHeader
+	a.GroupsHeader = envelope.Providers.ProxyHeader.GroupsHeader
+	a.GroupsSeparator = envelope.Providers.ProxyHeader.GroupsSeparator
+	a.Config = envelope.Providers.ProxyHeader.Config
+
+	if a.UserHeader == "" {
+		a.UserHeader = defaultUserHeader
+	}
+
+	if a.GroupsSeparator == "" {
+		a.GroupsSeparator = defaultGroupsSeparator
+	}
+
+	return a.Config.Parse()
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a AuthProxyHeader) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	user := strings.TrimSpace(r.Header.Get(a.UserHeader))
+	if user == "" {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	if !a.IsTrusted(r) {
+		return "", nil, plugins.NewLoginFailure("proxy header from untrusted source")
+	}
+
+	groups := []string{}
+	if a.GroupsHeader != "" {
+		for _, g := range strings.Split(r.Header.Get(a.GroupsHeader), a.GroupsSeparator) {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	return user, groups, nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a AuthProxyHeader) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	return "", nil, plugins.ErrNoValidUserFound
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a AuthProxyHeader) LoginFields() []plugins.LoginField { return nil }
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a AuthProxyHeader) Logout(res http.ResponseWriter, r *http.Request) error { return nil }
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a AuthProxyHeader) SupportsMFA() bool { return false }
@@ -0,0 +1,80 @@
+package proxyheader
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestDetectUser(t *testing.T) {
+	a := New()
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  proxy_header:
+    groups_header: X-Remote-Groups
+    trusted_sources: ["10.1.0.0/16", "192.168.0.5"]
+    source_ip_header: X-Forwarded-For
+    shared_secret_header: X-Proxy-Secret
+    shared_secret: "s3cr3t"
+`)))
+
+	for name, tc := range map[string]struct {
+		headers map[string]string
+		user    string
+		groups  []string
+		err     error
+	}{
+		"trusted network": {
+			headers: map[string]string{"X-Remote-User": "luzifer", "X-Remote-Groups": "admins, users,", "X-Forwarded-For": "1.2.3.4, 10.1.2.3"},
+			user:    "luzifer",
+			groups:  []string{"admins", "users"},
+		},
+		"trusted IP": {
+			headers: map[string]string{"X-Remote-User": "luzifer", "X-Forwarded-For": "192.168.0.5"},
+			user:    "luzifer",
+			groups:  []string{},
+		},
+		"shared secret": {
+			headers: map[string]string{"X-Remote-User": "luzifer", "X-Proxy-Secret": "s3cr3t"},
+			user:    "luzifer",
+			groups:  []string{},
+		},
+		"spoofed forwarded for": {
+			headers: map[string]string{"X-Remote-User": "luzifer", "X-Forwarded-For": "10.1.2.3, 1.2.3.4"},
+			err:     plugins.ErrNoValidUserFound,
+		},
+		"wrong secret": {
+			headers: map[string]string{"X-Remote-User": "luzifer", "X-Proxy-Secret": "guess"},
+			err:     plugins.ErrNoValidUserFound,
+		},
+		"no user": {
+			headers: map[string]string{"X-Forwarded-For": "10.1.2.3"},
+			err:     plugins.ErrNoValidUserFound,
+		},
+	} {
+		r := httptest.NewRequest("GET", "/auth", nil)
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+
+		user, groups, err := a.DetectUser(httptest.NewRecorder(), r)
+		if tc.err != nil {
+			assert.ErrorIs(t, err, tc.err, name)
+			continue
+		}
+
+		require.NoError(t, err, name)
+		assert.Equal(t, tc.user, user, name)
+		assert.Equal(t, tc.groups, groups, name)
+	}
+
+	assert.Error(t, New().Configure([]byte(`---
+providers:
+  proxy_header:
+    user_header: X-Remote-User
+`)), "configuration without trust anchor must be rejected")
+}
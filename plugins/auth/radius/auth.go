@@ -0,0 +1,559 @@
+// Package radius implements an Authenticator verifying users against
+// one or more RADIUS servers using PAP or CHAP. Access-Challenge
+// responses (i.e. for one-time codes) are passed to the user as a
+// second prompt on the login page.
+package radius
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5" // #nosec G501 - Required by the CHAP (RFC1994) and Message-Authenticator (RFC2869) specifications
+	"crypto/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const (
+	authTypeCHAP = "chap"
+	authTypePAP  = "pap"
+
+	groupAttributeClass    = "class"
+	groupAttributeFilterID = "filter-id"
+
+	challengeField          = "challenge-response"
+	defaultChallengeMessage = "Please enter your one-time code"
+	defaultNASIdentifier    = "nginx-sso"
+	defaultTimeout          = 5 * time.Second
+)
+
+type AuthRADIUS struct {
+	Servers         []string                       `yaml:"servers"`
+	Secret          string                         `yaml:"secret"`
+	Timeout         time.Duration                  `yaml:"timeout"`
+	AuthType        string                         `yaml:"auth_type"`
+	NASIdentifier   string                         `yaml:"nas_identifier"`
+	GroupAttribute  string                         `yaml:"group_attribute"`
+	EnableBasicAuth bool                           `yaml:"enable_basic_auth"`
+	MFA             map[string][]plugins.MFAConfig `yaml:"mfa"`
+
+	// Accept responses of legacy servers not sending a
+	// Message-Authenticator (vulnerable to forged responses)
+	AllowMissingMessageAuthenticator bool `yaml:"allow_missing_message_authenticator"`
+
+	cookie      plugins.CookieConfig
+	cookieStore *sessions.CookieStore
+}
+
+// exchangeResult contains the outcome of an Access-Request
+type exchangeResult struct {
+	response *radius.Packet
+	server   string
+}
+
+func New(cs *sessions.CookieStore) *AuthRADIUS {
+	return &AuthRADIUS{
+		cookieStore: cs,
+	}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a AuthRADIUS) AuthenticatorID() string { return "radius" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthRADIUS) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Cookie    plugins.CookieConfig `yaml:"cookie"`
+		Providers struct {
+			RADIUS *AuthRADIUS `yaml:"radius"`
+		} `yaml:"providers"`
+	}{}
+
+	envelope.Cookie = plugins.DefaultCookieConfig()
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.RADIUS == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.Servers = envelope.Providers.RADIUS.Servers
+	a.Secret = envelope.Providers.RADIUS.Secret
+	a.Timeout = envelope.Providers.RADIUS.Timeout
+	a.AuthType = strings.ToLower(envelope.Providers.RADIUS.AuthType)
+	a.NASIdentifier = envelope.Providers.RADIUS.NASIdentifier
+	a.GroupAttribute = strings.ToLower(envelope.Providers.RADIUS.GroupAttribute)
+	a.EnableBasicAuth = envelope.Providers.RADIUS.EnableBasicAuth
+	a.MFA = envelope.Providers.RADIUS.MFA
+	a.AllowMissingMessageAuthenticator = envelope.Providers.RADIUS.AllowMissingMessageAuthenticator
+
+	if len(a.Servers) == 0 {
+		return errors.New("At least one server is required")
+	}
+
+	if a.Secret == "" {
+		return errors.New("Shared secret is required")
+	}
+
+	for i, server := range a.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			a.Servers[i] = net.JoinHostPort(server, "1812")
+		}
+	}
+
+	if a.Timeout == 0 {
+		a.Timeout = defaultTimeout
+	}
+
+	switch a.AuthType {
+	case "":
+		a.AuthType = authTypePAP
+	case authTypePAP, authTypeCHAP:
+		// Valid
+	default:
+		return errors.Errorf("Unsupported auth_type %q", a.AuthType)
+	}
+
+	if a.NASIdentifier == "" {
+		a.NASIdentifier = defaultNASIdentifier
+	}
+
+	switch a.GroupAttribute {
+	case "":
+		a.GroupAttribute = groupAttributeClass
+	case groupAttributeClass, groupAttributeFilterID:
+		// Valid
+	default:
+		return errors.Errorf("Unsupported group_attribute %q", a.GroupAttribute)
+	}
+
+	a.cookie = envelope.Cookie
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a AuthRADIUS) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	if a.EnableBasicAuth {
+		if basicUser, basicPass, ok := r.BasicAuth(); ok {
+			result, err := a.authenticate(r.Context(), basicUser, basicPass, nil, "")
+			switch {
+			case err != nil && !errors.Is(err, plugins.ErrNoValidUserFound):
+				return "", nil, err
+			case err == nil && result.response.Code == radius.CodeAccessAccept:
+				return basicUser, a.groups(result.response), nil
+			}
+		}
+	}
+
+	sess, err := a.cookieStore.Get(r, a.sessionName())
+	if err != nil {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	user, ok := sess.Values["user"].(string)
+	if !ok {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	groups, _ := sess.Values["groups"].([]string)
+
+	// We had a cookie, lets renew it
+	sess.Options = a.cookie.GetSessionOpts()
+	if err := sess.Save(r, res); err != nil {
+		return "", nil, err
+	}
+
+	return user, groups, nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a AuthRADIUS) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+
+	var (
+		result   exchangeResult
+		username string
+		err      error
+	)
+
+	if response := r.FormValue(strings.Join([]string{a.AuthenticatorID(), challengeField}, "-")); response != "" {
+		// Answer to a previous Access-Challenge
+		var (
+			state  []byte
+			server string
+			ok     bool
+		)
+
+		if username, ok = sess.Values["challenge_user"].(string); !ok {
+			return "", nil, plugins.NewLoginFailure("no pending challenge")
+		}
+		state, _ = sess.Values["challenge_state"].([]byte)
+		server, _ = sess.Values["challenge_server"].(string)
+
+		result, err = a.authenticate(r.Context(), username, response, state, server)
+	} else {
+		username = r.FormValue(strings.Join([]string{a.AuthenticatorID(), "username"}, "-"))
+		password := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "password"}, "-"))
+
+		result, err = a.authenticate(r.Context(), username, password, nil, "")
+	}
+
+	// A challenge can only be answered once
+	_, hadChallenge := sess.Values["challenge_user"]
+	delete(sess.Values, "challenge_user")
+	delete(sess.Values, "challenge_state")
+	delete(sess.Values, "challenge_server")
+
+	if err != nil {
+		if hadChallenge {
+			if saveErr := sess.Save(r, res); saveErr != nil {
+				log.WithError(saveErr).Error("Unable to save session")
+			}
+		}
+		return "", nil, err
+	}
+
+	if result.response.Code == radius.CodeAccessChallenge {
+		sess.Values["challenge_user"] = username
+		sess.Values["challenge_state"] = rfc2865.State_Get(result.response)
+		sess.Values["challenge_server"] = result.server
+		if err := sess.Save(r, res); err != nil {
+			return "", nil, err
+		}
+
+		message := strings.Join(a.replyMessages(result.response), " ")
+		if message == "" {
+			message = defaultChallengeMessage
+		}
+
+		return "", nil, plugins.LoginChallenge{
+			Authenticator: a.AuthenticatorID(),
+			Message:       message,
+			Field: plugins.LoginField{
+				Label:       "Response",
+				Name:        challengeField,
+				Placeholder: "123456",
+				Type:        "text",
+			},
+		}
+	}
+
+	sess.Values["user"] = username
+	sess.Values["groups"] = a.groups(result.response)
+	return username, a.MFA[username], sess.Save(r, res)
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a AuthRADIUS) LoginFields() (fields []plugins.LoginField) {
+	return []plugins.LoginField{
+		{
+			Label:       "Username",
+			Name:        "username",
+			Placeholder: "Username",
+			Type:        "text",
+		},
+		{
+			Label:       "Password",
+			Name:        "password",
+			Placeholder: "****",
+			Type:        "password",
+		},
+	}
+}
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a AuthRADIUS) Logout(res http.ResponseWriter, r *http.Request) (err error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Options.MaxAge = -1 // Instant delete
+	return sess.Save(r, res)
+}
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a AuthRADIUS) SupportsMFA() bool { return true }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a AuthRADIUS) UsesLoginSession() bool { return true }
+
+// authenticate sends an Access-Request to the configured servers and
+// returns the first Access-Accept or Access-Challenge. When a state
+// from a previous challenge is given the request is sent to the server
+// which issued the challenge first. Unreachable servers are skipped.
+func (a AuthRADIUS) authenticate(ctx context.Context, username, password string, state []byte, preferred string) (exchangeResult, error) {
+	if username == "" || password == "" {
+		return exchangeResult{}, plugins.ErrNoValidUserFound
+	}
+
+	servers := a.Servers
+	if preferred != "" {
+		servers = append([]string{preferred}, servers...)
+	}
+
+	var lastErr error
+	tried := map[string]bool{}
+	for _, server := range servers {
+		if tried[server] {
+			continue
+		}
+		tried[server] = true
+
+		packet, err := a.buildRequest(username, password, state)
+		if err != nil {
+			return exchangeResult{}, err
+		}
+
+		response, err := a.exchange(ctx, packet, server)
+		if err != nil {
+			log.WithError(err).WithField("server", server).Warn("RADIUS server did not respond")
+			lastErr = err
+			continue
+		}
+
+		if err = a.verifyResponse(response, packet); err != nil {
+			log.WithError(err).WithField("server", server).Error("RADIUS response rejected")
+			lastErr = err
+			continue
+		}
+
+		switch response.Code {
+		case radius.CodeAccessAccept, radius.CodeAccessChallenge:
+			return exchangeResult{response: response, server: server}, nil
+
+		case radius.CodeAccessReject:
+			if msgs := a.replyMessages(response); len(msgs) > 0 {
+				log.WithField("user", username).Debugf("RADIUS reject: %s", strings.Join(msgs, " "))
+			}
+			return exchangeResult{}, plugins.ErrNoValidUserFound
+
+		default:
+			return exchangeResult{}, errors.Errorf("Unexpected RADIUS response code %s", response.Code)
+		}
+	}
+
+	return exchangeResult{}, errors.Wrap(lastErr, "No RADIUS server available")
+}
+
+func (a AuthRADIUS) buildRequest(username, password string, state []byte) (*radius.Packet, error) {
+	packet := radius.New(radius.CodeAccessRequest, []byte(a.Secret))
+
+	if err := rfc2865.UserName_SetString(packet, username); err != nil {
+		return nil, errors.Wrap(err, "Unable to set User-Name")
+	}
+
+	if err := rfc2865.NASIdentifier_SetString(packet, a.NASIdentifier); err != nil {
+		return nil, errors.Wrap(err, "Unable to set NAS-Identifier")
+	}
+
+	if len(state) > 0 {
+		if err := rfc2865.State_Set(packet, state); err != nil {
+			return nil, errors.Wrap(err, "Unable to set State")
+		}
+	}
+
+	if a.AuthType == authTypeCHAP {
+		challenge, chapPassword, err := chapResponse(password)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := rfc2865.CHAPChallenge_Set(packet, challenge); err != nil {
+			return nil, errors.Wrap(err, "Unable to set CHAP-Challenge")
+		}
+
+		if err := rfc2865.CHAPPassword_Set(packet, chapPassword); err != nil {
+			return nil, errors.Wrap(err, "Unable to set CHAP-Password")
+		}
+	} else if err := rfc2865.UserPassword_SetString(packet, password); err != nil {
+		return nil, errors.Wrap(err, "Unable to set User-Password")
+	}
+
+	return packet, signRequest(packet)
+}
+
+// verifyResponse checks the Message-Authenticator of an Access-Accept,
+// Access-Reject or Access-Challenge against the request it answers.
+// Without the attribute a response can be forged by anyone able to
+// spoof the server (BlastRADIUS, CVE-2024-3596).
+func (a AuthRADIUS) verifyResponse(response, request *radius.Packet) error {
+	values, err := rfc2869.MessageAuthenticator_Gets(response)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read Message-Authenticator")
+	}
+
+	switch len(values) {
+	case 0:
+		if a.AllowMissingMessageAuthenticator {
+			return nil
+		}
+		return errors.New("Response has no Message-Authenticator")
+
+	case 1:
+		// Expected
+
+	default:
+		return errors.New("Response has multiple Message-Authenticators")
+	}
+
+	expected, err := messageAuthenticator(response, request.Authenticator)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(values[0], expected) {
+		return errors.New("Response has an invalid Message-Authenticator")
+	}
+
+	return nil
+}
+
+func (a AuthRADIUS) exchange(ctx context.Context, packet *radius.Packet, server string) (*radius.Packet, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+
+	client := &radius.Client{
+		Retry:           time.Second,
+		MaxPacketErrors: 10,
+	}
+
+	return client.Exchange(ctx, packet, server)
+}
+
+// groups extracts the group names from the configured reply attribute
+// of an Access-Accept
+func (a AuthRADIUS) groups(response *radius.Packet) []string {
+	var (
+		values []string
+		err    error
+	)
+
+	switch a.GroupAttribute {
+	case groupAttributeFilterID:
+		values, err = rfc2865.FilterID_GetStrings(response)
+	default:
+		values, err = rfc2865.Class_GetStrings(response)
+	}
+
+	if err != nil {
+		log.WithError(err).Debug("Unable to read group attribute")
+		return nil
+	}
+
+	groups := []string{}
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			groups = append(groups, v)
+		}
+	}
+
+	return groups
+}
+
+func (AuthRADIUS) replyMessages(response *radius.Packet) []string {
+	msgs, _ := rfc2865.ReplyMessage_GetStrings(response) // #nosec G104 - Missing messages are fine
+	return msgs
+}
+
+func (a AuthRADIUS) sessionName() string {
+	return strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")
+}
+
+// signRequest adds the Message-Authenticator as first attribute of the
+// Access-Request, it must be called after all other attributes are set
+func signRequest(packet *radius.Packet) error {
+	packet.Del(rfc2869.MessageAuthenticator_Type)
+	packet.Attributes = append(radius.Attributes{{
+		Type:      rfc2869.MessageAuthenticator_Type,
+		Attribute: make(radius.Attribute, md5.Size),
+	}}, packet.Attributes...)
+
+	mac, err := messageAuthenticator(packet, packet.Authenticator)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(rfc2869.MessageAuthenticator_Set(packet, mac), "Unable to set Message-Authenticator")
+}
+
+// messageAuthenticator calculates the Message-Authenticator (RFC2869)
+// of the packet: HMAC-MD5 over the packet using the given request
+// authenticator and the value of the attribute set to zeros
+func messageAuthenticator(packet *radius.Packet, authenticator [16]byte) ([]byte, error) {
+	raw, err := packet.MarshalBinary()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to encode packet")
+	}
+
+	copy(raw[4:20], authenticator[:])
+
+	for i := 20; i < len(raw); {
+		if i+2 > len(raw) || raw[i+1] < 2 || i+int(raw[i+1]) > len(raw) {
+			return nil, errors.New("Malformed packet attributes")
+		}
+
+		length := int(raw[i+1])
+		if radius.Type(raw[i]) == rfc2869.MessageAuthenticator_Type {
+			clear(raw[i+2 : i+length])
+		}
+		i += length
+	}
+
+	mac := hmac.New(md5.New, packet.Secret)
+	mac.Write(raw)
+	return mac.Sum(nil), nil
+}
+
+// chapResponse generates a random CHAP challenge and the matching
+// CHAP-Password attribute (ident + MD5(ident + password + challenge))
+func chapResponse(password string) (challenge, chapPassword []byte, err error) {
+	challenge = make([]byte, 16)
+	if _, err = rand.Read(challenge); err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to generate CHAP challenge")
+	}
+
+	ident := make([]byte, 1)
+	if _, err = rand.Read(ident); err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to generate CHAP ident")
+	}
+
+	h := md5.New() // #nosec G401 - Required by the CHAP specification (RFC1994)
+	h.Write(ident)
+	h.Write([]byte(password))
+	h.Write(challenge)
+
+	return challenge, append(ident, h.Sum(nil)...), nil
+}
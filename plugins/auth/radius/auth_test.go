@@ -0,0 +1,240 @@
+package radius
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec G501 - Required by the CHAP specification (RFC1994)
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const testSecret = "s3cr3t"
+
+// testResponseWriter adds the Message-Authenticator to the responses
+// unless the server is a legacy server
+type testResponseWriter struct {
+	radius.ResponseWriter
+	request *radius.Request
+	legacy  bool
+}
+
+func (w testResponseWriter) Write(packet *radius.Packet) error {
+	if !w.legacy {
+		rfc2869.MessageAuthenticator_Set(packet, make([]byte, md5.Size)) // #nosec G104 - Test server
+		mac, _ := messageAuthenticator(packet, w.request.Authenticator)  // #nosec G104 - Test server
+		rfc2869.MessageAuthenticator_Set(packet, mac)                    // #nosec G104 - Test server
+	}
+	return w.ResponseWriter.Write(packet)
+}
+
+func startTestServer(t *testing.T, legacy bool) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte(testSecret)),
+		Handler: radius.HandlerFunc(func(rw radius.ResponseWriter, r *radius.Request) {
+			w := testResponseWriter{ResponseWriter: rw, request: r, legacy: legacy}
+
+			mac, err := messageAuthenticator(r.Packet, r.Authenticator)
+			if err != nil || r.Attributes[0].Type != rfc2869.MessageAuthenticator_Type || !bytes.Equal(r.Attributes[0].Attribute, mac) {
+				w.Write(r.Response(radius.CodeAccessReject)) // #nosec G104 - Test server
+				return
+			}
+
+			var (
+				user     = rfc2865.UserName_GetString(r.Packet)
+				password = rfc2865.UserPassword_GetString(r.Packet)
+				state    = rfc2865.State_GetString(r.Packet)
+			)
+
+			if chap := rfc2865.CHAPPassword_Get(r.Packet); len(chap) == 17 {
+				h := md5.New() // #nosec G401 - Required by the CHAP specification (RFC1994)
+				h.Write(chap[:1])
+				h.Write([]byte("password"))
+				h.Write(rfc2865.CHAPChallenge_Get(r.Packet))
+				if bytes.Equal(h.Sum(nil), chap[1:]) {
+					password = "password"
+				}
+			}
+
+			switch {
+			case user == "luzifer" && password == "password":
+				resp := r.Response(radius.CodeAccessAccept)
+				rfc2865.Class_AddString(resp, "admins") // #nosec G104 - Test server
+				rfc2865.Class_AddString(resp, "users")  // #nosec G104 - Test server
+				rfc2865.FilterID_AddString(resp, "vpn") // #nosec G104 - Test server
+				w.Write(resp)                           // #nosec G104 - Test server
+
+			case user == "otp" && state == "" && password == "password":
+				resp := r.Response(radius.CodeAccessChallenge)
+				rfc2865.State_SetString(resp, "challenge-1")        // #nosec G104 - Test server
+				rfc2865.ReplyMessage_SetString(resp, "Enter token") // #nosec G104 - Test server
+				w.Write(resp)                                       // #nosec G104 - Test server
+
+			case user == "otp" && state == "challenge-1" && password == "123456":
+				w.Write(r.Response(radius.CodeAccessAccept)) // #nosec G104 - Test server
+
+			default:
+				w.Write(r.Response(radius.CodeAccessReject)) // #nosec G104 - Test server
+			}
+		}),
+	}
+
+	go srv.Serve(conn) // #nosec G104 - Ends with the test
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.LocalAddr().String()
+}
+
+// unusedAddr returns an address no RADIUS server is listening on
+func unusedAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+	require.NoError(t, conn.Close())
+	return addr
+}
+
+func newTestAuth(t *testing.T, extra string) *AuthRADIUS {
+	return newTestAuthWithServer(t, startTestServer(t, false), extra)
+}
+
+func newTestAuthWithServer(t *testing.T, server, extra string) *AuthRADIUS {
+	a := New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72")))
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  radius:
+    servers: ["`+unusedAddr(t)+`", "`+server+`"]
+    secret: `+testSecret+`
+    timeout: 500ms
+`+extra)))
+	return a
+}
+
+func postLogin(a *AuthRADIUS, values url.Values, cookies []*http.Cookie) (*httptest.ResponseRecorder, string, error) {
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	res := httptest.NewRecorder()
+	user, _, err := a.Login(res, r)
+	return res, user, err
+}
+
+func TestPAPLoginWithFailover(t *testing.T) {
+	a := newTestAuth(t, "")
+
+	res, user, err := postLogin(a, url.Values{"radius-username": {"luzifer"}, "radius-password": {"password"}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+
+	r := httptest.NewRequest("GET", "/auth", nil)
+	for _, c := range res.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	user, groups, err := a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	assert.Equal(t, []string{"admins", "users"}, groups)
+
+	_, _, err = postLogin(a, url.Values{"radius-username": {"luzifer"}, "radius-password": {"wrong"}}, nil)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+}
+
+func TestCHAPLoginWithFilterID(t *testing.T) {
+	a := newTestAuth(t, "    auth_type: chap\n    group_attribute: filter-id\n")
+
+	res, user, err := postLogin(a, url.Values{"radius-username": {"luzifer"}, "radius-password": {"password"}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+
+	r := httptest.NewRequest("GET", "/auth", nil)
+	for _, c := range res.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	_, groups, err := a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vpn"}, groups)
+}
+
+func TestAccessChallenge(t *testing.T) {
+	a := newTestAuth(t, "")
+
+	res, _, err := postLogin(a, url.Values{"radius-username": {"otp"}, "radius-password": {"password"}}, nil)
+	var challenge plugins.LoginChallenge
+	require.ErrorAs(t, err, &challenge)
+	assert.Equal(t, "radius", challenge.Authenticator)
+	assert.Equal(t, "Enter token", challenge.Message)
+	assert.Equal(t, challengeField, challenge.Field.Name)
+
+	cookies := res.Result().Cookies()
+
+	_, _, err = postLogin(a, url.Values{"radius-challenge-response": {"000000"}}, cookies)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	_, user, err := postLogin(a, url.Values{"radius-challenge-response": {"123456"}}, cookies)
+	require.NoError(t, err)
+	assert.Equal(t, "otp", user)
+
+	_, _, err = postLogin(a, url.Values{"radius-challenge-response": {"123456"}}, nil)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+}
+
+func TestMessageAuthenticatorRequired(t *testing.T) {
+	server := startTestServer(t, true)
+	values := url.Values{"radius-username": {"luzifer"}, "radius-password": {"password"}}
+
+	_, _, err := postLogin(newTestAuthWithServer(t, server, ""), values, nil)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	_, user, err := postLogin(newTestAuthWithServer(t, server, "    allow_missing_message_authenticator: true\n"), values, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+}
+
+func TestForgedMessageAuthenticator(t *testing.T) {
+	a := newTestAuth(t, "")
+
+	request, err := a.buildRequest("luzifer", "password", nil)
+	require.NoError(t, err)
+
+	response := request.Response(radius.CodeAccessAccept)
+	rfc2869.MessageAuthenticator_Set(response, make([]byte, md5.Size)) // #nosec G104 - Test packet
+	mac, err := messageAuthenticator(response, request.Authenticator)
+	require.NoError(t, err)
+	rfc2869.MessageAuthenticator_Set(response, mac) // #nosec G104 - Test packet
+	assert.NoError(t, a.verifyResponse(response, request))
+
+	// Attributes added by an attacker invalidate the authenticator
+	rfc2865.Class_AddString(response, "admins") // #nosec G104 - Test packet
+	assert.Error(t, a.verifyResponse(response, request))
+}
+
+func TestConfigValidation(t *testing.T) {
+	a := New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72")))
+
+	assert.ErrorIs(t, a.Configure([]byte("---\nproviders: {}\n")), plugins.ErrProviderUnconfigured)
+	assert.Error(t, a.Configure([]byte("---\nproviders:\n  radius:\n    servers: [localhost]\n")))
+	assert.Error(t, a.Configure([]byte("---\nproviders:\n  radius:\n    servers: [localhost]\n    secret: a\n    auth_type: mschap\n")))
+
+	require.NoError(t, a.Configure([]byte("---\nproviders:\n  radius:\n    servers: [localhost]\n    secret: a\n")))
+	assert.Equal(t, []string{"localhost:1812"}, a.Servers)
+	assert.Equal(t, authTypePAP, a.AuthType)
+	assert.Equal(t, groupAttributeClass, a.GroupAttribute)
+}
@@ -0,0 +1,385 @@
+// Package saml implements a SAML 2.0 service provider Authenticator
+// for identity providers like ADFS or Shibboleth. The SP metadata and
+// protocol endpoints are served below /provider/saml/.
+package saml
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	dsig "github.com/russellhaering/goxmldsig"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const (
+	bindingPost     = "post"
+	bindingRedirect = "redirect"
+
+	endpointPrefix        = "/provider/saml"
+	metadataFetchTimeout  = 10 * time.Second
+	defaultIDPDisplayName = "SAML"
+	defaultMaxPending     = 10000
+)
+
+var nameIDFormats = map[string]saml.NameIDFormat{
+	"":            saml.UnspecifiedNameIDFormat,
+	"email":       saml.EmailAddressNameIDFormat,
+	"persistent":  saml.PersistentNameIDFormat,
+	"transient":   saml.TransientNameIDFormat,
+	"unspecified": saml.UnspecifiedNameIDFormat,
+}
+
+type AuthSAML struct {
+	IDPName           string `yaml:"idp_name"`
+	IDPMetadataURL    string `yaml:"idp_metadata_url"`
+	IDPMetadataFile   string `yaml:"idp_metadata_file"`
+	RootURL           string `yaml:"root_url"`
+	EntityID          string `yaml:"entity_id"`
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+	Binding           string `yaml:"binding"`
+	NameIDFormat      string `yaml:"name_id_format"`
+	UsernameAttribute string `yaml:"username_attribute"`
+	GroupsAttribute   string `yaml:"groups_attribute"`
+	AllowIDPInitiated bool   `yaml:"allow_idp_initiated"`
+	MaxPendingLogins  int    `yaml:"max_pending_logins"`
+
+	cookie      plugins.CookieConfig
+	cookieStore *sessions.CookieStore
+
+	pending *pendingStore
+	sp      *saml.ServiceProvider
+}
+
+func New(cs *sessions.CookieStore) *AuthSAML {
+	return &AuthSAML{
+		cookieStore: cs,
+		pending:     newPendingStore(defaultMaxPending),
+	}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a *AuthSAML) AuthenticatorID() (id string) { return "saml" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the ErrProviderUnconfigured
+func (a *AuthSAML) Configure(yamlSource []byte) (err error) {
+	envelope := struct {
+		Cookie    plugins.CookieConfig `yaml:"cookie"`
+		Providers struct {
+			SAML *AuthSAML `yaml:"saml"`
+		} `yaml:"providers"`
+	}{}
+
+	envelope.Cookie = plugins.DefaultCookieConfig()
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.SAML == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.IDPName = envelope.Providers.SAML.IDPName
+	a.IDPMetadataURL = envelope.Providers.SAML.IDPMetadataURL
+	a.IDPMetadataFile = envelope.Providers.SAML.IDPMetadataFile
+	a.RootURL = strings.TrimRight(envelope.Providers.SAML.RootURL, "/")
+	a.EntityID = envelope.Providers.SAML.EntityID
+	a.CertFile = envelope.Providers.SAML.CertFile
+	a.KeyFile = envelope.Providers.SAML.KeyFile
+	a.Binding = strings.ToLower(envelope.Providers.SAML.Binding)
+	a.NameIDFormat = strings.ToLower(envelope.Providers.SAML.NameIDFormat)
+	a.UsernameAttribute = envelope.Providers.SAML.UsernameAttribute
+	a.GroupsAttribute = envelope.Providers.SAML.GroupsAttribute
+	a.AllowIDPInitiated = envelope.Providers.SAML.AllowIDPInitiated
+	a.MaxPendingLogins = envelope.Providers.SAML.MaxPendingLogins
+
+	if a.IDPName == "" {
+		a.IDPName = defaultIDPDisplayName
+	}
+
+	if a.MaxPendingLogins <= 0 {
+		a.MaxPendingLogins = defaultMaxPending
+	}
+
+	switch a.Binding {
+	case "":
+		a.Binding = bindingRedirect
+	case bindingRedirect, bindingPost:
+		// Valid
+	default:
+		return errors.Errorf("Unsupported binding %q", a.Binding)
+	}
+
+	nameIDFormat, ok := nameIDFormats[a.NameIDFormat]
+	if !ok {
+		return errors.Errorf("Unsupported name_id_format %q", a.NameIDFormat)
+	}
+
+	rootURL, err := url.Parse(a.RootURL)
+	if err != nil || rootURL.Scheme == "" || rootURL.Host == "" {
+		return errors.New("root_url must be an absolute URL")
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "Unable to load SP certificate")
+	}
+
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "Unable to parse SP certificate")
+	}
+
+	var signatureMethod string
+	switch keyPair.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		signatureMethod = dsig.RSASHA256SignatureMethod
+	case *ecdsa.PrivateKey:
+		signatureMethod = dsig.ECDSASHA256SignatureMethod
+	default:
+		return errors.New("SP key must be a RSA or ECDSA key")
+	}
+
+	idpMetadata, err := a.loadIDPMetadata()
+	if err != nil {
+		return err
+	}
+
+	a.cookie = envelope.Cookie
+	a.pending = newPendingStore(a.MaxPendingLogins)
+	a.sp = &saml.ServiceProvider{
+		EntityID:          a.EntityID,
+		Key:               keyPair.PrivateKey.(crypto.Signer),
+		Certificate:       cert,
+		MetadataURL:       *rootURL.JoinPath(endpointPrefix, "metadata"),
+		AcsURL:            *rootURL.JoinPath(endpointPrefix, "acs"),
+		SloURL:            *rootURL.JoinPath(endpointPrefix, "slo"),
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: nameIDFormat,
+		AllowIDPInitiated: a.AllowIDPInitiated,
+		SignatureMethod:   signatureMethod,
+		LogoutBindings:    []string{saml.HTTPRedirectBinding, saml.HTTPPostBinding},
+	}
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the ErrNoValidUserFound needs to be
+// returned
+func (a *AuthSAML) DetectUser(res http.ResponseWriter, r *http.Request) (user string, groups []string, err error) {
+	sess, err := a.cookieStore.Get(r, a.sessionName())
+	if err != nil {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	user, ok := sess.Values["user"].(string)
+	if !ok {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	if expires, ok := sess.Values["session_expires"].(int64); ok && time.Now().Unix() >= expires {
+		// The IdP limited the lifetime of the session
+		return "", nil, plugins.NewLoginFailure("SAML session expired")
+	}
+
+	groups, _ = sess.Values["groups"].([]string)
+
+	// We had a cookie, lets renew it
+	sess.Options = a.cookie.GetSessionOpts()
+	if err := sess.Save(r, res); err != nil {
+		return "", nil, err
+	}
+
+	return user, groups, nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// With the login result an array of mfaConfig must be returned. In
+// case there is no MFA config or the provider does not support MFA
+// return nil.
+// If the user did not login correctly the ErrNoValidUserFound
+// needs to be returned
+func (a *AuthSAML) Login(res http.ResponseWriter, r *http.Request) (user string, mfaConfigs []plugins.MFAConfig, err error) {
+	var (
+		code  = r.URL.Query().Get("code")
+		state = r.URL.Query().Get("state")
+	)
+
+	if code == "" || state != a.AuthenticatorID() {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	if code == invalidResponseCode {
+		return "", nil, plugins.NewLoginFailure("invalid SAML response")
+	}
+
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	nonce, _ := sess.Values["login_nonce"].(string)
+
+	result, ok := a.pending.popResult(code, nonce)
+	if !ok {
+		return "", nil, plugins.NewLoginFailure("unknown or expired SAML response")
+	}
+
+	if result.err != nil {
+		return "", nil, result.err
+	}
+
+	sess.Options = a.cookie.GetSessionOpts()
+	delete(sess.Values, "login_nonce")
+	sess.Values["user"] = result.user
+	sess.Values["groups"] = result.groups
+	sess.Values["name_id"] = result.nameID
+	if result.sessionExpires != nil {
+		sess.Values["session_expires"] = result.sessionExpires.Unix()
+	}
+
+	return result.user, nil, sess.Save(r, res)
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a *AuthSAML) LoginFields() (fields []plugins.LoginField) {
+	return []plugins.LoginField{
+		{
+			Action:      fmt.Sprintf("window.location.href='%s'", endpointPrefix+"/login"),
+			Label:       "Trigger Login",
+			Name:        "button",
+			Placeholder: fmt.Sprintf("Sign in with %s", a.IDPName),
+			Type:        "button",
+		},
+	}
+}
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a *AuthSAML) Logout(res http.ResponseWriter, r *http.Request) (err error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Options.MaxAge = -1 // Instant delete
+	return sess.Save(r, res)
+}
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a *AuthSAML) SupportsMFA() bool { return false }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a *AuthSAML) UsesLoginSession() bool { return true }
+
+func (a *AuthSAML) loadIDPMetadata() (*saml.EntityDescriptor, error) {
+	switch {
+	case a.IDPMetadataFile != "":
+		data, err := os.ReadFile(a.IDPMetadataFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read IdP metadata")
+		}
+
+		md, err := samlsp.ParseMetadata(data)
+		return md, errors.Wrap(err, "Unable to parse IdP metadata")
+
+	case a.IDPMetadataURL != "":
+		mdURL, err := url.Parse(a.IDPMetadataURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid idp_metadata_url")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), metadataFetchTimeout)
+		defer cancel()
+
+		md, err := samlsp.FetchMetadata(ctx, http.DefaultClient, *mdURL)
+		return md, errors.Wrap(err, "Unable to fetch IdP metadata")
+
+	default:
+		return nil, errors.New("Either idp_metadata_url or idp_metadata_file is required")
+	}
+}
+
+// userFromAssertion maps the subject and attributes of the assertion
+// to the username and groups
+func (a *AuthSAML) userFromAssertion(assertion *saml.Assertion) (loginResult, error) {
+	result := loginResult{groups: []string{}}
+
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		result.nameID = assertion.Subject.NameID.Value
+	}
+
+	for _, stmt := range assertion.AuthnStatements {
+		if stmt.SessionNotOnOrAfter != nil && (result.sessionExpires == nil || stmt.SessionNotOnOrAfter.Before(*result.sessionExpires)) {
+			result.sessionExpires = stmt.SessionNotOnOrAfter
+		}
+	}
+
+	if a.UsernameAttribute == "" {
+		result.user = result.nameID
+	} else if values := attributeValues(assertion, a.UsernameAttribute); len(values) > 0 {
+		result.user = values[0]
+	}
+
+	if result.user == "" {
+		return loginResult{}, plugins.NewLoginFailure("no username in SAML assertion")
+	}
+
+	if a.GroupsAttribute != "" {
+		result.groups = append(result.groups, attributeValues(assertion, a.GroupsAttribute)...)
+	}
+
+	return result, nil
+}
+
+func (a *AuthSAML) sessionName() string {
+	return strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")
+}
+
+// attributeValues collects the values of all attributes matching the
+// name either by their Name or by their FriendlyName
+func attributeValues(assertion *saml.Assertion, name string) []string {
+	var values []string
+
+	for _, stmt := range assertion.AttributeStatements {
+		for _, attr := range stmt.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+
+			for _, v := range attr.Values {
+				if v.Value != "" {
+					values = append(values, v.Value)
+				}
+			}
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,259 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const testIDPMetadata = `<?xml version="1.0"?>
+<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/metadata">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/slo"/>
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`
+
+func writeTestKeyPair(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nginx-sso"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	certFile = path.Join(dir, "sp.crt")
+	keyFile = path.Join(dir, "sp.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+
+	return certFile, keyFile
+}
+
+func newTestAuth(t *testing.T, extra string) *AuthSAML {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir)
+
+	mdFile := path.Join(dir, "idp.xml")
+	require.NoError(t, os.WriteFile(mdFile, []byte(testIDPMetadata), 0o600))
+
+	a := New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72")))
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  saml:
+    idp_metadata_file: "`+mdFile+`"
+    root_url: "https://login.example.com/"
+    cert_file: "`+certFile+`"
+    key_file: "`+keyFile+`"
+    groups_attribute: "groups"
+`+extra)))
+
+	return a
+}
+
+func TestMetadataEndpoint(t *testing.T) {
+	a := newTestAuth(t, "")
+
+	res := httptest.NewRecorder()
+	a.ServeEndpoint(res, httptest.NewRequest("GET", "/metadata", nil))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `entityID="https://login.example.com/provider/saml/metadata"`)
+	assert.Contains(t, res.Body.String(), `Location="https://login.example.com/provider/saml/acs"`)
+	assert.Contains(t, res.Body.String(), `Location="https://login.example.com/provider/saml/slo"`)
+}
+
+func TestLoginRedirectIsSigned(t *testing.T) {
+	a := newTestAuth(t, "")
+
+	res := httptest.NewRecorder()
+	a.ServeEndpoint(res, httptest.NewRequest("GET", "/login", nil))
+	require.Equal(t, http.StatusFound, res.Code)
+
+	target, err := url.Parse(res.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "idp.example.com", target.Host)
+	assert.NotEmpty(t, target.Query().Get("SAMLRequest"))
+	assert.NotEmpty(t, target.Query().Get("Signature"))
+
+	relayState := target.Query().Get("RelayState")
+	nonce, ok := a.pending.popRequest(relayState)
+	assert.True(t, ok)
+	assert.NotEmpty(t, nonce)
+	_, ok = a.pending.popRequest(relayState)
+	assert.False(t, ok, "request IDs must be single-use")
+}
+
+func TestLoginResultBoundToBrowser(t *testing.T) {
+	a := newTestAuth(t, "")
+
+	res := httptest.NewRecorder()
+	a.ServeEndpoint(res, httptest.NewRequest("GET", "/login", nil))
+	require.Equal(t, http.StatusFound, res.Code)
+	cookies := res.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	target, err := url.Parse(res.Header().Get("Location"))
+	require.NoError(t, err)
+	nonce, ok := a.pending.popRequest(target.Query().Get("RelayState"))
+	require.True(t, ok)
+
+	code, err := a.pending.addResult(loginResult{user: "luzifer", nonce: nonce})
+	require.NoError(t, err)
+
+	// Another browser (i.e. the victim of a login CSRF) cannot use the code
+	_, _, err = a.Login(httptest.NewRecorder(), httptest.NewRequest("GET", "/login?state=saml&code="+code, nil))
+	assert.Equal(t, "unknown or expired SAML response", plugins.FailureReason(err, ""))
+
+	r := httptest.NewRequest("GET", "/login?state=saml&code="+code, nil)
+	r.AddCookie(cookies[0])
+	user, _, err := a.Login(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+}
+
+func TestLoginPostBinding(t *testing.T) {
+	a := newTestAuth(t, "    binding: post\n")
+
+	res := httptest.NewRecorder()
+	a.ServeEndpoint(res, httptest.NewRequest("GET", "/login", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `action="https://idp.example.com/sso"`)
+	assert.Contains(t, res.Body.String(), `name="SAMLRequest"`)
+}
+
+func TestInvalidResponseIsLoginFailure(t *testing.T) {
+	a := newTestAuth(t, "")
+
+	r := httptest.NewRequest("POST", "/acs", strings.NewReader(url.Values{
+		"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte("<invalid/>"))},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	a.ServeEndpoint(res, r)
+	require.Equal(t, http.StatusFound, res.Code)
+
+	target, err := url.Parse(res.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/login", target.Path)
+	assert.Equal(t, "saml", target.Query().Get("state"))
+
+	_, _, err = a.Login(httptest.NewRecorder(), httptest.NewRequest("GET", target.String(), nil))
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.Equal(t, "invalid SAML response", plugins.FailureReason(err, ""))
+
+	// Unparseable responses must not fill the pending store
+	assert.Empty(t, a.pending.results)
+}
+
+func TestPendingStoreLimit(t *testing.T) {
+	p := newPendingStore(2)
+
+	for _, id := range []string{"a", "b", "c"} {
+		p.addRequest(id, "nonce")
+	}
+	assert.Len(t, p.requests, 2)
+
+	for i := 0; i < 3; i++ {
+		_, err := p.addResult(loginResult{user: "luzifer"})
+		require.NoError(t, err)
+	}
+	assert.Len(t, p.results, 2)
+}
+
+func TestAttributeMappingAndSession(t *testing.T) {
+	a := newTestAuth(t, "    username_attribute: uid\n")
+
+	expires := time.Now().Add(time.Hour)
+	result, err := a.userFromAssertion(&saml.Assertion{
+		Subject: &saml.Subject{NameID: &saml.NameID{Value: "_transient123"}},
+		AuthnStatements: []saml.AuthnStatement{
+			{SessionNotOnOrAfter: &expires},
+		},
+		AttributeStatements: []saml.AttributeStatement{{Attributes: []saml.Attribute{
+			{Name: "urn:oid:0.9.2342.19200300.100.1.1", FriendlyName: "uid", Values: []saml.AttributeValue{{Value: "luzifer"}}},
+			{Name: "groups", Values: []saml.AttributeValue{{Value: "admins"}, {Value: "users"}}},
+		}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", result.user)
+	assert.Equal(t, "_transient123", result.nameID)
+	assert.Equal(t, []string{"admins", "users"}, result.groups)
+
+	code, err := a.pending.addResult(result)
+	require.NoError(t, err)
+
+	res := httptest.NewRecorder()
+	user, _, err := a.Login(res, httptest.NewRequest("GET", "/login?state=saml&code="+code, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+
+	// Results can only be used once
+	_, _, err = a.Login(httptest.NewRecorder(), httptest.NewRequest("GET", "/login?state=saml&code="+code, nil))
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	r := httptest.NewRequest("GET", "/auth", nil)
+	for _, c := range res.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	user, groups, err := a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	assert.Equal(t, []string{"admins", "users"}, groups)
+
+	_, err = a.userFromAssertion(&saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{Value: "x"}}})
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+}
+
+func TestIDPInitiatedLogout(t *testing.T) {
+	a := newTestAuth(t, "")
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(`<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="id-logout" Version="2.0"><saml:Issuer>https://idp.example.com/metadata</saml:Issuer><saml:NameID>luzifer</saml:NameID></samlp:LogoutRequest>`))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	res := httptest.NewRecorder()
+	a.ServeEndpoint(res, httptest.NewRequest("GET", "/slo?"+url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(buf.Bytes())},
+	}.Encode(), nil))
+	require.Equal(t, http.StatusFound, res.Code)
+
+	target, err := url.Parse(res.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://idp.example.com/slo", target.Scheme+"://"+target.Host+target.Path)
+	assert.NotEmpty(t, target.Query().Get("SAMLResponse"))
+
+	cookies := res.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, -1, cookies[0].MaxAge)
+}
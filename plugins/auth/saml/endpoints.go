@@ -0,0 +1,270 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/crewjam/saml"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxLogoutRequestSize = 1 << 20
+
+// ServeEndpoint serves the SP metadata and the SAML protocol endpoints
+// below /provider/saml/
+func (a *AuthSAML) ServeEndpoint(res http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/metadata":
+		a.handleMetadata(res)
+	case "/login":
+		a.handleLogin(res, r)
+	case "/acs":
+		a.handleACS(res, r)
+	case "/logout":
+		a.handleLogout(res, r)
+	case "/slo":
+		a.handleSLO(res, r)
+	default:
+		http.NotFound(res, r)
+	}
+}
+
+func (a *AuthSAML) handleMetadata(res http.ResponseWriter) {
+	buf, err := xml.MarshalIndent(a.sp.Metadata(), "", "  ")
+	if err != nil {
+		log.WithError(err).Error("Unable to render SAML metadata")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/samlmetadata+xml")
+	res.Write(buf) // #nosec G104 - Nothing to do on error
+}
+
+// handleLogin issues a signed AuthnRequest and sends the user to the IdP.
+// A random nonce is stored in the session of the browser and bound to
+// the request so only this browser can complete the login.
+func (a *AuthSAML) handleLogin(res http.ResponseWriter, r *http.Request) {
+	binding := saml.HTTPRedirectBinding
+	if a.Binding == bindingPost {
+		binding = saml.HTTPPostBinding
+	}
+
+	req, err := a.sp.MakeAuthenticationRequest(a.sp.GetSSOBindingLocation(binding), binding, saml.HTTPPostBinding)
+	if err != nil {
+		log.WithError(err).Error("Unable to create SAML AuthnRequest")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	nonce, err := randomHex()
+	if err != nil {
+		log.WithError(err).Error("Unable to generate SAML login nonce")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Values["login_nonce"] = nonce
+	if err = sess.Save(r, res); err != nil {
+		log.WithError(err).Error("Unable to save SAML session")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	a.pending.addRequest(req.ID, nonce)
+
+	if binding == saml.HTTPPostBinding {
+		a.writePostForm(res, req.Post(req.ID))
+		return
+	}
+
+	target, err := req.Redirect(req.ID, a.sp)
+	if err != nil {
+		log.WithError(err).Error("Unable to encode SAML AuthnRequest")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Location", target.String())
+	res.WriteHeader(http.StatusFound)
+}
+
+// handleACS validates the response of the IdP and hands the result to
+// the login handler. As the IdP posts the response cross-site the
+// session cookies are not available here so the result is passed
+// through the pending store.
+func (a *AuthSAML) handleACS(res http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(res, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		possibleRequestIDs []string
+		nonce              string
+	)
+	if relayState := r.PostForm.Get("RelayState"); relayState != "" {
+		var ok bool
+		if nonce, ok = a.pending.popRequest(relayState); ok {
+			possibleRequestIDs = []string{relayState}
+		}
+	}
+
+	assertion, err := a.sp.ParseResponse(r, possibleRequestIDs)
+	if err != nil {
+		var ire *saml.InvalidResponseError
+		if errors.As(err, &ire) {
+			err = ire.PrivateErr
+		}
+		log.WithError(err).Warn("Invalid SAML response")
+		http.Redirect(res, r, "/login?"+url.Values{"code": {invalidResponseCode}, "state": {a.AuthenticatorID()}}.Encode(), http.StatusFound)
+		return
+	}
+
+	result, err := a.userFromAssertion(assertion)
+	if err != nil {
+		result.err = err
+	}
+
+	// Responses to our own requests can only be picked up by the browser
+	// which started the login, IdP initiated responses are not bound to
+	// a browser
+	result.nonce = nonce
+
+	code, err := a.pending.addResult(result)
+	if err != nil {
+		log.WithError(err).Error("Unable to store SAML login result")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(res, r, "/login?"+url.Values{"code": {code}, "state": {a.AuthenticatorID()}}.Encode(), http.StatusFound)
+}
+
+// handleLogout removes the local session and starts the single logout
+// at the IdP. The IdP sends the user back to the SLO endpoint.
+func (a *AuthSAML) handleLogout(res http.ResponseWriter, r *http.Request) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	nameID, _ := sess.Values["name_id"].(string)
+
+	if err := a.Logout(res, r); err != nil {
+		log.WithError(err).Error("Unable to remove SAML session")
+	}
+
+	switch {
+	case nameID == "":
+		// No SAML session, nothing to do at the IdP
+
+	case a.sp.GetSLOBindingLocation(saml.HTTPRedirectBinding) != "":
+		target, err := a.sp.MakeRedirectLogoutRequest(nameID, "")
+		if err == nil {
+			http.Redirect(res, r, target.String(), http.StatusFound)
+			return
+		}
+		log.WithError(err).Error("Unable to create SAML LogoutRequest")
+
+	case a.sp.GetSLOBindingLocation(saml.HTTPPostBinding) != "":
+		form, err := a.sp.MakePostLogoutRequest(nameID, "")
+		if err == nil {
+			a.writePostForm(res, form)
+			return
+		}
+		log.WithError(err).Error("Unable to create SAML LogoutRequest")
+	}
+
+	http.Redirect(res, r, "/logout", http.StatusFound)
+}
+
+// handleSLO processes LogoutResponses to our own LogoutRequests and
+// LogoutRequests initiated by the IdP
+func (a *AuthSAML) handleSLO(res http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(res, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if r.Form.Get("SAMLResponse") != "" {
+		if err := a.sp.ValidateLogoutResponseRequest(r); err != nil {
+			log.WithError(err).Warn("Invalid SAML LogoutResponse")
+		}
+
+		// Finish the logout of all other providers
+		http.Redirect(res, r, "/logout", http.StatusFound)
+		return
+	}
+
+	req, err := parseLogoutRequest(r)
+	if err != nil || req.Issuer == nil || req.Issuer.Value != a.sp.IDPMetadata.EntityID {
+		log.WithError(err).Warn("Invalid SAML LogoutRequest")
+		http.Error(res, "Invalid logout request", http.StatusBadRequest)
+		return
+	}
+
+	// Forging a LogoutRequest only allows to log out the user which is
+	// also possible through the /logout endpoint, so the request is
+	// accepted without verifying its signature
+	if err = a.Logout(res, r); err != nil {
+		log.WithError(err).Error("Unable to remove SAML session")
+	}
+
+	relayState := r.Form.Get("RelayState")
+	if a.sp.GetSLOBindingLocation(saml.HTTPRedirectBinding) != "" {
+		target, err := a.sp.MakeRedirectLogoutResponse(req.ID, relayState)
+		if err == nil {
+			http.Redirect(res, r, target.String(), http.StatusFound)
+			return
+		}
+		log.WithError(err).Error("Unable to create SAML LogoutResponse")
+	} else if form, err := a.sp.MakePostLogoutResponse(req.ID, relayState); err == nil {
+		a.writePostForm(res, form)
+		return
+	}
+
+	http.Redirect(res, r, "/logout", http.StatusFound)
+}
+
+func (*AuthSAML) writePostForm(res http.ResponseWriter, form []byte) {
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.Write([]byte("<!DOCTYPE html><html><body>")) // #nosec G104 - Nothing to do on error
+	res.Write(form)                                  // #nosec G104 - Nothing to do on error
+	res.Write([]byte("</body></html>"))              // #nosec G104 - Nothing to do on error
+}
+
+// parseLogoutRequest decodes a LogoutRequest sent through the redirect
+// (deflated) or the POST binding
+func parseLogoutRequest(r *http.Request) (*saml.LogoutRequest, error) {
+	var raw []byte
+
+	if data := r.URL.Query().Get("SAMLRequest"); data != "" {
+		compressed, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to decode request")
+		}
+
+		if raw, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), maxLogoutRequestSize)); err != nil {
+			return nil, errors.Wrap(err, "Unable to inflate request")
+		}
+	} else {
+		var err error
+		if raw, err = base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLRequest")); err != nil {
+			return nil, errors.Wrap(err, "Unable to decode request")
+		}
+	}
+
+	req := &saml.LogoutRequest{}
+	return req, errors.Wrap(xml.Unmarshal(raw, req), "Unable to parse request")
+}
@@ -0,0 +1,176 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pendingRequestTTL      = 10 * time.Minute
+	pendingResultTTL       = time.Minute
+	pendingCleanupInterval = time.Minute
+
+	// invalidResponseCode is passed to the login handler instead of a
+	// result code when the response could not be parsed. Those results
+	// are not stored as anyone can post them.
+	invalidResponseCode = "invalid"
+)
+
+// loginResult contains the outcome of a processed SAML response until
+// it is picked up by the login handler
+type loginResult struct {
+	user           string
+	groups         []string
+	nameID         string
+	sessionExpires *time.Time
+	err            error
+
+	// nonce of the browser which started the login, empty for IdP
+	// initiated logins
+	nonce string
+
+	created time.Time
+}
+
+// pendingRequest is an issued AuthnRequest waiting for the response
+type pendingRequest struct {
+	nonce   string
+	expires time.Time
+}
+
+// pendingStore keeps track of issued AuthnRequests and of processed
+// responses. It is held in memory as the responses are delivered
+// through a cross-site POST which does not carry the session cookies.
+// At most maxEntries requests and results are kept to limit the memory
+// unauthenticated clients can use.
+type pendingStore struct {
+	lock        sync.Mutex
+	maxEntries  int
+	requests    map[string]pendingRequest
+	results     map[string]loginResult
+	lastCleanup time.Time
+}
+
+func newPendingStore(maxEntries int) *pendingStore {
+	return &pendingStore{
+		maxEntries: maxEntries,
+		requests:   map[string]pendingRequest{},
+		results:    map[string]loginResult{},
+	}
+}
+
+// addRequest registers the ID of an issued AuthnRequest together with
+// the nonce stored in the session of the browser starting the login
+func (p *pendingStore) addRequest(id, nonce string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.cleanup()
+	if _, ok := p.requests[id]; !ok && len(p.requests) >= p.maxEntries {
+		// Make room by evicting an arbitrary request, the map iteration
+		// order is random
+		for k := range p.requests {
+			delete(p.requests, k)
+			break
+		}
+	}
+	p.requests[id] = pendingRequest{nonce: nonce, expires: time.Now().Add(pendingRequestTTL)}
+}
+
+// popRequest returns the nonce of the AuthnRequest with the given ID
+// and reports whether it was issued and is not yet expired. Each ID
+// can only be used once.
+func (p *pendingStore) popRequest(id string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	req, ok := p.requests[id]
+	delete(p.requests, id)
+
+	if !ok || time.Now().After(req.expires) {
+		return "", false
+	}
+
+	return req.nonce, true
+}
+
+// addResult stores the result and returns a random code to retrieve it
+func (p *pendingStore) addResult(result loginResult) (string, error) {
+	code, err := randomHex()
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to generate result code")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.cleanup()
+	if len(p.results) >= p.maxEntries {
+		// Make room by evicting an arbitrary result, the map iteration
+		// order is random
+		for k := range p.results {
+			delete(p.results, k)
+			break
+		}
+	}
+	result.created = time.Now()
+	p.results[code] = result
+
+	return code, nil
+}
+
+// popResult retrieves and removes the result stored for the code. The
+// result is only returned to the browser holding the nonce the login
+// was started with, other browsers cannot consume it.
+func (p *pendingStore) popResult(code, nonce string) (loginResult, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	result, ok := p.results[code]
+	if ok && result.nonce != "" && subtle.ConstantTimeCompare([]byte(result.nonce), []byte(nonce)) != 1 {
+		return loginResult{}, false
+	}
+	delete(p.results, code)
+
+	if !ok || time.Since(result.created) > pendingResultTTL {
+		return loginResult{}, false
+	}
+
+	return result, true
+}
+
+// cleanup removes expired entries at most once per cleanup interval,
+// the lock must be held by the caller
+func (p *pendingStore) cleanup() {
+	now := time.Now()
+	if now.Sub(p.lastCleanup) < pendingCleanupInterval {
+		return
+	}
+	p.lastCleanup = now
+
+	for id, req := range p.requests {
+		if now.After(req.expires) {
+			delete(p.requests, id)
+		}
+	}
+
+	for code, result := range p.results {
+		if now.Sub(result.created) > pendingResultTTL {
+			delete(p.results, code)
+		}
+	}
+}
+
+func randomHex() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, "Unable to read random bytes")
+	}
+
+	return hex.EncodeToString(raw), nil
+}
@@ -2,30 +2,39 @@ package simple
 
 import (
 	"net/http"
-	"slices"
 	"strings"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	yaml "gopkg.in/yaml.v3"
 
 	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/pwhash"
 )
 
 type AuthSimple struct {
-	EnableBasicAuth bool                           `yaml:"enable_basic_auth"`
-	Users           map[string]string              `yaml:"users"`
-	Groups          map[string][]string            `yaml:"groups"`
-	MFA             map[string][]plugins.MFAConfig `yaml:"mfa"`
+	EnableBasicAuth   bool                           `yaml:"enable_basic_auth"`
+	Users             map[string]User                `yaml:"users"`
+	Groups            map[string][]string            `yaml:"groups"`
+	MFA               map[string][]plugins.MFAConfig `yaml:"mfa"`
+	UsersFile         string                         `yaml:"users_file"`
+	UsersFileFormat   string                         `yaml:"users_file_format"`
+	UsersFileWritable bool                           `yaml:"users_file_writable"`
+	PreferredHash     string                         `yaml:"preferred_hash"`
+	PasswordPolicy    PasswordPolicy                 `yaml:"password_policy"`
 
 	cookie      plugins.CookieConfig
 	cookieStore *sessions.CookieStore
+	store       *userStore
 }
 
 func New(cs *sessions.CookieStore) *AuthSimple {
 	return &AuthSimple{
 		cookieStore: cs,
+		store:       &userStore{},
 	}
 }
 
@@ -52,6 +61,7 @@ func (a *AuthSimple) Configure(yamlSource []byte) error {
 	}
 
 	if envelope.Providers.Simple == nil {
+		a.store.close()
 		return plugins.ErrProviderUnconfigured
 	}
 
@@ -59,10 +69,23 @@ func (a *AuthSimple) Configure(yamlSource []byte) error {
 	a.Users = envelope.Providers.Simple.Users
 	a.Groups = envelope.Providers.Simple.Groups
 	a.MFA = envelope.Providers.Simple.MFA
+	a.UsersFile = envelope.Providers.Simple.UsersFile
+	a.UsersFileFormat = envelope.Providers.Simple.UsersFileFormat
+	a.UsersFileWritable = envelope.Providers.Simple.UsersFileWritable
+	a.PreferredHash = envelope.Providers.Simple.PreferredHash
+	a.PasswordPolicy = envelope.Providers.Simple.PasswordPolicy
 
 	a.cookie = envelope.Cookie
 
-	return nil
+	if a.PreferredHash != "" && !pwhash.CanHash(a.PreferredHash) {
+		return errors.Errorf("Unsupported preferred_hash %q", a.PreferredHash)
+	}
+
+	return a.store.configure(userDatabase{
+		Users:  a.Users,
+		Groups: a.Groups,
+		MFA:    a.MFA,
+	}, a.UsersFile, a.UsersFileFormat, a.UsersFileWritable)
 }
 
 // DetectUser is used to detect a user without a login form from
@@ -74,15 +97,10 @@ func (a AuthSimple) DetectUser(res http.ResponseWriter, r *http.Request) (string
 
 	if a.EnableBasicAuth {
 		if basicUser, basicPass, ok := r.BasicAuth(); ok {
-			for u, p := range a.Users {
-				if u != basicUser {
-					continue
-				}
-				if bcrypt.CompareHashAndPassword([]byte(p), []byte(basicPass)) != nil {
-					continue
-				}
-
+			if err := a.checkPassword(basicUser, basicPass); err == nil {
 				user = basicUser
+			} else if !errors.Is(err, plugins.ErrNoValidUserFound) {
+				return "", nil, err
 			}
 		}
 	}
@@ -99,6 +117,16 @@ func (a AuthSimple) DetectUser(res http.ResponseWriter, r *http.Request) (string
 			return "", nil, plugins.ErrNoValidUserFound
 		}
 
+		// Existing sessions must end when the account is no longer usable
+		u, ok := a.store.user(user)
+		if !ok {
+			return "", nil, plugins.ErrNoValidUserFound
+		}
+
+		if err := u.checkStatus(time.Now()); err != nil {
+			return "", nil, err
+		}
+
 		// We had a cookie, lets renew it
 		sess.Options = a.cookie.GetSessionOpts()
 		if err := sess.Save(r, res); err != nil {
@@ -106,14 +134,7 @@ func (a AuthSimple) DetectUser(res http.ResponseWriter, r *http.Request) (string
 		}
 	}
 
-	groups := []string{}
-	for group, users := range a.Groups {
-		if slices.Contains(users, user) {
-			groups = append(groups, group)
-		}
-	}
-
-	return user, groups, nil
+	return user, a.store.groups(user), nil
 }
 
 // Login is called when the user submits the login form and needs
@@ -126,21 +147,14 @@ func (a AuthSimple) Login(res http.ResponseWriter, r *http.Request) (string, []p
 	username := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "username"}, "-"))
 	password := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "password"}, "-"))
 
-	for u, p := range a.Users {
-		if u != username {
-			continue
-		}
-		if bcrypt.CompareHashAndPassword([]byte(p), []byte(password)) != nil {
-			continue
-		}
-
-		sess, _ := a.cookieStore.Get(r, strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")) // #nosec G104 - On error empty session is returned
-		sess.Options = a.cookie.GetSessionOpts()
-		sess.Values["user"] = u
-		return u, a.MFA[u], sess.Save(r, res)
+	if err := a.checkPassword(username, password); err != nil {
+		return "", nil, err
 	}
 
-	return "", nil, plugins.ErrNoValidUserFound
+	sess, _ := a.cookieStore.Get(r, strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Values["user"] = username
+	return username, a.store.mfa(username), sess.Save(r, res)
 }
 
 // LoginFields needs to return the fields required for this login
@@ -178,3 +192,109 @@ func (a AuthSimple) Logout(res http.ResponseWriter, r *http.Request) (err error)
 // will display an additional field for this provider for the user
 // to fill in their MFA token.
 func (a AuthSimple) SupportsMFA() bool { return true }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a AuthSimple) UsesLoginSession() bool { return true }
+
+// CheckUserStatus returns the current groups of the user or an
+// error when the account must no longer be used. If the user is
+// unknown the plugins.ErrNoValidUserFound needs to be returned.
+func (a AuthSimple) CheckUserStatus(user string) ([]string, error) {
+	u, ok := a.store.user(user)
+	if !ok {
+		return nil, plugins.ErrNoValidUserFound
+	}
+
+	if err := u.checkStatus(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return a.store.groups(user), nil
+}
+
+// CanChangePassword reports whether the password of the given user
+// can be changed through this Authenticator
+func (a AuthSimple) CanChangePassword(user string) bool { return a.store.canWrite(user) }
+
+// ChangePassword verifies the current password of the user and
+// replaces it with the new password. If the current password is
+// not valid the plugins.ErrNoValidUserFound needs to be returned, if
+// the new password is not acceptable a plugins.PasswordPolicyViolation
+func (a AuthSimple) ChangePassword(user, currentPassword, newPassword string) error {
+	if !a.store.canWrite(user) {
+		return errors.New("User is not stored in a writable users file")
+	}
+
+	u, ok := a.store.user(user)
+	if !ok {
+		return plugins.ErrNoValidUserFound
+	}
+
+	valid, err := pwhash.Verify(u.Password, currentPassword)
+	if err != nil || !valid {
+		return plugins.ErrNoValidUserFound
+	}
+
+	if err = a.PasswordPolicy.check(user, newPassword); err != nil {
+		return err
+	}
+
+	scheme := a.PreferredHash
+	if scheme == "" {
+		scheme = pwhash.SchemeBcrypt
+	}
+
+	hash, err := pwhash.Hash(scheme, newPassword)
+	if err != nil {
+		return errors.Wrap(err, "Unable to hash password")
+	}
+
+	return errors.Wrap(a.store.setPassword(user, hash), "Unable to store password")
+}
+
+// checkPassword validates the password of the user against the stored
+// hash and the account status. If the password is valid the hash is
+// replaced with one of the preferred scheme if the user is stored in a
+// writable users file.
+func (a AuthSimple) checkPassword(user, password string) error {
+	u, ok := a.store.user(user)
+	if !ok {
+		return plugins.ErrNoValidUserFound
+	}
+
+	hash := u.Password
+	logger := log.WithFields(log.Fields{"authenticator": a.AuthenticatorID(), "user": user})
+
+	valid, err := pwhash.Verify(hash, password)
+	if err != nil {
+		logger.WithError(err).Error("Unable to verify password hash")
+		return plugins.ErrNoValidUserFound
+	}
+
+	if !valid {
+		return plugins.ErrNoValidUserFound
+	}
+
+	// Only report the account status after a valid password was given
+	// to not disclose information about the account to others
+	if err = u.checkStatus(time.Now()); err != nil {
+		return err
+	}
+
+	if a.PreferredHash != "" && pwhash.Scheme(hash) != a.PreferredHash && a.store.canWrite(user) {
+		newHash, err := pwhash.Hash(a.PreferredHash, password)
+		if err == nil {
+			err = a.store.setPassword(user, newHash)
+		}
+
+		if err != nil {
+			// Login is still valid, we just were not able to upgrade the hash
+			logger.WithError(err).Error("Unable to rehash password")
+		} else {
+			logger.WithField("scheme", a.PreferredHash).Info("Rehashed password")
+		}
+	}
+
+	return nil
+}
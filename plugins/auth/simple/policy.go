@@ -0,0 +1,164 @@
+package simple
+
+import (
+	"bufio"
+	"crypto/sha1" // #nosec G505 - Required to match HaveIBeenPwned hash lists
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const passwordPolicyDefaultMinLength = 8
+
+// PasswordPolicy defines the requirements for passwords set through
+// the password change
+type PasswordPolicy struct {
+	MinLength             int    `yaml:"min_length"`
+	MinCharacterClasses   int    `yaml:"min_character_classes"`
+	BreachedPasswordsFile string `yaml:"breached_passwords_file"`
+}
+
+// check validates the password against the policy and returns a
+// plugins.PasswordPolicyViolation if the password is not acceptable
+func (p PasswordPolicy) check(user, password string) error {
+	minLength := p.MinLength
+	if minLength == 0 {
+		minLength = passwordPolicyDefaultMinLength
+	}
+
+	if len([]rune(password)) < minLength {
+		return plugins.PasswordPolicyViolation{Reason: "Password is too short"}
+	}
+
+	if strings.EqualFold(password, user) {
+		return plugins.PasswordPolicyViolation{Reason: "Password must not match the username"}
+	}
+
+	if p.characterClasses(password) < p.MinCharacterClasses {
+		return plugins.PasswordPolicyViolation{Reason: "Password needs to contain more types of characters (lower case, upper case, digits, special characters)"}
+	}
+
+	if p.BreachedPasswordsFile == "" {
+		return nil
+	}
+
+	breached, err := p.isBreached(password)
+	if err != nil {
+		return err
+	}
+
+	if breached {
+		return plugins.PasswordPolicyViolation{Reason: "Password is known from data breaches"}
+	}
+
+	return nil
+}
+
+func (PasswordPolicy) characterClasses(password string) int {
+	var lower, upper, digit, special int
+
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			special = 1
+		}
+	}
+
+	return lower + upper + digit + special
+}
+
+// isBreached looks up the SHA-1 hash of the password in the breached
+// passwords file
+func (p PasswordPolicy) isBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password)) // #nosec G401 - Required to match HaveIBeenPwned hash lists
+	return p.containsHash(strings.ToUpper(hex.EncodeToString(sum[:])))
+}
+
+// containsHash binary searches the breached passwords file for the
+// hash. The file must contain the upper-case SHA-1 hashes in the
+// HaveIBeenPwned format (`HASH:count`) ordered by hash in order not to
+// read the whole list for every password change.
+func (p PasswordPolicy) containsHash(hash string) (bool, error) {
+	f, err := os.Open(p.BreachedPasswordsFile)
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to open breached passwords file")
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to stat breached passwords file")
+	}
+
+	// Search the lines starting within [lo, hi)
+	lo, hi := int64(0), stat.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, line, err := readLineFrom(f, mid, stat.Size())
+		if err != nil {
+			return false, errors.Wrap(err, "Unable to read breached passwords file")
+		}
+
+		if start >= hi {
+			// No line starts between mid and hi
+			hi = mid
+			continue
+		}
+
+		lineHash, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ":")
+		switch strings.Compare(strings.ToUpper(lineHash), hash) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = start + int64(len(line))
+		default:
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+// readLineFrom returns the first line starting at or after the offset
+// together with its start offset. The returned line includes the line
+// break.
+func readLineFrom(f *os.File, offset, size int64) (int64, string, error) {
+	start := offset
+	if offset > 0 {
+		// Skip the rest of the line the byte before the offset belongs to
+		start = offset - 1
+	}
+
+	rd := bufio.NewReader(io.NewSectionReader(f, start, size-start))
+
+	if offset > 0 {
+		skipped, err := rd.ReadString('\n')
+		start += int64(len(skipped))
+		if err == io.EOF {
+			return start, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	line, err := rd.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+
+	return start, line, nil
+}
@@ -0,0 +1,87 @@
+package simple
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	require.NoError(t, os.WriteFile(breached, []byte(
+		"0000000000000000000000000000000000000001:1\r\n"+
+			"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:100\r\n"+
+			// SHA-1 of "Correct-Horse-1"
+			"CA466851173D2C9EF4A0E79FDC54DA5B5EFDE6CC:12\r\n"+
+			"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:7\r\n"+
+			"letmein-please\r\n",
+	), 0o600))
+
+	p := PasswordPolicy{MinLength: 10, MinCharacterClasses: 3, BreachedPasswordsFile: breached}
+
+	for pass, rejected := range map[string]bool{
+		"Sh0rt!":              true,
+		"alllowercaseletters": true,
+		"AliceAlice1":         true, // matches username
+		"Correct-Horse-1":     true, // breached by hash
+		"Correct-Horse-2":     false,
+	} {
+		err := p.check("alicealice1", pass)
+		if rejected {
+			assert.ErrorAs(t, err, &plugins.PasswordPolicyViolation{}, pass)
+		} else {
+			assert.NoError(t, err, pass)
+		}
+	}
+
+	// Only hashes are matched, not plain text passwords
+	p.MinCharacterClasses = 2
+	assert.NoError(t, p.check("alice", "letmein-please"))
+}
+
+func TestBreachedPasswordsSearch(t *testing.T) {
+	hashes := []string{
+		"0000000000000000000000000000000000000001",
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8",
+		"874572E7A5AE6A49466A6AC578B98ADBA78C6AA6",
+		"CA466851173D2C9EF4A0E79FDC54DA5B5EFDE6CC",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+	}
+
+	var content strings.Builder
+	for i, hash := range hashes {
+		fmt.Fprintf(&content, "%s:%d\r\n", hash, i*1000+1)
+	}
+
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	require.NoError(t, os.WriteFile(breached, []byte(content.String()), 0o600))
+	p := PasswordPolicy{BreachedPasswordsFile: breached}
+
+	for _, hash := range hashes {
+		found, err := p.containsHash(hash)
+		require.NoError(t, err)
+		assert.True(t, found, hash)
+	}
+
+	for _, hash := range []string{
+		"0000000000000000000000000000000000000000",
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD9",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFE",
+	} {
+		found, err := p.containsHash(hash)
+		require.NoError(t, err)
+		assert.False(t, found, hash)
+	}
+
+	// "password" is in the list
+	breachedPass, err := p.isBreached("password")
+	require.NoError(t, err)
+	assert.True(t, breachedPass)
+}
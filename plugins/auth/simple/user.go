@@ -0,0 +1,125 @@
+package simple
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+// User describes an account in the embedded user database. In the
+// configuration it can either be given as the plain password hash or
+// as a mapping containing the additional attributes.
+type User struct {
+	Password     string             `yaml:"password"`
+	Disabled     bool               `yaml:"disabled"`
+	ExpiresAt    *time.Time         `yaml:"expires_at"`
+	DisplayName  string             `yaml:"display_name"`
+	Email        string             `yaml:"email"`
+	AllowedTimes []AllowedTimeRange `yaml:"allowed_times"`
+}
+
+// AllowedTimeRange restricts the times the user is allowed to log in
+type AllowedTimeRange struct {
+	Days     []string `yaml:"days"`
+	From     string   `yaml:"from"`
+	To       string   `yaml:"to"`
+	Timezone string   `yaml:"timezone"`
+}
+
+// UnmarshalYAML supports the plain password hash as well as the
+// mapping with additional attributes
+func (u *User) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*u = User{Password: node.Value}
+		return nil
+	}
+
+	type rawUser User
+	return node.Decode((*rawUser)(u))
+}
+
+// checkStatus returns a LoginFailure when the account must not be
+// used at the given time
+func (u User) checkStatus(now time.Time) error {
+	if u.Disabled {
+		return plugins.NewLoginFailure("account disabled")
+	}
+
+	if u.ExpiresAt != nil && !now.Before(*u.ExpiresAt) {
+		return plugins.NewLoginFailure("account expired")
+	}
+
+	if len(u.AllowedTimes) == 0 {
+		return nil
+	}
+
+	for _, r := range u.AllowedTimes {
+		ok, err := r.contains(now)
+		if err != nil {
+			return errors.Wrap(err, "Invalid allowed_times configuration")
+		}
+
+		if ok {
+			return nil
+		}
+	}
+
+	return plugins.NewLoginFailure("outside allowed time window")
+}
+
+func (a AllowedTimeRange) contains(t time.Time) (bool, error) {
+	if a.Timezone != "" {
+		loc, err := time.LoadLocation(a.Timezone)
+		if err != nil {
+			return false, errors.Wrap(err, "Unable to load timezone")
+		}
+		t = t.In(loc)
+	}
+
+	if len(a.Days) > 0 && !slices.ContainsFunc(a.Days, func(d string) bool {
+		return strings.EqualFold(d, t.Weekday().String()[:3])
+	}) {
+		return false, nil
+	}
+
+	from, err := parseDayMinute(a.From, 0)
+	if err != nil {
+		return false, err
+	}
+
+	to, err := parseDayMinute(a.To, 24*60)
+	if err != nil {
+		return false, err
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return from <= now && now < to, nil
+	}
+
+	// Range spans midnight (i.e. 22:00 - 06:00)
+	return now >= from || now < to, nil
+}
+
+// parseDayMinute converts a HH:MM time into the minute of the day
+func parseDayMinute(v string, fallback int) (int, error) {
+	if v == "" {
+		return fallback, nil
+	}
+
+	if v == "24:00" {
+		return 24 * 60, nil
+	}
+
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, errors.Errorf("Invalid time %q, expected HH:MM", v)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,76 @@
+package simple
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestUserUnmarshal(t *testing.T) {
+	var db userDatabase
+	require.NoError(t, yaml.Unmarshal([]byte(`---
+users:
+  alice: "alicehash"
+  bob:
+    password: "bobhash"
+    disabled: true
+    expires_at: 2024-12-31T00:00:00Z
+    display_name: "Bob"
+    email: "bob@example.com"
+`), &db))
+
+	assert.Equal(t, User{Password: "alicehash"}, db.Users["alice"])
+	assert.Equal(t, "bobhash", db.Users["bob"].Password)
+	assert.True(t, db.Users["bob"].Disabled)
+	assert.Equal(t, "bob@example.com", db.Users["bob"].Email)
+	require.NotNil(t, db.Users["bob"].ExpiresAt)
+	assert.Equal(t, time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC), *db.Users["bob"].ExpiresAt)
+}
+
+func TestUserCheckStatus(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, 6, 5, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	for reason, u := range map[string]User{
+		"":                            {},
+		"account disabled":            {Disabled: true},
+		"account expired":             {ExpiresAt: &past},
+		"outside allowed time window": {AllowedTimes: []AllowedTimeRange{{Days: []string{"sat", "sun"}}, {From: "13:00", To: "18:00"}}},
+		"-future-expiry":              {ExpiresAt: &future},
+		"-weekday":                    {AllowedTimes: []AllowedTimeRange{{Days: []string{"Mon", "Wed"}, From: "08:00", To: "18:00"}}},
+		"-overnight":                  {AllowedTimes: []AllowedTimeRange{{From: "22:00", To: "13:00"}}},
+		"-timezone":                   {AllowedTimes: []AllowedTimeRange{{From: "13:00", To: "15:00", Timezone: "Europe/Berlin"}}},
+	} {
+		err := u.checkStatus(now)
+		if reason == "" || reason[0] == '-' {
+			assert.NoError(t, err, reason)
+			continue
+		}
+		assert.Equal(t, reason, plugins.FailureReason(err, ""))
+	}
+
+	err := User{AllowedTimes: []AllowedTimeRange{{From: "8am"}}}.checkStatus(now)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, plugins.ErrNoValidUserFound)
+}
+
+func TestSetYAMLPasswordWithAttributes(t *testing.T) {
+	raw, err := setYAMLPassword([]byte(`---
+users:
+  bob:
+    password: "oldhash"
+    email: "bob@example.com"
+`), "bob", "newhash")
+	require.NoError(t, err)
+
+	var db userDatabase
+	require.NoError(t, yaml.Unmarshal(raw, &db))
+	assert.Equal(t, User{Password: "newhash", Email: "bob@example.com"}, db.Users["bob"])
+}
@@ -0,0 +1,424 @@
+package simple
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
+)
+
+const (
+	usersFileFormatHtpasswd = "htpasswd"
+	usersFileFormatYAML     = "yaml"
+
+	usersFileReloadDelay = 250 * time.Millisecond
+)
+
+// userDatabase contains the users, groups and MFA configs either
+// from the inline configuration or from the external users file
+type userDatabase struct {
+	Users  map[string]User                `yaml:"users"`
+	Groups map[string][]string            `yaml:"groups"`
+	MFA    map[string][]plugins.MFAConfig `yaml:"mfa"`
+}
+
+// userStore holds the effective user database merged from the inline
+// configuration and the external users file and keeps it up-to-date
+// when the users file changes
+type userStore struct {
+	inline   userDatabase
+	format   string
+	path     string
+	writable bool
+
+	db        userDatabase
+	fileUsers map[string]bool
+	lock      sync.RWMutex
+	watcher   *fsnotify.Watcher
+}
+
+func (u *userStore) configure(inline userDatabase, path, format string, writable bool) error {
+	u.close()
+
+	if format == "" {
+		format = usersFileFormatHtpasswd
+		if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+			format = usersFileFormatYAML
+		}
+	}
+
+	if format != usersFileFormatHtpasswd && format != usersFileFormatYAML {
+		return errors.Errorf("Unsupported users file format %q", format)
+	}
+
+	if path != "" {
+		var err error
+		if path, err = filepath.Abs(path); err != nil {
+			return errors.Wrap(err, "Unable to resolve users file path")
+		}
+	}
+
+	u.lock.Lock()
+	u.inline = inline
+	u.format = format
+	u.path = path
+	u.writable = writable && path != ""
+	u.lock.Unlock()
+
+	if u.path != "" {
+		// Start watching before reading the file in order not to miss
+		// changes made in between
+		if err := u.watch(); err != nil {
+			return err
+		}
+	}
+
+	if err := u.reload(); err != nil {
+		u.close()
+		return err
+	}
+
+	return nil
+}
+
+// close stops watching the users file if it is watched
+func (u *userStore) close() {
+	if u.watcher != nil {
+		u.watcher.Close() // #nosec G104 - Watcher is discarded anyway
+		u.watcher = nil
+	}
+}
+
+func (u *userStore) groups(user string) []string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	groups := []string{}
+	for group, users := range u.db.Groups {
+		if slices.Contains(users, user) {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+func (u *userStore) mfa(user string) []plugins.MFAConfig {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.db.MFA[user]
+}
+
+func (u *userStore) user(name string) (User, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	user, ok := u.db.Users[name]
+	return user, ok
+}
+
+// reload reads the users file, merges it with the inline configuration
+// and replaces the current database. In case the file cannot be read
+// the current database is kept. The caller must not hold the lock.
+func (u *userStore) reload() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	db := userDatabase{
+		Users:  map[string]User{},
+		Groups: map[string][]string{},
+		MFA:    map[string][]plugins.MFAConfig{},
+	}
+
+	var file userDatabase
+	if u.path != "" {
+		var err error
+		if file, err = u.read(); err != nil {
+			return err
+		}
+	}
+
+	for _, src := range []userDatabase{u.inline, file} {
+		for name, user := range src.Users {
+			for _, r := range user.AllowedTimes {
+				if _, err := r.contains(time.Now()); err != nil {
+					return errors.Wrapf(err, "Invalid allowed_times for user %q", name)
+				}
+			}
+
+			db.Users[name] = user
+		}
+
+		for group, users := range src.Groups {
+			for _, user := range users {
+				if !slices.Contains(db.Groups[group], user) {
+					db.Groups[group] = append(db.Groups[group], user)
+				}
+			}
+		}
+
+		for user, cfgs := range src.MFA {
+			db.MFA[user] = cfgs
+		}
+	}
+
+	u.db = db
+	u.fileUsers = map[string]bool{}
+	for user := range file.Users {
+		u.fileUsers[user] = true
+	}
+
+	return nil
+}
+
+func (u *userStore) read() (userDatabase, error) {
+	var db userDatabase
+
+	raw, err := os.ReadFile(u.path)
+	if err != nil {
+		return db, errors.Wrap(err, "Unable to read users file")
+	}
+
+	switch u.format {
+	case usersFileFormatHtpasswd:
+		db.Users = map[string]User{}
+
+		scanner := bufio.NewScanner(bytes.NewReader(raw))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok {
+				return db, errors.New("Invalid line in htpasswd users file")
+			}
+
+			db.Users[user] = User{Password: hash}
+		}
+
+		return db, errors.Wrap(scanner.Err(), "Unable to parse htpasswd users file")
+
+	case usersFileFormatYAML:
+		return db, errors.Wrap(yaml.Unmarshal(raw, &db), "Unable to parse YAML users file")
+	}
+
+	return db, errors.Errorf("Unsupported users file format %q", u.format)
+}
+
+// canWrite reports whether the user is defined in the users file and
+// the users file may be modified
+func (u *userStore) canWrite(user string) bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.writable && u.fileUsers[user]
+}
+
+// setPassword replaces the password hash of the user in the users file
+// and in the current database
+func (u *userStore) setPassword(user, hash string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if !u.writable || !u.fileUsers[user] {
+		return errors.New("User is not stored in a writable users file")
+	}
+
+	raw, err := os.ReadFile(u.path)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read users file")
+	}
+
+	switch u.format {
+	case usersFileFormatHtpasswd:
+		raw, err = setHtpasswdPassword(raw, user, hash)
+	case usersFileFormatYAML:
+		raw, err = setYAMLPassword(raw, user, hash)
+	default:
+		err = errors.Errorf("Unsupported users file format %q", u.format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = filestore.WriteAtomic(u.path, raw); err != nil {
+		return err
+	}
+
+	entry := u.db.Users[user]
+	entry.Password = hash
+	u.db.Users[user] = entry
+
+	return nil
+}
+
+func (u *userStore) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "Unable to create file watcher")
+	}
+
+	// Watch the directory instead of the file itself as editors and
+	// config management tools tend to replace the file instead of
+	// writing into it which would end the watch on the file
+	if err = watcher.Add(filepath.Dir(u.path)); err != nil {
+		watcher.Close() // #nosec G104 - Watcher is discarded anyway
+		return errors.Wrap(err, "Unable to watch users file")
+	}
+
+	resolved, _ := filepath.EvalSymlinks(u.path) // #nosec G104 - Missing file is detected on reload
+
+	u.watcher = watcher
+	go func(path string) {
+		logger := log.WithField("users_file", path)
+
+		// Writing a file causes multiple events (truncate, write, ...) so
+		// we wait for the events to settle before reading the file in
+		// order not to load a partially written file
+		reload := time.AfterFunc(time.Hour, func() {
+			if err := u.reload(); err != nil {
+				logger.WithError(err).Error("Unable to reload users file, keeping previous version")
+				return
+			}
+			logger.Info("Reloaded users file")
+		})
+		reload.Stop()
+		defer reload.Stop()
+
+		for {
+			select {
+			case evt, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if evt.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+					continue
+				}
+
+				// Kubernetes ConfigMaps and similar tools swap a symlink
+				// in the directory instead of touching the file itself so
+				// any change of the resolved path triggers a reload too
+				target, err := filepath.EvalSymlinks(path)
+				if evt.Name != path && (err != nil || target == resolved) {
+					continue
+				}
+				if err == nil {
+					resolved = target
+				}
+
+				reload.Reset(usersFileReloadDelay)
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.WithError(err).Error("Error while watching users file")
+			}
+		}
+	}(u.path)
+
+	return nil
+}
+
+func setHtpasswdPassword(raw []byte, user, hash string) ([]byte, error) {
+	var (
+		buf   = new(bytes.Buffer)
+		found bool
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if lineUser, _, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && lineUser == user {
+			line = strings.Join([]string{user, hash}, ":")
+			found = true
+		}
+		buf.WriteString(line + "\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to parse htpasswd users file")
+	}
+
+	if !found {
+		return nil, errors.New("User not found in htpasswd users file")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func setYAMLPassword(raw []byte, user, hash string) ([]byte, error) {
+	// Work on the node tree in order to keep comments and ordering
+	// of the users file intact
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, errors.Wrap(err, "Unable to parse YAML users file")
+	}
+
+	if len(doc.Content) != 1 {
+		return nil, errors.New("Users file does not contain a document")
+	}
+
+	users := yamlMappingValue(doc.Content[0], "users")
+	if users == nil {
+		return nil, errors.New("Users file does not contain users")
+	}
+
+	entry := yamlMappingValue(users, user)
+	if entry == nil {
+		return nil, errors.New("User not found in YAML users file")
+	}
+
+	if entry.Kind == yaml.MappingNode {
+		// User with attributes, update the password inside
+		if entry = yamlMappingValue(entry, "password"); entry == nil {
+			return nil, errors.New("User in YAML users file has no password")
+		}
+	}
+
+	entry.Kind = yaml.ScalarNode
+	entry.Tag = "!!str"
+	entry.Value = hash
+	entry.Style = yaml.DoubleQuotedStyle
+
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, errors.Wrap(err, "Unable to encode YAML users file")
+	}
+
+	return buf.Bytes(), errors.Wrap(enc.Close(), "Unable to encode YAML users file")
+}
+
+// yamlMappingValue returns the value node for the given key in a
+// mapping node or nil if the key does not exist
+func yamlMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package simple
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestUserStoreMergesInlineAndFile(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.yaml")
+	require.NoError(t, os.WriteFile(usersFile, []byte(`---
+users:
+  alice: "filehash"
+  bob: "bobhash"
+groups:
+  admins: ["bob"]
+mfa:
+  bob:
+    - provider: totp
+`), 0o600))
+
+	s := &userStore{}
+	defer s.close()
+
+	require.NoError(t, s.configure(userDatabase{
+		Users:  map[string]User{"alice": {Password: "inlinehash"}, "carol": {Password: "carolhash"}},
+		Groups: map[string][]string{"admins": {"alice"}},
+	}, usersFile, "", false))
+
+	u, ok := s.user("alice")
+	assert.True(t, ok)
+	assert.Equal(t, "filehash", u.Password)
+
+	_, ok = s.user("carol")
+	assert.True(t, ok)
+
+	assert.Equal(t, []string{"admins"}, s.groups("bob"))
+	assert.Equal(t, []string{"admins"}, s.groups("alice"))
+	assert.Equal(t, []plugins.MFAConfig{{Provider: "totp"}}, s.mfa("bob"))
+}
+
+func TestUserStoreReloadsHtpasswd(t *testing.T) {
+	dir := t.TempDir()
+	usersFile := filepath.Join(dir, "users.htpasswd")
+	require.NoError(t, os.WriteFile(usersFile, []byte("# Comment\nalice:hash1\n"), 0o600))
+
+	s := &userStore{}
+	defer s.close()
+
+	require.NoError(t, s.configure(userDatabase{}, usersFile, "", false))
+
+	u, _ := s.user("alice")
+	assert.Equal(t, "hash1", u.Password)
+
+	// Replace the file atomically as config management would do
+	tmpFile := filepath.Join(dir, "users.tmp")
+	require.NoError(t, os.WriteFile(tmpFile, []byte("alice:hash2\nbob:hash3\n"), 0o600))
+	require.NoError(t, os.Rename(tmpFile, usersFile))
+
+	assert.Eventually(t, func() bool {
+		u, _ := s.user("alice")
+		_, ok := s.user("bob")
+		return u.Password == "hash2" && ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Broken files must not replace the current state
+	require.NoError(t, os.WriteFile(usersFile, []byte("invalid line\n"), 0o600))
+	time.Sleep(2 * usersFileReloadDelay)
+
+	_, ok := s.user("bob")
+	assert.True(t, ok)
+}
+
+func TestUserStoreReloadsSymlinkSwap(t *testing.T) {
+	// Layout of a mounted Kubernetes ConfigMap
+	dir := t.TempDir()
+	writeVersion := func(version, content string) {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, version), 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, version, "users.htpasswd"), []byte(content), 0o600))
+	}
+
+	writeVersion("..v1", "alice:hash1\n")
+	require.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "users.htpasswd"), filepath.Join(dir, "users.htpasswd")))
+
+	s := &userStore{}
+	defer s.close()
+
+	require.NoError(t, s.configure(userDatabase{}, filepath.Join(dir, "users.htpasswd"), "", false))
+
+	u, _ := s.user("alice")
+	assert.Equal(t, "hash1", u.Password)
+
+	// Update the ConfigMap by swapping the data symlink
+	writeVersion("..v2", "alice:hash2\n")
+	require.NoError(t, os.Symlink("..v2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+
+	assert.Eventually(t, func() bool {
+		u, _ := s.user("alice")
+		return u.Password == "hash2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUserStoreSetPassword(t *testing.T) {
+	dir := t.TempDir()
+
+	for file, content := range map[string]string{
+		"users.yaml":     "---\n# Managed users\nusers:\n  alice: \"oldhash\" # Alice\n  bob: \"bobhash\"\n",
+		"users.htpasswd": "# Managed users\nalice:oldhash\nbob:bobhash\n",
+	} {
+		usersFile := filepath.Join(dir, file)
+		require.NoError(t, os.WriteFile(usersFile, []byte(content), 0o640))
+
+		s := &userStore{}
+		require.NoError(t, s.configure(userDatabase{Users: map[string]User{"carol": {Password: "inline"}}}, usersFile, "", true))
+
+		assert.True(t, s.canWrite("alice"), file)
+		assert.False(t, s.canWrite("carol"), file)
+		assert.Error(t, s.setPassword("carol", "newhash"), file)
+
+		require.NoError(t, s.setPassword("alice", "newhash"), file)
+		u, _ := s.user("alice")
+		assert.Equal(t, "newhash", u.Password, file)
+
+		raw, err := os.ReadFile(usersFile) // #nosec G304 - Test file
+		require.NoError(t, err)
+		assert.Contains(t, string(raw), "# Managed users", file)
+		assert.Contains(t, string(raw), "newhash", file)
+		assert.Contains(t, string(raw), "bobhash", file)
+		assert.NotContains(t, string(raw), "oldhash", file)
+
+		st, err := os.Stat(usersFile)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o640), st.Mode().Perm(), file)
+
+		s.close()
+	}
+}
@@ -0,0 +1,378 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	// Register the supported database drivers
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/pwhash"
+)
+
+const defaultQueryTimeout = 5 * time.Second
+
+// drivers maps the driver names accepted in the configuration to the
+// names the drivers are registered with
+var drivers = map[string]string{
+	"mysql":    "mysql",
+	"postgres": "pgx",
+	"sqlite":   "sqlite",
+}
+
+type AuthSQL struct {
+	EnableBasicAuth bool          `yaml:"enable_basic_auth"`
+	Driver          string        `yaml:"driver"`
+	DSN             string        `yaml:"dsn"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	QueryTimeout    time.Duration `yaml:"query_timeout"`
+
+	UserQuery   string `yaml:"user_query"`
+	GroupsQuery string `yaml:"groups_query"`
+	MFAQuery    string `yaml:"mfa_query"`
+
+	cookie      plugins.CookieConfig
+	cookieStore *sessions.CookieStore
+
+	db *dbsql.DB
+}
+
+func New(cs *sessions.CookieStore) *AuthSQL {
+	return &AuthSQL{
+		cookieStore: cs,
+	}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a AuthSQL) AuthenticatorID() string { return "sql" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthSQL) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Cookie    plugins.CookieConfig `yaml:"cookie"`
+		Providers struct {
+			SQL *AuthSQL `yaml:"sql"`
+		} `yaml:"providers"`
+	}{}
+
+	envelope.Cookie = plugins.DefaultCookieConfig()
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.SQL == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.EnableBasicAuth = envelope.Providers.SQL.EnableBasicAuth
+	a.Driver = envelope.Providers.SQL.Driver
+	a.DSN = envelope.Providers.SQL.DSN
+	a.MaxOpenConns = envelope.Providers.SQL.MaxOpenConns
+	a.MaxIdleConns = envelope.Providers.SQL.MaxIdleConns
+	a.ConnMaxLifetime = envelope.Providers.SQL.ConnMaxLifetime
+	a.QueryTimeout = envelope.Providers.SQL.QueryTimeout
+	a.UserQuery = envelope.Providers.SQL.UserQuery
+	a.GroupsQuery = envelope.Providers.SQL.GroupsQuery
+	a.MFAQuery = envelope.Providers.SQL.MFAQuery
+
+	a.cookie = envelope.Cookie
+
+	if a.QueryTimeout == 0 {
+		a.QueryTimeout = defaultQueryTimeout
+	}
+
+	driver, ok := drivers[a.Driver]
+	if !ok {
+		return errors.Errorf("Unsupported driver %q", a.Driver)
+	}
+
+	if a.UserQuery == "" {
+		return errors.New("user_query needs to be set")
+	}
+
+	db, err := dbsql.Open(driver, a.DSN)
+	if err != nil {
+		return errors.Wrap(err, "Unable to open database")
+	}
+
+	db.SetMaxOpenConns(a.MaxOpenConns)
+	db.SetConnMaxLifetime(a.ConnMaxLifetime)
+	if a.MaxIdleConns > 0 {
+		// Zero would disable idle connections instead of using the default
+		db.SetMaxIdleConns(a.MaxIdleConns)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.QueryTimeout)
+	defer cancel()
+
+	if err = db.PingContext(ctx); err != nil {
+		db.Close() // #nosec G104 - Already in error state
+		return errors.Wrap(err, "Unable to connect to database")
+	}
+
+	// On configuration reload the old pool is replaced
+	if a.db != nil {
+		a.db.Close() // #nosec G104 - Old pool is discarded anyway
+	}
+	a.db = db
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a AuthSQL) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	var user string
+
+	if a.EnableBasicAuth {
+		if basicUser, basicPass, ok := r.BasicAuth(); ok {
+			if err := a.checkPassword(r.Context(), basicUser, basicPass); err == nil {
+				user = basicUser
+			} else if !errors.Is(err, plugins.ErrNoValidUserFound) {
+				return "", nil, err
+			}
+		}
+	}
+
+	if user == "" {
+		sess, err := a.cookieStore.Get(r, strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-"))
+		if err != nil {
+			return "", nil, plugins.ErrNoValidUserFound
+		}
+
+		var ok bool
+		user, ok = sess.Values["user"].(string)
+		if !ok {
+			return "", nil, plugins.ErrNoValidUserFound
+		}
+
+		// Existing sessions must end when the user is no longer
+		// returned by the user query
+		if _, err = a.passwordHash(r.Context(), user); err != nil {
+			return "", nil, err
+		}
+
+		// We had a cookie, lets renew it
+		sess.Options = a.cookie.GetSessionOpts()
+		if err := sess.Save(r, res); err != nil {
+			return "", nil, err
+		}
+	}
+
+	groups, err := a.groups(r.Context(), user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return user, groups, nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a AuthSQL) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	username := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "username"}, "-"))
+	password := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "password"}, "-"))
+
+	if err := a.checkPassword(r.Context(), username, password); err != nil {
+		return "", nil, err
+	}
+
+	mfaCfgs, err := a.mfa(r.Context(), username)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sess, _ := a.cookieStore.Get(r, strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Values["user"] = username
+	return username, mfaCfgs, sess.Save(r, res)
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a AuthSQL) LoginFields() (fields []plugins.LoginField) {
+	return []plugins.LoginField{
+		{
+			Label:       "Username",
+			Name:        "username",
+			Placeholder: "Username",
+			Type:        "text",
+		},
+		{
+			Label:       "Password",
+			Name:        "password",
+			Placeholder: "****",
+			Type:        "password",
+		},
+	}
+}
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a AuthSQL) Logout(res http.ResponseWriter, r *http.Request) (err error) {
+	sess, _ := a.cookieStore.Get(r, strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Options.MaxAge = -1 // Instant delete
+	return sess.Save(r, res)
+}
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a AuthSQL) SupportsMFA() bool { return a.MFAQuery != "" }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a AuthSQL) UsesLoginSession() bool { return true }
+
+func (a AuthSQL) checkPassword(ctx context.Context, user, password string) error {
+	if user == "" || password == "" {
+		return plugins.ErrNoValidUserFound
+	}
+
+	hash, err := a.passwordHash(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	match, err := pwhash.Verify(hash, password)
+	if err != nil {
+		log.WithFields(log.Fields{"authenticator": a.AuthenticatorID(), "user": user}).WithError(err).Error("Unable to verify password hash")
+		return plugins.ErrNoValidUserFound
+	}
+
+	if !match {
+		return plugins.ErrNoValidUserFound
+	}
+
+	return nil
+}
+
+// passwordHash executes the user query which needs to return exactly
+// one column containing the password hash of the user
+func (a AuthSQL) passwordHash(ctx context.Context, user string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.QueryTimeout)
+	defer cancel()
+
+	var hash string
+	err := a.db.QueryRowContext(ctx, a.UserQuery, user).Scan(&hash)
+	switch {
+	case err == nil:
+		return hash, nil
+
+	case errors.Is(err, dbsql.ErrNoRows):
+		return "", plugins.ErrNoValidUserFound
+
+	default:
+		return "", errors.Wrap(err, "Unable to execute user query")
+	}
+}
+
+// groups executes the groups query which needs to return one row per
+// group with the group name as the only column
+func (a AuthSQL) groups(ctx context.Context, user string) ([]string, error) {
+	groups := []string{}
+	if a.GroupsQuery == "" {
+		return groups, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.QueryTimeout)
+	defer cancel()
+
+	rows, err := a.db.QueryContext(ctx, a.GroupsQuery, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to execute groups query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var group string
+		if err = rows.Scan(&group); err != nil {
+			return nil, errors.Wrap(err, "Unable to read group")
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, errors.Wrap(rows.Err(), "Unable to read groups")
+}
+
+// mfa executes the MFA query which needs to return one row per MFA
+// config with the provider name and the attributes as JSON object
+// (or NULL if there are none)
+func (a AuthSQL) mfa(ctx context.Context, user string) ([]plugins.MFAConfig, error) {
+	if a.MFAQuery == "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.QueryTimeout)
+	defer cancel()
+
+	rows, err := a.db.QueryContext(ctx, a.MFAQuery, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to execute MFA query")
+	}
+	defer rows.Close()
+
+	var cfgs []plugins.MFAConfig
+	for rows.Next() {
+		var (
+			cfg        plugins.MFAConfig
+			attributes dbsql.NullString
+		)
+
+		if err = rows.Scan(&cfg.Provider, &attributes); err != nil {
+			return nil, errors.Wrap(err, "Unable to read MFA config")
+		}
+
+		if attributes.Valid && attributes.String != "" {
+			if err = json.Unmarshal([]byte(attributes.String), &cfg.Attributes); err != nil {
+				return nil, errors.Wrapf(err, "Unable to decode MFA attributes of user %q", user)
+			}
+			normalizeNumbers(cfg.Attributes)
+		}
+
+		cfgs = append(cfgs, cfg)
+	}
+
+	return cfgs, errors.Wrap(rows.Err(), "Unable to read MFA configs")
+}
+
+// normalizeNumbers converts integral JSON numbers into int values as
+// they would have been decoded from the YAML configuration in order
+// for plugins.MFAConfig.AttributeInt to work
+func normalizeNumbers(attributes map[string]interface{}) {
+	for k, v := range attributes {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) {
+			attributes[k] = int(f)
+		}
+	}
+}
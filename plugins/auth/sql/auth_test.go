@@ -0,0 +1,91 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const testSchema = `
+CREATE TABLE users (username TEXT PRIMARY KEY, password_hash TEXT, active INTEGER);
+CREATE TABLE user_groups (username TEXT, group_name TEXT);
+CREATE TABLE user_mfa (username TEXT, provider TEXT, attributes TEXT);
+
+INSERT INTO users VALUES
+  ('luzifer', '$2a$04$stlpl1OMZJ25JQ/SUIvXNu7sB/CH1sn1mCFIQN3yHxKVqD/oD54qO', 1),
+  ('inactive', '$2a$04$stlpl1OMZJ25JQ/SUIvXNu7sB/CH1sn1mCFIQN3yHxKVqD/oD54qO', 0),
+  ('malformed', '$argon2id$v=19$m=65536,t=0,p=1$c2FsdA$aGFzaA', 1);
+INSERT INTO user_groups VALUES ('luzifer', 'admins'), ('luzifer', 'users');
+INSERT INTO user_mfa VALUES ('luzifer', 'totp', '{"secret": "MZXW6YTBOIFA", "digits": 8}'), ('luzifer', 'duo', NULL);
+`
+
+func TestSQLAuth(t *testing.T) {
+	dbFile := path.Join(t.TempDir(), "users.db")
+
+	db, err := dbsql.Open("sqlite", dbFile)
+	require.NoError(t, err)
+	_, err = db.ExecContext(context.Background(), testSchema)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	a := New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72")))
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  sql:
+    driver: sqlite
+    dsn: "`+dbFile+`"
+    user_query: "SELECT password_hash FROM users WHERE username = ? AND active = 1"
+    groups_query: "SELECT group_name FROM user_groups WHERE username = ? ORDER BY group_name"
+    mfa_query: "SELECT provider, attributes FROM user_mfa WHERE username = ? ORDER BY provider DESC"
+`)))
+
+	login := func(user, pass string) (*httptest.ResponseRecorder, string, []plugins.MFAConfig, error) {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{
+			"sql-username": {user},
+			"sql-password": {pass},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		res := httptest.NewRecorder()
+		u, mfa, err := a.Login(res, r)
+		return res, u, mfa, err
+	}
+
+	res, user, mfa, err := login("luzifer", "password")
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	require.Len(t, mfa, 2)
+	assert.Equal(t, "totp", mfa[0].Provider)
+	assert.Equal(t, "MZXW6YTBOIFA", mfa[0].AttributeString("secret"))
+	assert.Equal(t, 8, mfa[0].AttributeInt("digits"))
+	assert.Equal(t, "duo", mfa[1].Provider)
+
+	// Session cookie from the login is used to detect the user
+	r := httptest.NewRequest("GET", "/auth", nil)
+	for _, c := range res.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	user, groups, err := a.DetectUser(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	assert.Equal(t, []string{"admins", "users"}, groups)
+
+	for _, creds := range [][2]string{{"luzifer", "wrong"}, {"inactive", "password"}, {"unknown", "password"}, {"malformed", "password"}} {
+		_, _, _, err = login(creds[0], creds[1])
+		assert.ErrorIs(t, err, plugins.ErrNoValidUserFound, creds[0])
+	}
+
+	_, _, err = a.DetectUser(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/auth", nil))
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+}
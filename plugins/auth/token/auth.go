@@ -1,9 +1,15 @@
 package token
 
 import (
+	"crypto/sha256"
 	"net/http"
 	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Luzifer/nginx-sso/plugins"
 
@@ -11,12 +17,23 @@ import (
 )
 
 type AuthToken struct {
-	Tokens map[string]string   `yaml:"tokens"`
-	Groups map[string][]string `yaml:"groups"`
+	Tokens         map[string]Token    `yaml:"tokens"`
+	Groups         map[string][]string `yaml:"groups"`
+	LastUsedFile   string              `yaml:"last_used_file"`
+	Sources        []TokenSource       `yaml:"sources"`
+	PersonalTokens PersonalTokenConfig `yaml:"personal_tokens"`
+
+	lastUsed *lastUsedStore
+	personal *personalTokenStore
+	verified *verifiedTokens
 }
 
 func New() *AuthToken {
-	return &AuthToken{}
+	return &AuthToken{
+		lastUsed: &lastUsedStore{},
+		personal: &personalTokenStore{},
+		verified: &verifiedTokens{},
+	}
 }
 
 // AuthenticatorID needs to return an unique string to identify
@@ -44,8 +61,27 @@ func (a *AuthToken) Configure(yamlSource []byte) error {
 
 	a.Tokens = envelope.Providers.Token.Tokens
 	a.Groups = envelope.Providers.Token.Groups
+	a.LastUsedFile = envelope.Providers.Token.LastUsedFile
+	a.Sources = envelope.Providers.Token.Sources
+	a.PersonalTokens = envelope.Providers.Token.PersonalTokens
+
+	if len(a.Sources) == 0 {
+		a.Sources = defaultTokenSources
+	}
+
+	for i, src := range a.Sources {
+		if err := src.validate(); err != nil {
+			return errors.Wrapf(err, "Invalid token source on position %d", i+1)
+		}
+	}
 
-	return nil
+	a.verified.reset()
+
+	if err := a.personal.configure(a.PersonalTokens); err != nil {
+		return errors.Wrap(err, "Unable to configure personal tokens")
+	}
+
+	return errors.Wrap(a.lastUsed.configure(a.LastUsedFile), "Unable to configure last-used store")
 }
 
 // DetectUser is used to detect a user without a login form from
@@ -53,30 +89,39 @@ func (a *AuthToken) Configure(yamlSource []byte) error {
 // If no user was detected the plugins.ErrNoValidUserFound needs to be
 // returned
 func (a AuthToken) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
-	authHeader := r.Header.Get("Authorization")
-
-	if !strings.HasPrefix(authHeader, "Token ") {
-		return "", nil, plugins.ErrNoValidUserFound
+	var suppliedToken string
+	for _, src := range a.Sources {
+		if suppliedToken = src.extract(r); suppliedToken != "" {
+			break
+		}
 	}
 
-	tmp := strings.SplitN(authHeader, " ", 2)
-	suppliedToken := tmp[1]
+	now := time.Now()
 
-	var (
-		user, token string
-		userFound   bool
-	)
-	for user, token = range a.Tokens {
-		if token == suppliedToken {
-			userFound = true
-			break
+	if strings.HasPrefix(suppliedToken, personalTokenPrefix) {
+		entry, err := a.personal.verify(suppliedToken, now)
+		if err != nil {
+			return "", nil, err
 		}
+
+		// The owner might have been disabled or lost groups since
+		// the token was issued
+		plugins.SetIssuingAuthenticator(r, entry.Authenticator)
+		return entry.User, entry.Groups, nil
 	}
 
-	if !userFound {
-		return "", nil, plugins.ErrNoValidUserFound
+	user, err := a.findToken(suppliedToken)
+	if err != nil {
+		return "", nil, err
 	}
 
+	if err = a.Tokens[user].checkRestrictions(now, r.Host, r.Header.Get("X-Origin-URI")); err != nil {
+		return "", nil, err
+	}
+
+	a.lastUsed.record(user, now)
+	log.WithField("token", user).Debug("Token used")
+
 	groups := []string{}
 	for group, users := range a.Groups {
 		if slices.Contains(users, user) {
@@ -112,3 +157,120 @@ func (a AuthToken) Logout(res http.ResponseWriter, r *http.Request) error { retu
 // will display an additional field for this provider for the user
 // to fill in their MFA token.
 func (a AuthToken) SupportsMFA() bool { return false }
+
+// SupportsPersonalTokens reports whether personal access tokens
+// are enabled in the configuration of the Authenticator
+func (a AuthToken) SupportsPersonalTokens() bool { return a.personal.enabled() }
+
+// CreatePersonalToken issues a new token for the user logged in
+// through the given authenticator which is granted the given
+// groups. The cleartext token is returned only once and cannot be
+// retrieved afterwards. If the request is not acceptable a
+// TokenRejected error needs to be returned. When the token is used
+// the authenticator must be passed to SetIssuingAuthenticator.
+func (a AuthToken) CreatePersonalToken(authenticator, user string, groups []string, name string, expiresAt *time.Time) (string, plugins.PersonalToken, error) {
+	return a.personal.create(authenticator, user, groups, name, expiresAt, time.Now())
+}
+
+// ListPersonalTokens returns all tokens issued to the user
+func (a AuthToken) ListPersonalTokens(user string) ([]plugins.PersonalToken, error) {
+	return a.personal.list(user), nil
+}
+
+// RevokePersonalToken removes the token with the given ID issued
+// to the user. If there is no such token ErrTokenNotFound needs
+// to be returned.
+func (a AuthToken) RevokePersonalToken(user, id string) error {
+	return a.personal.revoke(user, id)
+}
+
+// findToken returns the name of the token matching the supplied one.
+// All configured tokens without password hash are checked to not leak
+// which token matched through the response time. Tokens stored with an
+// (intentionally slow) password hash need to be supplied prefixed with
+// their name (`<name>:<token>`) so only that one hash is verified.
+func (a AuthToken) findToken(supplied string) (string, error) {
+	if supplied == "" {
+		return "", plugins.ErrNoValidUserFound
+	}
+
+	if name, ok := a.verified.get(supplied); ok {
+		if _, exists := a.Tokens[name]; exists {
+			return name, nil
+		}
+	}
+
+	var found string
+	for name, token := range a.Tokens {
+		if token.isPasswordHash() {
+			continue
+		}
+
+		match, err := token.matches(supplied)
+		if err != nil {
+			log.WithError(err).WithField("token", name).Error("Unable to verify token")
+			continue
+		}
+
+		if match {
+			found = name
+		}
+	}
+
+	if name, secret, ok := strings.Cut(supplied, ":"); ok && found == "" {
+		if token, exists := a.Tokens[name]; exists && token.isPasswordHash() {
+			match, err := token.matches(secret)
+			if err != nil {
+				log.WithError(err).WithField("token", name).Error("Unable to verify token")
+			}
+
+			if match {
+				found = name
+			}
+		}
+	}
+
+	if found == "" {
+		return "", plugins.ErrNoValidUserFound
+	}
+
+	if a.Tokens[found].isHashed() {
+		a.verified.add(supplied, found)
+	}
+
+	return found, nil
+}
+
+// verifiedTokens caches the names of tokens which have already been
+// verified against their hash in order not to run the (intentionally
+// slow) hash verification on every request
+type verifiedTokens struct {
+	lock   sync.RWMutex
+	tokens map[[sha256.Size]byte]string
+}
+
+func (v *verifiedTokens) add(token, name string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.tokens == nil {
+		v.tokens = map[[sha256.Size]byte]string{}
+	}
+
+	v.tokens[sha256.Sum256([]byte(token))] = name
+}
+
+func (v *verifiedTokens) get(token string) (string, bool) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	name, ok := v.tokens[sha256.Sum256([]byte(token))]
+	return name, ok
+}
+
+func (v *verifiedTokens) reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.tokens = nil
+}
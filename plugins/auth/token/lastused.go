@@ -0,0 +1,75 @@
+package token
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
+)
+
+// lastUsedPersistInterval limits how often the usage of a single
+// token causes the last-used file to be rewritten
+const lastUsedPersistInterval = time.Minute
+
+// lastUsedStore keeps track of the last time each token was used and
+// optionally persists this information into a JSON file
+type lastUsedStore struct {
+	path string
+
+	lock     sync.Mutex
+	lastUsed map[string]time.Time
+	written  map[string]time.Time
+}
+
+func (l *lastUsedStore) configure(path string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.path = path
+	l.lastUsed = map[string]time.Time{}
+	l.written = map[string]time.Time{}
+
+	if path == "" {
+		return nil
+	}
+
+	if err := filestore.LoadJSON(path, &l.lastUsed); err != nil {
+		return errors.Wrap(err, "Unable to load last-used file")
+	}
+
+	for name, t := range l.lastUsed {
+		l.written[name] = t
+	}
+
+	return nil
+}
+
+// record stores the usage of the token and writes the last-used file
+// if the previously written usage is older than the persist interval
+func (l *lastUsedStore) record(name string, t time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.lastUsed == nil {
+		l.lastUsed = map[string]time.Time{}
+		l.written = map[string]time.Time{}
+	}
+
+	l.lastUsed[name] = t
+
+	if l.path == "" || t.Sub(l.written[name]) < lastUsedPersistInterval {
+		return
+	}
+
+	if err := filestore.SaveJSON(l.path, l.lastUsed); err != nil {
+		log.WithError(err).Error("Unable to write token last-used file")
+		return
+	}
+
+	for n, used := range l.lastUsed {
+		l.written[n] = used
+	}
+}
@@ -0,0 +1,253 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
+)
+
+const (
+	personalTokenPrefix            = "nsso_"
+	personalTokenIDLength          = 8
+	personalTokenSecretLength      = 32
+	personalTokenDefaultMaxPerUser = 10
+	personalTokenMaxNameLength     = 64
+	personalTokenLastUsedPrecision = time.Minute
+)
+
+// PersonalTokenConfig configures the personal access tokens users can
+// create for themselves on the account page
+type PersonalTokenConfig struct {
+	StoreFile        string        `yaml:"store_file"`
+	MaxTokensPerUser int           `yaml:"max_tokens_per_user"`
+	MaxLifetime      time.Duration `yaml:"max_lifetime"`
+}
+
+type personalToken struct {
+	ID            string     `json:"id"`
+	User          string     `json:"user"`
+	Authenticator string     `json:"authenticator"`
+	Name          string     `json:"name"`
+	Groups        []string   `json:"groups"`
+	Hash          string     `json:"hash"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	LastUsed      *time.Time `json:"last_used,omitempty"`
+}
+
+func (p personalToken) info() plugins.PersonalToken {
+	return plugins.PersonalToken{
+		ID:        p.ID,
+		Name:      p.Name,
+		CreatedAt: p.CreatedAt,
+		ExpiresAt: p.ExpiresAt,
+		LastUsed:  p.LastUsed,
+	}
+}
+
+// personalTokenStore holds the personal access tokens and persists
+// them into a JSON file. Only a SHA-256 hash of each token is stored.
+type personalTokenStore struct {
+	cfg PersonalTokenConfig
+
+	lock    sync.Mutex
+	tokens  map[string]*personalToken
+	written map[string]time.Time
+}
+
+func (p *personalTokenStore) configure(cfg PersonalTokenConfig) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if cfg.MaxTokensPerUser == 0 {
+		cfg.MaxTokensPerUser = personalTokenDefaultMaxPerUser
+	}
+
+	p.cfg = cfg
+	p.tokens = map[string]*personalToken{}
+	p.written = map[string]time.Time{}
+
+	if cfg.StoreFile == "" {
+		return nil
+	}
+
+	return errors.Wrap(filestore.LoadJSON(cfg.StoreFile, &p.tokens), "Unable to load personal tokens")
+}
+
+func (p *personalTokenStore) enabled() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.cfg.StoreFile != ""
+}
+
+func (p *personalTokenStore) create(authenticator, user string, groups []string, name string, expiresAt *time.Time, now time.Time) (string, plugins.PersonalToken, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.cfg.StoreFile == "" {
+		return "", plugins.PersonalToken{}, plugins.TokenRejected{Reason: "Personal tokens are not enabled"}
+	}
+
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", plugins.PersonalToken{}, plugins.TokenRejected{Reason: "Token name must not be empty"}
+
+	case len(name) > personalTokenMaxNameLength:
+		return "", plugins.PersonalToken{}, plugins.TokenRejected{Reason: "Token name is too long"}
+
+	case expiresAt != nil && !expiresAt.After(now):
+		return "", plugins.PersonalToken{}, plugins.TokenRejected{Reason: "Expiry must be in the future"}
+	}
+
+	if p.cfg.MaxLifetime > 0 {
+		maxExpiry := now.Add(p.cfg.MaxLifetime)
+		if expiresAt == nil || expiresAt.After(maxExpiry) {
+			return "", plugins.PersonalToken{}, plugins.TokenRejected{Reason: "Tokens must expire within " + p.cfg.MaxLifetime.String()}
+		}
+	}
+
+	var count int
+	for _, t := range p.tokens {
+		if t.User == user {
+			count++
+		}
+	}
+	if count >= p.cfg.MaxTokensPerUser {
+		return "", plugins.PersonalToken{}, plugins.TokenRejected{Reason: "Maximum number of tokens reached"}
+	}
+
+	id, err := randomHex(personalTokenIDLength)
+	if err != nil {
+		return "", plugins.PersonalToken{}, err
+	}
+
+	secret, err := randomHex(personalTokenSecretLength)
+	if err != nil {
+		return "", plugins.PersonalToken{}, err
+	}
+
+	token := personalTokenPrefix + id + "_" + secret
+	entry := &personalToken{
+		ID:            id,
+		User:          user,
+		Authenticator: authenticator,
+		Name:          name,
+		Groups:        groups,
+		Hash:          hashPersonalToken(token),
+		CreatedAt:     now.UTC().Truncate(time.Second),
+		ExpiresAt:     expiresAt,
+	}
+
+	p.tokens[id] = entry
+	if err = p.save(); err != nil {
+		delete(p.tokens, id)
+		return "", plugins.PersonalToken{}, err
+	}
+
+	return token, entry.info(), nil
+}
+
+func (p *personalTokenStore) list(user string) []plugins.PersonalToken {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	result := []plugins.PersonalToken{}
+	for _, t := range p.tokens {
+		if t.User == user {
+			result = append(result, t.info())
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+
+	return result
+}
+
+func (p *personalTokenStore) revoke(user, id string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entry, ok := p.tokens[id]
+	if !ok || entry.User != user {
+		return plugins.ErrTokenNotFound
+	}
+
+	delete(p.tokens, id)
+	if err := p.save(); err != nil {
+		p.tokens[id] = entry
+		return err
+	}
+
+	return nil
+}
+
+// verify checks whether the supplied token is a valid personal access
+// token and returns a copy of its entry
+func (p *personalTokenStore) verify(supplied string, now time.Time) (personalToken, error) {
+	rest, ok := strings.CutPrefix(supplied, personalTokenPrefix)
+	if !ok {
+		return personalToken{}, plugins.ErrNoValidUserFound
+	}
+
+	id, _, _ := strings.Cut(rest, "_")
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entry, ok := p.tokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(entry.Hash), []byte(hashPersonalToken(supplied))) != 1 {
+		return personalToken{}, plugins.ErrNoValidUserFound
+	}
+
+	if entry.ExpiresAt != nil && !now.Before(*entry.ExpiresAt) {
+		return personalToken{}, plugins.NewLoginFailure("token expired")
+	}
+
+	used := now.UTC().Truncate(personalTokenLastUsedPrecision)
+	entry.LastUsed = &used
+
+	if !p.written[id].Equal(used) {
+		// Persisting the last usage is best effort, failing to write it
+		// must not deny access
+		if err := p.save(); err != nil {
+			log.WithError(err).Error("Unable to record personal token usage")
+		} else {
+			p.written[id] = used
+		}
+	}
+
+	return *entry, nil
+}
+
+// save writes the tokens into the store file, the lock must be held
+// by the caller
+func (p *personalTokenStore) save() error {
+	return errors.Wrap(filestore.SaveJSON(p.cfg.StoreFile, p.tokens), "Unable to save personal tokens")
+}
+
+func hashPersonalToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, "Unable to generate random token")
+	}
+
+	return hex.EncodeToString(raw), nil
+}
@@ -0,0 +1,65 @@
+package token
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TokenSource describes where to look for the token in the request.
+// Exactly one of the fields needs to be set.
+type TokenSource struct {
+	// Authorization reads the token from the Authorization header
+	// using the given scheme (i.e. `Token` or `Bearer`)
+	Authorization string `yaml:"authorization"`
+	// Header reads the token from the given header (i.e. `X-API-Key`)
+	Header string `yaml:"header"`
+	// Query reads the token from the given query parameter of the
+	// original request passed in the `X-Origin-URI` header
+	Query string `yaml:"query"`
+}
+
+var defaultTokenSources = []TokenSource{{Authorization: "Token"}}
+
+func (t TokenSource) validate() error {
+	set := 0
+	for _, v := range []string{t.Authorization, t.Header, t.Query} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return errors.New("Token source needs exactly one of authorization, header or query")
+	}
+
+	return nil
+}
+
+// extract returns the token from the request or an empty string if
+// the source is not present in the request
+func (t TokenSource) extract(r *http.Request) string {
+	switch {
+	case t.Authorization != "":
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, t.Authorization) {
+			return ""
+		}
+		return strings.TrimSpace(token)
+
+	case t.Header != "":
+		return strings.TrimSpace(r.Header.Get(t.Header))
+
+	case t.Query != "":
+		u, err := url.ParseRequestURI(r.Header.Get("X-Origin-URI"))
+		if err != nil {
+			return ""
+		}
+		return u.Query().Get(t.Query)
+
+	default:
+		return ""
+	}
+}
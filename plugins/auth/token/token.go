@@ -0,0 +1,156 @@
+package token
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/pwhash"
+)
+
+const saltedSHA256Prefix = "$sha256$"
+
+// Token describes a single API token. In the configuration it can
+// either be given as a plain string (the token or its hash) or as a
+// mapping with additional restrictions.
+type Token struct {
+	Token     string     `yaml:"token"`
+	ExpiresAt *time.Time `yaml:"expires_at"`
+	Hosts     []string   `yaml:"hosts"`
+	Paths     []string   `yaml:"paths"`
+}
+
+// UnmarshalYAML allows the token to be specified as a plain string
+// for backwards compatibility
+func (t *Token) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = Token{Token: node.Value}
+		return nil
+	}
+
+	type plain Token
+	return node.Decode((*plain)(t))
+}
+
+// isHashed reports whether the configured token is a hash instead of
+// the cleartext token
+func (t Token) isHashed() bool {
+	return strings.HasPrefix(t.Token, saltedSHA256Prefix) || t.isPasswordHash()
+}
+
+// isPasswordHash reports whether the configured token is a hash of
+// the pwhash package which is expensive to verify
+func (t Token) isPasswordHash() bool {
+	return pwhash.Scheme(t.Token) != ""
+}
+
+// matches checks the supplied token against the configured one. The
+// configured token may be cleartext, a salted SHA-256 hash in the
+// format `$sha256$<salt>$<hex digest of salt+token>` or any hash
+// supported by the pwhash package.
+func (t Token) matches(supplied string) (bool, error) {
+	switch {
+	case strings.HasPrefix(t.Token, saltedSHA256Prefix):
+		parts := strings.Split(strings.TrimPrefix(t.Token, saltedSHA256Prefix), "$")
+		if len(parts) != 2 {
+			return false, errors.Wrap(pwhash.ErrMalformedHash, "Invalid salted SHA-256 token hash")
+		}
+
+		expected, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return false, errors.Wrap(pwhash.ErrMalformedHash, "Invalid salted SHA-256 token hash")
+		}
+
+		sum := sha256.Sum256([]byte(parts[0] + supplied))
+		return subtle.ConstantTimeCompare(sum[:], expected) == 1, nil
+
+	case pwhash.Scheme(t.Token) != "":
+		return pwhash.Verify(t.Token, supplied)
+
+	default:
+		return subtle.ConstantTimeCompare([]byte(t.Token), []byte(supplied)) == 1, nil
+	}
+}
+
+// checkRestrictions validates expiry and scope of the token for the
+// given host and request URI. A plugins.LoginFailure describing the
+// violated restriction is returned if the token must not be used.
+func (t Token) checkRestrictions(now time.Time, host, requestURI string) error {
+	if t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+		return plugins.NewLoginFailure("token expired")
+	}
+
+	if len(t.Hosts) > 0 && !t.matchesHost(host) {
+		return plugins.NewLoginFailure("token not valid for host")
+	}
+
+	if len(t.Paths) > 0 && !t.matchesPath(requestURI) {
+		return plugins.NewLoginFailure("token not valid for path")
+	}
+
+	return nil
+}
+
+// matchesHost checks the host against the allowed hosts, entries
+// starting with `*.` match all subdomains of the given domain
+func (t Token) matchesHost(host string) bool {
+	if h, _, found := strings.Cut(host, ":"); found {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, allowed := range t.Hosts {
+		allowed = strings.ToLower(allowed)
+
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok && strings.HasPrefix(suffix, ".") {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+			continue
+		}
+
+		if host == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesPath checks the path of the request URI against the allowed
+// path prefixes. The prefixes only match on segment boundaries of the
+// cleaned path so neither traversal (`/api/../admin`) nor sibling
+// paths (`/apiary` for `/api`) pass.
+func (t Token) matchesPath(requestURI string) bool {
+	if requestURI == "" {
+		return false
+	}
+
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		return false
+	}
+
+	// The path is already decoded, encoded dots are resolved as well
+	p := path.Clean(u.Path)
+	if strings.Contains(p, "..") {
+		return false
+	}
+
+	for _, prefix := range t.Paths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
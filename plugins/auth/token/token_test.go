@@ -0,0 +1,206 @@
+package token
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+func TestTokenMatches(t *testing.T) {
+	for _, tc := range []struct {
+		stored   string
+		supplied string
+		match    bool
+	}{
+		{"MYTOKEN", "MYTOKEN", true},
+		{"MYTOKEN", "OTHERTOKEN", false},
+		{"$sha256$pepper$56854b5ff8f5092865daa9d03389242ab7e7902b3c8b6449d0ebb77ebfb2d1b6", "MYTOKEN", true},
+		{"$sha256$pepper$56854b5ff8f5092865daa9d03389242ab7e7902b3c8b6449d0ebb77ebfb2d1b6", "OTHERTOKEN", false},
+		{"$2a$04$stlpl1OMZJ25JQ/SUIvXNu7sB/CH1sn1mCFIQN3yHxKVqD/oD54qO", "password", true},
+		{"$2a$04$stlpl1OMZJ25JQ/SUIvXNu7sB/CH1sn1mCFIQN3yHxKVqD/oD54qO", "MYTOKEN", false},
+	} {
+		match, err := Token{Token: tc.stored}.matches(tc.supplied)
+		require.NoError(t, err)
+		assert.Equal(t, tc.match, match, "stored=%q supplied=%q", tc.stored, tc.supplied)
+	}
+
+	_, err := Token{Token: "$sha256$nodigest"}.matches("MYTOKEN")
+	assert.Error(t, err)
+}
+
+func TestTokenRestrictions(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	expiry := now.Add(time.Hour)
+
+	tok := Token{
+		ExpiresAt: &expiry,
+		Hosts:     []string{"api.example.com", "*.internal.example.com"},
+		Paths:     []string{"/api/", "/metrics"},
+	}
+
+	assert.NoError(t, tok.checkRestrictions(now, "api.example.com", "/api/v1/users?page=2"))
+	assert.NoError(t, tok.checkRestrictions(now, "svc.internal.example.com:8443", "/metrics"))
+	assert.NoError(t, tok.checkRestrictions(now, "api.example.com", "/metrics/cpu"))
+	assert.NoError(t, tok.checkRestrictions(now, "api.example.com", "/api"))
+	assert.NoError(t, tok.checkRestrictions(now, "api.example.com", "/api/v1/../v2"))
+
+	for _, err := range []error{
+		tok.checkRestrictions(now.Add(2*time.Hour), "api.example.com", "/api/"),
+		tok.checkRestrictions(now, "www.example.com", "/api/"),
+		tok.checkRestrictions(now, "internal.example.com", "/api/"),
+		tok.checkRestrictions(now, "api.example.com", "/admin"),
+		tok.checkRestrictions(now, "api.example.com", ""),
+		tok.checkRestrictions(now, "api.example.com", "/api/../admin"),
+		tok.checkRestrictions(now, "api.example.com", "/api/%2e%2e/admin"),
+		tok.checkRestrictions(now, "api.example.com", "/api/%2E%2E/%2e%2e/admin"),
+		tok.checkRestrictions(now, "api.example.com", "/metrics/../admin"),
+		tok.checkRestrictions(now, "api.example.com", "/metricsfoo"),
+		tok.checkRestrictions(now, "api.example.com", "/apiary"),
+		tok.checkRestrictions(now, "api.example.com", "/api..x/"),
+	} {
+		assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	}
+
+	assert.Equal(t, "token expired", plugins.FailureReason(tok.checkRestrictions(now.Add(2*time.Hour), "", ""), ""))
+}
+
+func TestDetectUser(t *testing.T) {
+	a := New()
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  token:
+    tokens:
+      plain: "MYTOKEN"
+      hashed:
+        token: "$2a$04$stlpl1OMZJ25JQ/SUIvXNu7sB/CH1sn1mCFIQN3yHxKVqD/oD54qO"
+        hosts: ["api.example.com"]
+    groups:
+      ci: ["hashed"]
+`)))
+
+	for _, tc := range []struct {
+		host, token, user string
+		groups            []string
+		err               error
+	}{
+		{"api.example.com", "MYTOKEN", "plain", []string{}, nil},
+		{"api.example.com", "hashed:password", "hashed", []string{"ci"}, nil},
+		// Second request is served from the verification cache
+		{"api.example.com", "hashed:password", "hashed", []string{"ci"}, nil},
+		{"www.example.com", "hashed:password", "", nil, plugins.ErrNoValidUserFound},
+		// Password hashes are only verified for the named token
+		{"api.example.com", "password", "", nil, plugins.ErrNoValidUserFound},
+		{"api.example.com", "plain:password", "", nil, plugins.ErrNoValidUserFound},
+		{"api.example.com", "unknown", "", nil, plugins.ErrNoValidUserFound},
+	} {
+		r := httptest.NewRequest("GET", "http://"+tc.host+"/auth", nil)
+		r.Header.Set("Authorization", "Token "+tc.token)
+
+		user, groups, err := a.DetectUser(httptest.NewRecorder(), r)
+		if tc.err != nil {
+			assert.ErrorIs(t, err, tc.err)
+			continue
+		}
+
+		require.NoError(t, err)
+		assert.Equal(t, tc.user, user)
+		assert.Equal(t, tc.groups, groups)
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	a := New()
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  token:
+    tokens:
+      ci: "MYTOKEN"
+    sources:
+      - authorization: Bearer
+      - header: X-API-Key
+      - query: token
+`)))
+
+	for name, setup := range map[string]func(*http.Request){
+		"bearer": func(r *http.Request) { r.Header.Set("Authorization", "bearer MYTOKEN") },
+		"header": func(r *http.Request) { r.Header.Set("X-API-Key", "MYTOKEN") },
+		"query":  func(r *http.Request) { r.Header.Set("X-Origin-URI", "/hook?token=MYTOKEN&foo=bar") },
+	} {
+		r := httptest.NewRequest("GET", "/auth", nil)
+		setup(r)
+
+		user, _, err := a.DetectUser(httptest.NewRecorder(), r)
+		require.NoError(t, err, name)
+		assert.Equal(t, "ci", user, name)
+	}
+
+	// Default source is disabled through the explicit configuration
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.Header.Set("Authorization", "Token MYTOKEN")
+	_, _, err := a.DetectUser(httptest.NewRecorder(), r)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	assert.Error(t, New().Configure([]byte(`---
+providers:
+  token:
+    sources:
+      - header: X-API-Key
+        query: token
+`)))
+}
+
+func TestPersonalTokens(t *testing.T) {
+	var (
+		now   = time.Now()
+		store = &personalTokenStore{}
+	)
+
+	require.NoError(t, store.configure(PersonalTokenConfig{
+		StoreFile:        t.TempDir() + "/tokens.json",
+		MaxTokensPerUser: 2,
+		MaxLifetime:      24 * time.Hour,
+	}))
+
+	_, _, err := store.create("simple", "luzifer", nil, "ci", nil, now)
+	assert.Equal(t, "Tokens must expire within 24h0m0s", err.(plugins.TokenRejected).Reason)
+
+	expiry := now.Add(time.Hour)
+	token, info, err := store.create("simple", "luzifer", []string{"admins"}, "ci", &expiry, now)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, personalTokenPrefix+info.ID+"_"))
+
+	entry, err := store.verify(token, now)
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", entry.User)
+	assert.Equal(t, "simple", entry.Authenticator)
+	assert.Equal(t, []string{"admins"}, entry.Groups)
+
+	_, err = store.verify(token+"0", now)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	_, err = store.verify(token, expiry)
+	assert.Equal(t, "token expired", plugins.FailureReason(err, ""))
+
+	// Store is persisted and reloaded on configuration
+	require.NoError(t, store.configure(store.cfg))
+	assert.Len(t, store.list("luzifer"), 1)
+	assert.Empty(t, store.list("someone"))
+
+	_, _, err = store.create("simple", "luzifer", nil, "second", &expiry, now)
+	require.NoError(t, err)
+	_, _, err = store.create("simple", "luzifer", nil, "third", &expiry, now)
+	assert.Error(t, err)
+
+	assert.ErrorIs(t, store.revoke("someone", info.ID), plugins.ErrTokenNotFound)
+	require.NoError(t, store.revoke("luzifer", info.ID))
+
+	_, err = store.verify(token, now)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+}
@@ -0,0 +1,438 @@
+// Package webauthn implements an Authenticator logging in users with
+// passkeys (discoverable WebAuthn credentials) without entering a
+// username. Logged in users register their passkeys on the account page.
+package webauthn
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	libwebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/webauthnstore"
+)
+
+const (
+	endpointPrefix = "/provider/webauthn"
+
+	// Time the user has to finish a passkey ceremony, enforced on the
+	// server as the ceremony is kept in the client side session
+	ceremonyTimeout = 5 * time.Minute
+	loginCodeTTL    = time.Minute
+)
+
+type AuthWebAuthn struct {
+	RPID             string               `yaml:"rp_id"`
+	RPDisplayName    string               `yaml:"rp_display_name"`
+	RPOrigins        []string             `yaml:"rp_origins"`
+	UserVerification string               `yaml:"user_verification"`
+	Store            webauthnstore.Config `yaml:"store"`
+	Groups           map[string][]string  `yaml:"groups"`
+
+	cookie      plugins.CookieConfig
+	cookieStore *sessions.CookieStore
+
+	store    webauthnstore.Store
+	webauthn *libwebauthn.WebAuthn
+
+	challenges *webauthnstore.ChallengeCache
+}
+
+func New(cs *sessions.CookieStore) *AuthWebAuthn {
+	return &AuthWebAuthn{
+		cookieStore: cs,
+		challenges:  webauthnstore.NewChallengeCache(),
+	}
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a *AuthWebAuthn) AuthenticatorID() string { return "webauthn" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (a *AuthWebAuthn) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Cookie    plugins.CookieConfig `yaml:"cookie"`
+		Providers struct {
+			WebAuthn *AuthWebAuthn `yaml:"webauthn"`
+		} `yaml:"providers"`
+	}{}
+
+	envelope.Cookie = plugins.DefaultCookieConfig()
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.WebAuthn == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	a.RPID = envelope.Providers.WebAuthn.RPID
+	a.RPDisplayName = envelope.Providers.WebAuthn.RPDisplayName
+	a.RPOrigins = envelope.Providers.WebAuthn.RPOrigins
+	a.UserVerification = envelope.Providers.WebAuthn.UserVerification
+	a.Store = envelope.Providers.WebAuthn.Store
+	a.Groups = envelope.Providers.WebAuthn.Groups
+
+	if a.RPDisplayName == "" {
+		a.RPDisplayName = "nginx-sso"
+	}
+
+	if a.UserVerification == "" {
+		a.UserVerification = string(protocol.VerificationRequired)
+	}
+
+	switch protocol.UserVerificationRequirement(a.UserVerification) {
+	case protocol.VerificationRequired, protocol.VerificationPreferred, protocol.VerificationDiscouraged:
+	default:
+		return errors.Errorf("Invalid user_verification %q", a.UserVerification)
+	}
+
+	wa, err := libwebauthn.New(&libwebauthn.Config{
+		RPID:          a.RPID,
+		RPDisplayName: a.RPDisplayName,
+		RPOrigins:     a.RPOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.UserVerificationRequirement(a.UserVerification),
+		},
+		Timeouts: libwebauthn.TimeoutsConfig{
+			Login:        libwebauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout},
+			Registration: libwebauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Invalid WebAuthn configuration")
+	}
+
+	store, err := webauthnstore.New(a.Store, "webauthn_credentials")
+	if err != nil {
+		return err
+	}
+
+	a.cookie = envelope.Cookie
+	a.store = store
+	a.webauthn = wa
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the plugins.ErrNoValidUserFound needs to be
+// returned
+func (a *AuthWebAuthn) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	sess, err := a.cookieStore.Get(r, a.sessionName())
+	if err != nil {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	user, ok := sess.Values["user"].(string)
+	if !ok {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	// We had a cookie, lets renew it
+	sess.Options = a.cookie.GetSessionOpts()
+	if err := sess.Save(r, res); err != nil {
+		return "", nil, err
+	}
+
+	return user, a.groupsOf(user), nil
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the plugins.ErrNoValidUserFound
+// needs to be returned
+func (a *AuthWebAuthn) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	code := r.URL.Query().Get("code")
+	if code == "" || r.URL.Query().Get("state") != a.AuthenticatorID() {
+		return "", nil, plugins.ErrNoValidUserFound
+	}
+
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+
+	var (
+		expectedCode, _ = sess.Values["login_code"].(string)
+		user, _         = sess.Values["login_user"].(string)
+		expires, _      = sess.Values["login_expires"].(int64)
+	)
+
+	// The code is only valid once
+	delete(sess.Values, "login_code")
+	delete(sess.Values, "login_user")
+	delete(sess.Values, "login_expires")
+
+	if expectedCode == "" || subtle.ConstantTimeCompare([]byte(expectedCode), []byte(code)) != 1 || time.Now().Unix() > expires {
+		if err := sess.Save(r, res); err != nil {
+			return "", nil, err
+		}
+		return "", nil, plugins.NewLoginFailure("invalid passkey login code")
+	}
+
+	sess.Values["user"] = user
+	return user, nil, sess.Save(r, res)
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a *AuthWebAuthn) LoginFields() (fields []plugins.LoginField) {
+	return []plugins.LoginField{
+		{
+			Action:      "passkeyLogin('" + endpointPrefix + "')",
+			Name:        "login",
+			Placeholder: "Sign in with a passkey",
+			Type:        "button",
+		},
+	}
+}
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a *AuthWebAuthn) Logout(res http.ResponseWriter, r *http.Request) (err error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	sess.Options.MaxAge = -1 // Instant delete
+	return sess.Save(r, res)
+}
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a *AuthWebAuthn) SupportsMFA() bool { return false }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a *AuthWebAuthn) UsesLoginSession() bool { return true }
+
+// ServeEndpoint handles the WebAuthn login ceremony started by the
+// login page
+func (a *AuthWebAuthn) ServeEndpoint(res http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(res, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/login/begin":
+		a.handleLoginBegin(res, r)
+
+	case "/login/finish":
+		a.handleLoginFinish(res, r)
+
+	default:
+		http.NotFound(res, r)
+	}
+}
+
+func (a *AuthWebAuthn) handleLoginBegin(res http.ResponseWriter, r *http.Request) {
+	assertion, ceremony, err := a.webauthn.BeginDiscoverableLogin(
+		libwebauthn.WithUserVerification(protocol.UserVerificationRequirement(a.UserVerification)),
+	)
+	if err != nil {
+		log.WithError(err).Error("Unable to start passkey login")
+		writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	if err = a.saveCeremony(res, r, "login_ceremony", ceremony); err != nil {
+		log.WithError(err).Error("Unable to save passkey login ceremony")
+		writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	writeJSON(res, http.StatusOK, assertion)
+}
+
+func (a *AuthWebAuthn) handleLoginFinish(res http.ResponseWriter, r *http.Request) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+
+	ceremony, err := webauthnstore.PopCeremony(sess, "login_ceremony")
+	if err != nil || !a.challenges.Use(ceremony) {
+		writeJSONError(res, http.StatusBadRequest, "No passkey login in progress")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(http.MaxBytesReader(res, r.Body, 64*1024))
+	if err != nil {
+		log.WithError(err).Debug("Invalid passkey assertion")
+		writeJSONError(res, http.StatusBadRequest, "Invalid passkey response")
+		return
+	}
+
+	var rec *webauthnstore.UserRecord
+	_, credential, err := a.webauthn.ValidatePasskeyLogin(func(_, userHandle []byte) (libwebauthn.User, error) {
+		var lookupErr error
+		if rec, lookupErr = a.store.GetByHandle(userHandle); lookupErr != nil {
+			return nil, lookupErr
+		}
+		if rec == nil {
+			return nil, errors.New("Unknown user handle")
+		}
+		return rec, nil
+	}, *ceremony, parsed)
+	if err != nil {
+		log.WithError(err).Debug("Passkey assertion rejected")
+		writeJSONError(res, http.StatusUnauthorized, "Passkey not accepted")
+		return
+	}
+
+	if credential.Authenticator.CloneWarning {
+		log.WithField("user", rec.User).Warn("Passkey signature counter did not increase, authenticator might be cloned")
+		writeJSONError(res, http.StatusUnauthorized, "Passkey not accepted")
+		return
+	}
+
+	// Persist the updated signature counter and flags
+	now := time.Now()
+	rec.MarkUsed(credential, now)
+
+	if err = a.store.Save(rec); err != nil {
+		log.WithError(err).Error("Unable to update passkey")
+		writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	// Hand the login over to the login handler which performs the
+	// remaining steps of the login (audit log, redirect)
+	code, err := randomString()
+	if err != nil {
+		log.WithError(err).Error("Unable to generate login code")
+		writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	sess.Values["login_code"] = code
+	sess.Values["login_user"] = rec.User
+	sess.Values["login_expires"] = now.Add(loginCodeTTL).Unix()
+
+	if err = sess.Save(r, res); err != nil {
+		log.WithError(err).Error("Unable to save session")
+		writeJSONError(res, http.StatusInternalServerError, "Something went wrong")
+		return
+	}
+
+	writeJSON(res, http.StatusOK, map[string]string{
+		"redirect": "/login?" + url.Values{"code": {code}, "state": {a.AuthenticatorID()}}.Encode(),
+	})
+}
+
+// BeginPasskeyRegistration returns the options to be passed to
+// navigator.credentials.create() for the user and remembers the
+// challenge for FinishPasskeyRegistration
+func (a *AuthWebAuthn) BeginPasskeyRegistration(res http.ResponseWriter, r *http.Request, user string) (interface{}, error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+
+	creation, err := webauthnstore.BeginRegistration(a.webauthn, a.store, sess, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return creation, errors.Wrap(sess.Save(r, res), "Unable to save session")
+}
+
+// FinishPasskeyRegistration verifies the credential created by the
+// browser and stores it under the given name. If the credential is
+// not acceptable a PasskeyRejected error needs to be returned.
+func (a *AuthWebAuthn) FinishPasskeyRegistration(res http.ResponseWriter, r *http.Request, user, name string, response []byte) (plugins.Passkey, error) {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+
+	info, err := webauthnstore.FinishRegistration(a.webauthn, a.store, sess, user, name, response)
+	if saveErr := sess.Save(r, res); saveErr != nil {
+		return plugins.Passkey{}, errors.Wrap(saveErr, "Unable to save session")
+	}
+
+	return info, err
+}
+
+// ListPasskeys returns all passkeys registered by the user
+func (a *AuthWebAuthn) ListPasskeys(user string) ([]plugins.Passkey, error) {
+	return webauthnstore.ListPasskeys(a.store, user)
+}
+
+// RemovePasskey removes the passkey with the given ID registered by
+// the user. If there is no such passkey ErrPasskeyNotFound needs to
+// be returned.
+func (a *AuthWebAuthn) RemovePasskey(user, id string) error {
+	return webauthnstore.RemovePasskey(a.store, user, id)
+}
+
+func (a *AuthWebAuthn) groupsOf(user string) []string {
+	groups := []string{}
+	for group, members := range a.Groups {
+		for _, m := range members {
+			if m == user {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+
+	return groups
+}
+
+// saveCeremony stores the data of the running ceremony in the session
+// of the provider. The session is signed so the challenge cannot be
+// modified by the client.
+func (a *AuthWebAuthn) saveCeremony(res http.ResponseWriter, r *http.Request, key string, ceremony *libwebauthn.SessionData) error {
+	sess, _ := a.cookieStore.Get(r, a.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = a.cookie.GetSessionOpts()
+	if err := webauthnstore.SaveCeremony(sess, key, ceremony); err != nil {
+		return err
+	}
+
+	return errors.Wrap(sess.Save(r, res), "Unable to save session")
+}
+
+func (a *AuthWebAuthn) sessionName() string {
+	return strings.Join([]string{a.cookie.Prefix, a.AuthenticatorID()}, "-")
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		log.WithError(err).Error("Unable to encode JSON response")
+	}
+}
+
+func writeJSONError(res http.ResponseWriter, status int, message string) {
+	writeJSON(res, status, map[string]string{"error": message})
+}
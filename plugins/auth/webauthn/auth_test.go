@@ -0,0 +1,219 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/webauthnstore"
+	"github.com/Luzifer/nginx-sso/plugins/webauthntest"
+)
+
+func newTestAuth(t *testing.T, store string) *AuthWebAuthn {
+	a := New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72")))
+	require.NoError(t, a.Configure([]byte(`---
+providers:
+  webauthn:
+    rp_id: "`+webauthntest.RPID+`"
+    rp_origins: ["`+webauthntest.Origin+`"]
+    groups:
+      admins: [luzifer]
+    store:
+`+store)))
+	return a
+}
+
+func registerPasskey(t *testing.T, a *AuthWebAuthn, b *webauthntest.Browser, ta *webauthntest.Authenticator) {
+	var (
+		options interface{}
+		err     error
+	)
+
+	b.Do(httptest.NewRequest("POST", "/api/account/passkeys/register", nil), func(res http.ResponseWriter, r *http.Request) {
+		options, err = a.BeginPasskeyRegistration(res, r, "luzifer")
+	})
+	require.NoError(t, err)
+
+	var info plugins.Passkey
+	b.Do(httptest.NewRequest("PUT", "/api/account/passkeys/register", nil), func(res http.ResponseWriter, r *http.Request) {
+		info, err = a.FinishPasskeyRegistration(res, r, "luzifer", "Laptop", ta.Create(t, options.(*protocol.CredentialCreation)))
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Laptop", info.Name)
+}
+
+func passkeyLogin(t *testing.T, a *AuthWebAuthn, b *webauthntest.Browser, ta *webauthntest.Authenticator) (*httptest.ResponseRecorder, []byte) {
+	res := b.Do(httptest.NewRequest("POST", "/login/begin", nil), a.ServeEndpoint)
+	require.Equal(t, http.StatusOK, res.Code)
+
+	options := &protocol.CredentialAssertion{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(options))
+	assert.Empty(t, options.Response.AllowedCredentials, "login must be usernameless")
+
+	response := ta.Get(t, options)
+	return b.Do(httptest.NewRequest("POST", "/login/finish", bytes.NewReader(response)), a.ServeEndpoint), response
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	a := newTestAuth(t, "      file: \""+path.Join(t.TempDir(), "webauthn.json")+"\"\n")
+	ta := webauthntest.NewAuthenticator(t, true)
+
+	registerPasskey(t, a, webauthntest.NewBrowser(), ta)
+
+	keys, err := a.ListPasskeys("luzifer")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Nil(t, keys[0].LastUsed)
+
+	// Login from another browser without any cookies
+	b := webauthntest.NewBrowser()
+	res, _ := passkeyLogin(t, a, b, ta)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+
+	var result struct{ Redirect string }
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+
+	var user string
+	b.Do(httptest.NewRequest("GET", result.Redirect, nil), func(res http.ResponseWriter, r *http.Request) {
+		user, _, err = a.Login(res, r)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+
+	var groups []string
+	b.Do(httptest.NewRequest("GET", "/auth", nil), func(res http.ResponseWriter, r *http.Request) {
+		user, groups, err = a.DetectUser(res, r)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "luzifer", user)
+	assert.Equal(t, []string{"admins"}, groups)
+
+	// The login code is only valid once
+	b.Do(httptest.NewRequest("GET", result.Redirect, nil), func(res http.ResponseWriter, r *http.Request) {
+		_, _, err = a.Login(res, r)
+	})
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	keys, err = a.ListPasskeys("luzifer")
+	require.NoError(t, err)
+	assert.NotNil(t, keys[0].LastUsed)
+
+	// Passkey can be removed
+	assert.Equal(t, plugins.ErrPasskeyNotFound, a.RemovePasskey("luzifer", "unknown"))
+	require.NoError(t, a.RemovePasskey("luzifer", keys[0].ID))
+
+	res, _ = passkeyLogin(t, a, b, ta)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestPasskeyReplay(t *testing.T) {
+	a := newTestAuth(t, "      file: \""+path.Join(t.TempDir(), "webauthn.json")+"\"\n")
+	ta := webauthntest.NewAuthenticator(t, true)
+	registerPasskey(t, a, webauthntest.NewBrowser(), ta)
+
+	b := webauthntest.NewBrowser()
+	res := b.Do(httptest.NewRequest("POST", "/login/begin", nil), a.ServeEndpoint)
+	ceremonyCookies := b.Cookies[a.sessionName()]
+
+	options := &protocol.CredentialAssertion{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(options))
+	response := ta.Get(t, options)
+
+	res = b.Do(httptest.NewRequest("POST", "/login/finish", bytes.NewReader(response)), a.ServeEndpoint)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+
+	// Replaying the ceremony cookie with the same response is rejected
+	b.Cookies[a.sessionName()] = ceremonyCookies
+	res = b.Do(httptest.NewRequest("POST", "/login/finish", bytes.NewReader(response)), a.ServeEndpoint)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	// Authenticators must increase their signature counter
+	ta.Counter--
+	res, _ = passkeyLogin(t, a, b, ta)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestCeremonyExpires(t *testing.T) {
+	a := newTestAuth(t, "      file: \""+path.Join(t.TempDir(), "webauthn.json")+"\"\n")
+
+	b := webauthntest.NewBrowser()
+	b.Do(httptest.NewRequest("POST", "/login/begin", nil), a.ServeEndpoint)
+
+	r := httptest.NewRequest("POST", "/login/finish", nil)
+	r.AddCookie(b.Cookies[a.sessionName()])
+	sess, err := a.cookieStore.Get(r, a.sessionName())
+	require.NoError(t, err)
+
+	// The server rejects the ceremony after the timeout
+	ceremony, err := webauthnstore.PopCeremony(sess, "login_ceremony")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(ceremonyTimeout), ceremony.Expires, 5*time.Second)
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	a := newTestAuth(t, "      file: \""+path.Join(t.TempDir(), "webauthn.json")+"\"\n")
+	b := webauthntest.NewBrowser()
+
+	var err error
+	b.Do(httptest.NewRequest("PUT", "/", nil), func(res http.ResponseWriter, r *http.Request) {
+		_, err = a.FinishPasskeyRegistration(res, r, "luzifer", "Laptop", []byte("{}"))
+	})
+	var rejected plugins.PasskeyRejected
+	require.ErrorAs(t, err, &rejected)
+	assert.Equal(t, "No key registration in progress", rejected.Reason)
+
+	b.Do(httptest.NewRequest("PUT", "/", nil), func(res http.ResponseWriter, r *http.Request) {
+		_, err = a.FinishPasskeyRegistration(res, r, "luzifer", " ", []byte("{}"))
+	})
+	require.ErrorAs(t, err, &rejected)
+	assert.Equal(t, "A name is required", rejected.Reason)
+
+	// Ceremony started for another user
+	b.Do(httptest.NewRequest("POST", "/", nil), func(res http.ResponseWriter, r *http.Request) {
+		_, err = a.BeginPasskeyRegistration(res, r, "luzifer")
+	})
+	require.NoError(t, err)
+	require.NoError(t, a.store.Save(&webauthnstore.UserRecord{User: "mallory", Handle: []byte("mallory")}))
+	b.Do(httptest.NewRequest("PUT", "/", nil), func(res http.ResponseWriter, r *http.Request) {
+		_, err = a.FinishPasskeyRegistration(res, r, "mallory", "Laptop", []byte("{}"))
+	})
+	require.ErrorAs(t, err, &rejected)
+}
+
+func TestSQLStore(t *testing.T) {
+	a := newTestAuth(t, "      driver: sqlite\n      dsn: \""+path.Join(t.TempDir(), "sso.db")+"\"\n")
+	ta := webauthntest.NewAuthenticator(t, true)
+	registerPasskey(t, a, webauthntest.NewBrowser(), ta)
+
+	rec, err := a.store.GetByHandle(ta.Handle)
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, "luzifer", rec.User)
+	assert.Len(t, rec.Credentials, 1)
+
+	res, _ := passkeyLogin(t, a, webauthntest.NewBrowser(), ta)
+	assert.Equal(t, http.StatusOK, res.Code, res.Body.String())
+
+	rec, err = a.store.Get("unknown")
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+
+}
+
+func TestLoginIgnoresOtherProviders(t *testing.T) {
+	a := newTestAuth(t, "      file: \""+path.Join(t.TempDir(), "webauthn.json")+"\"\n")
+
+	_, _, err := a.Login(httptest.NewRecorder(), httptest.NewRequest("GET", "/login?"+url.Values{"code": {"abc"}, "state": {"oidc"}}.Encode(), nil))
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
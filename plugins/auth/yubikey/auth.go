@@ -5,21 +5,22 @@ import (
 	"slices"
 	"strings"
 
-	"github.com/GeertJohan/yubigo"
 	"github.com/gorilla/sessions"
 	yaml "gopkg.in/yaml.v3"
 
 	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/yubiotp"
 )
 
 type AuthYubikey struct {
-	ClientID  string              `yaml:"client_id"`
-	SecretKey string              `yaml:"secret_key"`
-	Devices   map[string]string   `yaml:"devices"`
-	Groups    map[string][]string `yaml:"groups"`
+	yubiotp.Config `yaml:",inline"`
+
+	Devices map[string]string   `yaml:"devices"`
+	Groups  map[string][]string `yaml:"groups"`
 
 	cookie      plugins.CookieConfig
 	cookieStore *sessions.CookieStore
+	validator   yubiotp.Validator
 }
 
 func New(cs *sessions.CookieStore) *AuthYubikey {
@@ -54,12 +55,17 @@ func (a *AuthYubikey) Configure(yamlSource []byte) error {
 		return plugins.ErrProviderUnconfigured
 	}
 
-	a.ClientID = envelope.Providers.Yubikey.ClientID
-	a.SecretKey = envelope.Providers.Yubikey.SecretKey
+	a.Config = envelope.Providers.Yubikey.Config
 	a.Devices = envelope.Providers.Yubikey.Devices
 	a.Groups = envelope.Providers.Yubikey.Groups
 
+	validator, err := yubiotp.New(a.Config)
+	if err != nil {
+		return err
+	}
+
 	a.cookie = envelope.Cookie
+	a.validator = validator
 
 	return nil
 }
@@ -104,16 +110,11 @@ func (a AuthYubikey) DetectUser(res http.ResponseWriter, r *http.Request) (strin
 func (a AuthYubikey) Login(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
 	keyInput := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "key-input"}, "-"))
 
-	yubiAuth, err := yubigo.NewYubiAuth(a.ClientID, a.SecretKey)
+	ok, err := a.validator.Verify(keyInput)
 	if err != nil {
 		return "", nil, err
 	}
 
-	_, ok, err := yubiAuth.Verify(keyInput)
-	if err != nil && !strings.Contains(err.Error(), "OTP has wrong length.") {
-		return "", nil, err
-	}
-
 	if !ok {
 		// Not a valid authentication
 		return "", nil, plugins.ErrNoValidUserFound
@@ -160,3 +161,7 @@ func (a AuthYubikey) Logout(res http.ResponseWriter, r *http.Request) (err error
 // will display an additional field for this provider for the user
 // to fill in their MFA token.
 func (a AuthYubikey) SupportsMFA() bool { return false }
+
+// UsesLoginSession reports whether users detected by DetectUser
+// logged in interactively through the login page
+func (a AuthYubikey) UsesLoginSession() bool { return true }
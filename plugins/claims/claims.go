@@ -0,0 +1,45 @@
+// Package claims contains helpers to extract users and groups from
+// the claims of tokens issued by external identity providers.
+package claims
+
+import "strings"
+
+// Value resolves a claim by its name. Nested claims can be
+// addressed using dots (i.e. `realm_access.roles`).
+func Value(claims map[string]interface{}, name string) interface{} {
+	var current interface{} = claims
+
+	for _, part := range strings.Split(name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		if current, ok = m[part]; !ok {
+			return nil
+		}
+	}
+
+	return current
+}
+
+// Strings converts a claim into a list of strings. Lists are
+// taken as they are, strings are split at whitespace as used in the
+// `scope` claim.
+func Strings(v interface{}) []string {
+	result := []string{}
+
+	switch v := v.(type) {
+	case string:
+		result = append(result, strings.Fields(v)...)
+
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok && s != "" {
+				result = append(result, s)
+			}
+		}
+	}
+
+	return result
+}
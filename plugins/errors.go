@@ -5,4 +5,97 @@ import "errors"
 var (
 	ErrProviderUnconfigured = errors.New("No valid configuration found for this provider")
 	ErrNoValidUserFound     = errors.New("No valid users found")
+	ErrTokenNotFound        = errors.New("Token not found")
+	ErrPasskeyNotFound      = errors.New("Passkey not found")
 )
+
+// LoginFailure can be returned instead of ErrNoValidUserFound in
+// order to provide a more specific reason for the audit log. When
+// checked using errors.Is it matches ErrNoValidUserFound.
+type LoginFailure struct {
+	Reason string
+}
+
+// NewLoginFailure creates a LoginFailure with the given reason
+func NewLoginFailure(reason string) error {
+	return LoginFailure{Reason: reason}
+}
+
+func (l LoginFailure) Error() string { return ErrNoValidUserFound.Error() + ": " + l.Reason }
+
+// Is makes the LoginFailure match ErrNoValidUserFound
+func (l LoginFailure) Is(target error) bool { return target == ErrNoValidUserFound }
+
+// FailureReason extracts the reason from a LoginFailure contained in
+// the error chain or returns the fallback if there is none
+func FailureReason(err error, fallback string) string {
+	var lf LoginFailure
+	if errors.As(err, &lf) && lf.Reason != "" {
+		return lf.Reason
+	}
+
+	return fallback
+}
+
+// PasswordPolicyViolation is returned when a new password does not
+// satisfy the password policy. The Reason is displayed to the user.
+type PasswordPolicyViolation struct {
+	Reason string
+}
+
+func (p PasswordPolicyViolation) Error() string { return "Password rejected by policy: " + p.Reason }
+
+// TokenRejected is returned when a personal access token cannot be
+// created with the requested parameters. The Reason is displayed to
+// the user.
+type TokenRejected struct {
+	Reason string
+}
+
+func (t TokenRejected) Error() string { return "Token request rejected: " + t.Reason }
+
+// PasskeyRejected is returned when a passkey cannot be registered.
+// The Reason is displayed to the user.
+type PasskeyRejected struct {
+	Reason string
+}
+
+func (p PasskeyRejected) Error() string { return "Passkey rejected: " + p.Reason }
+
+// LoginChallenge is returned by Login when the backend requires an
+// additional response from the user (i.e. a one-time code) before the
+// login can be completed. The login page prompts the user for the
+// Field and submits it to the Authenticator again.
+type LoginChallenge struct {
+	Authenticator string
+	Message       string
+	Field         LoginField
+}
+
+func (l LoginChallenge) Error() string { return "Login challenge: " + l.Message }
+
+// LoginPending is returned by Login when the login cannot be completed
+// within the request (i.e. the user needs to follow a link sent by
+// mail). The Message is displayed to the user instead of the login
+// form.
+type LoginPending struct {
+	Message string
+}
+
+func (l LoginPending) Error() string { return "Login pending: " + l.Message }
+
+// MFAChallenge is returned by ValidateMFA when the provider requires
+// an additional response from the user (i.e. a security key assertion)
+// after the first factor. The login page prompts the user for the
+// Field, passes the Options to the browser and submits the response
+// to the MFA providers again. If Resend is set the page offers to
+// submit the MFAResendFieldName instead (i.e. to send a new code).
+type MFAChallenge struct {
+	Provider string
+	Message  string
+	Field    LoginField
+	Options  interface{}
+	Resend   bool
+}
+
+func (m MFAChallenge) Error() string { return "MFA challenge: " + m.Message }
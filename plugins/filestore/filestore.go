@@ -0,0 +1,72 @@
+// Package filestore contains helpers for plugins persisting state into
+// local files which need to survive restarts of nginx-sso.
+package filestore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WriteAtomic replaces the file at the given path by writing the
+// content into a temporary file in the same directory and renaming it
+// afterwards. Permissions of an existing file are preserved, new files
+// are created with mode 0600.
+func WriteAtomic(path string, content []byte) error {
+	mode := os.FileMode(0o600)
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "Unable to create temporary file")
+	}
+	defer os.Remove(tmp.Name()) // #nosec G104 - Fails after successful rename
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close() // #nosec G104 - Already in error state
+		return errors.Wrap(err, "Unable to write temporary file")
+	}
+
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close() // #nosec G104 - Already in error state
+		return errors.Wrap(err, "Unable to set file permissions")
+	}
+
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "Unable to close temporary file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path), "Unable to replace file")
+}
+
+// LoadJSON reads the JSON file at the given path into v. A missing
+// file is not treated as an error and leaves v untouched.
+func LoadJSON(path string, v interface{}) error {
+	raw, err := os.ReadFile(path) // #nosec G304 - Path is taken from the configuration
+	switch {
+	case err == nil:
+		// All fine
+
+	case os.IsNotExist(err):
+		return nil
+
+	default:
+		return errors.Wrap(err, "Unable to read file")
+	}
+
+	return errors.Wrap(json.Unmarshal(raw, v), "Unable to decode file")
+}
+
+// SaveJSON atomically writes v as indented JSON to the given path
+func SaveJSON(path string, v interface{}) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode file")
+	}
+
+	return WriteAtomic(path, append(raw, '\n'))
+}
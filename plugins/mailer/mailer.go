@@ -0,0 +1,117 @@
+// Package mailer contains the SMTP client used by plugins sending mails
+// to their users (i.e. login links or codes).
+package mailer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultPort is the submission port used when no port is configured
+	DefaultPort = 587
+
+	defaultSMTPTimeout = 10 * time.Second
+)
+
+// Config describes the mail server the mails are sent through
+type Config struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	// ImplicitTLS connects using TLS (port 465) instead of STARTTLS
+	ImplicitTLS bool `yaml:"implicit_tls"`
+}
+
+// Send delivers a plain text mail to the recipient. When the server
+// supports STARTTLS the connection is upgraded before authenticating.
+func (s Config) Send(to, subject, body string) error {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	tlsConfig := &tls.Config{ServerName: s.Host, MinVersion: tls.VersionTLS12}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	dialer := &net.Dialer{Timeout: defaultSMTPTimeout}
+	if s.ImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Unable to connect to SMTP server")
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(defaultSMTPTimeout)); err != nil {
+		conn.Close() // #nosec G104 - Closing a failed connection
+		return errors.Wrap(err, "Unable to set deadline")
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close() // #nosec G104 - Closing a failed connection
+		return errors.Wrap(err, "Unable to start SMTP session")
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !s.ImplicitTLS {
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return errors.Wrap(err, "Unable to start TLS")
+		}
+	}
+
+	if s.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return errors.Wrap(err, "Unable to authenticate at SMTP server")
+		}
+	}
+
+	if err = c.Mail(s.From); err != nil {
+		return errors.Wrap(err, "Sender rejected")
+	}
+
+	if err = c.Rcpt(to); err != nil {
+		return errors.Wrap(err, "Recipient rejected")
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return errors.Wrap(err, "Unable to start mail data")
+	}
+
+	if _, err = w.Write(buildMessage(s.From, to, subject, body)); err != nil {
+		return errors.Wrap(err, "Unable to write mail")
+	}
+
+	if err = w.Close(); err != nil {
+		return errors.Wrap(err, "Mail rejected")
+	}
+
+	return errors.Wrap(c.Quit(), "Unable to close SMTP session")
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: 8bit",
+	}
+
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	return []byte(fmt.Sprintf("%s\r\n\r\n%s\r\n", strings.Join(headers, "\r\n"), body))
+}
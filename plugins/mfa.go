@@ -1,8 +1,19 @@
 package plugins
 
-import "net/http"
+import (
+	"net/http"
 
-const MFALoginFieldName = "mfa-token"
+	"github.com/gorilla/context"
+)
+
+const (
+	MFALoginFieldName  = "mfa-token"
+	MFAResendFieldName = "resend"
+	// MFARecoveryFieldName is the form field recovery codes are submitted
+	// in, it must not end in MFALoginFieldName as other providers would
+	// otherwise receive the recovery codes as their token
+	MFARecoveryFieldName = "mfa-recovery-code"
+)
 
 type MFAProvider interface {
 	// ProviderID needs to return an unique string to identify
@@ -20,6 +31,32 @@ type MFAProvider interface {
 	ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []MFAConfig) error
 }
 
+// MFAChallengeSender can optionally be implemented by an MFAProvider
+// delivering its challenge out of band (i.e. a code sent by mail).
+// SendChallenge is only called for the challenge shown to the user so
+// nothing is sent for factors the user is not asked for. It returns
+// the challenge to show (i.e. with an updated message) or an error.
+type MFAChallengeSender interface {
+	SendChallenge(r *http.Request, user string, mfaCfgs []MFAConfig, challenge MFAChallenge) error
+}
+
+type mfaLoginIDKey struct{}
+
+// SetMFALoginID attaches the ID of the login waiting for the MFA
+// validation to the request
+func SetMFALoginID(r *http.Request, id string) {
+	context.Set(r, mfaLoginIDKey{}, id)
+}
+
+// MFALoginID returns the ID of the login waiting for the MFA
+// validation. The ID stays the same while the user responds to the
+// challenges of one login and can be used to keep state between the
+// responses. An empty string is returned outside of a login.
+func MFALoginID(r *http.Request) string {
+	id, _ := context.Get(r, mfaLoginIDKey{}).(string)
+	return id
+}
+
 type MFAConfig struct {
 	Provider   string                 `yaml:"provider"`
 	Attributes map[string]interface{} `yaml:"attributes"`
@@ -44,3 +81,20 @@ func (m MFAConfig) AttributeString(key string) string {
 
 	return ""
 }
+
+// RecoveryCodeManager can optionally be implemented by an MFAProvider
+// which issues single-use recovery codes to the users
+type RecoveryCodeManager interface {
+	// GenerateRecoveryCodes replaces all recovery codes of the user by
+	// a new set. The cleartext codes are returned only once and cannot
+	// be retrieved afterwards.
+	GenerateRecoveryCodes(user string) (codes []string, err error)
+
+	// RecoveryCodeStatus returns the number of unused recovery codes of
+	// the user and whether the user is running low on codes
+	RecoveryCodeStatus(user string) (remaining int, low bool, err error)
+
+	// UseRecoveryCode checks the code against the unused recovery codes
+	// of the user and invalidates it if it matches
+	UseRecoveryCode(user, code string) (remaining int, ok bool, err error)
+}
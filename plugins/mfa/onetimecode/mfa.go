@@ -0,0 +1,382 @@
+// Package onetimecode implements an MFA provider sending short numeric
+// codes to the email address or phone of the user after the first
+// factor succeeded.
+package onetimecode
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/mailer"
+)
+
+const (
+	defaultCodeLength     = 6
+	defaultCodeTTL        = 5 * time.Minute
+	defaultMaxAttempts    = 3
+	defaultResendInterval = time.Minute
+	defaultSubject        = "Your login code"
+
+	minCodeLength = 4
+	maxCodeLength = 10
+
+	messageText = "Your login code is %s. It is valid for %d minutes."
+
+	mailBody = `Hello,
+
+your login code is:
+
+%s
+
+The code is valid for %d minutes. If you did not try to log in please
+change your password.
+`
+)
+
+var errResendThrottled = plugins.NewLoginFailure("Please wait before requesting a new code")
+
+type MFAOneTimeCode struct {
+	// Number of digits of the codes
+	CodeLength int `yaml:"code_length"`
+	// Time the user has to enter the code
+	CodeTTL time.Duration `yaml:"code_ttl"`
+	// Number of invalid codes accepted before the login is aborted
+	MaxAttempts int `yaml:"max_attempts"`
+	// Minimum time between two codes sent to the same user
+	ResendInterval time.Duration `yaml:"resend_interval"`
+	// Subject of the mails sent
+	Subject string `yaml:"subject"`
+
+	SMTP *mailer.Config `yaml:"smtp"`
+	SMS  *SMSGateway    `yaml:"sms"`
+
+	lock sync.Mutex
+	// Codes waiting to be entered by the ID of the login
+	pending map[string]*pendingCode
+	// Time the last code was sent by the user
+	lastSent map[string]time.Time
+
+	sendMail func(to, subject, body string) error
+	sendSMS  func(to, message string) error
+}
+
+// pendingCode is a code sent to the user waiting to be entered
+type pendingCode struct {
+	code     string
+	expires  time.Time
+	attempts int
+}
+
+// destination is the address the codes of a user are sent to
+type destination struct {
+	email string
+	phone string
+}
+
+func New() *MFAOneTimeCode {
+	return &MFAOneTimeCode{
+		pending:  map[string]*pendingCode{},
+		lastSent: map[string]time.Time{},
+	}
+}
+
+// ProviderID needs to return an unique string to identify
+// this special MFA provider
+func (m *MFAOneTimeCode) ProviderID() (id string) { return "one_time_code" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (m *MFAOneTimeCode) Configure(yamlSource []byte) (err error) {
+	envelope := struct {
+		MFA struct {
+			OneTimeCode *MFAOneTimeCode `yaml:"one_time_code"`
+		} `yaml:"mfa"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.MFA.OneTimeCode == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	cfg := envelope.MFA.OneTimeCode
+
+	if cfg.SMTP == nil && cfg.SMS == nil {
+		return errors.New("At least one of smtp or sms is required")
+	}
+
+	if cfg.CodeLength == 0 {
+		cfg.CodeLength = defaultCodeLength
+	}
+
+	if cfg.CodeLength < minCodeLength || cfg.CodeLength > maxCodeLength {
+		return errors.Errorf("code_length must be between %d and %d", minCodeLength, maxCodeLength)
+	}
+
+	if cfg.CodeTTL == 0 {
+		cfg.CodeTTL = defaultCodeTTL
+	}
+
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+
+	if cfg.ResendInterval == 0 {
+		cfg.ResendInterval = defaultResendInterval
+	}
+
+	if cfg.Subject == "" {
+		cfg.Subject = defaultSubject
+	}
+
+	m.CodeLength = cfg.CodeLength
+	m.CodeTTL = cfg.CodeTTL
+	m.MaxAttempts = cfg.MaxAttempts
+	m.ResendInterval = cfg.ResendInterval
+	m.Subject = cfg.Subject
+	m.SMTP = cfg.SMTP
+	m.SMS = cfg.SMS
+
+	m.sendMail, m.sendSMS = nil, nil
+
+	if m.SMTP != nil {
+		if m.SMTP.Host == "" || m.SMTP.From == "" {
+			return errors.New("SMTP host and from address are required")
+		}
+
+		if m.SMTP.Port == 0 {
+			m.SMTP.Port = mailer.DefaultPort
+		}
+
+		m.sendMail = m.SMTP.Send
+	}
+
+	if m.SMS != nil {
+		if err := m.SMS.prepare(); err != nil {
+			return errors.Wrap(err, "Invalid SMS gateway")
+		}
+
+		m.sendSMS = m.SMS.send
+	}
+
+	return nil
+}
+
+// ValidateMFA takes the user from the login cookie and performs a
+// validation against the provided MFA configuration for this user
+func (m *MFAOneTimeCode) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []plugins.MFAConfig) error {
+	dest, ok := m.destination(mfaCfgs)
+	loginID := plugins.MFALoginID(r)
+	if !ok || loginID == "" {
+		// Report this provider was not able to verify the MFA request
+		return plugins.ErrNoValidUserFound
+	}
+
+	var (
+		code   = r.FormValue(m.fieldName(plugins.MFALoginFieldName))
+		resend = r.FormValue(m.fieldName(plugins.MFAResendFieldName)) != ""
+	)
+
+	if code != "" && !resend {
+		ok, err := m.checkCode(loginID, code, time.Now())
+		if ok || err != nil {
+			return err
+		}
+		// There is no valid code to check against, a new one is sent
+	}
+
+	// The code is sent by SendChallenge if this challenge is shown
+	return m.challenge(fmt.Sprintf("A code has been sent to %s.", dest.masked()))
+}
+
+// SendChallenge sends a code to the user when the challenge of this
+// provider is shown to the user and there is no code pending for the
+// login or the user requested a new one
+func (m *MFAOneTimeCode) SendChallenge(r *http.Request, user string, mfaCfgs []plugins.MFAConfig, challenge plugins.MFAChallenge) error {
+	dest, ok := m.destination(mfaCfgs)
+	if !ok {
+		return plugins.ErrNoValidUserFound
+	}
+
+	resend := r.FormValue(m.fieldName(plugins.MFAResendFieldName)) != ""
+	return m.sendCode(plugins.MFALoginID(r), user, dest, resend, challenge, time.Now())
+}
+
+// checkCode compares the code with the code sent for the login. It
+// returns false without error if there is no code to compare to.
+func (m *MFAOneTimeCode) checkCode(loginID, code string, now time.Time) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.cleanup(now)
+
+	p, ok := m.pending[loginID]
+	if !ok {
+		return false, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(p.code), []byte(strings.TrimSpace(code))) == 1 {
+		delete(m.pending, loginID)
+		return true, nil
+	}
+
+	p.attempts++
+	if p.attempts >= m.MaxAttempts {
+		delete(m.pending, loginID)
+		return false, plugins.NewLoginFailure("Too many invalid codes")
+	}
+
+	return false, m.challenge("The code is not valid, please try again.")
+}
+
+// sendCode sends a new code for the login unless a code is pending and
+// no new code was requested. Codes are not sent to the same user more
+// often than the resend interval allows.
+func (m *MFAOneTimeCode) sendCode(loginID, user string, dest destination, resend bool, challenge plugins.MFAChallenge, now time.Time) error {
+	code, err := generateCode(m.CodeLength)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	m.cleanup(now)
+
+	_, hasPending := m.pending[loginID]
+	if hasPending && !resend {
+		m.lock.Unlock()
+		return challenge
+	}
+
+	if last, ok := m.lastSent[user]; ok && now.Sub(last) < m.ResendInterval {
+		m.lock.Unlock()
+
+		if !hasPending {
+			// Code was invalidated (i.e. too many attempts) or another
+			// login of the user received a code, no new one can be sent yet
+			return errResendThrottled
+		}
+		return m.challenge("Please wait before requesting a new code.")
+	}
+
+	// Reserve the send before releasing the lock so concurrent logins
+	// cannot send more codes than allowed
+	m.lastSent[user] = now
+	m.lock.Unlock()
+
+	minutes := int(m.CodeTTL.Minutes())
+	if dest.email != "" {
+		err = m.sendMail(dest.email, m.Subject, fmt.Sprintf(mailBody, code, minutes))
+	} else {
+		err = m.sendSMS(dest.phone, fmt.Sprintf(messageText, code, minutes))
+	}
+	if err != nil {
+		// Allow to retry sending the code
+		m.lock.Lock()
+		delete(m.lastSent, user)
+		m.lock.Unlock()
+
+		return errors.Wrap(err, "Unable to send login code")
+	}
+
+	m.lock.Lock()
+	m.pending[loginID] = &pendingCode{code: code, expires: now.Add(m.CodeTTL)}
+	m.lock.Unlock()
+
+	return m.challenge(fmt.Sprintf("A code has been sent to %s.", dest.masked()))
+}
+
+func (m *MFAOneTimeCode) challenge(message string) plugins.MFAChallenge {
+	return plugins.MFAChallenge{
+		Provider: m.ProviderID(),
+		Message:  message,
+		Field: plugins.LoginField{
+			Name:        plugins.MFALoginFieldName,
+			Placeholder: strings.Repeat("0", m.CodeLength),
+			Type:        "text",
+		},
+		Resend: true,
+	}
+}
+
+// cleanup removes expired codes and send times, the lock must be held
+func (m *MFAOneTimeCode) cleanup(now time.Time) {
+	for loginID, p := range m.pending {
+		if now.After(p.expires) {
+			delete(m.pending, loginID)
+		}
+	}
+
+	for user, t := range m.lastSent {
+		if now.Sub(t) >= m.ResendInterval {
+			delete(m.lastSent, user)
+		}
+	}
+}
+
+// destination returns where to send the codes of the user to, only
+// channels configured for the provider are considered
+func (m *MFAOneTimeCode) destination(mfaCfgs []plugins.MFAConfig) (destination, bool) {
+	for _, c := range mfaCfgs {
+		if c.Provider != m.ProviderID() {
+			continue
+		}
+
+		if email := c.AttributeString("email"); email != "" && m.sendMail != nil {
+			return destination{email: email}, true
+		}
+
+		if phone := c.AttributeString("phone"); phone != "" && m.sendSMS != nil {
+			return destination{phone: phone}, true
+		}
+	}
+
+	return destination{}, false
+}
+
+func (m *MFAOneTimeCode) fieldName(name string) string {
+	return strings.Join([]string{m.ProviderID(), name}, "-")
+}
+
+// masked returns the destination in a form which can be shown to
+// the user before the second factor is verified
+func (d destination) masked() string {
+	if d.email != "" {
+		local, domain, ok := strings.Cut(d.email, "@")
+		if !ok || local == "" {
+			return "your email address"
+		}
+		return local[:1] + "***@" + domain
+	}
+
+	if len(d.phone) <= 4 {
+		return "your phone"
+	}
+	return strings.Repeat("*", len(d.phone)-4) + d.phone[len(d.phone)-4:]
+}
+
+func generateCode(length int) (string, error) {
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", errors.Wrap(err, "Unable to generate code")
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+
+	return string(code), nil
+}
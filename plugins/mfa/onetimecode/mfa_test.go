@@ -0,0 +1,210 @@
+package onetimecode
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const testConfig = `---
+mfa:
+  one_time_code:
+    max_attempts: 2
+    smtp:
+      host: smtp.example.com
+      from: login@example.com
+    sms:
+      url: "https://sms.example.com/send"
+`
+
+var (
+	testMFACfgs = []plugins.MFAConfig{{Provider: "one_time_code", Attributes: map[string]interface{}{"email": "jane@example.com"}}}
+	codeRegex   = regexp.MustCompile(`[0-9]{6}`)
+)
+
+func newTestProvider(t *testing.T) (*MFAOneTimeCode, *[]string) {
+	m := New()
+	require.NoError(t, m.Configure([]byte(testConfig)))
+
+	sent := []string{}
+	m.sendMail = func(to, subject, body string) error {
+		sent = append(sent, to+": "+codeRegex.FindString(body))
+		return nil
+	}
+	m.sendSMS = func(to, message string) error {
+		sent = append(sent, to+": "+codeRegex.FindString(message))
+		return nil
+	}
+
+	return m, &sent
+}
+
+func testRequest(loginID, code string, resend bool) *http.Request {
+	form := url.Values{"one_time_code-" + plugins.MFALoginFieldName: {code}}
+	if resend {
+		form.Set("one_time_code-"+plugins.MFAResendFieldName, "1")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	plugins.SetMFALoginID(r, loginID)
+
+	return r
+}
+
+// validateLogin validates the response like the login handler does
+// when the challenge of this provider is shown
+func validateLogin(m *MFAOneTimeCode, loginID, code string, resend bool) error {
+	r := testRequest(loginID, code, resend)
+
+	err := m.ValidateMFA(httptest.NewRecorder(), r, "jane", testMFACfgs)
+
+	var challenge plugins.MFAChallenge
+	if errors.As(err, &challenge) {
+		return m.SendChallenge(r, "jane", testMFACfgs, challenge)
+	}
+	return err
+}
+
+func validate(m *MFAOneTimeCode, code string, resend bool) error {
+	return validateLogin(m, "login-1", code, resend)
+}
+
+func TestConfigure(t *testing.T) {
+	assert.Equal(t, plugins.ErrProviderUnconfigured, New().Configure([]byte("---\n")))
+
+	for _, cfg := range []string{
+		"---\nmfa:\n  one_time_code: {}\n",
+		"---\nmfa:\n  one_time_code:\n    smtp:\n      host: smtp.example.com\n",
+		"---\nmfa:\n  one_time_code:\n    code_length: 3\n    sms:\n      url: https://sms.example.com/\n",
+		"---\nmfa:\n  one_time_code:\n    sms:\n      url: \"{{ .To \"\n",
+	} {
+		assert.Error(t, New().Configure([]byte(cfg)), cfg)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	m, sent := newTestProvider(t)
+
+	// Users without configured destination are not handled
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	assert.Equal(t, plugins.ErrNoValidUserFound, m.ValidateMFA(httptest.NewRecorder(), r, "jane", nil))
+
+	// First factor passed, the code is sent
+	var challenge plugins.MFAChallenge
+	require.ErrorAs(t, validate(m, "", false), &challenge)
+	assert.Equal(t, "A code has been sent to j***@example.com.", challenge.Message)
+	assert.True(t, challenge.Resend)
+	require.Len(t, *sent, 1)
+	code := strings.TrimPrefix((*sent)[0], "jane@example.com: ")
+
+	// Resending is throttled
+	require.ErrorAs(t, validate(m, "", true), &challenge)
+	assert.Equal(t, "Please wait before requesting a new code.", challenge.Message)
+	assert.Len(t, *sent, 1)
+
+	// Invalid code can be retried
+	require.ErrorAs(t, validate(m, "000000", false), &challenge)
+	assert.Equal(t, "The code is not valid, please try again.", challenge.Message)
+
+	require.NoError(t, validate(m, code, false))
+
+	// Codes are single-use, a new code cannot be sent yet
+	err := validate(m, code, false)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.Equal(t, "Please wait before requesting a new code", plugins.FailureReason(err, ""))
+}
+
+func TestAttemptLimit(t *testing.T) {
+	m, sent := newTestProvider(t)
+
+	var challenge plugins.MFAChallenge
+	require.ErrorAs(t, validate(m, "", false), &challenge)
+	require.Len(t, *sent, 1)
+	code := strings.TrimPrefix((*sent)[0], "jane@example.com: ")
+
+	require.ErrorAs(t, validate(m, "000000", false), &challenge)
+
+	err := validate(m, "000000", false)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.Equal(t, "Too many invalid codes", plugins.FailureReason(err, ""))
+
+	// The code was invalidated
+	assert.ErrorIs(t, validate(m, code, false), plugins.ErrNoValidUserFound)
+}
+
+func TestExpiry(t *testing.T) {
+	m, sent := newTestProvider(t)
+
+	var challenge plugins.MFAChallenge
+	require.ErrorAs(t, validate(m, "", false), &challenge)
+	code := strings.TrimPrefix((*sent)[0], "jane@example.com: ")
+
+	m.lock.Lock()
+	m.pending["login-1"].expires = time.Now().Add(-time.Second)
+	m.lastSent["jane"] = time.Now().Add(-m.ResendInterval)
+	m.lock.Unlock()
+
+	// Expired code is rejected and a new one is sent
+	require.ErrorAs(t, validate(m, code, false), &challenge)
+	assert.Len(t, *sent, 2)
+}
+
+func TestCodeBoundToLogin(t *testing.T) {
+	m, sent := newTestProvider(t)
+
+	// Nothing is sent unless the challenge is shown
+	var challenge plugins.MFAChallenge
+	require.ErrorAs(t, m.ValidateMFA(httptest.NewRecorder(), testRequest("login-1", "", false), "jane", testMFACfgs), &challenge)
+	assert.Empty(t, *sent)
+
+	// Without login there is nothing to bind the code to
+	assert.Equal(t, plugins.ErrNoValidUserFound, m.ValidateMFA(httptest.NewRecorder(), testRequest("", "", false), "jane", testMFACfgs))
+
+	require.ErrorAs(t, validateLogin(m, "login-1", "", false), &challenge)
+	require.Len(t, *sent, 1)
+	code := strings.TrimPrefix((*sent)[0], "jane@example.com: ")
+
+	// The code cannot be used for another login of the same user
+	assert.ErrorIs(t, validateLogin(m, "login-2", code, false), plugins.ErrNoValidUserFound)
+	assert.Len(t, *sent, 1)
+
+	require.NoError(t, validateLogin(m, "login-1", code, false))
+}
+
+func TestSMSGateway(t *testing.T) {
+	var received map[string]string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		assert.Equal(t, received["to"], r.URL.Query().Get("to"))
+
+		if received["to"] == "+490" {
+			res.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	gw := &SMSGateway{
+		URL:     srv.URL + "/send?to={{ urlquery .To }}",
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	}
+	require.NoError(t, gw.prepare())
+
+	require.NoError(t, gw.send("+4912345678", `Your "code"`))
+	assert.Equal(t, map[string]string{"to": "+4912345678", "message": `Your "code"`}, received)
+
+	assert.Error(t, gw.send("+490", "Your code"))
+}
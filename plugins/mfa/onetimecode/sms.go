@@ -0,0 +1,114 @@
+package onetimecode
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSMSBody    = `{"to": {{ json .To }}, "message": {{ json .Message }}}`
+	defaultSMSMethod  = http.MethodPost
+	defaultSMSTimeout = 10 * time.Second
+)
+
+// SMSGateway describes a generic HTTP webhook sending the message to
+// the phone of the user. URL and body are Go templates receiving the
+// `.To` and `.Message` fields, the `json` function encodes a value as
+// JSON string and `urlquery` escapes it for the URL.
+type SMSGateway struct {
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+
+	client  *http.Client
+	urlTpl  *template.Template
+	bodyTpl *template.Template
+}
+
+type smsTemplateData struct {
+	To      string
+	Message string
+}
+
+var smsTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		raw, err := json.Marshal(v)
+		return string(raw), err
+	},
+}
+
+func (s *SMSGateway) prepare() (err error) {
+	if s.URL == "" {
+		return errors.New("url is required")
+	}
+
+	if s.Method == "" {
+		s.Method = defaultSMSMethod
+	}
+
+	if s.Body == "" && s.Method != http.MethodGet {
+		s.Body = defaultSMSBody
+	}
+
+	if s.urlTpl, err = template.New("url").Funcs(smsTemplateFuncs).Parse(s.URL); err != nil {
+		return errors.Wrap(err, "Unable to parse url template")
+	}
+
+	if s.bodyTpl, err = template.New("body").Funcs(smsTemplateFuncs).Parse(s.Body); err != nil {
+		return errors.Wrap(err, "Unable to parse body template")
+	}
+
+	s.client = &http.Client{Timeout: defaultSMSTimeout}
+
+	return nil
+}
+
+// send renders the request for the message and submits it to the
+// gateway, any non-2xx status is treated as failure
+func (s *SMSGateway) send(to, message string) error {
+	data := smsTemplateData{To: to, Message: message}
+
+	target := new(bytes.Buffer)
+	if err := s.urlTpl.Execute(target, data); err != nil {
+		return errors.Wrap(err, "Unable to render url")
+	}
+
+	body := new(bytes.Buffer)
+	if err := s.bodyTpl.Execute(body, data); err != nil {
+		return errors.Wrap(err, "Unable to render body")
+	}
+
+	req, err := http.NewRequest(s.Method, target.String(), body)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create request")
+	}
+
+	if body.Len() > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Unable to reach SMS gateway")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512)) // #nosec G104 - Only used for the error message
+		return errors.Errorf("SMS gateway returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package recovery
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
+	"github.com/Luzifer/nginx-sso/plugins/pwhash"
+)
+
+const (
+	// Alphabet without characters easily confused when reading the
+	// codes from paper (0 / o, 1 / l / i)
+	codeAlphabet  = "abcdefghjkmnpqrstuvwxyz23456789"
+	codeLength    = 10
+	codeGroupSize = 5
+
+	defaultCount         = 10
+	defaultWarnThreshold = 3
+)
+
+type MFARecovery struct {
+	// File to store the hashed recovery codes of the users in
+	File string `yaml:"file"`
+	// Number of codes generated at once
+	Count int `yaml:"count"`
+	// Warn the user when this number of codes or less is left
+	WarnThreshold int `yaml:"warn_threshold"`
+
+	lock  sync.Mutex
+	codes map[string][]string
+}
+
+func New() *MFARecovery {
+	return &MFARecovery{codes: map[string][]string{}}
+}
+
+// ProviderID needs to return an unique string to identify
+// this special MFA provider
+func (m *MFARecovery) ProviderID() (id string) { return "recovery" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (m *MFARecovery) Configure(yamlSource []byte) (err error) {
+	envelope := struct {
+		MFA struct {
+			Recovery *MFARecovery `yaml:"recovery"`
+		} `yaml:"mfa"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.MFA.Recovery == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	if envelope.MFA.Recovery.File == "" {
+		return errors.New("mfa.recovery.file is required")
+	}
+
+	m.File = envelope.MFA.Recovery.File
+
+	m.Count = envelope.MFA.Recovery.Count
+	if m.Count <= 0 {
+		m.Count = defaultCount
+	}
+
+	m.WarnThreshold = envelope.MFA.Recovery.WarnThreshold
+	if m.WarnThreshold <= 0 {
+		m.WarnThreshold = defaultWarnThreshold
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.codes = map[string][]string{}
+	return errors.Wrap(filestore.LoadJSON(m.File, &m.codes), "Unable to load recovery codes")
+}
+
+// ValidateMFA takes the user from the login cookie and performs a
+// validation against the provided MFA configuration for this user
+func (m *MFARecovery) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []plugins.MFAConfig) error {
+	// The recovery codes replace any other second factor and therefore
+	// do not need a MFA config, they are only accepted if the user is
+	// required to use a second factor at all
+	if len(mfaCfgs) == 0 {
+		return plugins.ErrNoValidUserFound
+	}
+
+	remaining, used, err := m.UseRecoveryCode(user, r.FormValue(plugins.MFARecoveryFieldName))
+	if err != nil {
+		return err
+	}
+
+	if used {
+		plugins.AddAuditFields(r, map[string]string{"recovery_codes_remaining": strconv.Itoa(remaining)})
+
+		if remaining <= m.WarnThreshold {
+			log.WithFields(log.Fields{
+				"remaining": remaining,
+				"user":      user,
+			}).Warn("User is running out of recovery codes")
+		}
+
+		return nil
+	}
+
+	// Report this provider was not able to verify the MFA request
+	return plugins.ErrNoValidUserFound
+}
+
+// GenerateRecoveryCodes replaces all recovery codes of the user by
+// a new set. The cleartext codes are returned only once and cannot
+// be retrieved afterwards.
+func (m *MFARecovery) GenerateRecoveryCodes(user string) (codes []string, err error) {
+	hashes := make([]string, 0, m.Count)
+
+	for len(codes) < m.Count {
+		code, err := generateCode()
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := pwhash.Hash(pwhash.SchemeArgon2id, code)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to hash recovery code")
+		}
+
+		codes = append(codes, code[:codeGroupSize]+"-"+code[codeGroupSize:])
+		hashes = append(hashes, hash)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	prev, existed := m.codes[user]
+	m.codes[user] = hashes
+
+	if err := m.save(user, prev, existed); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// RecoveryCodeStatus returns the number of unused recovery codes of
+// the user and whether the user is running low on codes
+func (m *MFARecovery) RecoveryCodeStatus(user string) (remaining int, low bool, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	remaining = len(m.codes[user])
+	return remaining, remaining <= m.WarnThreshold, nil
+}
+
+// UseRecoveryCode checks the code against the unused recovery codes
+// of the user and invalidates it if it matches
+func (m *MFARecovery) UseRecoveryCode(user, code string) (remaining int, ok bool, err error) {
+	normalized, ok := normalizeCode(code)
+	if !ok {
+		return 0, false, nil
+	}
+
+	return m.useCode(user, normalized)
+}
+
+// useCode removes the code from the codes of the user and reports
+// whether it was found. The hashes are verified without holding the
+// lock, the matching hash is removed afterwards only if it was not used
+// by a concurrent login in the meantime.
+func (m *MFARecovery) useCode(user, code string) (int, bool, error) {
+	m.lock.Lock()
+	hashes := m.codes[user]
+	m.lock.Unlock()
+
+	var match string
+	for _, hash := range hashes {
+		ok, err := pwhash.Verify(hash, code)
+		if err != nil {
+			return 0, false, errors.Wrap(err, "Unable to verify recovery code")
+		}
+
+		if ok {
+			match = hash
+			break
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	current := m.codes[user]
+	i := slices.Index(current, match)
+	if match == "" || i < 0 {
+		return len(current), false, nil
+	}
+
+	remaining := append(append([]string{}, current[:i]...), current[i+1:]...)
+	m.codes[user] = remaining
+
+	if err := m.save(user, current, true); err != nil {
+		return 0, false, err
+	}
+
+	return len(remaining), true, nil
+}
+
+// save writes the codes to the file and restores the previous codes
+// of the user on error to keep memory and file in sync
+func (m *MFARecovery) save(user string, prev []string, existed bool) error {
+	if len(m.codes[user]) == 0 {
+		delete(m.codes, user)
+	}
+
+	if err := filestore.SaveJSON(m.File, m.codes); err != nil {
+		if existed {
+			m.codes[user] = prev
+		} else {
+			delete(m.codes, user)
+		}
+		return errors.Wrap(err, "Unable to save recovery codes")
+	}
+
+	return nil
+}
+
+func generateCode() (string, error) {
+	alphabetSize := big.NewInt(int64(len(codeAlphabet)))
+
+	code := make([]byte, codeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", errors.Wrap(err, "Unable to generate recovery code")
+		}
+		code[i] = codeAlphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+// normalizeCode removes the formatting users might have copied along
+// with the code and reports whether the input looks like a code
+func normalizeCode(input string) (string, bool) {
+	code := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(input))
+
+	if len(code) != codeLength {
+		return "", false
+	}
+
+	for _, r := range code {
+		if !strings.ContainsRune(codeAlphabet, r) {
+			return "", false
+		}
+	}
+
+	return code, true
+}
@@ -0,0 +1,131 @@
+package recovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+var testMFACfgs = []plugins.MFAConfig{{Provider: "totp", Attributes: map[string]interface{}{"secret": "MZXW6YTBOIFA"}}}
+
+func newTestProvider(t *testing.T, file string) *MFARecovery {
+	m := New()
+	require.NoError(t, m.Configure([]byte("---\nmfa:\n  recovery:\n    file: \""+file+"\"\n    count: 4\n    warn_threshold: 2\n")))
+	return m
+}
+
+func validate(m *MFARecovery, user, token string, mfaCfgs []plugins.MFAConfig) (map[string]string, error) {
+	return validateField(m, plugins.MFARecoveryFieldName, user, token, mfaCfgs)
+}
+
+func validateField(m *MFARecovery, field, user, token string, mfaCfgs []plugins.MFAConfig) (map[string]string, error) {
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{field: {token}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm() // #nosec G104 - Form is valid
+	defer context.Clear(r)
+
+	err := m.ValidateMFA(httptest.NewRecorder(), r, user, mfaCfgs)
+	return plugins.AuditFields(r), err
+}
+
+func TestConfigure(t *testing.T) {
+	assert.Equal(t, plugins.ErrProviderUnconfigured, New().Configure([]byte("---\n")))
+	assert.Error(t, New().Configure([]byte("---\nmfa:\n  recovery: {}\n")))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	file := path.Join(t.TempDir(), "recovery.json")
+	m := newTestProvider(t, file)
+
+	codes, err := m.GenerateRecoveryCodes("luzifer")
+	require.NoError(t, err)
+	require.Len(t, codes, 4)
+
+	remaining, low, err := m.RecoveryCodeStatus("luzifer")
+	require.NoError(t, err)
+	assert.Equal(t, 4, remaining)
+	assert.False(t, low)
+
+	// Codes are only accepted for users required to use MFA
+	_, err = validate(m, "luzifer", codes[0], nil)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+
+	// Codes submitted as token of another provider are ignored
+	_, err = validateField(m, "totp-"+plugins.MFALoginFieldName, "luzifer", codes[0], testMFACfgs)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+
+	// Formatting of the code is ignored
+	fields, err := validate(m, "luzifer", strings.ToUpper(strings.ReplaceAll(codes[0], "-", " ")), testMFACfgs)
+	require.NoError(t, err)
+	assert.Equal(t, "3", fields["recovery_codes_remaining"])
+
+	// Codes are single-use
+	_, err = validate(m, "luzifer", codes[0], testMFACfgs)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+
+	// Codes are bound to the user
+	_, err = validate(m, "other", codes[1], testMFACfgs)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+
+	_, err = validate(m, "luzifer", "123456", testMFACfgs)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+
+	// Used codes stay invalid after restarts
+	m = newTestProvider(t, file)
+	_, err = validate(m, "luzifer", codes[0], testMFACfgs)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+
+	_, err = validate(m, "luzifer", codes[1], testMFACfgs)
+	require.NoError(t, err)
+
+	remaining, low, err = m.RecoveryCodeStatus("luzifer")
+	require.NoError(t, err)
+	assert.Equal(t, 2, remaining)
+	assert.True(t, low)
+
+	// Generating new codes invalidates the old ones
+	_, err = m.GenerateRecoveryCodes("luzifer")
+	require.NoError(t, err)
+	_, err = validate(m, "luzifer", codes[2], testMFACfgs)
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
+
+func TestConcurrentUse(t *testing.T) {
+	m := newTestProvider(t, path.Join(t.TempDir(), "recovery.json"))
+
+	codes, err := m.GenerateRecoveryCodes("luzifer")
+	require.NoError(t, err)
+
+	var (
+		used int32
+		wg   sync.WaitGroup
+	)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := validate(m, "luzifer", codes[0], testMFACfgs); err == nil {
+				atomic.AddInt32(&used, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), used, "code must only be accepted once")
+
+	remaining, _, err := m.RecoveryCodeStatus("luzifer")
+	require.NoError(t, err)
+	assert.Equal(t, 3, remaining)
+}
@@ -1,54 +1,151 @@
 package totp
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
 
 	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
 )
 
-type MFATOTP struct{}
+const defaultStateFileName = "totp-state.json"
+
+type MFATOTP struct {
+	// File to persist the last accepted time-step of each user / secret
+	// to, defaults to a file next to the MFA store
+	StateFile string `yaml:"state_file"`
+
+	lock      sync.Mutex
+	lastSteps map[string]int64
+}
 
 // ProviderID needs to return an unique string to identify
 // this special MFA provider
-func (m MFATOTP) ProviderID() (id string) {
+func (m *MFATOTP) ProviderID() (id string) {
 	return "totp"
 }
 
 func New() *MFATOTP {
-	return &MFATOTP{}
+	return &MFATOTP{lastSteps: map[string]int64{}}
 }
 
 // Configure loads the configuration for the Authenticator from the
 // global config.yaml file which is passed as a byte-slice.
 // If no configuration for the Authenticator is supplied the function
 // needs to return the plugins.ErrProviderUnconfigured
-func (m MFATOTP) Configure(yamlSource []byte) (err error) { return nil }
+func (m *MFATOTP) Configure(yamlSource []byte) (err error) {
+	envelope := struct {
+		MFA struct {
+			TOTP *MFATOTP `yaml:"totp"`
+		} `yaml:"mfa"`
+		MFAStore struct {
+			File string `yaml:"file"`
+		} `yaml:"mfa_store"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	// The provider does not need a configuration, the secrets are
+	// stored in the MFA configs of the users
+	m.StateFile = ""
+	if envelope.MFA.TOTP != nil {
+		m.StateFile = envelope.MFA.TOTP.StateFile
+	}
+
+	if m.StateFile == "" && envelope.MFAStore.File != "" {
+		m.StateFile = filepath.Join(filepath.Dir(envelope.MFAStore.File), defaultStateFileName)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.lastSteps = map[string]int64{}
+	if m.StateFile == "" {
+		log.Warn("Neither mfa.totp.state_file nor mfa_store.file is set, used TOTP codes are accepted again after a restart")
+		return nil
+	}
+
+	return errors.Wrap(filestore.LoadJSON(m.StateFile, &m.lastSteps), "Unable to load TOTP state")
+}
 
 // ValidateMFA takes the user from the login cookie and performs a
 // validation against the provided MFA configuration for this user
-func (m MFATOTP) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []plugins.MFAConfig) error {
+func (m *MFATOTP) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []plugins.MFAConfig) error {
+	var configured, submitted, replayed bool
+
 	// Look for mfaConfigs with own provider name
 	for _, c := range mfaCfgs {
 		// Provider has been renamed, keep "google" for backwards compatibility
 		if c.Provider != m.ProviderID() && c.Provider != "google" {
 			continue
 		}
+		configured = true
 
-		token, err := m.exec(c)
+		secret, opts, err := m.opts(c)
 		if err != nil {
 			return errors.Wrap(err, "Generating the MFA token failed")
 		}
 
 		for key, values := range r.Form {
-			if strings.HasSuffix(key, plugins.MFALoginFieldName) && values[0] == token {
-				return nil
+			if !strings.HasSuffix(key, plugins.MFALoginFieldName) || values[0] == "" {
+				continue
+			}
+			submitted = true
+
+			step, drift, err := m.match(secret, opts, values[0], time.Now())
+			if err != nil {
+				return errors.Wrap(err, "Generating the MFA token failed")
 			}
+
+			if drift == nil {
+				continue
+			}
+
+			ok, err := m.useStep(m.stateKey(user, secret), step)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				replayed = true
+				continue
+			}
+
+			plugins.AddAuditFields(r, map[string]string{"totp_drift": strconv.FormatInt(*drift, 10)})
+			return nil
+		}
+	}
+
+	if replayed {
+		return plugins.NewLoginFailure("TOTP code already used")
+	}
+
+	if configured && !submitted {
+		// The login form of the authenticator had no MFA field or it
+		// was left empty, ask for the code after the first factor
+		return plugins.MFAChallenge{
+			Provider: m.ProviderID(),
+			Message:  "Please enter the code shown by your authenticator app.",
+			Field: plugins.LoginField{
+				Name:        plugins.MFALoginFieldName,
+				Placeholder: "123456",
+				Type:        "text",
+			},
 		}
 	}
 
@@ -56,7 +153,66 @@ func (m MFATOTP) ValidateMFA(res http.ResponseWriter, r *http.Request, user stri
 	return plugins.ErrNoValidUserFound
 }
 
-func (m MFATOTP) exec(c plugins.MFAConfig) (string, error) {
+// match checks the code against the time-steps within the skew window
+// and returns the matching time-step together with its distance to the
+// current time-step. The drift is nil if no time-step matched.
+func (m *MFATOTP) match(secret string, opts totp.ValidateOpts, code string, now time.Time) (int64, *int64, error) {
+	current := now.Unix() / int64(opts.Period)
+
+	for drift := -int64(opts.Skew); drift <= int64(opts.Skew); drift++ {
+		step := current + drift
+
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*int64(opts.Period), 0), opts)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, &drift, nil
+		}
+	}
+
+	return 0, nil, nil
+}
+
+// useStep stores the time-step as the last accepted one and reports
+// whether it is newer than the previously accepted time-step. Accepting
+// each time-step only once prevents replaying observed codes.
+func (m *MFATOTP) useStep(key string, step int64) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	prev, existed := m.lastSteps[key]
+	if existed && step <= prev {
+		return false, nil
+	}
+
+	m.lastSteps[key] = step
+	if m.StateFile == "" {
+		return true, nil
+	}
+
+	if err := filestore.SaveJSON(m.StateFile, m.lastSteps); err != nil {
+		// Keep memory and file in sync
+		if existed {
+			m.lastSteps[key] = prev
+		} else {
+			delete(m.lastSteps, key)
+		}
+		return false, errors.Wrap(err, "Unable to save TOTP state")
+	}
+
+	return true, nil
+}
+
+// stateKey identifies the user / secret combination without storing
+// the secret in the state file
+func (m *MFATOTP) stateKey(user, secret string) string {
+	h := sha256.Sum256([]byte(user + "\x00" + secret))
+	return hex.EncodeToString(h[:])
+}
+
+func (m *MFATOTP) opts(c plugins.MFAConfig) (string, totp.ValidateOpts, error) {
 	secret := c.AttributeString("secret")
 
 	// By default use Google Authenticator compatible settings
@@ -88,7 +244,7 @@ func (m MFATOTP) exec(c plugins.MFAConfig) (string, error) {
 		case "sha512":
 			generatorOpts.Algorithm = otp.AlgorithmSHA512
 		default:
-			return "", errors.Errorf("Unsupported algorithm %q", algorithm)
+			return "", generatorOpts, errors.Errorf("Unsupported algorithm %q", algorithm)
 		}
 	}
 
@@ -96,5 +252,5 @@ func (m MFATOTP) exec(c plugins.MFAConfig) (string, error) {
 		secret += strings.Repeat("=", 8-n)
 	}
 
-	return totp.GenerateCodeCustom(strings.ToUpper(secret), time.Now(), generatorOpts)
+	return strings.ToUpper(secret), generatorOpts, nil
 }
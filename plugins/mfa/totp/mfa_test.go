@@ -0,0 +1,116 @@
+package totp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const testSecret = "MZXW6YTBOIFA"
+
+var testMFACfgs = []plugins.MFAConfig{{Provider: "totp", Attributes: map[string]interface{}{"secret": testSecret}}}
+
+func code(t *testing.T, at time.Time) string {
+	c, err := totp.GenerateCodeCustom(testSecret+"====", at, totp.ValidateOpts{Period: 30, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+	require.NoError(t, err)
+	return c
+}
+
+func validate(m *MFATOTP, user, token string) (map[string]string, error) {
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{"simple-" + plugins.MFALoginFieldName: {token}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm() // #nosec G104 - Form is valid
+	defer context.Clear(r)
+
+	err := m.ValidateMFA(httptest.NewRecorder(), r, user, testMFACfgs)
+	return plugins.AuditFields(r), err
+}
+
+func TestSkewWindow(t *testing.T) {
+	m := New()
+	require.NoError(t, m.Configure([]byte("---\n")))
+
+	fields, err := validate(m, "luzifer", code(t, time.Now().Add(-30*time.Second)))
+	require.NoError(t, err)
+	assert.Equal(t, "-1", fields["totp_drift"])
+
+	fields, err = validate(m, "luzifer", code(t, time.Now().Add(30*time.Second)))
+	require.NoError(t, err)
+	assert.Equal(t, "1", fields["totp_drift"])
+
+	_, err = validate(m, "luzifer", code(t, time.Now().Add(90*time.Second)))
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
+
+func TestReplay(t *testing.T) {
+	stateFile := path.Join(t.TempDir(), "totp.json")
+
+	m := New()
+	require.NoError(t, m.Configure([]byte("---\nmfa:\n  totp:\n    state_file: \""+stateFile+"\"\n")))
+
+	token := code(t, time.Now())
+	_, err := validate(m, "luzifer", token)
+	require.NoError(t, err)
+
+	_, err = validate(m, "luzifer", token)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+	assert.Equal(t, "TOTP code already used", plugins.FailureReason(err, ""))
+
+	// Older codes within the skew window are rejected as well
+	_, err = validate(m, "luzifer", code(t, time.Now().Add(-30*time.Second)))
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+
+	// Time-steps are tracked per user
+	_, err = validate(m, "other", token)
+	assert.NoError(t, err)
+
+	// The state survives restarts
+	m = New()
+	require.NoError(t, m.Configure([]byte("---\nmfa:\n  totp:\n    state_file: \""+stateFile+"\"\n")))
+	_, err = validate(m, "luzifer", token)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+}
+
+func TestDefaultStateFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := []byte("---\nmfa_store:\n  file: \"" + path.Join(dir, "mfa-store.yaml") + "\"\n")
+
+	m := New()
+	require.NoError(t, m.Configure(cfg))
+	assert.Equal(t, path.Join(dir, "totp-state.json"), m.StateFile)
+
+	token := code(t, time.Now())
+	_, err := validate(m, "luzifer", token)
+	require.NoError(t, err)
+
+	// The state is kept next to the MFA store and survives restarts
+	m = New()
+	require.NoError(t, m.Configure(cfg))
+	_, err = validate(m, "luzifer", token)
+	assert.ErrorIs(t, err, plugins.ErrNoValidUserFound)
+}
+
+func TestChallengeWithoutCode(t *testing.T) {
+	m := New()
+	require.NoError(t, m.Configure([]byte("---\n")))
+
+	_, err := validate(m, "luzifer", "")
+	var challenge plugins.MFAChallenge
+	require.ErrorAs(t, err, &challenge)
+	assert.Equal(t, plugins.MFALoginFieldName, challenge.Field.Name)
+
+	_, err = validate(m, "luzifer", "000000")
+	assert.Equal(t, plugins.ErrNoValidUserFound, err)
+}
@@ -0,0 +1,286 @@
+// Package webauthn implements an MFAProvider challenging the security
+// keys (WebAuthn credentials) registered by the user after the first
+// factor. Logged in users register their keys on the account page.
+package webauthn
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	libwebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/webauthnstore"
+)
+
+const (
+	assertionFieldName = "assertion"
+	loginCeremonyKey   = "login_ceremony"
+
+	// Time the user has to finish a security key ceremony, enforced on
+	// the server as the ceremony is kept in the client side session
+	ceremonyTimeout = 5 * time.Minute
+)
+
+type MFAWebAuthn struct {
+	RPID             string               `yaml:"rp_id"`
+	RPDisplayName    string               `yaml:"rp_display_name"`
+	RPOrigins        []string             `yaml:"rp_origins"`
+	UserVerification string               `yaml:"user_verification"`
+	Store            webauthnstore.Config `yaml:"store"`
+
+	cookie      plugins.CookieConfig
+	cookieStore *sessions.CookieStore
+
+	challenges *webauthnstore.ChallengeCache
+	store      webauthnstore.Store
+	webauthn   *libwebauthn.WebAuthn
+}
+
+func New(cs *sessions.CookieStore) *MFAWebAuthn {
+	return &MFAWebAuthn{
+		cookieStore: cs,
+		challenges:  webauthnstore.NewChallengeCache(),
+	}
+}
+
+// ProviderID needs to return an unique string to identify
+// this special MFA provider
+func (m *MFAWebAuthn) ProviderID() (id string) { return "webauthn" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the plugins.ErrProviderUnconfigured
+func (m *MFAWebAuthn) Configure(yamlSource []byte) (err error) {
+	envelope := struct {
+		Cookie plugins.CookieConfig `yaml:"cookie"`
+		MFA    struct {
+			WebAuthn *MFAWebAuthn `yaml:"webauthn"`
+		} `yaml:"mfa"`
+	}{}
+
+	envelope.Cookie = plugins.DefaultCookieConfig()
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.MFA.WebAuthn == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+
+	m.RPID = envelope.MFA.WebAuthn.RPID
+	m.RPDisplayName = envelope.MFA.WebAuthn.RPDisplayName
+	m.RPOrigins = envelope.MFA.WebAuthn.RPOrigins
+	m.UserVerification = envelope.MFA.WebAuthn.UserVerification
+	m.Store = envelope.MFA.WebAuthn.Store
+
+	if m.RPDisplayName == "" {
+		m.RPDisplayName = "nginx-sso"
+	}
+
+	if m.UserVerification == "" {
+		// The key is a second factor, presence is sufficient
+		m.UserVerification = string(protocol.VerificationDiscouraged)
+	}
+
+	switch protocol.UserVerificationRequirement(m.UserVerification) {
+	case protocol.VerificationRequired, protocol.VerificationPreferred, protocol.VerificationDiscouraged:
+	default:
+		return errors.Errorf("Invalid user_verification %q", m.UserVerification)
+	}
+
+	wa, err := libwebauthn.New(&libwebauthn.Config{
+		RPID:          m.RPID,
+		RPDisplayName: m.RPDisplayName,
+		RPOrigins:     m.RPOrigins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementDiscouraged,
+			UserVerification: protocol.UserVerificationRequirement(m.UserVerification),
+		},
+		Timeouts: libwebauthn.TimeoutsConfig{
+			Login:        libwebauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout},
+			Registration: libwebauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Invalid WebAuthn configuration")
+	}
+
+	store, err := webauthnstore.New(m.Store, "webauthn_mfa_credentials")
+	if err != nil {
+		return err
+	}
+
+	m.cookie = envelope.Cookie
+	m.store = store
+	m.webauthn = wa
+
+	return nil
+}
+
+// ValidateMFA takes the user from the login cookie and performs a
+// validation against the provided MFA configuration for this user
+func (m *MFAWebAuthn) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []plugins.MFAConfig) error {
+	var recs []*webauthnstore.UserRecord
+
+	// Look for mfaConfigs with own provider name
+	for _, c := range mfaCfgs {
+		if c.Provider != m.ProviderID() {
+			continue
+		}
+
+		// The credentials are registered for the login name unless
+		// the configuration references another record
+		key := c.AttributeString("user")
+		if key == "" {
+			key = user
+		}
+
+		rec, err := m.store.Get(key)
+		if err != nil {
+			return errors.Wrap(err, "Unable to load security keys")
+		}
+
+		if rec != nil && len(rec.Credentials) > 0 {
+			recs = append(recs, rec)
+		}
+	}
+
+	if len(recs) == 0 {
+		// Report this provider was not able to verify the MFA request
+		return plugins.ErrNoValidUserFound
+	}
+
+	sess, _ := m.cookieStore.Get(r, m.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = m.cookie.GetSessionOpts()
+
+	if response := r.FormValue(strings.Join([]string{m.ProviderID(), assertionFieldName}, "-")); response != "" {
+		return m.validateAssertion(res, r, sess, recs, response)
+	}
+
+	// Ask the browser to sign a challenge using one of the keys
+	assertion, ceremony, err := m.webauthn.BeginLogin(recs[0],
+		libwebauthn.WithUserVerification(protocol.UserVerificationRequirement(m.UserVerification)),
+	)
+	if err != nil {
+		return errors.Wrap(err, "Unable to start security key challenge")
+	}
+
+	if err = webauthnstore.SaveCeremony(sess, loginCeremonyKey, ceremony); err != nil {
+		return err
+	}
+
+	if err = sess.Save(r, res); err != nil {
+		return errors.Wrap(err, "Unable to save session")
+	}
+
+	return plugins.MFAChallenge{
+		Provider: m.ProviderID(),
+		Message:  "Please confirm your login using your security key.",
+		Field: plugins.LoginField{
+			Name:        assertionFieldName,
+			Placeholder: "Use security key",
+			Type:        "webauthn",
+		},
+		Options: assertion,
+	}
+}
+
+func (m *MFAWebAuthn) validateAssertion(res http.ResponseWriter, r *http.Request, sess *sessions.Session, recs []*webauthnstore.UserRecord, response string) error {
+	ceremony, err := webauthnstore.PopCeremony(sess, loginCeremonyKey)
+	if saveErr := sess.Save(r, res); saveErr != nil {
+		return errors.Wrap(saveErr, "Unable to save session")
+	}
+
+	if err != nil || !m.challenges.Use(ceremony) {
+		return plugins.NewLoginFailure("no security key challenge in progress")
+	}
+
+	var rec *webauthnstore.UserRecord
+	for _, c := range recs {
+		if subtle.ConstantTimeCompare(c.Handle, ceremony.UserID) == 1 {
+			rec = c
+		}
+	}
+
+	if rec == nil {
+		// Ceremony was started for another user
+		return plugins.NewLoginFailure("no security key challenge in progress")
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes([]byte(response))
+	if err != nil {
+		log.WithError(err).Debug("Invalid security key assertion")
+		return plugins.NewLoginFailure("invalid security key response")
+	}
+
+	credential, err := m.webauthn.ValidateLogin(rec, *ceremony, parsed)
+	if err != nil {
+		log.WithError(err).Debug("Security key assertion rejected")
+		return plugins.NewLoginFailure("security key not accepted")
+	}
+
+	if credential.Authenticator.CloneWarning {
+		log.WithField("user", rec.User).Warn("Security key signature counter did not increase, authenticator might be cloned")
+		return plugins.NewLoginFailure("security key might be cloned")
+	}
+
+	// Persist the updated signature counter and flags
+	rec.MarkUsed(credential, time.Now())
+	return errors.Wrap(m.store.Save(rec), "Unable to update security key")
+}
+
+// BeginPasskeyRegistration returns the options to be passed to
+// navigator.credentials.create() for the user and remembers the
+// challenge for FinishPasskeyRegistration
+func (m *MFAWebAuthn) BeginPasskeyRegistration(res http.ResponseWriter, r *http.Request, user string) (interface{}, error) {
+	sess, _ := m.cookieStore.Get(r, m.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = m.cookie.GetSessionOpts()
+
+	creation, err := webauthnstore.BeginRegistration(m.webauthn, m.store, sess, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return creation, errors.Wrap(sess.Save(r, res), "Unable to save session")
+}
+
+// FinishPasskeyRegistration verifies the credential created by the
+// browser and stores it under the given name. If the credential is
+// not acceptable a PasskeyRejected error needs to be returned.
+func (m *MFAWebAuthn) FinishPasskeyRegistration(res http.ResponseWriter, r *http.Request, user, name string, response []byte) (plugins.Passkey, error) {
+	sess, _ := m.cookieStore.Get(r, m.sessionName()) // #nosec G104 - On error empty session is returned
+	sess.Options = m.cookie.GetSessionOpts()
+
+	info, err := webauthnstore.FinishRegistration(m.webauthn, m.store, sess, user, name, response)
+	if saveErr := sess.Save(r, res); saveErr != nil {
+		return plugins.Passkey{}, errors.Wrap(saveErr, "Unable to save session")
+	}
+
+	return info, err
+}
+
+// ListPasskeys returns all passkeys registered by the user
+func (m *MFAWebAuthn) ListPasskeys(user string) ([]plugins.Passkey, error) {
+	return webauthnstore.ListPasskeys(m.store, user)
+}
+
+// RemovePasskey removes the passkey with the given ID registered by
+// the user. If there is no such passkey ErrPasskeyNotFound needs to
+// be returned.
+func (m *MFAWebAuthn) RemovePasskey(user, id string) error {
+	return webauthnstore.RemovePasskey(m.store, user, id)
+}
+
+func (m *MFAWebAuthn) sessionName() string {
+	return strings.Join([]string{m.cookie.Prefix, "mfa", m.ProviderID()}, "-")
+}
@@ -0,0 +1,141 @@
+package webauthn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/webauthntest"
+)
+
+func newTestProvider(t *testing.T) *MFAWebAuthn {
+	m := New(sessions.NewCookieStore([]byte("Ff1uWJcLouKu9kwxgbnKcU3ps47gps72")))
+	require.NoError(t, m.Configure([]byte(`---
+mfa:
+  webauthn:
+    rp_id: "`+webauthntest.RPID+`"
+    rp_origins: ["`+webauthntest.Origin+`"]
+    store:
+      file: "`+path.Join(t.TempDir(), "webauthn.json")+`"
+`)))
+	return m
+}
+
+func registerKey(t *testing.T, m *MFAWebAuthn, user string, tk *webauthntest.Authenticator) {
+	var (
+		b       = webauthntest.NewBrowser()
+		options interface{}
+		err     error
+	)
+
+	b.Do(httptest.NewRequest("POST", "/api/account/security-keys/register", nil), func(res http.ResponseWriter, r *http.Request) {
+		options, err = m.BeginPasskeyRegistration(res, r, user)
+	})
+	require.NoError(t, err)
+
+	b.Do(httptest.NewRequest("PUT", "/api/account/security-keys/register", nil), func(res http.ResponseWriter, r *http.Request) {
+		_, err = m.FinishPasskeyRegistration(res, r, user, "YubiKey", tk.Create(t, options.(*protocol.CredentialCreation)))
+	})
+	require.NoError(t, err)
+}
+
+func validate(b *webauthntest.Browser, m *MFAWebAuthn, user string, mfaCfgs []plugins.MFAConfig, assertion []byte) (err error) {
+	form := url.Values{}
+	if len(assertion) > 0 {
+		form.Set("webauthn-assertion", string(assertion))
+	}
+
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	b.Do(r, func(res http.ResponseWriter, r *http.Request) {
+		err = m.ValidateMFA(res, r, user, mfaCfgs)
+	})
+	return err
+}
+
+func TestSecurityKeyChallenge(t *testing.T) {
+	m := newTestProvider(t)
+	tk := webauthntest.NewAuthenticator(t, false)
+	registerKey(t, m, "luzifer", tk)
+
+	mfaCfgs := []plugins.MFAConfig{{Provider: "webauthn"}}
+	b := webauthntest.NewBrowser()
+
+	// Without response the user is asked to use the key
+	var challenge plugins.MFAChallenge
+	require.ErrorAs(t, validate(b, m, "luzifer", mfaCfgs, nil), &challenge)
+	assert.Equal(t, "webauthn", challenge.Provider)
+	assert.Equal(t, "webauthn", challenge.Field.Type)
+
+	options := challenge.Options.(*protocol.CredentialAssertion)
+	require.Len(t, options.Response.AllowedCredentials, 1)
+
+	// Remember the cookie containing the ceremony for the replay
+	replayed := webauthntest.NewBrowser()
+	for k, v := range b.Cookies {
+		replayed.Cookies[k] = v
+	}
+
+	assertion := tk.Get(t, options)
+	require.NoError(t, validate(b, m, "luzifer", mfaCfgs, assertion))
+
+	keys, err := m.ListPasskeys("luzifer")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.NotNil(t, keys[0].LastUsed)
+
+	// Neither the ceremony nor the assertion can be used twice
+	assert.ErrorIs(t, validate(b, m, "luzifer", mfaCfgs, assertion), plugins.ErrNoValidUserFound)
+	assert.ErrorIs(t, validate(replayed, m, "luzifer", mfaCfgs, assertion), plugins.ErrNoValidUserFound)
+}
+
+func TestSecurityKeyOtherUser(t *testing.T) {
+	m := newTestProvider(t)
+	tk := webauthntest.NewAuthenticator(t, false)
+	registerKey(t, m, "luzifer", tk)
+	registerKey(t, m, "mallory", webauthntest.NewAuthenticator(t, false))
+
+	b := webauthntest.NewBrowser()
+
+	// Ceremony started for mallory cannot complete the login of luzifer
+	var challenge plugins.MFAChallenge
+	require.ErrorAs(t, validate(b, m, "mallory", []plugins.MFAConfig{{Provider: "webauthn"}}, nil), &challenge)
+
+	assertion := tk.Get(t, challenge.Options.(*protocol.CredentialAssertion))
+	assert.ErrorIs(t, validate(b, m, "luzifer", []plugins.MFAConfig{{Provider: "webauthn"}}, assertion), plugins.ErrNoValidUserFound)
+
+	// The record can be referenced explicitly
+	require.ErrorAs(t, validate(b, m, "admin", []plugins.MFAConfig{{
+		Provider:   "webauthn",
+		Attributes: map[string]interface{}{"user": "luzifer"},
+	}}, nil), &challenge)
+
+	assertion = tk.Get(t, challenge.Options.(*protocol.CredentialAssertion))
+	assert.NoError(t, validate(b, m, "admin", []plugins.MFAConfig{{
+		Provider:   "webauthn",
+		Attributes: map[string]interface{}{"user": "luzifer"},
+	}}, assertion))
+}
+
+func TestSecurityKeyNotConfigured(t *testing.T) {
+	m := newTestProvider(t)
+
+	// User without registered keys
+	assert.Equal(t, plugins.ErrNoValidUserFound, validate(webauthntest.NewBrowser(), m, "luzifer", []plugins.MFAConfig{{Provider: "webauthn"}}, nil))
+
+	// User without config for this provider
+	registerKey(t, m, "luzifer", webauthntest.NewAuthenticator(t, false))
+	assert.Equal(t, plugins.ErrNoValidUserFound, validate(webauthntest.NewBrowser(), m, "luzifer", []plugins.MFAConfig{{Provider: "totp"}}, nil))
+
+	assert.Equal(t, plugins.ErrProviderUnconfigured, New(nil).Configure([]byte("---\nmfa: {}\n")))
+}
@@ -4,16 +4,16 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/GeertJohan/yubigo"
-	"github.com/pkg/errors"
 	yaml "gopkg.in/yaml.v3"
 
 	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/Luzifer/nginx-sso/plugins/yubiotp"
 )
 
 type MFAYubikey struct {
-	ClientID  string `yaml:"client_id"`
-	SecretKey string `yaml:"secret_key"`
+	yubiotp.Config `yaml:",inline"`
+
+	validator yubiotp.Validator
 }
 
 func New() *MFAYubikey {
@@ -43,10 +43,10 @@ func (m *MFAYubikey) Configure(yamlSource []byte) (err error) {
 		return plugins.ErrProviderUnconfigured
 	}
 
-	m.ClientID = envelope.MFA.Yubikey.ClientID
-	m.SecretKey = envelope.MFA.Yubikey.SecretKey
+	m.Config = envelope.MFA.Yubikey.Config
 
-	return nil
+	m.validator, err = yubiotp.New(m.Config)
+	return err
 }
 
 // ValidateMFA takes the user from the login cookie and performs a
@@ -54,11 +54,6 @@ func (m *MFAYubikey) Configure(yamlSource []byte) (err error) {
 func (m MFAYubikey) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []plugins.MFAConfig) error {
 	var keyInput string
 
-	yubiAuth, err := yubigo.NewYubiAuth(m.ClientID, m.SecretKey)
-	if err != nil {
-		return errors.Wrap(err, "Unable to create Yubikey client")
-	}
-
 	for _, c := range mfaCfgs {
 		if c.Provider != m.ProviderID() {
 			continue
@@ -74,9 +69,9 @@ func (m MFAYubikey) ValidateMFA(res http.ResponseWriter, r *http.Request, user s
 			continue
 		}
 
-		_, ok, err := yubiAuth.Verify(keyInput)
-		if err != nil && !strings.Contains(err.Error(), "OTP has wrong length.") {
-			return errors.Wrap(err, "OTP verification failed")
+		ok, err := m.validator.Verify(keyInput)
+		if err != nil {
+			return err
 		}
 
 		if ok {
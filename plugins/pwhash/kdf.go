@@ -0,0 +1,229 @@
+package pwhash
+
+import (
+	"crypto/pbkdf2"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Default parameters used when creating new hashes, following the
+// OWASP password storage recommendations
+const (
+	argon2DefaultMemory  = 19 * 1024
+	argon2DefaultThreads = 1
+	argon2DefaultTime    = 2
+	argon2KeyLength      = 32
+
+	// Upper bound of the memory (in KiB) accepted from stored hashes to
+	// prevent a single verification from exhausting the memory
+	argon2MaxMemory = 1024 * 1024
+
+	pbkdf2DefaultRounds = 600000
+	// Upper bound of the rounds accepted from stored hashes to prevent
+	// a single verification from blocking a CPU for minutes
+	pbkdf2MaxRounds = 10000000
+
+	scryptDefaultLogN = 15
+	scryptDefaultP    = 1
+	scryptDefaultR    = 8
+	scryptKeyLength   = 32
+	// Upper bounds of the memory (128 * r * N bytes) and parallelization
+	// accepted from stored hashes
+	scryptMaxMemory = 1 << 30
+	scryptMaxP      = 16
+)
+
+// --- Argon2: $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+
+func hashArgon2(scheme, password string) (string, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return "", err
+	}
+
+	kdf := argon2.IDKey
+	if scheme == SchemeArgon2i {
+		kdf = argon2.Key
+	}
+
+	key := kdf([]byte(password), salt, argon2DefaultTime, argon2DefaultMemory, argon2DefaultThreads, argon2KeyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		scheme, argon2.Version,
+		argon2DefaultMemory, argon2DefaultTime, argon2DefaultThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func verifyArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.Wrap(ErrMalformedHash, "unsupported argon2 version")
+	}
+
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errors.Wrap(ErrMalformedHash, "invalid argon2 parameters")
+	}
+
+	// argon2 panics on zero time or threads
+	if time < 1 || threads < 1 || memory > argon2MaxMemory {
+		return false, errors.Wrap(ErrMalformedHash, "argon2 parameters out of range")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errors.Wrap(ErrMalformedHash, "invalid argon2 salt")
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errors.Wrap(ErrMalformedHash, "invalid argon2 hash")
+	}
+
+	if len(expected) == 0 {
+		return false, errors.Wrap(ErrMalformedHash, "empty argon2 hash")
+	}
+
+	kdf := argon2.IDKey
+	if parts[1] == SchemeArgon2i {
+		kdf = argon2.Key
+	}
+
+	// #nosec G115 - Length of the hash is bound by the hash itself
+	return secureCompare(kdf([]byte(password), salt, time, memory, threads, uint32(len(expected))), expected), nil
+}
+
+// --- PBKDF2: $pbkdf2-sha256$<rounds>$<salt>$<hash> (passlib)
+// ---         pbkdf2_sha256$<rounds>$<salt>$<hash> (Django)
+
+func hashPBKDF2(scheme, password string) (string, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return "", err
+	}
+
+	h, keyLen := hashFuncForScheme(scheme)
+	key, err := pbkdf2.Key(h, password, salt, pbkdf2DefaultRounds, keyLen)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to derive key")
+	}
+
+	prefix := scheme
+	if scheme == SchemePBKDF2SHA1 {
+		prefix = "pbkdf2"
+	}
+
+	return fmt.Sprintf("$%s$%d$%s$%s", prefix, pbkdf2DefaultRounds, ab64.EncodeToString(salt), ab64.EncodeToString(key)), nil
+}
+
+func verifyPBKDF2(hash, password string) (bool, error) {
+	var (
+		django   = !strings.HasPrefix(hash, "$")
+		expected []byte
+		salt     []byte
+		err      error
+	)
+
+	parts := strings.Split(strings.TrimPrefix(hash, "$"), "$")
+	if len(parts) != 4 {
+		return false, ErrMalformedHash
+	}
+
+	rounds, err := strconv.Atoi(parts[1])
+	if err != nil || rounds < 1 {
+		return false, errors.Wrap(ErrMalformedHash, "invalid pbkdf2 rounds")
+	}
+
+	if rounds > pbkdf2MaxRounds {
+		return false, errors.Wrap(ErrMalformedHash, "pbkdf2 rounds out of range")
+	}
+
+	if django {
+		salt = []byte(parts[2])
+		expected, err = base64.StdEncoding.DecodeString(parts[3])
+	} else {
+		if salt, err = ab64.DecodeString(parts[2]); err != nil {
+			return false, errors.Wrap(ErrMalformedHash, "invalid pbkdf2 salt")
+		}
+		expected, err = ab64.DecodeString(parts[3])
+	}
+	if err != nil || len(expected) == 0 {
+		return false, errors.Wrap(ErrMalformedHash, "invalid pbkdf2 hash")
+	}
+
+	h, _ := hashFuncForScheme(Scheme(hash))
+	key, err := pbkdf2.Key(h, password, salt, rounds, len(expected))
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to derive key")
+	}
+
+	return secureCompare(key, expected), nil
+}
+
+// --- scrypt: $scrypt$ln=15,r=8,p=1$<salt>$<hash> (passlib)
+
+func hashScrypt(password string) (string, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<scryptDefaultLogN, scryptDefaultR, scryptDefaultP, scryptKeyLength)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to derive key")
+	}
+
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		scryptDefaultLogN, scryptDefaultR, scryptDefaultP,
+		ab64.EncodeToString(salt), ab64.EncodeToString(key),
+	), nil
+}
+
+func verifyScrypt(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return false, ErrMalformedHash
+	}
+
+	var logN, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil || logN < 1 || logN > 30 {
+		return false, errors.Wrap(ErrMalformedHash, "invalid scrypt parameters")
+	}
+
+	if r < 1 || p < 1 || p > scryptMaxP || r > scryptMaxMemory/(128<<logN) {
+		return false, errors.Wrap(ErrMalformedHash, "scrypt parameters out of range")
+	}
+
+	salt, err := ab64.DecodeString(parts[3])
+	if err != nil {
+		return false, errors.Wrap(ErrMalformedHash, "invalid scrypt salt")
+	}
+
+	expected, err := ab64.DecodeString(parts[4])
+	if err != nil || len(expected) == 0 {
+		return false, errors.Wrap(ErrMalformedHash, "invalid scrypt hash")
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(expected))
+	if err != nil {
+		return false, errors.Wrap(ErrMalformedHash, err.Error())
+	}
+
+	return secureCompare(key, expected), nil
+}
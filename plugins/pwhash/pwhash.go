@@ -0,0 +1,169 @@
+// Package pwhash implements detection and verification of password
+// hashes in the commonly used modular crypt formats as found in
+// htpasswd files or `/etc/shadow` exports and the generation of new
+// hashes for a selected scheme.
+package pwhash
+
+import (
+	"crypto/rand"
+	"crypto/sha1" // #nosec G505 - Required to verify legacy PBKDF2-SHA1 hashes
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported hashing schemes as returned by Scheme and accepted by Hash
+const (
+	SchemeArgon2i      = "argon2i"
+	SchemeArgon2id     = "argon2id"
+	SchemeBcrypt       = "bcrypt"
+	SchemePBKDF2SHA1   = "pbkdf2-sha1"
+	SchemePBKDF2SHA256 = "pbkdf2-sha256"
+	SchemePBKDF2SHA512 = "pbkdf2-sha512"
+	SchemeSHA512Crypt  = "sha512-crypt"
+	SchemeScrypt       = "scrypt"
+)
+
+const saltLength = 16
+
+var (
+	// ErrUnsupportedScheme is returned when the hash scheme could not
+	// be detected or is not supported for the requested operation
+	ErrUnsupportedScheme = errors.New("Unsupported hash scheme")
+	// ErrMalformedHash is returned when the scheme of the hash was
+	// detected but the hash could not be parsed
+	ErrMalformedHash = errors.New("Malformed hash")
+
+	// ab64 is the "adapted base64" encoding used by passlib
+	ab64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+	schemePrefixes = []struct {
+		prefix string
+		scheme string
+	}{
+		{"$2a$", SchemeBcrypt},
+		{"$2b$", SchemeBcrypt},
+		{"$2y$", SchemeBcrypt},
+		{"$6$", SchemeSHA512Crypt},
+		{"$argon2i$", SchemeArgon2i},
+		{"$argon2id$", SchemeArgon2id},
+		{"$pbkdf2$", SchemePBKDF2SHA1},
+		{"$pbkdf2-sha256$", SchemePBKDF2SHA256},
+		{"$pbkdf2-sha512$", SchemePBKDF2SHA512},
+		{"$scrypt$", SchemeScrypt},
+		// Django style PBKDF2 hashes
+		{"pbkdf2_sha1$", SchemePBKDF2SHA1},
+		{"pbkdf2_sha256$", SchemePBKDF2SHA256},
+	}
+)
+
+// Scheme detects the hashing scheme from the prefix of the given
+// hash and returns an empty string if the scheme is unknown
+func Scheme(hash string) string {
+	for _, sp := range schemePrefixes {
+		if strings.HasPrefix(hash, sp.prefix) {
+			return sp.scheme
+		}
+	}
+
+	return ""
+}
+
+// CanHash reports whether Hash is able to create hashes for the
+// given scheme
+func CanHash(scheme string) bool {
+	switch scheme {
+	case SchemeArgon2i, SchemeArgon2id, SchemeBcrypt, SchemePBKDF2SHA1, SchemePBKDF2SHA256, SchemePBKDF2SHA512, SchemeSHA512Crypt, SchemeScrypt:
+		return true
+	default:
+		return false
+	}
+}
+
+// Hash creates a new hash of the password using the given scheme
+// with sane default parameters and a random salt
+func Hash(scheme, password string) (string, error) {
+	switch scheme {
+	case SchemeArgon2i, SchemeArgon2id:
+		return hashArgon2(scheme, password)
+
+	case SchemeBcrypt:
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(h), errors.Wrap(err, "Unable to generate bcrypt hash")
+
+	case SchemePBKDF2SHA1, SchemePBKDF2SHA256, SchemePBKDF2SHA512:
+		return hashPBKDF2(scheme, password)
+
+	case SchemeSHA512Crypt:
+		salt, err := randomSalt()
+		if err != nil {
+			return "", err
+		}
+		return sha512Crypt(password, ab64.EncodeToString(salt)[:saltLength], sha512CryptDefaultRounds, false), nil
+
+	case SchemeScrypt:
+		return hashScrypt(password)
+
+	default:
+		return "", ErrUnsupportedScheme
+	}
+}
+
+// Verify checks the password against the given hash. In case the hash
+// scheme is unsupported or the hash is malformed an error is returned.
+func Verify(hash, password string) (bool, error) {
+	switch Scheme(hash) {
+	case SchemeArgon2i, SchemeArgon2id:
+		return verifyArgon2(hash, password)
+
+	case SchemeBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		switch err {
+		case nil:
+			return true, nil
+		case bcrypt.ErrMismatchedHashAndPassword:
+			return false, nil
+		default:
+			return false, errors.Wrap(ErrMalformedHash, err.Error())
+		}
+
+	case SchemePBKDF2SHA1, SchemePBKDF2SHA256, SchemePBKDF2SHA512:
+		return verifyPBKDF2(hash, password)
+
+	case SchemeSHA512Crypt:
+		return verifySHA512Crypt(hash, password)
+
+	case SchemeScrypt:
+		return verifyScrypt(hash, password)
+
+	default:
+		return false, ErrUnsupportedScheme
+	}
+}
+
+func hashFuncForScheme(scheme string) (func() hash.Hash, int) {
+	switch scheme {
+	case SchemePBKDF2SHA1:
+		return sha1.New, sha1.Size
+	case SchemePBKDF2SHA256:
+		return sha256.New, sha256.Size
+	default:
+		return sha512.New, sha512.Size
+	}
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	_, err := rand.Read(salt)
+	return salt, errors.Wrap(err, "Unable to generate salt")
+}
+
+func secureCompare(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
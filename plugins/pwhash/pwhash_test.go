@@ -0,0 +1,114 @@
+package pwhash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyKnownHashes(t *testing.T) {
+	for name, tc := range map[string]struct {
+		hash, password, scheme string
+	}{
+		"argon2i": {
+			hash:     "$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+			password: "password",
+			scheme:   SchemeArgon2i,
+		},
+		"bcrypt": {
+			hash:     "$2a$04$stlpl1OMZJ25JQ/SUIvXNu7sB/CH1sn1mCFIQN3yHxKVqD/oD54qO",
+			password: "password",
+			scheme:   SchemeBcrypt,
+		},
+		"pbkdf2 passlib": {
+			hash:     "$pbkdf2-sha256$1000$MDEyMzQ1Njc4OWFiY2RlZg$hRRjgXWkW8ResfIvBP99J/T4vkgEmMRV/0tJTOjR59I",
+			password: "password",
+			scheme:   SchemePBKDF2SHA256,
+		},
+		"pbkdf2 django": {
+			hash:     "pbkdf2_sha256$1000$seasalt$YIWkt6M1JFXrHg5s0jZjBSc7C2Cz6QvchSJ0h8Y+i7c=",
+			password: "password",
+			scheme:   SchemePBKDF2SHA256,
+		},
+		"scrypt": {
+			hash:     "$scrypt$ln=10,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$ZEBCzLptWM7dhpNJDU2HbQ945ovKHmVEozHkePPbSqw",
+			password: "password",
+			scheme:   SchemeScrypt,
+		},
+		// Test vectors from the SHA-crypt specification
+		"sha512-crypt": {
+			hash:     "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			password: "Hello world!",
+			scheme:   SchemeSHA512Crypt,
+		},
+		"sha512-crypt rounds": {
+			hash:     "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+			password: "Hello world!",
+			scheme:   SchemeSHA512Crypt,
+		},
+	} {
+		assert.Equal(t, tc.scheme, Scheme(tc.hash), name)
+
+		ok, err := Verify(tc.hash, tc.password)
+		assert.NoError(t, err, name)
+		assert.True(t, ok, name)
+
+		ok, err = Verify(tc.hash, tc.password+"x")
+		assert.NoError(t, err, name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	for _, scheme := range []string{
+		SchemeArgon2i,
+		SchemeArgon2id,
+		SchemeBcrypt,
+		SchemePBKDF2SHA1,
+		SchemePBKDF2SHA256,
+		SchemePBKDF2SHA512,
+		SchemeSHA512Crypt,
+		SchemeScrypt,
+	} {
+		h, err := Hash(scheme, "secret")
+		require.NoError(t, err, scheme)
+		assert.Equal(t, scheme, Scheme(h))
+
+		ok, err := Verify(h, "secret")
+		assert.NoError(t, err, scheme)
+		assert.True(t, ok, scheme)
+	}
+}
+
+func TestVerifyInvalidHashes(t *testing.T) {
+	_, err := Verify("plaintext", "plaintext")
+	assert.ErrorIs(t, err, ErrUnsupportedScheme)
+
+	_, err = Verify("$argon2id$v=19$m=x$salt$hash", "password")
+	assert.ErrorIs(t, err, ErrMalformedHash)
+
+	_, err = Verify("$scrypt$ln=10,r=8,p=1$!!!$hash", "password")
+	assert.ErrorIs(t, err, ErrMalformedHash)
+
+	for _, params := range []string{"m=19456,t=0,p=1", "m=19456,t=2,p=0", "m=4294967295,t=2,p=1"} {
+		_, err = Verify("$argon2id$v=19$"+params+"$c2FsdHNhbHQ$aGFzaGhhc2g", "password")
+		assert.ErrorIs(t, err, ErrMalformedHash, params)
+	}
+
+	// Parameters exceeding the limits must be rejected before deriving
+	// the key as a single verification would take minutes or exhaust
+	// the memory
+	for _, hash := range []string{
+		"$scrypt$ln=21,r=8,p=1$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$scrypt$ln=16,r=1000000,p=1$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$scrypt$ln=15,r=8,p=17$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$scrypt$ln=15,r=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$pbkdf2-sha256$10000001$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"pbkdf2_sha256$2147483647$salt$aGFzaGhhc2g=",
+		"$6$rounds=5000001$saltsalt$hash",
+	} {
+		_, err = Verify(hash, "password")
+		assert.ErrorIs(t, err, ErrMalformedHash, hash)
+	}
+}
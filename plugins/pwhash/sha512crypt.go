@@ -0,0 +1,169 @@
+package pwhash
+
+import (
+	"crypto/sha512"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SHA-512-crypt as specified in https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMinRounds     = 1000
+	// Upper bound of the rounds accepted from stored hashes to prevent
+	// a single verification from blocking a CPU for minutes
+	sha512CryptMaxVerifyRounds = 5000000
+	sha512CryptMaxSalt         = 16
+
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Order in which the bytes of the digest are encoded into the
+// resulting string
+var sha512CryptPermutation = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+func verifySHA512Crypt(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) < 4 || len(parts) > 5 {
+		return false, ErrMalformedHash
+	}
+
+	var (
+		rounds         = sha512CryptDefaultRounds
+		explicitRounds bool
+		salt           = parts[2]
+	)
+
+	if len(parts) == 5 {
+		r, ok := strings.CutPrefix(parts[2], "rounds=")
+		if !ok {
+			return false, ErrMalformedHash
+		}
+
+		var err error
+		if rounds, err = strconv.Atoi(r); err != nil {
+			return false, ErrMalformedHash
+		}
+
+		if rounds > sha512CryptMaxVerifyRounds {
+			return false, errors.Wrap(ErrMalformedHash, "sha512-crypt rounds out of range")
+		}
+		explicitRounds = true
+		salt = parts[3]
+	}
+
+	return secureCompare([]byte(sha512Crypt(password, salt, rounds, explicitRounds)), []byte(hash)), nil
+}
+
+func sha512Crypt(password, salt string, rounds int, explicitRounds bool) string {
+	rounds = min(max(rounds, sha512CryptMinRounds), sha512CryptMaxRounds)
+	if len(salt) > sha512CryptMaxSalt {
+		salt = salt[:sha512CryptMaxSalt]
+	}
+
+	p, s := []byte(password), []byte(salt)
+
+	// Digest B
+	h := sha512.New()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	digestB := h.Sum(nil)
+
+	// Digest A
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	for i := len(p); i > 0; i -= sha512.Size {
+		h.Write(digestB[:min(i, sha512.Size)])
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(digestB)
+		} else {
+			h.Write(p)
+		}
+	}
+	digestA := h.Sum(nil)
+
+	// Byte sequence P
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	seqP := repeatToLength(h.Sum(nil), len(p))
+
+	// Byte sequence S
+	h.Reset()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		h.Write(s)
+	}
+	seqS := repeatToLength(h.Sum(nil), len(s))
+
+	// Rounds
+	digestC := digestA
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+
+		if i&1 != 0 {
+			h.Write(seqP)
+		} else {
+			h.Write(digestC)
+		}
+
+		if i%3 != 0 {
+			h.Write(seqS)
+		}
+
+		if i%7 != 0 {
+			h.Write(seqP)
+		}
+
+		if i&1 != 0 {
+			h.Write(digestC)
+		} else {
+			h.Write(seqP)
+		}
+
+		digestC = h.Sum(nil)
+	}
+
+	out := new(strings.Builder)
+	out.WriteString("$6$")
+	if explicitRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt + "$")
+
+	for _, idx := range sha512CryptPermutation {
+		cryptEncode(out, uint(digestC[idx[0]])<<16|uint(digestC[idx[1]])<<8|uint(digestC[idx[2]]), 4)
+	}
+	cryptEncode(out, uint(digestC[63]), 2)
+
+	return out.String()
+}
+
+func cryptEncode(out *strings.Builder, v uint, n int) {
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+}
+
+func repeatToLength(in []byte, length int) []byte {
+	out := make([]byte, 0, length)
+	for len(out) < length {
+		out = append(out, in[:min(len(in), length-len(out))]...)
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+// Package trustedsource contains helpers for plugins trusting headers
+// set by the proxy in front of nginx-sso which must not be accepted
+// when sent by arbitrary clients.
+package trustedsource
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Config describes how to recognize requests sent by the trusted proxy
+// and is meant to be inlined into the plugin configuration
+type Config struct {
+	TrustedSources     []string `yaml:"trusted_sources"`
+	SourceIPHeader     string   `yaml:"source_ip_header"`
+	SharedSecretHeader string   `yaml:"shared_secret_header"`
+	SharedSecret       string   `yaml:"shared_secret"`
+
+	trustedNets []*net.IPNet
+}
+
+// Parse validates the configuration and needs to be called before
+// IsTrusted can be used. At least one of trusted sources and shared
+// secret needs to be configured.
+func (c *Config) Parse() error {
+	if (c.SharedSecretHeader == "") != (c.SharedSecret == "") {
+		return errors.New("shared_secret_header and shared_secret need to be set together")
+	}
+
+	if len(c.TrustedSources) == 0 && c.SharedSecret == "" {
+		return errors.New("At least one of trusted_sources and shared_secret needs to be set")
+	}
+
+	c.trustedNets = nil
+	for _, src := range c.TrustedSources {
+		if !strings.Contains(src, "/") {
+			if strings.Contains(src, ":") {
+				src += "/128"
+			} else {
+				src += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(src)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid trusted source %q", src)
+		}
+		c.trustedNets = append(c.trustedNets, n)
+	}
+
+	return nil
+}
+
+// IsTrusted checks whether the request either carries the shared
+// secret or originates from one of the trusted sources
+func (c Config) IsTrusted(r *http.Request) bool {
+	if c.SharedSecret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(c.SharedSecretHeader)), []byte(c.SharedSecret)) == 1 {
+		return true
+	}
+
+	ip := c.sourceIP(r)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range c.trustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sourceIP determines the IP of the request source either from the
+// configured header (set by nginx, i.e. `X-Real-IP`) or from the
+// connection itself
+func (c Config) sourceIP(r *http.Request) net.IP {
+	if c.SourceIPHeader != "" {
+		// Only the last entry of a X-Forwarded-For style header was
+		// added by the proxy in front of nginx-sso
+		values := strings.Split(r.Header.Get(c.SourceIPHeader), ",")
+		return net.ParseIP(strings.TrimSpace(values[len(values)-1]))
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
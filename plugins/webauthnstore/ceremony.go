@@ -0,0 +1,78 @@
+package webauthnstore
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	libwebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// SaveCeremony stores the data of the running ceremony in the session.
+// The session is signed so the challenge cannot be modified by the
+// client, the session needs to be saved by the caller.
+func SaveCeremony(sess *sessions.Session, key string, ceremony *libwebauthn.SessionData) error {
+	raw, err := json.Marshal(ceremony)
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode ceremony")
+	}
+
+	sess.Values[key] = string(raw)
+	return nil
+}
+
+// PopCeremony retrieves and removes the ceremony data from the session,
+// the session needs to be saved by the caller
+func PopCeremony(sess *sessions.Session, key string) (*libwebauthn.SessionData, error) {
+	raw, ok := sess.Values[key].(string)
+	delete(sess.Values, key)
+	if !ok {
+		return nil, errors.New("No ceremony in session")
+	}
+
+	ceremony := &libwebauthn.SessionData{}
+	return ceremony, errors.Wrap(json.Unmarshal([]byte(raw), ceremony), "Unable to decode ceremony")
+}
+
+// ChallengeCache remembers the challenges of finished ceremonies until
+// the ceremonies expire. As the ceremony is stored in the client side
+// session the session cookie could be replayed otherwise.
+type ChallengeCache struct {
+	lock sync.Mutex
+	used map[string]time.Time
+}
+
+// NewChallengeCache creates an empty ChallengeCache
+func NewChallengeCache() *ChallengeCache {
+	return &ChallengeCache{used: map[string]time.Time{}}
+}
+
+// Use marks the challenge of the ceremony as used and reports whether
+// it was unused before. Ceremonies without expiry are rejected as their
+// challenge would need to be kept forever, the timeouts of the
+// libwebauthn.Config must be enforced.
+func (c *ChallengeCache) Use(ceremony *libwebauthn.SessionData) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for challenge, expires := range c.used {
+		if now.After(expires) {
+			delete(c.used, challenge)
+		}
+	}
+
+	if ceremony.Expires.IsZero() || now.After(ceremony.Expires) {
+		return false
+	}
+
+	if _, ok := c.used[ceremony.Challenge]; ok {
+		return false
+	}
+
+	c.used[ceremony.Challenge] = ceremony.Expires
+
+	return true
+}
@@ -0,0 +1,114 @@
+package webauthnstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	libwebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const userHandleLength = 32
+
+// UserRecord contains the WebAuthn user handle of a user together with
+// all credentials registered by the user. It implements the User
+// interface of the WebAuthn library.
+type UserRecord struct {
+	User        string       `json:"user"`
+	Handle      []byte       `json:"handle"`
+	Credentials []Credential `json:"credentials"`
+}
+
+// Credential is a registered WebAuthn credential together with the
+// information displayed to the user
+type Credential struct {
+	Name       string                 `json:"name"`
+	CreatedAt  time.Time              `json:"created_at"`
+	LastUsed   *time.Time             `json:"last_used,omitempty"`
+	Credential libwebauthn.Credential `json:"credential"`
+}
+
+// NewUserRecord creates an empty record with a random user handle
+func NewUserRecord(user string) (*UserRecord, error) {
+	handle := make([]byte, userHandleLength)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, errors.Wrap(err, "Unable to generate user handle")
+	}
+
+	return &UserRecord{User: user, Handle: handle}, nil
+}
+
+// WebAuthnID returns the user handle of the user
+func (u *UserRecord) WebAuthnID() []byte { return u.Handle }
+
+// WebAuthnName returns the username
+func (u *UserRecord) WebAuthnName() string { return u.User }
+
+// WebAuthnDisplayName returns the username
+func (u *UserRecord) WebAuthnDisplayName() string { return u.User }
+
+// WebAuthnCredentials returns the credentials registered by the user
+func (u *UserRecord) WebAuthnCredentials() []libwebauthn.Credential {
+	creds := make([]libwebauthn.Credential, 0, len(u.Credentials))
+	for _, c := range u.Credentials {
+		creds = append(creds, c.Credential)
+	}
+	return creds
+}
+
+// MarkUsed replaces the stored credential with the one updated by the
+// login ceremony (signature counter, flags) and records the usage
+func (u *UserRecord) MarkUsed(credential *libwebauthn.Credential, at time.Time) {
+	for i := range u.Credentials {
+		if bytes.Equal(u.Credentials[i].Credential.ID, credential.ID) {
+			u.Credentials[i].Credential = *credential
+			u.Credentials[i].LastUsed = &at
+		}
+	}
+}
+
+// Remove deletes the credential with the given ID and reports whether
+// it was found
+func (u *UserRecord) Remove(id string) bool {
+	for i, c := range u.Credentials {
+		if c.ID() == id {
+			u.Credentials = append(u.Credentials[:i], u.Credentials[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Passkeys returns the information of all credentials to be displayed
+// to the user
+func (u *UserRecord) Passkeys() []plugins.Passkey {
+	keys := []plugins.Passkey{}
+	if u == nil {
+		return keys
+	}
+
+	for _, c := range u.Credentials {
+		keys = append(keys, c.Info())
+	}
+	return keys
+}
+
+// ID returns the credential ID in the representation used to reference
+// the credential in the account API
+func (c Credential) ID() string {
+	return base64.RawURLEncoding.EncodeToString(c.Credential.ID)
+}
+
+// Info returns the information displayed to the user
+func (c Credential) Info() plugins.Passkey {
+	return plugins.Passkey{
+		ID:        c.ID(),
+		Name:      c.Name,
+		CreatedAt: c.CreatedAt,
+		LastUsed:  c.LastUsed,
+	}
+}
@@ -0,0 +1,130 @@
+package webauthnstore
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	libwebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const (
+	maxNameLength = 64
+
+	registrationCeremonyKey = "registration_ceremony"
+)
+
+// BeginRegistration returns the options to be passed to
+// navigator.credentials.create() for the user and stores the ceremony
+// in the session, the session needs to be saved by the caller
+func BeginRegistration(wa *libwebauthn.WebAuthn, s Store, sess *sessions.Session, user string) (*protocol.CredentialCreation, error) {
+	rec, err := s.Get(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec == nil {
+		// The record is created when the first credential is registered
+		if rec, err = NewUserRecord(user); err != nil {
+			return nil, err
+		}
+	}
+
+	creation, ceremony, err := wa.BeginRegistration(rec,
+		libwebauthn.WithExclusions(libwebauthn.Credentials(rec.WebAuthnCredentials()).CredentialDescriptors()),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to start registration")
+	}
+
+	return creation, SaveCeremony(sess, registrationCeremonyKey, ceremony)
+}
+
+// FinishRegistration verifies the credential created by the browser
+// against the ceremony stored in the session and stores it under the
+// given name. Unacceptable credentials are reported as
+// plugins.PasskeyRejected, the session needs to be saved by the caller.
+func FinishRegistration(wa *libwebauthn.WebAuthn, s Store, sess *sessions.Session, user, name string, response []byte) (plugins.Passkey, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return plugins.Passkey{}, plugins.PasskeyRejected{Reason: "A name is required"}
+	case len(name) > maxNameLength:
+		return plugins.Passkey{}, plugins.PasskeyRejected{Reason: "The name is too long"}
+	}
+
+	ceremony, err := PopCeremony(sess, registrationCeremonyKey)
+	if err != nil {
+		return plugins.Passkey{}, plugins.PasskeyRejected{Reason: "No key registration in progress"}
+	}
+
+	rec, err := s.Get(user)
+	switch {
+	case err != nil:
+		return plugins.Passkey{}, err
+
+	case rec == nil:
+		rec = &UserRecord{User: user, Handle: ceremony.UserID}
+
+	case subtle.ConstantTimeCompare(rec.Handle, ceremony.UserID) != 1:
+		// Ceremony was started for another user
+		return plugins.Passkey{}, plugins.PasskeyRejected{Reason: "No key registration in progress"}
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		log.WithError(err).Debug("Invalid WebAuthn attestation")
+		return plugins.Passkey{}, plugins.PasskeyRejected{Reason: "Invalid key response"}
+	}
+
+	credential, err := wa.CreateCredential(rec, *ceremony, parsed)
+	if err != nil {
+		log.WithError(err).Debug("WebAuthn attestation rejected")
+		return plugins.Passkey{}, plugins.PasskeyRejected{Reason: "The key could not be verified"}
+	}
+
+	stored := Credential{
+		Name:       name,
+		CreatedAt:  time.Now(),
+		Credential: *credential,
+	}
+	rec.Credentials = append(rec.Credentials, stored)
+
+	if err = s.Save(rec); err != nil {
+		return plugins.Passkey{}, err
+	}
+
+	return stored.Info(), nil
+}
+
+// ListPasskeys returns the information of all credentials registered
+// by the user
+func ListPasskeys(s Store, user string) ([]plugins.Passkey, error) {
+	rec, err := s.Get(user)
+	if err != nil {
+		return []plugins.Passkey{}, err
+	}
+
+	return rec.Passkeys(), nil
+}
+
+// RemovePasskey removes the credential with the given ID registered by
+// the user or returns plugins.ErrPasskeyNotFound
+func RemovePasskey(s Store, user, id string) error {
+	rec, err := s.Get(user)
+	if err != nil {
+		return err
+	}
+
+	if rec == nil || !rec.Remove(id) {
+		return plugins.ErrPasskeyNotFound
+	}
+
+	return s.Save(rec)
+}
@@ -0,0 +1,303 @@
+// Package webauthnstore contains the persistence of WebAuthn credentials
+// shared by the WebAuthn authenticator and MFA provider. Credentials are
+// stored either in a local JSON file or in a SQL database table.
+package webauthnstore
+
+import (
+	"bytes"
+	"context"
+	dbsql "database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	// Register the supported database drivers
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
+)
+
+const defaultQueryTimeout = 5 * time.Second
+
+// drivers maps the driver names accepted in the configuration to the
+// names the drivers are registered with
+var drivers = map[string]string{
+	"mysql":    "mysql",
+	"postgres": "pgx",
+	"sqlite":   "sqlite",
+}
+
+// Config selects where the registered credentials are persisted:
+// either a local JSON file or a table in a SQL database
+type Config struct {
+	File   string `yaml:"file"`
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+	Table  string `yaml:"table"`
+}
+
+// Store persists the UserRecords
+type Store interface {
+	// Get returns the record of the user or nil if there is none
+	Get(user string) (*UserRecord, error)
+	// GetByHandle returns the record having the user handle or nil
+	GetByHandle(handle []byte) (*UserRecord, error)
+	// Save creates or replaces the record of the user
+	Save(rec *UserRecord) error
+}
+
+// New creates the Store described by the configuration. The default
+// table name is used when the configuration does not specify one.
+func New(cfg Config, defaultTable string) (Store, error) {
+	switch {
+	case cfg.File != "" && cfg.Driver != "":
+		return nil, errors.New("Only one of store.file or store.driver can be used")
+
+	case cfg.File != "":
+		return newFileStore(cfg.File)
+
+	case cfg.Driver != "":
+		if cfg.Table == "" {
+			cfg.Table = defaultTable
+		}
+		return newSQLStore(cfg)
+
+	default:
+		return nil, errors.New("Either store.file or store.driver is required")
+	}
+}
+
+// fileStore keeps all records in memory and persists them into a JSON
+// file on every change
+type fileStore struct {
+	path string
+
+	lock    sync.RWMutex
+	records map[string]*UserRecord
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{path: path, records: map[string]*UserRecord{}}
+	if err := filestore.LoadJSON(path, &s.records); err != nil {
+		return nil, errors.Wrap(err, "Unable to load credential store")
+	}
+	return s, nil
+}
+
+func (s *fileStore) Get(user string) (*UserRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return copyRecord(s.records[user])
+}
+
+func (s *fileStore) GetByHandle(handle []byte) (*UserRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, rec := range s.records {
+		if bytes.Equal(rec.Handle, handle) {
+			return copyRecord(rec)
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *fileStore) Save(rec *UserRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored, err := copyRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	prev, existed := s.records[rec.User]
+	s.records[rec.User] = stored
+
+	if err := filestore.SaveJSON(s.path, s.records); err != nil {
+		// Keep memory and file in sync
+		if existed {
+			s.records[rec.User] = prev
+		} else {
+			delete(s.records, rec.User)
+		}
+		return errors.Wrap(err, "Unable to save credential store")
+	}
+
+	return nil
+}
+
+// copyRecord returns a deep copy of the record so callers can modify
+// it without affecting the store before saving
+func copyRecord(rec *UserRecord) (*UserRecord, error) {
+	if rec == nil {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to encode record")
+	}
+
+	out := &UserRecord{}
+	return out, errors.Wrap(json.Unmarshal(raw, out), "Unable to decode record")
+}
+
+// sqlStore persists one row per user containing the credentials as
+// JSON document. The table is created if it does not exist.
+type sqlStore struct {
+	db       *dbsql.DB
+	postgres bool
+	table    string
+}
+
+func newSQLStore(cfg Config) (*sqlStore, error) {
+	driver, ok := drivers[cfg.Driver]
+	if !ok {
+		return nil, errors.Errorf("Unsupported driver %q", cfg.Driver)
+	}
+
+	if cfg.DSN == "" {
+		return nil, errors.New("store.dsn is required")
+	}
+
+	if !isIdentifier(cfg.Table) {
+		return nil, errors.Errorf("Invalid table name %q", cfg.Table)
+	}
+
+	db, err := dbsql.Open(driver, cfg.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open database")
+	}
+
+	s := &sqlStore{db: db, postgres: cfg.Driver == "postgres", table: cfg.Table}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	// #nosec G202 - Table name is validated to be a plain identifier
+	if _, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.table+` (
+		username VARCHAR(255) NOT NULL PRIMARY KEY,
+		user_handle VARCHAR(128) NOT NULL UNIQUE,
+		credentials TEXT NOT NULL
+	)`); err != nil {
+		db.Close() // #nosec G104 - Already in error state
+		return nil, errors.Wrap(err, "Unable to create credential table")
+	}
+
+	return s, nil
+}
+
+func (s *sqlStore) Get(user string) (*UserRecord, error) {
+	return s.query(`SELECT username, user_handle, credentials FROM `+s.table+` WHERE username = ?`, user)
+}
+
+func (s *sqlStore) GetByHandle(handle []byte) (*UserRecord, error) {
+	return s.query(`SELECT username, user_handle, credentials FROM `+s.table+` WHERE user_handle = ?`, hex.EncodeToString(handle))
+}
+
+func (s *sqlStore) Save(rec *UserRecord) error {
+	creds, err := json.Marshal(rec.Credentials)
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode credentials")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "Unable to start transaction")
+	}
+	defer tx.Rollback() // #nosec G104 - No-op after commit
+
+	result, err := tx.ExecContext(ctx, s.rebind(`UPDATE `+s.table+` SET credentials = ? WHERE username = ?`), string(creds), rec.User)
+	if err != nil {
+		return errors.Wrap(err, "Unable to update credentials")
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "Unable to get affected rows")
+	} else if n == 0 {
+		if _, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO `+s.table+` (username, user_handle, credentials) VALUES (?, ?, ?)`),
+			rec.User, hex.EncodeToString(rec.Handle), string(creds)); err != nil {
+			return errors.Wrap(err, "Unable to insert credentials")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "Unable to commit transaction")
+}
+
+func (s *sqlStore) query(query string, arg interface{}) (*UserRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	var (
+		rec           = &UserRecord{}
+		handle, creds string
+	)
+
+	err := s.db.QueryRowContext(ctx, s.rebind(query), arg).Scan(&rec.User, &handle, &creds)
+	switch {
+	case err == nil:
+		// All fine
+
+	case errors.Is(err, dbsql.ErrNoRows):
+		return nil, nil
+
+	default:
+		return nil, errors.Wrap(err, "Unable to query credentials")
+	}
+
+	if rec.Handle, err = hex.DecodeString(handle); err != nil {
+		return nil, errors.Wrap(err, "Unable to decode user handle")
+	}
+
+	return rec, errors.Wrap(json.Unmarshal([]byte(creds), &rec.Credentials), "Unable to decode credentials")
+}
+
+// rebind converts the `?` placeholders into the `$n` placeholders
+// required by PostgreSQL
+func (s *sqlStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+
+	var (
+		b strings.Builder
+		n int
+	)
+
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
+
+func isIdentifier(s string) bool {
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,87 @@
+package webauthnstore
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	libwebauthn "github.com/go-webauthn/webauthn/webauthn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStoreRoundTrip(t *testing.T, s Store) {
+	rec, err := NewUserRecord("luzifer")
+	require.NoError(t, err)
+	rec.Credentials = append(rec.Credentials, Credential{
+		Name:       "Laptop",
+		CreatedAt:  time.Now(),
+		Credential: libwebauthn.Credential{ID: []byte("cred")},
+	})
+	require.NoError(t, s.Save(rec))
+
+	stored, err := s.GetByHandle(rec.Handle)
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, "luzifer", stored.User)
+	require.Len(t, stored.Credentials, 1)
+
+	stored.MarkUsed(&libwebauthn.Credential{ID: []byte("cred")}, time.Now())
+	require.NoError(t, s.Save(stored))
+
+	stored, err = s.Get("luzifer")
+	require.NoError(t, err)
+	require.Len(t, stored.Passkeys(), 1)
+	assert.NotNil(t, stored.Passkeys()[0].LastUsed)
+
+	assert.True(t, stored.Remove(stored.Credentials[0].ID()))
+	assert.False(t, stored.Remove("unknown"))
+	require.NoError(t, s.Save(stored))
+
+	stored, err = s.Get("luzifer")
+	require.NoError(t, err)
+	assert.Empty(t, stored.Credentials)
+
+	stored, err = s.Get("unknown")
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+	assert.Empty(t, stored.Passkeys())
+}
+
+func TestFileStore(t *testing.T) {
+	s, err := New(Config{File: path.Join(t.TempDir(), "webauthn.json")}, "webauthn")
+	require.NoError(t, err)
+	testStoreRoundTrip(t, s)
+}
+
+func TestSQLStore(t *testing.T) {
+	s, err := New(Config{Driver: "sqlite", DSN: path.Join(t.TempDir(), "sso.db")}, "webauthn")
+	require.NoError(t, err)
+	testStoreRoundTrip(t, s)
+
+	assert.Equal(t, "SELECT a FROM t WHERE b = $1 AND c = $2", (&sqlStore{postgres: true}).rebind("SELECT a FROM t WHERE b = ? AND c = ?"))
+	assert.False(t, isIdentifier("users; DROP TABLE users"))
+
+	_, err = New(Config{Driver: "sqlite", DSN: ":memory:", Table: "users; DROP TABLE users"}, "webauthn")
+	assert.Error(t, err)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := New(Config{}, "webauthn")
+	assert.Error(t, err)
+
+	_, err = New(Config{File: "a.json", Driver: "sqlite"}, "webauthn")
+	assert.Error(t, err)
+}
+
+func TestChallengeCache(t *testing.T) {
+	c := NewChallengeCache()
+
+	ceremony := &libwebauthn.SessionData{Challenge: "abc", Expires: time.Now().Add(time.Minute)}
+	assert.True(t, c.Use(ceremony))
+	assert.False(t, c.Use(ceremony), "challenges must be single-use")
+
+	// Ceremonies without enforced timeout or expired ones are rejected
+	assert.False(t, c.Use(&libwebauthn.SessionData{Challenge: "def"}))
+	assert.False(t, c.Use(&libwebauthn.SessionData{Challenge: "ghi", Expires: time.Now().Add(-time.Second)}))
+}
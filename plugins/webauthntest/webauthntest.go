@@ -0,0 +1,181 @@
+// Package webauthntest provides a software authenticator and a browser
+// keeping cookies between requests for testing the WebAuthn plugins.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// Origin is the origin the client data is created for
+	Origin = "https://login.example.com"
+	// RPID is the relying party the credentials are created for
+	RPID = "login.example.com"
+)
+
+var b64 = base64.RawURLEncoding
+
+// Authenticator is a software authenticator creating ES256 credentials
+// with "none" attestation. Resident authenticators (passkeys) verify
+// the user and return the user handle with their assertions, other
+// authenticators (security keys) only report the presence of the user.
+type Authenticator struct {
+	// Counter is the signature counter, it is increased with every
+	// assertion
+	Counter uint32
+	// Handle is the user handle the credential was created for
+	Handle []byte
+
+	resident bool
+	key      *ecdsa.PrivateKey
+	credID   []byte
+}
+
+// NewAuthenticator creates an Authenticator with a new key
+func NewAuthenticator(t *testing.T, resident bool) *Authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credID := make([]byte, 16)
+	_, err = rand.Read(credID)
+	require.NoError(t, err)
+
+	return &Authenticator{resident: resident, key: key, credID: credID}
+}
+
+// Create answers the registration options with a new credential
+func (a *Authenticator) Create(t *testing.T, options *protocol.CredentialCreation) []byte {
+	a.Handle = options.Response.User.ID.(protocol.URLEncodedBase64)
+
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	require.NoError(t, err)
+
+	authData := a.authData(true)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credID)))
+	authData = append(authData, a.credID...)
+	authData = append(authData, coseKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	require.NoError(t, err)
+
+	return a.marshal(t, map[string]string{
+		"clientDataJSON":    b64.EncodeToString(clientData(t, "webauthn.create", options.Response.Challenge)),
+		"attestationObject": b64.EncodeToString(attestation),
+	})
+}
+
+// Get answers the login options with an assertion of the credential
+func (a *Authenticator) Get(t *testing.T, options *protocol.CredentialAssertion) []byte {
+	a.Counter++
+
+	cd := clientData(t, "webauthn.get", options.Response.Challenge)
+	cdHash := sha256.Sum256(cd)
+	authData := a.authData(false)
+
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	response := map[string]string{
+		"clientDataJSON":    b64.EncodeToString(cd),
+		"authenticatorData": b64.EncodeToString(authData),
+		"signature":         b64.EncodeToString(sig),
+	}
+	if a.resident {
+		response["userHandle"] = b64.EncodeToString(a.Handle)
+	}
+
+	return a.marshal(t, response)
+}
+
+func (a *Authenticator) authData(withCredential bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(RPID))
+
+	flags := protocol.FlagUserPresent
+	if a.resident {
+		flags |= protocol.FlagUserVerified
+	}
+	if withCredential {
+		flags |= protocol.FlagAttestedCredentialData
+	}
+
+	buf := bytes.NewBuffer(rpIDHash[:])
+	buf.WriteByte(byte(flags))
+	binary.Write(buf, binary.BigEndian, a.Counter) // #nosec G104 - Writing to buffer never fails
+
+	return buf.Bytes()
+}
+
+func (a *Authenticator) marshal(t *testing.T, response map[string]string) []byte {
+	raw, err := json.Marshal(map[string]interface{}{
+		"id":       b64.EncodeToString(a.credID),
+		"rawId":    b64.EncodeToString(a.credID),
+		"type":     "public-key",
+		"response": response,
+	})
+	require.NoError(t, err)
+	return raw
+}
+
+func clientData(t *testing.T, typ string, challenge protocol.URLEncodedBase64) []byte {
+	raw, err := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": b64.EncodeToString(challenge),
+		"origin":    Origin,
+	})
+	require.NoError(t, err)
+	return raw
+}
+
+// Browser keeps the cookies between requests
+type Browser struct {
+	Cookies map[string]*http.Cookie
+}
+
+// NewBrowser creates a Browser without any cookies
+func NewBrowser() *Browser { return &Browser{Cookies: map[string]*http.Cookie{}} }
+
+// Do sends the cookies along with the request to the handler and
+// stores the cookies set in the response
+func (b *Browser) Do(r *http.Request, handler func(http.ResponseWriter, *http.Request)) *httptest.ResponseRecorder {
+	for _, c := range b.Cookies {
+		r.AddCookie(c)
+	}
+
+	res := httptest.NewRecorder()
+	handler(res, r)
+
+	for _, c := range res.Result().Cookies() {
+		b.Cookies[c.Name] = c
+	}
+
+	return res
+}
@@ -0,0 +1,215 @@
+package yubiotp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/GeertJohan/yubigo"
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/plugins/filestore"
+)
+
+const (
+	modhexAlphabet = "cbdefghijklnrtuv"
+
+	// crcResidue is the CRC16 of a valid token including its checksum
+	crcResidue = 0xf0b8
+
+	privateIDLength = 6
+)
+
+// LocalConfig contains the keys of the devices to validate OTPs without
+// a validation server
+type LocalConfig struct {
+	// File to persist the last accepted counter of each device to
+	CounterFile string `yaml:"counter_file"`
+	// Public ID (modhex, first characters of the OTP) to key mapping
+	Keys map[string]LocalKey `yaml:"keys"`
+}
+
+// LocalKey contains the secrets programmed into the device
+type LocalKey struct {
+	PrivateID string `yaml:"private_id"`
+	AESKey    string `yaml:"aes_key"`
+}
+
+type localKey struct {
+	privateID []byte
+	cipher    cipher.Block
+}
+
+// localValidator decrypts the OTPs using the AES keys of the devices
+// and rejects tokens whose counter did not increase
+type localValidator struct {
+	counters *counterStore
+	keys     map[string]localKey
+}
+
+func newLocalValidator(cfg LocalConfig) (*localValidator, error) {
+	if cfg.CounterFile == "" {
+		return nil, errors.New("local.counter_file is required")
+	}
+
+	v := &localValidator{keys: map[string]localKey{}}
+
+	for publicID, k := range cfg.Keys {
+		if _, err := decodeModhex(publicID); err != nil {
+			return nil, errors.Errorf("Public ID %q is not modhex encoded", publicID)
+		}
+
+		privateID, err := hex.DecodeString(k.PrivateID)
+		if err != nil || len(privateID) != privateIDLength {
+			return nil, errors.Errorf("Private ID of %q must be %d hex encoded bytes", publicID, privateIDLength)
+		}
+
+		aesKey, err := hex.DecodeString(k.AESKey)
+		if err != nil || len(aesKey) != aes.BlockSize {
+			return nil, errors.Errorf("AES key of %q must be %d hex encoded bytes", publicID, aes.BlockSize)
+		}
+
+		block, err := aes.NewCipher(aesKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid AES key of %q", publicID)
+		}
+
+		v.keys[publicID] = localKey{privateID: privateID, cipher: block}
+	}
+
+	counters, err := openCounterStore(cfg.CounterFile)
+	if err != nil {
+		return nil, err
+	}
+	v.counters = counters
+
+	return v, nil
+}
+
+func (v *localValidator) Verify(otp string) (bool, error) {
+	publicID, ciphertext, err := yubigo.ParseOTP(otp)
+	if err != nil {
+		// Wrong length, not an OTP
+		return false, nil
+	}
+
+	key, ok := v.keys[publicID]
+	if !ok {
+		return false, nil
+	}
+
+	raw, err := decodeModhex(ciphertext)
+	if err != nil {
+		return false, nil
+	}
+
+	token := make([]byte, aes.BlockSize)
+	key.cipher.Decrypt(token, raw)
+
+	if crc16(token) != crcResidue || subtle.ConstantTimeCompare(token[:privateIDLength], key.privateID) != 1 {
+		// Encrypted with another key or modified
+		return false, nil
+	}
+
+	// The usage counter is incremented on power-up, the session
+	// counter on every OTP generated while powered
+	counter := uint32(binary.LittleEndian.Uint16(token[6:8]))<<8 | uint32(token[11])
+
+	return v.counters.advance(publicID, counter)
+}
+
+// counterStore persists the last accepted counter of each device. The
+// store is shared between all validators using the same file so the
+// authenticator and MFA provider cannot accept the same OTP.
+type counterStore struct {
+	path string
+
+	lock     sync.Mutex
+	counters map[string]uint32
+}
+
+var (
+	counterStores     = map[string]*counterStore{}
+	counterStoresLock sync.Mutex
+)
+
+func openCounterStore(path string) (*counterStore, error) {
+	counterStoresLock.Lock()
+	defer counterStoresLock.Unlock()
+
+	if s, ok := counterStores[path]; ok {
+		return s, nil
+	}
+
+	s := &counterStore{path: path, counters: map[string]uint32{}}
+	if err := filestore.LoadJSON(path, &s.counters); err != nil {
+		return nil, errors.Wrap(err, "Unable to load counter file")
+	}
+
+	counterStores[path] = s
+	return s, nil
+}
+
+// advance stores the counter if it is greater than the last accepted
+// one and reports whether it was
+func (s *counterStore) advance(publicID string, counter uint32) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev, existed := s.counters[publicID]
+	if existed && counter <= prev {
+		// Replayed or outdated OTP
+		return false, nil
+	}
+
+	s.counters[publicID] = counter
+	if err := filestore.SaveJSON(s.path, s.counters); err != nil {
+		// Keep memory and file in sync
+		if existed {
+			s.counters[publicID] = prev
+		} else {
+			delete(s.counters, publicID)
+		}
+		return false, errors.Wrap(err, "Unable to save counter file")
+	}
+
+	return true, nil
+}
+
+func decodeModhex(s string) ([]byte, error) {
+	if len(s)%2 != 0 {
+		return nil, errors.New("Odd length")
+	}
+
+	out := make([]byte, len(s)/2)
+	for i := 0; i < len(s); i += 2 {
+		hi := strings.IndexByte(modhexAlphabet, s[i])
+		lo := strings.IndexByte(modhexAlphabet, s[i+1])
+		if hi < 0 || lo < 0 {
+			return nil, errors.New("Invalid modhex character")
+		}
+		out[i/2] = byte(hi<<4 | lo)
+	}
+
+	return out, nil
+}
+
+// crc16 calculates the ISO 13239 checksum used by the Yubikey
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			carry := crc & 1
+			crc >>= 1
+			if carry != 0 {
+				crc ^= 0x8408
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,108 @@
+// Package yubiotp contains the validation of Yubikey one-time passwords
+// shared by the Yubikey authenticator and MFA provider. OTPs are either
+// validated against the Yubico cloud, against self-hosted validation
+// servers (yubikey-val) or locally using the AES keys of the devices.
+package yubiotp
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/GeertJohan/yubigo"
+	"github.com/pkg/errors"
+)
+
+// Config describes how OTPs are validated. Without api_servers and
+// local configuration the Yubico cloud is used.
+type Config struct {
+	ClientID   string       `yaml:"client_id"`
+	SecretKey  string       `yaml:"secret_key"`
+	APIServers []string     `yaml:"api_servers"`
+	Local      *LocalConfig `yaml:"local"`
+}
+
+// Validator checks whether an OTP is valid. Malformed OTPs and OTPs of
+// unknown devices are reported as invalid without error.
+type Validator interface {
+	Verify(otp string) (bool, error)
+}
+
+// New creates the Validator described by the configuration
+func New(cfg Config) (Validator, error) {
+	if cfg.Local != nil {
+		if len(cfg.APIServers) > 0 {
+			return nil, errors.New("Only one of api_servers or local can be used")
+		}
+		return newLocalValidator(*cfg.Local)
+	}
+
+	return newRemoteValidator(cfg)
+}
+
+// remoteValidator validates OTPs using the Yubico validation protocol
+type remoteValidator struct {
+	auth *yubigo.YubiAuth
+}
+
+func newRemoteValidator(cfg Config) (*remoteValidator, error) {
+	auth, err := yubigo.NewYubiAuth(cfg.ClientID, cfg.SecretKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create Yubikey client")
+	}
+
+	if len(cfg.APIServers) > 0 {
+		servers, useHTTPS, err := parseAPIServers(cfg.APIServers)
+		if err != nil {
+			return nil, err
+		}
+
+		auth.UseHttps(useHTTPS)
+		auth.SetApiServerList(servers...)
+	}
+
+	return &remoteValidator{auth: auth}, nil
+}
+
+func (v *remoteValidator) Verify(otp string) (bool, error) {
+	if _, _, err := yubigo.ParseOTP(otp); err != nil {
+		// Wrong length, not an OTP
+		return false, nil
+	}
+
+	_, ok, err := v.auth.Verify(otp)
+	if err != nil {
+		return false, errors.Wrap(err, "OTP verification failed")
+	}
+
+	return ok, nil
+}
+
+// parseAPIServers converts the URLs of the validation servers into the
+// scheme-less form used by the client. All servers need to use the
+// same scheme as the client does not support mixing them.
+func parseAPIServers(urls []string) ([]string, bool, error) {
+	var (
+		servers = make([]string, 0, len(urls))
+		scheme  string
+	)
+
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "Invalid API server URL %q", raw)
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, false, errors.Errorf("API server URL %q must be an absolute http(s) URL", raw)
+		}
+
+		if scheme != "" && u.Scheme != scheme {
+			return nil, false, errors.New("All API servers must use the same scheme")
+		}
+		scheme = u.Scheme
+
+		servers = append(servers, strings.TrimPrefix(raw, u.Scheme+"://"))
+	}
+
+	return servers, scheme == "https", nil
+}
@@ -0,0 +1,166 @@
+package yubiotp
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPublicID  = "ccccccfcvuul"
+	testPrivateID = "8792ebfe26cc"
+	testAESKey    = "ecde18dbe76fbd0c33330f1c354871db"
+)
+
+// makeOTP generates an OTP the way a Yubikey does
+func makeOTP(t *testing.T, aesKey string, useCtr uint16, sessionCtr byte) string {
+	privateID, err := hex.DecodeString(testPrivateID)
+	require.NoError(t, err)
+
+	token := make([]byte, aes.BlockSize)
+	copy(token, privateID)
+	binary.LittleEndian.PutUint16(token[6:8], useCtr)
+	token[11] = sessionCtr
+	binary.LittleEndian.PutUint16(token[14:], ^crc16(token[:14]))
+
+	key, err := hex.DecodeString(aesKey)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	block.Encrypt(token, token)
+
+	otp := testPublicID
+	for _, b := range token {
+		otp += string(modhexAlphabet[b>>4]) + string(modhexAlphabet[b&0xf])
+	}
+	return otp
+}
+
+func newTestLocalValidator(t *testing.T, counterFile string) Validator {
+	v, err := New(Config{Local: &LocalConfig{
+		CounterFile: counterFile,
+		Keys: map[string]LocalKey{
+			testPublicID: {PrivateID: testPrivateID, AESKey: testAESKey},
+		},
+	}})
+	require.NoError(t, err)
+	return v
+}
+
+func TestLocalValidation(t *testing.T) {
+	counterFile := path.Join(t.TempDir(), "counters.json")
+	v := newTestLocalValidator(t, counterFile)
+
+	for _, tc := range []struct {
+		name string
+		otp  string
+		ok   bool
+	}{
+		{"first OTP", makeOTP(t, testAESKey, 3, 1), true},
+		{"same OTP replayed", makeOTP(t, testAESKey, 3, 1), false},
+		{"next OTP in session", makeOTP(t, testAESKey, 3, 2), true},
+		{"OTP of older session", makeOTP(t, testAESKey, 2, 9), false},
+		{"OTP of new session", makeOTP(t, testAESKey, 4, 0), true},
+		{"wrong AES key", makeOTP(t, "00112233445566778899aabbccddeeff", 5, 0), false},
+		{"unknown device", "ccccccccccbb" + makeOTP(t, testAESKey, 6, 0)[12:], false},
+		{"not an OTP", "123456", false},
+	} {
+		ok, err := v.Verify(tc.otp)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.ok, ok, tc.name)
+	}
+
+	// Counters survive restarts and are shared between validators
+	delete(counterStores, counterFile)
+	v = newTestLocalValidator(t, counterFile)
+	ok, err := v.Verify(makeOTP(t, testAESKey, 4, 0))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestLocalConfig(t *testing.T) {
+	counterFile := path.Join(t.TempDir(), "counters.json")
+
+	for _, cfg := range []Config{
+		{Local: &LocalConfig{}},
+		{Local: &LocalConfig{CounterFile: counterFile}, APIServers: []string{"https://val.example.com/wsapi/2.0/verify"}},
+		{Local: &LocalConfig{CounterFile: counterFile, Keys: map[string]LocalKey{"abc": {PrivateID: testPrivateID, AESKey: testAESKey}}}},
+		{Local: &LocalConfig{CounterFile: counterFile, Keys: map[string]LocalKey{testPublicID: {PrivateID: "8792", AESKey: testAESKey}}}},
+		{Local: &LocalConfig{CounterFile: counterFile, Keys: map[string]LocalKey{testPublicID: {PrivateID: testPrivateID, AESKey: "ecde"}}}},
+	} {
+		_, err := New(cfg)
+		assert.Error(t, err)
+	}
+}
+
+func TestRemoteValidation(t *testing.T) {
+	secret := []byte("validation-secret")
+	validOTP := makeOTP(t, testAESKey, 1, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/wsapi/2.0/verify", r.URL.Path)
+
+		status := "BAD_OTP"
+		if r.URL.Query().Get("otp") == validOTP {
+			status = "OK"
+		}
+
+		params := []string{
+			"nonce=" + r.URL.Query().Get("nonce"),
+			"otp=" + r.URL.Query().Get("otp"),
+			"status=" + status,
+		}
+		sort.Strings(params)
+
+		mac := hmac.New(sha1.New, secret)
+		mac.Write([]byte(strings.Join(params, "&"))) // #nosec G104 - Writing to hash never fails
+
+		fmt.Fprintf(res, "%s\r\nh=%s\r\n", strings.Join(params, "\r\n"), base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	}))
+	defer srv.Close()
+
+	v, err := New(Config{
+		ClientID:   "1",
+		SecretKey:  base64.StdEncoding.EncodeToString(secret),
+		APIServers: []string{srv.URL + "/wsapi/2.0/verify"},
+	})
+	require.NoError(t, err)
+
+	ok, err := v.Verify(validOTP)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = v.Verify(makeOTP(t, testAESKey, 1, 2))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = v.Verify("123456")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestParseAPIServers(t *testing.T) {
+	servers, useHTTPS, err := parseAPIServers([]string{"https://val1.example.com/wsapi/2.0/verify", "https://val2.example.com:8443/wsapi/2.0/verify"})
+	require.NoError(t, err)
+	assert.True(t, useHTTPS)
+	assert.Equal(t, []string{"val1.example.com/wsapi/2.0/verify", "val2.example.com:8443/wsapi/2.0/verify"}, servers)
+
+	_, _, err = parseAPIServers([]string{"https://val1.example.com/verify", "http://val2.example.com/verify"})
+	assert.Error(t, err)
+
+	_, _, err = parseAPIServers([]string{"val1.example.com/verify"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+const providerEndpointPrefix = "/provider/"
+
+// handleProviderRequest passes requests to /provider/<id>/... to the
+// active Authenticator with that ID if it serves own endpoints
+func handleProviderRequest(res http.ResponseWriter, r *http.Request) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, providerEndpointPrefix), "/")
+
+	ep := findEndpointProvider(id)
+	if ep == nil {
+		http.NotFound(res, r)
+		return
+	}
+
+	http.StripPrefix(providerEndpointPrefix+id, http.HandlerFunc(ep.ServeEndpoint)).ServeHTTP(res, r)
+}
+
+func findEndpointProvider(id string) plugins.EndpointProvider {
+	authenticatorRegistryMutex.RLock()
+	defer authenticatorRegistryMutex.RUnlock()
+
+	for _, a := range activeAuthenticators {
+		if a.AuthenticatorID() != id {
+			continue
+		}
+
+		if ep, ok := a.(plugins.EndpointProvider); ok {
+			return ep
+		}
+	}
+
+	return nil
+}
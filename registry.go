@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -57,38 +59,90 @@ func detectUser(res http.ResponseWriter, r *http.Request) (string, []string, err
 	authenticatorRegistryMutex.RLock()
 	defer authenticatorRegistryMutex.RUnlock()
 
+	noUserErr := plugins.ErrNoValidUserFound
 	for _, a := range activeAuthenticators {
 		user, groups, err := a.DetectUser(res, r)
-		switch err {
-		case nil:
+		switch {
+		case err == nil:
+			if issuer := plugins.IssuingAuthenticator(r); issuer != "" {
+				if groups, err = checkUserStatus(issuer, user, groups); err != nil {
+					return "", nil, err
+				}
+			}
+
+			if plugins.IsMarkedLogin(r) {
+				mainCfg.AuditLog.Log(auditEventLoginSuccess, r, map[string]string{"username": user, "authenticator": a.AuthenticatorID()}) // #nosec G104 - This is only logging
+			}
 			return user, groups, err
-		case plugins.ErrNoValidUserFound:
-			// This is okay.
+		case errors.Is(err, plugins.ErrNoValidUserFound):
+			// This is okay, keep a more specific reason if there is one
+			if err != plugins.ErrNoValidUserFound {
+				noUserErr = err
+			}
 		default:
 			return "", nil, err
 		}
 	}
 
-	return "", nil, plugins.ErrNoValidUserFound
+	return "", nil, noUserErr
+}
+
+// checkUserStatus re-checks the user of a credential issued while the
+// user was logged in through the given authenticator and limits the
+// groups granted by the credential to the groups the user still has.
+// Authenticators not implementing the UserStatusChecker keep the
+// granted groups. The registry lock must be held by the caller.
+func checkUserStatus(authenticator, user string, granted []string) ([]string, error) {
+	for _, a := range activeAuthenticators {
+		if a.AuthenticatorID() != authenticator {
+			continue
+		}
+
+		sc, ok := a.(plugins.UserStatusChecker)
+		if !ok {
+			return granted, nil
+		}
+
+		current, err := sc.CheckUserStatus(user)
+		if err != nil {
+			return nil, err
+		}
+
+		groups := []string{}
+		for _, g := range granted {
+			if slices.Contains(current, g) {
+				groups = append(groups, g)
+			}
+		}
+
+		return groups, nil
+	}
+
+	return nil, plugins.NewLoginFailure("issuing authenticator no longer active")
 }
 
 func loginUser(res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
 	authenticatorRegistryMutex.RLock()
 	defer authenticatorRegistryMutex.RUnlock()
 
+	noUserErr := plugins.ErrNoValidUserFound
 	for _, a := range activeAuthenticators {
 		user, mfaCfgs, err := a.Login(res, r)
-		switch err {
-		case nil:
-			return user, mfaCfgs, nil
-		case plugins.ErrNoValidUserFound:
-			// This is okay.
+		switch {
+		case err == nil:
+			// Add the MFA configs enrolled by the user
+			return user, append(mfaCfgs, mainCfg.MFAStore.get(user)...), nil
+		case errors.Is(err, plugins.ErrNoValidUserFound):
+			// This is okay, keep a more specific reason if there is one
+			if err != plugins.ErrNoValidUserFound {
+				noUserErr = err
+			}
 		default:
 			return "", nil, err
 		}
 	}
 
-	return "", nil, plugins.ErrNoValidUserFound
+	return "", nil, noUserErr
 }
 
 func logoutUser(res http.ResponseWriter, r *http.Request) error {
@@ -104,6 +158,22 @@ func logoutUser(res http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func getHTTPAuthChallenges(r *http.Request) []string {
+	authenticatorRegistryMutex.RLock()
+	defer authenticatorRegistryMutex.RUnlock()
+
+	var challenges []string
+	for _, a := range activeAuthenticators {
+		if c, ok := a.(plugins.HTTPAuthChallenger); ok {
+			if challenge := c.HTTPAuthChallenge(r); challenge != "" {
+				challenges = append(challenges, challenge)
+			}
+		}
+	}
+
+	return challenges
+}
+
 func getFrontendAuthenticators() map[string][]plugins.LoginField {
 	authenticatorRegistryMutex.RLock()
 	defer authenticatorRegistryMutex.RUnlock()